@@ -1,26 +1,102 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"github.com/lisgie/bazo_miner/miner"
 	"github.com/lisgie/bazo_miner/p2p"
 	"github.com/lisgie/bazo_miner/storage"
+	"net"
 	"os"
+	"strings"
 )
 
 func main() {
 
-	var localConn, dbname string
+	//Only apply to running a miner
+	pruneDepth := flag.Uint("prune", 0, "Only keep tx payloads of this many recent blocks, 0 keeps everything")
+	fastSync := flag.Bool("fastsync", false, "Start from a snapshot of another miner if the database is empty")
+	powWorkers := flag.Int("workers", 0, "Number of goroutines that calculate the proof of work, 0 uses all cores")
+	workerIPs := flag.String("getwork", "", "Comma-separated IPs of external workers that may fetch work, workers on this host always can")
+	flag.Uint64Var(&storage.ReplaceFeeBump, "rbfbump", storage.MEMPOOL_REPLACEBUMP, "Minimum fee increase (in percent) for a fundsTx to replace a pending one")
+	flag.Parse()
+	args := flag.Args()
 
-	dbname = os.Args[1]
-	localConn = os.Args[2]
+	//bazo_miner export|import <dbname> <bootstrap file>
+	if len(args) == 3 && (args[0] == "export" || args[0] == "import") {
+		if err := bootstrap(args[0], args[1], args[2]); err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	//bazo_miner fsck <dbname>
+	if len(args) == 2 && args[0] == "fsck" {
+		if err := fsck(args[1]); err != nil {
+			fmt.Printf("%v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Chain is consistent.")
+		return
+	}
+
+	//bazo_miner [-prune depth] [-fastsync] [-rbfbump percent] [-workers n] [-getwork ips] <dbname> <ip:port>
+	if len(args) != 2 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	for _, addr := range strings.Split(*workerIPs, ",") {
+		if addr == "" {
+			continue
+		}
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			fmt.Printf("Invalid worker IP: %v\n", addr)
+			os.Exit(1)
+		}
+		p2p.WorkerIPs = append(p2p.WorkerIPs, ip)
+	}
+	dbname, localConn := args[0], args[1]
+
+	//The database is not wiped on startup, the miner restores the state of the last validated block
+	store, err := storage.NewBoltStorage(dbname)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return
+	}
+	defer store.Close()
 
-	storage.Init(dbname)
-	storage.DeleteAll()
-	err := p2p.Init(localConn)
+	err = p2p.Init(localConn, store)
 	if err != nil {
 		fmt.Printf("%v\n", err)
 		return
 	}
-	miner.Init()
+	miner.Init(store, uint32(*pruneDepth), *fastSync, *powWorkers)
+}
+
+//Neither of the commands needs networking, the p2p package is not started
+func bootstrap(command, dbname, filename string) error {
+
+	store, err := storage.NewBoltStorage(dbname)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	if command == "export" {
+		return miner.Export(store, filename)
+	}
+	return miner.Import(store, filename)
+}
+
+func fsck(dbname string) error {
+
+	store, err := storage.NewBoltStorage(dbname)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	return miner.Fsck(store)
 }
@@ -17,6 +17,10 @@ type blockData struct {
 	fundsTxSlice  []*protocol.FundsTx
 	configTxSlice []*protocol.ConfigTx
 	block         *protocol.Block
+	//Records all state changes of the block, needed to revert them
+	journal *storage.Journal
+	//State the block commits to, only set for blocks at snapshot heights
+	snapshot []byte
 }
 
 //Block constructor, argument is the previous block in the blockchain
@@ -32,7 +36,8 @@ func newBlock(prevHash [32]byte) *protocol.Block {
 //which is done on the global state
 //b: Block to add the transaction to
 //tx: A tx that implements the Transaction interface
-func addTx(b *protocol.Block, tx protocol.Transaction) error {
+//snapshot: State the block is built on, all txs of a block need to be checked against the same snapshot
+func addTx(b *protocol.Block, tx protocol.Transaction, snapshot *storage.Snapshot) error {
 
 	//activeParameters is a datastructure that stores the current system parameters, gets only changed when
 	//configTxs are broadcast in the network
@@ -48,7 +53,7 @@ func addTx(b *protocol.Block, tx protocol.Transaction) error {
 	//the address (public key of signature) in the transaction inside the tx -> would resulted in bigger tx size.
 	//So the trade-off is effectively clean abstraction vs. tx size. Everything related to fundsTx is postponed because
 	//the txs are dependent on each other.
-	if !verify(tx) {
+	if !verify(tx, snapshot) {
 		logger.Printf("Transaction could not be verified: %v", tx)
 		return errors.New("Transaction could not be verified.")
 	}
@@ -56,13 +61,13 @@ func addTx(b *protocol.Block, tx protocol.Transaction) error {
 	//This check involves the state, e.g., does the account already exist, does the sender have enough balance etc.
 	switch tx.(type) {
 	case *protocol.AccTx:
-		err := addAccTx(b, tx.(*protocol.AccTx))
+		err := addAccTx(b, tx.(*protocol.AccTx), snapshot)
 		if err != nil {
 			logger.Printf("Adding accTx tx failed (%v): %v\n", err, tx.(*protocol.AccTx))
 			return err
 		}
 	case *protocol.FundsTx:
-		err := addFundsTx(b, tx.(*protocol.FundsTx))
+		err := addFundsTx(b, tx.(*protocol.FundsTx), snapshot)
 		if err != nil {
 			logger.Printf("Adding fundsTx tx failed (%v): %v\n", err, tx.(*protocol.FundsTx))
 			return err
@@ -77,16 +82,22 @@ func addTx(b *protocol.Block, tx protocol.Transaction) error {
 		return errors.New("Transaction type not recognized.")
 	}
 
+	//The mempool might replace, evict or expire the tx before the block is mined, the block needs it for validation
+	if b.TxPayloads == nil {
+		b.TxPayloads = make(map[[32]byte]protocol.Transaction)
+	}
+	b.TxPayloads[tx.Hash()] = tx
+
 	return nil
 }
 
-func addAccTx(b *protocol.Block, tx *protocol.AccTx) error {
+func addAccTx(b *protocol.Block, tx *protocol.AccTx, snapshot *storage.Snapshot) error {
 
 	accHash := sha3.Sum256(tx.PubKey[:])
 	//According to the accTx specification, we only accept new accounts _except_ if the removal bit is
 	//set in the header (2nd bit)
 	if tx.Header&0x02 != 0x02 {
-		if _, exists := storage.State[accHash]; exists {
+		if snapshot.GetAccount(accHash) != nil {
 			return errors.New("Account already exists.")
 		}
 	}
@@ -97,17 +108,21 @@ func addAccTx(b *protocol.Block, tx *protocol.AccTx) error {
 	return nil
 }
 
-func addFundsTx(b *protocol.Block, tx *protocol.FundsTx) error {
+func addFundsTx(b *protocol.Block, tx *protocol.FundsTx, snapshot *storage.Snapshot) error {
+
+	//The block is going to be appended to the current chain
+	if height := uint32(globalBlockCount + 1); tx.Expired(height) {
+		return errors.New(fmt.Sprintf("Transaction expired at height %v, block height is %v.", tx.ValidUntil, height))
+	}
 
 	//Checking if the sender account is already in the local state copy. If not and account exist, create local copy
 	//If account does not exist in state, abort.
 	if _, exists := b.StateCopy[tx.From]; !exists {
-		if acc := storage.State[tx.From]; acc != nil {
+		if acc := snapshot.GetAccount(tx.From); acc != nil {
 			hash := serializeHashContent(acc.Address)
 			if hash == tx.From {
-				newAcc := protocol.Account{}
-				newAcc = *acc
-				b.StateCopy[tx.From] = &newAcc
+				//Snapshots return copies, no need to copy again
+				b.StateCopy[tx.From] = acc
 			}
 		} else {
 			return errors.New(fmt.Sprintf("Sender account not present in the state: %x\n", tx.From))
@@ -116,12 +131,10 @@ func addFundsTx(b *protocol.Block, tx *protocol.FundsTx) error {
 
 	//Vice versa for receiver account
 	if _, exists := b.StateCopy[tx.To]; !exists {
-		if acc := storage.State[tx.To]; acc != nil {
+		if acc := snapshot.GetAccount(tx.To); acc != nil {
 			hash := serializeHashContent(acc.Address)
 			if hash == tx.To {
-				newAcc := protocol.Account{}
-				newAcc = *acc
-				b.StateCopy[tx.To] = &newAcc
+				b.StateCopy[tx.To] = acc
 			}
 		} else {
 			return errors.New(fmt.Sprintf("Receiver account not present in the state: %x\n", tx.From))
@@ -130,7 +143,7 @@ func addFundsTx(b *protocol.Block, tx *protocol.FundsTx) error {
 
 	//Root accounts are exempt from balance requirements. All other accounts need to have (at least)
 	//fee + amount to spend as balance available
-	if !isRootKey(tx.From) {
+	if !snapshot.IsRootKey(tx.From) {
 		if (tx.Amount + tx.Fee) >= b.StateCopy[tx.From].Balance {
 			return errors.New("Not enough funds to complete the transaction!")
 		}
@@ -173,20 +186,46 @@ func addConfigTx(b *protocol.Block, tx *protocol.ConfigTx) error {
 //This function prepares the block to broadcast into the network. No new txs are added at this point.
 func finalizeBlock(b *protocol.Block) error {
 
+	prepareHeader(b)
+
+	valid := targetPoW(protocol.CompactToTarget(b.Target))
+	if !b.HasTarget() {
+		valid = legacyPoW(getTarget())
+	}
+
+	partialHash := b.HashBlock()
+	nonce, err := proofOfWork(valid, partialHash, b.PrevHash)
+	if err != nil {
+		return err
+	}
+	sealBlock(b, partialHash, nonce)
+
+	return nil
+}
+
+//Sets all header fields that are covered by the partial hash, except the ones set while adding txs
+func prepareHeader(b *protocol.Block) {
+
 	//Merkle tree includes the hashes of all txs
 	b.MerkleRoot = buildMerkleTree(b.AccTxData, b.FundsTxData, b.ConfigTxData)
 
 	b.Timestamp = time.Now().Unix()
 
+	//The block commits to the target it is mined against. Blocks below the target fork height don't, they're checked
+	//for leading zero bits
+	if globalBlockCount+1 >= targetForkHeight {
+		b.Header |= protocol.BLOCKFLAG_TARGET
+		b.Target = getTarget()
+	}
+
 	//BENEFICIARY is a config parameter set in config.go
 	beneficiary, _ := new(big.Int).SetString(BENEFICIARY, 16)
 	copy(b.Beneficiary[:], beneficiary.Bytes())
+}
+
+//Completes the block once a valid nonce has been found
+func sealBlock(b *protocol.Block, partialHash [32]byte, nonce [8]byte) {
 
-	partialHash := b.HashBlock()
-	nonce, err := proofOfWork(getDifficulty(), partialHash, b.PrevHash)
-	if err != nil {
-		return err
-	}
 	b.Nonce = nonce
 	//Put pieces to gether to get the final hash
 	b.Hash = sha3.Sum256(append(nonce[:], partialHash[:]...))
@@ -196,8 +235,6 @@ func finalizeBlock(b *protocol.Block) error {
 	b.NrAccTx = uint16(len(b.AccTxData))
 	b.NrFundsTx = uint16(len(b.FundsTxData))
 	b.NrConfigTx = uint8(len(b.ConfigTxData))
-
-	return nil
 }
 
 //This function is split into block syntax/PoW check and actual state change
@@ -209,6 +246,8 @@ func validateBlock(b *protocol.Block) error {
 	//validated concurrently
 	blockValidation.Lock()
 	defer blockValidation.Unlock()
+	//Runs before the unlock, also if the validation failed halfway (e.g., after rolling back blocks)
+	defer publishAdmissionParams()
 
 	//Prepare datastructure to fill tx payloads
 	blockDataMap := make(map[[32]byte]blockData)
@@ -220,7 +259,8 @@ func validateBlock(b *protocol.Block) error {
 	//If we're syncing or far behind, we cannot do this dynamic check
 	//We therefore include a boolean uptodate. If it's true we consider ourselves uptodate and
 	//do dynamic time checking
-	if len(blocksToValidate) > DELAYED_BLOCKS {
+	//Blocks from a bootstrap file are never checked against system time
+	if len(blocksToValidate) > DELAYED_BLOCKS || importing {
 		uptodate = false
 	} else {
 		uptodate = true
@@ -230,6 +270,11 @@ func validateBlock(b *protocol.Block) error {
 		return errors.New("Common ancestor not found or new chain shorter than current one.")
 	}
 
+	//Pruned blocks have neither tx payloads nor undo data anymore
+	if len(blocksToRollback) > 0 && globalBlockCount-int64(len(blocksToRollback)) < int64(store.ReadPrunedHeight()) {
+		return errors.New("Rollback would go beyond the pruned part of the chain.")
+	}
+
 	//If not the whole chain of blocks is valid, we don't do state changes on any of them before
 	//making sure they're properly formed. This avoids the attack to create a fake long chain with
 	//only some blocks valid
@@ -239,17 +284,29 @@ func validateBlock(b *protocol.Block) error {
 		if err != nil {
 			return err
 		}
-		blockDataMap[block.Hash] = blockData{accTxs, fundsTxs, configTxs, block}
+		blockDataMap[block.Hash] = blockData{accTxs, fundsTxs, configTxs, block, store.State().NewJournal(), nil}
 	}
 
+	//Snapshots are not taken while the state changes, readers either see the state before or after all blocks
+	var err error
+	store.State().Lock()
+	defer store.State().Unlock()
+
 	//No rollback needed, just a new block to validate
 	if len(blocksToRollback) == 0 {
 		for _, block := range blocksToValidate {
-			if err := stateValidation(blockDataMap[block.Hash]); err != nil {
+			data := blockDataMap[block.Hash]
+			if err := targetCheck(block); err != nil {
+				return err
+			}
+			if data.snapshot, err = verifyStateCommitment(block); err != nil {
+				return err
+			}
+			if err := stateValidation(data); err != nil {
 				return err
 			}
 			logger.Printf("Validating block: %vState:\n%v", block, getState())
-			postValidation(blockDataMap[block.Hash])
+			postValidation(data)
 		}
 	} else {
 		for _, block := range blocksToRollback {
@@ -259,17 +316,49 @@ func validateBlock(b *protocol.Block) error {
 			logger.Printf("Rolled back block: %vState:\n%v", block, getState())
 		}
 		for _, block := range blocksToValidate {
-			if err := stateValidation(blockDataMap[block.Hash]); err != nil {
+			data := blockDataMap[block.Hash]
+			if err := targetCheck(block); err != nil {
+				return err
+			}
+			if data.snapshot, err = verifyStateCommitment(block); err != nil {
+				return err
+			}
+			if err := stateValidation(data); err != nil {
 				return err
 			}
 			logger.Printf("Validating block: %vState:\n%v",block, getState())
-			postValidation(blockDataMap[block.Hash])
+			postValidation(data)
 		}
 	}
 
 	return nil
 }
 
+//The target of a block depends on the blocks before it, this is checked after the predecessor's statistics have been
+//collected (and after rollbacks). The PoW of blocks below the target fork height is checked here as well, they don't
+//carry the target it depends on
+func targetCheck(block *protocol.Block) error {
+
+	if globalBlockCount+1 < targetForkHeight {
+		if block.HasTarget() {
+			return errors.New("Block below the target fork height carries a target.")
+		}
+		if !legacyPoW(getTarget())(block.Hash) {
+			return errors.New("Proof of work is incorrect.")
+		}
+		return nil
+	}
+
+	if !block.HasTarget() {
+		return errors.New("Block has no target.")
+	}
+	if block.Target != getTarget() {
+		return errors.New(fmt.Sprintf("Block target %x does not match the expected target %x.", block.Target, getTarget()))
+	}
+
+	return nil
+}
+
 //Doesn't involve any state changes
 func preValidation(block *protocol.Block) (accTxSlice []*protocol.AccTx, fundsTxSlice []*protocol.FundsTx, configTxSlice []*protocol.ConfigTx, err error) {
 
@@ -327,13 +416,20 @@ func preValidation(block *protocol.Block) (accTxSlice []*protocol.AccTx, fundsTx
 	}
 
 	//Does the beneficiary exist in the state
-	if acc := storage.GetAccountFromHash(block.Beneficiary); acc == nil {
+	if acc := store.State().GetAccount(block.Beneficiary); acc == nil {
 		return nil, nil, nil, errors.New("Beneficiary not in the State.")
 	}
 
+	//Whether the target is the one the chain expects at this height can only be checked once the predecessor has been
+	//validated (see targetCheck), the PoW is checked against the target in the header. Blocks below the target fork
+	//height don't carry one, their PoW is checked by targetCheck
+	if block.HasTarget() && protocol.CompactToTarget(block.Target).Cmp(protocol.MaxTarget) > 0 {
+		return nil, nil, nil, errors.New("Block has no valid target.")
+	}
+
 	//PoW validation
 	partialHash := block.HashBlock()
-	if block.Hash != sha3.Sum256(append(block.Nonce[:], partialHash[:]...)) || !validateProofOfWork(getDifficulty(), block.Hash) {
+	if block.Hash != sha3.Sum256(append(block.Nonce[:], partialHash[:]...)) || block.HasTarget() && !validateProofOfWork(protocol.CompactToTarget(block.Target), block.Hash) {
 		return nil, nil, nil, errors.New("Proof of work is incorrect.")
 		logger.Println("Proof of work is incorrect.")
 
@@ -368,17 +464,19 @@ func timestampCheck(timestamp int64) error {
 func fetchAccTxData(block *protocol.Block, accTxSlice []*protocol.AccTx, errChan chan error) {
 
 	for cnt, txHash := range block.AccTxData {
-		//Reject blocks that have txs which have already been validated
-		closedTx := storage.ReadClosedTx(txHash)
-		if closedTx != nil {
+		//Reject blocks that have txs which have already been validated. The location index is kept when the payload
+		//of a confirmed tx is pruned, pruned and full nodes need to agree on replays
+		if store.ReadTxLocation(txHash) != nil {
 			errChan <- errors.New("Block validation had accTx that was already in a previous block")
 			return
 		}
 
 		var tx protocol.Transaction
 		var accTx *protocol.AccTx
-		//Tx is either in open storage or needs to be fetched from the network
-		tx = storage.ReadOpenTx(txHash)
+		//Tx is either part of our own block, in open storage or needs to be fetched from the network
+		if tx = block.TxPayloads[txHash]; tx == nil {
+			tx = store.ReadOpenTx(txHash)
+		}
 		if tx != nil {
 			accTx = tx.(*protocol.AccTx)
 		} else {
@@ -410,15 +508,16 @@ func fetchAccTxData(block *protocol.Block, accTxSlice []*protocol.AccTx, errChan
 func fetchFundsTxData(block *protocol.Block, fundsTxSlice []*protocol.FundsTx, errChan chan error) {
 
 	for cnt, txHash := range block.FundsTxData {
-		closedTx := storage.ReadClosedTx(txHash)
-		if closedTx != nil {
+		if store.ReadTxLocation(txHash) != nil {
 			errChan <- errors.New("Block validation had fundsTx that was already in a previous block")
 			return
 		}
 
 		var tx protocol.Transaction
 		var fundsTx *protocol.FundsTx
-		tx = storage.ReadOpenTx(txHash)
+		if tx = block.TxPayloads[txHash]; tx == nil {
+			tx = store.ReadOpenTx(txHash)
+		}
 		if tx != nil {
 			fundsTx = tx.(*protocol.FundsTx)
 		} else {
@@ -447,15 +546,16 @@ func fetchFundsTxData(block *protocol.Block, fundsTxSlice []*protocol.FundsTx, e
 func fetchConfigTxData(block *protocol.Block, configTxSlice []*protocol.ConfigTx, errChan chan error) {
 
 	for cnt, txHash := range block.ConfigTxData {
-		closedTx := storage.ReadClosedTx(txHash)
-		if closedTx != nil {
+		if store.ReadTxLocation(txHash) != nil {
 			errChan <- errors.New("Block validation had configTx that was already in a previous block")
 			return
 		}
 
 		var tx protocol.Transaction
 		var configTx *protocol.ConfigTx
-		tx = storage.ReadOpenTx(txHash)
+		if tx = block.TxPayloads[txHash]; tx == nil {
+			tx = store.ReadOpenTx(txHash)
+		}
 		if tx != nil {
 			configTx = tx.(*protocol.ConfigTx)
 		} else {
@@ -486,25 +586,24 @@ func stateValidation(data blockData) error {
 
 	//The sequence of validation matters. If we start with accs, then fund transfers can be done in the same block
 	//even though the accounts did not exist before the block validation
-	if err := accStateChange(data.accTxSlice); err != nil {
+	//If any of the state changes fails, the journal brings the state back to what it was before the block
+	if err := accStateChange(data.accTxSlice, data.journal); err != nil {
+		data.journal.Revert()
 		return err
 	}
 
-	if err := fundsStateChange(data.fundsTxSlice); err != nil {
-		accStateChangeRollback(data.accTxSlice)
+	if err := fundsStateChange(data.fundsTxSlice, data.journal); err != nil {
+		data.journal.Revert()
 		return err
 	}
 
-	if err := collectTxFees(data.accTxSlice, data.fundsTxSlice, data.configTxSlice, data.block.Beneficiary); err != nil {
-		fundsStateChangeRollback(data.fundsTxSlice)
-		accStateChangeRollback(data.accTxSlice)
+	if err := collectTxFees(data.accTxSlice, data.fundsTxSlice, data.configTxSlice, data.block.Beneficiary, data.journal); err != nil {
+		data.journal.Revert()
 		return err
 	}
 
-	if err := collectBlockReward(activeParameters.block_reward, data.block.Beneficiary); err != nil {
-		collectTxFeesRollback(data.accTxSlice, data.fundsTxSlice, data.configTxSlice, data.block.Beneficiary)
-		fundsStateChangeRollback(data.fundsTxSlice)
-		accStateChangeRollback(data.accTxSlice)
+	if err := collectBlockReward(activeParameters.block_reward, data.block.Beneficiary, data.journal); err != nil {
+		data.journal.Revert()
 		return err
 	}
 
@@ -512,30 +611,49 @@ func stateValidation(data blockData) error {
 }
 
 func postValidation(data blockData) {
+
+	//All disk writes for this block are collected and committed at once
+	batch := storage.NewBatch()
+
 	//Write all open transactions to closed/validated storage
 	for _, tx := range data.accTxSlice {
-		storage.WriteClosedTx(tx)
-		storage.DeleteOpenTx(tx)
+		batch.WriteClosedTx(tx)
+		batch.DeleteOpenTx(tx)
 	}
 
 	for _, tx := range data.fundsTxSlice {
-		storage.WriteClosedTx(tx)
-		storage.DeleteOpenTx(tx)
+		batch.WriteClosedTx(tx)
+		batch.DeleteOpenTx(tx)
 	}
 
 	for _, tx := range data.configTxSlice {
-		storage.WriteClosedTx(tx)
-		storage.DeleteOpenTx(tx)
+		batch.WriteClosedTx(tx)
+		batch.DeleteOpenTx(tx)
 	}
 
 	//The new system parameters get active if the block was successfully validated
 	//This is done after state validation (in contrast to accTx/fundsTx).
 	//Conversely, if blocks are rolled back, the system parameters are changed first
 	configStateChange(data.configTxSlice, data.block.Hash)
+	//The block had to meet the target that is active before its statistics are collected (see targetCheck)
+	batch.WriteChainWork(data.block.Hash, new(big.Int).Add(chainWork(data.block.PrevHash), blockWork(getTarget())))
+
 	//Collects meta information about the block (and handled difficulty adaption)
 	collectStatistics(data.block)
 
 	//It might be that block is not in the openblock storage, but this doesn't matter
-	storage.DeleteOpenBlock(data.block.Hash)
-	storage.WriteClosedBlock(data.block)
+	batch.DeleteOpenBlock(data.block.Hash)
+	batch.WriteClosedBlock(data.block)
+	persistTxLocations(batch, data, uint32(globalBlockCount))
+	persistHistory(batch, data, uint32(globalBlockCount))
+	batch.WriteUndo(data.block.Hash, data.journal)
+	persistSnapshot(batch, data, uint32(globalBlockCount))
+
+	//Persist the new state, a restarted node continues from here
+	persistState(batch, data.journal.Accounts())
+	pruneBlocks(batch, uint32(globalBlockCount))
+
+	if err := store.Commit(batch); err != nil {
+		logger.Printf("CRITICAL: Block (%x) could not be written to disk: %v\n", data.block.Hash[0:12], err)
+	}
 }
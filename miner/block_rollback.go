@@ -14,15 +14,21 @@ func validateBlockRollback(b *protocol.Block) error {
 	if err != nil {
 		return err
 	}
-	data := blockData{accTxSlice, fundsTxSlice, configTxSlice, b}
+	//The undo data was stored together with the block, it contains the exact pre-block version of every account
+	//the block changed
+	journal := store.ReadUndo(b.Hash)
+	if journal == nil {
+		return errors.New("CRITICAL: Undo data of validated block is not available")
+	}
+	data := blockData{accTxSlice, fundsTxSlice, configTxSlice, b, journal, nil}
 
 	//Going back to pre-block system parameters before the state is rolled back
 	configStateChangeRollback(data.configTxSlice, b.Hash)
-	if err := stateValidationRollback(data); err != nil {
-		return err
-	}
+	//Revert clears the journal, the accounts it restored still need to be written to disk
+	accounts := data.journal.Accounts()
+	data.journal.Revert()
 
-	postValidationRollback(data)
+	postValidationRollback(data, accounts)
 	return nil
 }
 
@@ -31,7 +37,7 @@ func preValidationRollback(b *protocol.Block) (accTxSlice []*protocol.AccTx, fun
 	//fetch all transactions from closed storage
 	for _, hash := range b.AccTxData {
 		var accTx *protocol.AccTx
-		tx := storage.ReadClosedTx(hash)
+		tx := store.ReadClosedTx(hash)
 		if tx == nil {
 			//This should never happen, because all validated transactions are in closed storage
 			return nil, nil, nil, errors.New("CRITICAL: Validated accTx was not in the confirmed tx storage")
@@ -43,7 +49,7 @@ func preValidationRollback(b *protocol.Block) (accTxSlice []*protocol.AccTx, fun
 
 	for _, hash := range b.FundsTxData {
 		var fundsTx *protocol.FundsTx
-		tx := storage.ReadClosedTx(hash)
+		tx := store.ReadClosedTx(hash)
 		if tx == nil {
 			return nil, nil, nil, errors.New("CRITICAL: Validated fundsTx was not in the confirmed tx storage")
 		} else {
@@ -54,7 +60,7 @@ func preValidationRollback(b *protocol.Block) (accTxSlice []*protocol.AccTx, fun
 
 	for _, hash := range b.ConfigTxData {
 		var configTx *protocol.ConfigTx
-		tx := storage.ReadClosedTx(hash)
+		tx := store.ReadClosedTx(hash)
 		if tx == nil {
 			return nil, nil, nil, errors.New("CRITICAL: Validated configTx was not in the confirmed tx storage")
 		} else {
@@ -66,37 +72,41 @@ func preValidationRollback(b *protocol.Block) (accTxSlice []*protocol.AccTx, fun
 	return accTxSlice, fundsTxSlice, configTxSlice, nil
 }
 
-func stateValidationRollback(data blockData) error {
+func postValidationRollback(data blockData, accounts [][32]byte) {
 
-	//The rollback sequence is important and has to be exactly the reverse as with state change in state.go
-	collectBlockRewardRollback(activeParameters.block_reward, data.block.Beneficiary)
-	collectTxFeesRollback(data.accTxSlice, data.fundsTxSlice, data.configTxSlice, data.block.Beneficiary)
-	fundsStateChangeRollback(data.fundsTxSlice)
-	accStateChangeRollback(data.accTxSlice)
-	return nil
-}
-
-func postValidationRollback(data blockData) {
+	batch := storage.NewBatch()
 
 	//Put all validated txs into invalidated state
 	for _, tx := range data.fundsTxSlice {
-		storage.WriteOpenTx(tx)
-		storage.DeleteClosedTx(tx)
+		batch.WriteOpenTx(tx)
+		batch.DeleteClosedTx(tx)
 	}
 
 	for _, tx := range data.accTxSlice {
-		storage.WriteOpenTx(tx)
-		storage.DeleteClosedTx(tx)
+		batch.WriteOpenTx(tx)
+		batch.DeleteClosedTx(tx)
 	}
 
 	for _, tx := range data.configTxSlice {
-		storage.WriteOpenTx(tx)
-		storage.DeleteClosedTx(tx)
+		batch.WriteOpenTx(tx)
+		batch.DeleteClosedTx(tx)
 	}
 
+	//The rolled back block is no longer part of the canonical chain
+	batch.DeleteBlockHeight(uint32(globalBlockCount))
+	deleteHistory(batch, data, uint32(globalBlockCount))
+	deleteSnapshot(batch, data, uint32(globalBlockCount))
 	collectStatisticsRollback(data.block)
 
 	//For transactions we switch from closed to open. However, we do not write back blocks
 	//to open storage, because in case of rollback the chain they belonged to is likely to starve
-	storage.DeleteClosedBlock(data.block.Hash)
+	batch.DeleteClosedBlock(data.block.Hash)
+	deleteTxLocations(batch, data)
+	batch.DeleteUndo(data.block.Hash)
+
+	persistState(batch, accounts)
+
+	if err := store.Commit(batch); err != nil {
+		logger.Printf("CRITICAL: Rollback of block (%x) could not be written to disk: %v\n", data.block.Hash[0:12], err)
+	}
 }
@@ -18,7 +18,7 @@ func TestValidateBlockRollback(t *testing.T) {
 	accsBefore2 := make(map[[64]byte]protocol.Account)
 	accsAfter := make(map[[64]byte]protocol.Account)
 
-	for _, acc := range storage.State {
+	for _, acc := range store.State().Accounts() {
 		accsBefore[acc.Address] = *acc
 	}
 
@@ -27,7 +27,7 @@ func TestValidateBlockRollback(t *testing.T) {
 	finalizeBlock(b)
 	validateBlock(b)
 
-	for _, acc := range storage.State {
+	for _, acc := range store.State().Accounts() {
 		accsAfter[acc.Address] = *acc
 	}
 
@@ -40,7 +40,7 @@ func TestValidateBlockRollback(t *testing.T) {
 		t.Errorf("%v\n", err)
 	}
 
-	for _, acc := range storage.State {
+	for _, acc := range store.State().Accounts() {
 		accsBefore2[acc.Address] = *acc
 	}
 
@@ -72,7 +72,7 @@ func TestMultipleBlocksRollback(t *testing.T) {
 		t.Errorf("Block validation for (%v) failed: %v\n", b, err)
 	}
 
-	for _, acc := range storage.State {
+	for _, acc := range store.State().Accounts() {
 		stateb[acc.Address] = *acc
 	}
 
@@ -86,7 +86,7 @@ func TestMultipleBlocksRollback(t *testing.T) {
 		t.Errorf("Block failed: %v\n", b2)
 	}
 
-	for _, acc := range storage.State {
+	for _, acc := range store.State().Accounts() {
 		stateb2[acc.Address] = *acc
 	}
 
@@ -100,7 +100,7 @@ func TestMultipleBlocksRollback(t *testing.T) {
 		t.Errorf("Block failed: %v\n", b3)
 	}
 
-	for _, acc := range storage.State {
+	for _, acc := range store.State().Accounts() {
 		stateb3[acc.Address] = *acc
 	}
 
@@ -118,7 +118,7 @@ func TestMultipleBlocksRollback(t *testing.T) {
 	if err := validateBlockRollback(b4); err != nil {
 		t.Errorf("%v\n", err)
 	}
-	for _, acc := range storage.State {
+	for _, acc := range store.State().Accounts() {
 		tmpState[acc.Address] = *acc
 	}
 
@@ -133,7 +133,7 @@ func TestMultipleBlocksRollback(t *testing.T) {
 	if err := validateBlockRollback(b3); err != nil {
 		t.Errorf("%v\n", err)
 	}
-	for _, acc := range storage.State {
+	for _, acc := range store.State().Accounts() {
 		tmpState[acc.Address] = *acc
 	}
 	if !reflect.DeepEqual(tmpState, stateb2) || !reflect.DeepEqual(paramb2, parameterSlice) {
@@ -146,7 +146,7 @@ func TestMultipleBlocksRollback(t *testing.T) {
 	if err := validateBlockRollback(b2); err != nil {
 		t.Errorf("%v\n", err)
 	}
-	for _, acc := range storage.State {
+	for _, acc := range store.State().Accounts() {
 		tmpState[acc.Address] = *acc
 	}
 	if !reflect.DeepEqual(tmpState, stateb) || !reflect.DeepEqual(paramb, parameterSlice) {
@@ -159,7 +159,7 @@ func TestMultipleBlocksRollback(t *testing.T) {
 	if err := validateBlockRollback(b); err != nil {
 		t.Errorf("%v\n", err)
 	}
-	for _, acc := range storage.State {
+	for _, acc := range store.State().Accounts() {
 		tmpState[acc.Address] = *acc
 	}
 
@@ -167,3 +167,80 @@ func TestMultipleBlocksRollback(t *testing.T) {
 		delete(tmpState, k)
 	}
 }
+
+//Every confirmed tx needs to point to the block that confirmed it, until the block is rolled back
+func TestTxLocationRollback(t *testing.T) {
+
+	cleanAndPrepare()
+	b := newBlock([32]byte{})
+	createBlockWithTxs(b)
+	finalizeBlock(b)
+	if err := validateBlock(b); err != nil {
+		t.Errorf("Block validation failed: %v\n", err)
+	}
+
+	checkLocations := func(txHashes [][32]byte, txType uint8) {
+		for index, txHash := range txHashes {
+			loc := store.ReadTxLocation(txHash)
+			if loc == nil || loc.BlockHash != b.Hash || loc.Height != 1 || loc.TxType != txType || int(loc.Index) != index {
+				t.Errorf("Wrong location for tx %x: %v\n", txHash[0:8], loc)
+			}
+		}
+	}
+	checkLocations(b.AccTxData, storage.ACCTX)
+	checkLocations(b.FundsTxData, storage.FUNDSTX)
+	checkLocations(b.ConfigTxData, storage.CONFIGTX)
+
+	if err := validateBlockRollback(b); err != nil {
+		t.Errorf("%v\n", err)
+	}
+
+	for _, txHashes := range [][][32]byte{b.AccTxData, b.FundsTxData, b.ConfigTxData} {
+		for _, txHash := range txHashes {
+			if store.ReadTxLocation(txHash) != nil {
+				t.Errorf("Location of rolled back tx %x still exists.\n", txHash[0:8])
+			}
+		}
+	}
+}
+
+func TestAccountHistoryRollback(t *testing.T) {
+
+	cleanAndPrepare()
+	b := newBlock([32]byte{})
+	createBlockWithTxs(b)
+	finalizeBlock(b)
+	if err := validateBlock(b); err != nil {
+		t.Errorf("Block validation failed: %v\n", err)
+	}
+
+	accAHash := serializeHashContent(accA.Address)
+	history := store.ReadAccountHistory(accAHash, 0, len(b.FundsTxData)+1)
+	if len(history) != len(b.FundsTxData) {
+		t.Fatalf("Account history has %v entries, block has %v fundsTxs\n", len(history), len(b.FundsTxData))
+	}
+	for index, entry := range history {
+		if entry.Height != 1 || entry.TxType != storage.FUNDSTX || entry.Hash != b.FundsTxData[index] {
+			t.Errorf("Wrong history entry at position %v: %v\n", index, entry)
+		}
+	}
+
+	//The beneficiary is the issuer of the accTxs as well, the block reward comes last
+	beneficiaryHistory := store.ReadAccountHistory(b.Beneficiary, 0, len(b.AccTxData)+1)
+	if len(beneficiaryHistory) != len(b.AccTxData)+1 {
+		t.Errorf("Beneficiary history has %v entries, expected %v\n", len(beneficiaryHistory), len(b.AccTxData)+1)
+	} else if reward := beneficiaryHistory[len(b.AccTxData)]; reward.TxType != storage.BLOCKREWARD || reward.Hash != b.Hash {
+		t.Errorf("Block reward is missing in the beneficiary's history: %v\n", reward)
+	}
+
+	if err := validateBlockRollback(b); err != nil {
+		t.Errorf("%v\n", err)
+	}
+
+	if history := store.ReadAccountHistory(accAHash, 0, 1); len(history) != 0 {
+		t.Errorf("Account history still has entries after rollback: %v\n", history)
+	}
+	if history := store.ReadAccountHistory(b.Beneficiary, 0, 1); len(history) != 0 {
+		t.Errorf("Block reward still in history after rollback: %v\n", history)
+	}
+}
@@ -2,7 +2,6 @@ package miner
 
 import (
 	"github.com/lisgie/bazo_miner/protocol"
-	"github.com/lisgie/bazo_miner/storage"
 	"math/rand"
 	"reflect"
 	"testing"
@@ -25,7 +24,7 @@ func TestBlock(t *testing.T) {
 	decodedBlock = decodedBlock.Decode(encodedBlock)
 	err := validateBlock(decodedBlock)
 
-	b.StateCopy = nil
+	b.StateCopy, b.TxPayloads = nil, nil
 	decodedBlock.StateCopy = nil
 
 	if err != nil {
@@ -144,25 +143,25 @@ func createBlockWithTxs(b *protocol.Block) ([][32]byte, [][32]byte, [][32]byte)
 		accAHash := serializeHashContent(accA.Address)
 		accBHash := serializeHashContent(accB.Address)
 		tx, _ := protocol.ConstrFundsTx(0x01, rand.Uint64()%100+1, rand.Uint64()%100+1, uint32(cnt), accAHash, accBHash, &PrivKeyA)
-		if err := addTx(b, tx); err == nil {
+		if err := addTx(b, tx, store.State().Snapshot()); err == nil {
 			//Might  be that we generated a block that was already generated before
-			if storage.ReadOpenTx(tx.Hash()) != nil || storage.ReadClosedTx(tx.Hash()) != nil {
+			if store.ReadOpenTx(tx.Hash()) != nil || store.ReadTxLocation(tx.Hash()) != nil {
 				continue
 			}
 			hashFundsSlice = append(hashFundsSlice, tx.Hash())
-			storage.WriteOpenTx(tx)
+			store.WriteOpenTx(tx)
 		}
 	}
 
 	loopMax = int(rand.Uint32()%testSize) + 1
 	for cnt := 0; cnt < loopMax; cnt++ {
 		tx,_,_ := protocol.ConstrAccTx(0, rand.Uint64()%100+1, &RootPrivKey)
-		if err := addTx(b, tx); err == nil {
-			if storage.ReadOpenTx(tx.Hash()) != nil || storage.ReadClosedTx(tx.Hash()) != nil{
+		if err := addTx(b, tx, store.State().Snapshot()); err == nil {
+			if store.ReadOpenTx(tx.Hash()) != nil || store.ReadTxLocation(tx.Hash()) != nil{
 				continue
 			}
 			hashAccSlice = append(hashAccSlice, tx.Hash())
-			storage.WriteOpenTx(tx)
+			store.WriteOpenTx(tx)
 		}
 	}
 
@@ -171,7 +170,7 @@ func createBlockWithTxs(b *protocol.Block) ([][32]byte, [][32]byte, [][32]byte)
 	for cnt := 0; cnt < loopMax; cnt++ {
 		tx, _ := protocol.ConstrConfigTx(uint8(rand.Uint32()%256), uint8(rand.Uint32()%10+1), rand.Uint64()%2342873423, rand.Uint64()%1000+1, uint8(cnt), &RootPrivKey)
 
-		if storage.ReadOpenTx(tx.Hash()) != nil || storage.ReadClosedTx(tx.Hash()) != nil {
+		if store.ReadOpenTx(tx.Hash()) != nil || store.ReadTxLocation(tx.Hash()) != nil {
 			continue
 		}
 
@@ -179,10 +178,10 @@ func createBlockWithTxs(b *protocol.Block) ([][32]byte, [][32]byte, [][32]byte)
 		if tx.Id == 3 || tx.Id == 1 {
 			continue
 		}
-		if err := addTx(b, tx); err == nil {
+		if err := addTx(b, tx, store.State().Snapshot()); err == nil {
 
 			hashConfigSlice = append(hashConfigSlice, tx.Hash())
-			storage.WriteOpenTx(tx)
+			store.WriteOpenTx(tx)
 		}
 	}
 
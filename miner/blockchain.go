@@ -2,6 +2,7 @@ package miner
 
 import (
 	"fmt"
+	"github.com/lisgie/bazo_miner/p2p"
 	"github.com/lisgie/bazo_miner/protocol"
 	"github.com/lisgie/bazo_miner/storage"
 	"log"
@@ -13,21 +14,85 @@ import (
 
 var (
 	logger               *log.Logger
+	store                storage.Storage
 	blockValidation      = &sync.Mutex{}
 	parameterSlice       []parameters
 	activeParameters     *parameters
 	uptodate             bool
+	importing            bool
+	//Number of most recent blocks whose tx payloads and undo data are kept, 0 keeps everything
+	pruneDepth           uint32
+	fastSyncEnabled      bool
+	//Only changed by tests, all miners need to agree on the interval
+	snapshotInterval     = int64(SNAPSHOT_INTERVAL)
+	//Only changed by tests, the easiest target a block can have
+	genesisTarget        = targetFromZeroBits(GENESIS_TARGET_BITS)
+	//Only changed by tests, all miners need to agree on the height
+	targetForkHeight     = int64(TARGET_FORK_HEIGHT)
 )
 
-//Miner entry point
-func Init() {
+//Miner entry point. A miner that starts from scratch either starts with the genesis block or, if sync is set, tries
+//to start from a snapshot of another miner
+func Init(st storage.Storage, depth uint32, sync bool, workers int) {
 
-	//Initialize root key
-	initRootKey()
+	pruneDepth = depth
+	fastSyncEnabled = sync
+	//Zero uses all cores
+	if workers > 0 {
+		powWorkers = workers
+	}
+	setup(st)
+
+	//Txs from other miners are checked before they're written to the mempool and relayed
+	p2p.ValidateTx = verifyOpenTx
+	//External workers mine on templates of this node
+	p2p.GetWork = getWork
+	p2p.SubmitWork = submitWork
+
+	//Start to listen to network inputs (txs and blocks)
+	go incomingData()
+	mining()
+}
+
+//Brings the miner to the last validated block, without starting to mine or listening to the network
+func setup(st storage.Storage) {
+
+	store = st
+	initLogger()
+
+	//Resume from the last validated block if the node has been running before
+	if restoreChainState() {
+		backfillChainWork()
+		logger.Printf("Restored chain state, last block: %vState:\n%v", lastBlock, getState())
+	} else if fastSyncEnabled {
+		if err := fastSync(); err != nil {
+			logger.Printf("Fast sync failed, starting with the genesis block: %v\n", err)
+			initGenesis()
+		}
+	} else {
+		initGenesis()
+	}
+
+	//Blocks are mined on top of the restored tip
+	newTip(lastBlock.Hash)
+	publishAdmissionParams()
+
+	//Txs that were open when the miner stopped, checked against the restored state
+	loaded, dropped := store.LoadMempool(verifyOpenTx)
+	logger.Printf("Reloaded %v txs into the mempool, dropped %v.\n", loaded, dropped)
+}
+
+func initLogger() {
 
-	//Set up logger
 	LogFile, _ := os.OpenFile("logs/miner "+time.Now().String(), os.O_RDWR|os.O_CREATE, 0666)
 	logger = log.New(LogFile, "", log.LstdFlags)
+}
+
+//Sets up the root key, the initial system parameters and the genesis block for a node that starts from scratch
+func initGenesis() {
+
+	//Initialize root key
+	rootHash := initRootKey()
 
 	parameterSlice = append(parameterSlice, parameters{
 		[32]byte{},
@@ -36,21 +101,26 @@ func Init() {
 		2016,
 		60, //1min
 		0,
+		GENESIS_DIFF_ALGORITHM,
 	})
 	activeParameters = &parameterSlice[0]
 
 	currentTargetTime = new(timerange)
-	target = append(target, 26)
+	target = append(target, genesisTarget)
 
 	//Start blockchain with genesis block and 0 hash
 	//Don't validate nor broadcast
 	genesis := newBlock([32]byte{})
 	collectStatistics(genesis)
-	storage.WriteClosedBlock(genesis)
 
-	//Start to listen to network inputs (txs and blocks)
-	go incomingData()
-	mining()
+	batch := storage.NewBatch()
+	batch.WriteClosedBlock(genesis)
+	batch.WriteChainWork(genesis.Hash, big.NewInt(0))
+	persistAccount(batch, rootHash)
+	persistChainState(batch)
+	if err := store.Commit(batch); err != nil {
+		logger.Fatalf("Genesis block could not be written to disk: %v\n", err)
+	}
 }
 
 //Mining is a constant process, trying to come up with a successful PoW
@@ -82,13 +152,15 @@ func mining() {
 		blockValidation.Lock()
 		nextBlock := newBlock(lastBlock.Hash)
 		currentBlock = nextBlock
+		//Before any txs are added, the commitment counts towards the block size
+		addStateCommitment(currentBlock)
 		prepareBlock(currentBlock)
 		blockValidation.Unlock()
 	}
 }
 
 //At least one root key needs to be set which is allowed to create new accounts
-func initRootKey() {
+func initRootKey() (rootHash [32]byte) {
 
 	var pubKey [64]byte
 
@@ -98,10 +170,12 @@ func initRootKey() {
 	copy(pubKey[:32], pub1.Bytes())
 	copy(pubKey[32:], pub2.Bytes())
 
-	rootHash := serializeHashContent(pubKey)
+	rootHash = serializeHashContent(pubKey)
 
 	rootAcc := protocol.Account{Address: pubKey}
 
-	storage.State[rootHash] = &rootAcc
-	storage.RootKeys[rootHash] = &rootAcc
+	store.State().SetAccount(rootHash, &rootAcc)
+	store.State().SetRootKey(rootHash, &rootAcc)
+
+	return rootHash
 }
@@ -3,15 +3,15 @@ package miner
 import (
 	"fmt"
 	"github.com/lisgie/bazo_miner/protocol"
-	"github.com/lisgie/bazo_miner/storage"
 	"math"
+	"math/big"
 )
 
 var (
 	lastBlock        *protocol.Block
 	globalBlockCount = int64(-1)
 	localBlockCount  = int64(-1)
-	target            []uint8 //Stores the history of target values
+	target            []uint32 //Stores the history of target values (compact encoding)
 	currentTargetTime *timerange //Corresponds to the active timerange
 )
 
@@ -27,6 +27,7 @@ type parameters struct {
 	diff_interval  uint64
 	block_interval uint64
 	block_reward   uint64
+	diff_algorithm uint64
 }
 
 //Captures first and last timestamp of the intended blocks of the range
@@ -43,27 +44,25 @@ func collectStatistics(b *protocol.Block) {
 	globalBlockCount++
 	localBlockCount++
 
+	//The difficulty intervals are tracked with every algorithm, the target history gets a new entry at the end of
+	//each of them. Algorithms that retarget within an interval replace the last entry
+	algorithm := activeDifficultyAlgorithm()
 	if localBlockCount == int64(activeParameters.diff_interval) {
 
 		currentTargetTime.last = b.Timestamp
-		//The genesis block has timestamp = 0. This simplifies certain things: Every miner can start with an already
-		//existing genesis block (because all fields are set to 0). The "find common ancestor" algorithm can then
-		//use the genesis block as a common ancestor for new miners who have not synchronized with the chain yet.
-		if currentTargetTime.first == 0 {
-			target = append(target, target[len(target)-1])
-		} else {
-			target = append(target, calculateNewDifficulty(currentTargetTime))
-		}
-
+		target = append(target, algorithm.nextTarget(b, currentTargetTime, true))
 		targetTimes = append(targetTimes, *currentTargetTime)
 
-		logger.Printf("Target changed, new target: %v", target[len(target)-1])
+		logger.Printf("Target changed, new target: %x", target[len(target)-1])
 		localBlockCount = 0
 		currentTargetTime = new(timerange)
 		currentTargetTime.first = b.Timestamp
+	} else if newTarget := algorithm.nextTarget(b, currentTargetTime, false); newTarget != getTarget() {
+		target[len(target)-1] = newTarget
 	}
 
 	lastBlock = b
+	newTip(lastBlock.Hash)
 }
 
 func collectStatisticsRollback(b *protocol.Block) {
@@ -81,10 +80,55 @@ func collectStatisticsRollback(b *protocol.Block) {
 		localBlockCount--
 	}
 
-	lastBlock = storage.ReadClosedBlock(b.PrevHash)
+	//Whatever algorithm calculated it, the block was mined against the target that is active again now. This also
+	//reverts targets replaced within an interval
+	if b.HasTarget() {
+		target[len(target)-1] = b.Target
+	}
+
+	lastBlock = store.ReadClosedBlock(b.PrevHash)
+	newTip(b.PrevHash)
 }
 
-func calculateNewDifficulty(t *timerange) uint8 {
+//The target is scaled by the ratio of the time the last range took to the time it should have taken. Blocks that came
+//too fast make the target smaller (harder), blocks that came too slow make it bigger (easier)
+func calculateNewTarget(t *timerange) uint32 {
+
+	//Time difference between the first and last block in the measured range
+	diff_now := t.last - t.first
+	//This is how long it should have taken
+	diff_wanted := activeParameters.block_interval * (activeParameters.diff_interval)
+
+	//If the last is earlier time than first, the ratio doesn't make sense. Reasonable parameters should be chosen for
+	//block interval/diff interval such that this case does not happen. In case it still does, we give the current
+	//target back
+	if diff_now < 0 || diff_wanted == 0 {
+		return getTarget()
+	}
+
+	//Sanity check! Make it at most 8 times as hard or easy, Bitcoin has a similar check
+	if uint64(diff_now) > diff_wanted*8 {
+		diff_now = int64(diff_wanted * 8)
+	} else if uint64(diff_now) < diff_wanted/8 {
+		diff_now = int64(diff_wanted / 8)
+	}
+
+	current := protocol.CompactToTarget(getTarget())
+	newTarget := new(big.Int).Mul(current, big.NewInt(diff_now))
+	newTarget.Div(newTarget, new(big.Int).SetUint64(diff_wanted))
+
+	if newTarget.Sign() == 0 {
+		newTarget.SetInt64(1)
+	} else if newTarget.Cmp(protocol.MaxTarget) > 0 {
+		newTarget.Set(protocol.MaxTarget)
+	}
+
+	return protocol.TargetToCompact(newTarget)
+}
+
+//Retargeting of the blocks below the target fork height. The difficulty is the number of leading zero bits, it
+//changes by the log2 of the ratio of the time the last range should have taken to the time it took
+func calculateLegacyTarget(t *timerange) uint32 {
 
 	//Time difference between the first and last block in the measured range
 	diff_now := t.last - t.first
@@ -97,7 +141,7 @@ func calculateNewDifficulty(t *timerange) uint8 {
 	//this precipitates that reasonable parameter should be chosen for block interval/diff interval
 	//such that this case does not happen. In case it still does, we give the current difficulty back
 	if diff_ratio < 0 {
-		return getDifficulty()
+		return getTarget()
 	}
 
 	//Take the log2 from the diff_ratio, because adding a zero makes it twice as hard, adding two zeros four times as
@@ -118,17 +162,43 @@ func calculateNewDifficulty(t *timerange) uint8 {
 		target_change = -3
 	}
 
-	//Rounding down (for positive values) and runding up (for negative values)
-	target_change_rounded := uint8(target_change)
-
-	//Return the new target based on the calculation and the current target
-	return target_change_rounded + target[len(target)-1]
+	//Rounding down (for positive values) and runding up (for negative values). The difficulty was a uint8, the change
+	//wrapped around
+	return targetFromZeroBits(uint(uint8(int(zeroBits(getTarget())) + int(target_change))))
 }
 
-func getDifficulty() uint8 {
+func getTarget() uint32 {
 	return target[len(target)-1]
 }
 
+//The initial targets are given as the number of leading zero bits a hash needs to have
+func targetFromZeroBits(bits uint) uint32 {
+	return protocol.TargetToCompact(new(big.Int).Rsh(protocol.MaxTarget, bits))
+}
+
+//Inverse of targetFromZeroBits, a zero target needs all bits to be zero
+func zeroBits(compact uint32) uint8 {
+
+	bitLen := protocol.CompactToTarget(compact).BitLen()
+	if bitLen == 0 {
+		return 255
+	}
+
+	return uint8(256 - bitLen)
+}
+
+//Blocks below the target fork height don't carry their target. Block h was validated against the target of period
+//(h-1)/diff_interval of the history, assuming the difficulty interval never changed before the fork
+func legacyTarget(history []uint32, diffInterval uint64, height int64) uint32 {
+
+	period := (height - 1) / int64(diffInterval)
+	if period >= int64(len(history)) {
+		period = int64(len(history)) - 1
+	}
+
+	return history[period]
+}
+
 func (param parameters) String() string {
 	return fmt.Sprintf(
 		"\n"+
@@ -137,12 +207,14 @@ func (param parameters) String() string {
 			"Difficulty interval: %v\n"+
 			"Fee minimum: %v\n"+
 			"Block interval: %v\n"+
-			"Block reward: %v\n",
+			"Block reward: %v\n"+
+			"Difficulty algorithm: %v\n",
 		param.blockHash[0:8],
 		param.block_size,
 		param.diff_interval,
 		param.fee_minimum,
 		param.block_interval,
 		param.block_reward,
+		param.diff_algorithm,
 	)
 }
\ No newline at end of file
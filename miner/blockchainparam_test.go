@@ -1,7 +1,11 @@
 package miner
 
 import (
+	"context"
+	"encoding/binary"
 	"github.com/lisgie/bazo_miner/protocol"
+	"golang.org/x/crypto/sha3"
+	"math/big"
 	"testing"
 )
 
@@ -81,8 +85,8 @@ func TestTimestamps(t *testing.T) {
 			if err != nil || err2 != nil {
 				t.Errorf("Creating config txs failed: %v, %v\n", err, err2)
 			}
-			err = addTx(b, tx)
-			err2 = addTx(b, tx2)
+			err = addTx(b, tx, store.State().Snapshot())
+			err2 = addTx(b, tx2, store.State().Snapshot())
 			if err != nil || err2 != nil {
 				t.Errorf("Adding config txs to the block failed: %v, %v\n", err, err2)
 			}
@@ -104,48 +108,190 @@ func TestTimestamps(t *testing.T) {
 	}
 }
 
-//Tests whether the diff logic respects edge cases
-func TestCalculateNewDifficulty(t *testing.T) {
+//Tests whether the target calculation respects edge cases
+func TestCalculateNewTarget(t *testing.T) {
 
 	cleanAndPrepare()
 
 	//set new system parameters
-	target[len(target)-1] = 10
+	target[len(target)-1] = targetFromZeroBits(10)
 	activeParameters.block_interval = 10
 	activeParameters.diff_interval = 10
-	time := timerange{0, 100}
 
-	if calculateNewDifficulty(&time) != 10 {
-		t.Errorf("Difficulty should: %v, difficulty is: %v\n", 10, calculateNewDifficulty(&time))
+	//The current target scaled by the time it took (of the 100 it should have taken)
+	scaled := func(took int64) uint32 {
+		newTarget := new(big.Int).Mul(protocol.CompactToTarget(getTarget()), big.NewInt(took))
+		return protocol.TargetToCompact(newTarget.Div(newTarget, big.NewInt(100)))
 	}
 
-	//test for illegal values
-	time = timerange{100, 99}
-	if calculateNewDifficulty(&time) != 10 {
-		t.Errorf("Difficult should: %v, difficulty is: %v\n", 10, calculateNewDifficulty(&time))
+	for _, test := range []struct {
+		time timerange
+		want uint32
+	}{
+		//should: 100, is: 100, target stays the same
+		{timerange{0, 100}, getTarget()},
+		//illegal values
+		{timerange{100, 99}, getTarget()},
+		//should: 100, is: 500, 5 times as easy
+		{timerange{100, 600}, scaled(500)},
+		//should: 100, is: 50, twice as hard
+		{timerange{100, 150}, scaled(50)},
+		//should: 100, is: 900, at most 8 times as easy
+		{timerange{100, 1000}, scaled(800)},
+		//should: 100, is: 1, at most 8 times as hard
+		{timerange{1000, 1001}, scaled(12)},
+	} {
+		if newTarget := calculateNewTarget(&test.time); newTarget != test.want {
+			t.Errorf("Target for %v should: %x, target is: %x\n", test.time, test.want, newTarget)
+		}
+	}
+
+	if scaled(50) == getTarget() || scaled(500) == getTarget() {
+		t.Error("Target was not scaled.\n")
+	}
+
+	//The target can't get easier than the maximum
+	target[len(target)-1] = protocol.TargetToCompact(protocol.MaxTarget)
+	if newTarget := calculateNewTarget(&timerange{100, 300}); newTarget != protocol.TargetToCompact(protocol.MaxTarget) {
+		t.Errorf("Target exceeds the maximum: %x\n", newTarget)
+	}
+}
+
+//Blocks need to be mined against the target the chain expects
+func TestBlockTarget(t *testing.T) {
+
+	cleanAndPrepare()
+
+	b := newBlock(lastBlock.Hash)
+	prepareHeader(b)
+	if !b.HasTarget() || b.Target != getTarget() {
+		t.Errorf("Block was not prepared with the current target: %x\n", b.Target)
 	}
 
-	//should: 100, is: 900, target should be -3
-	time = timerange{100, 1000}
-	if calculateNewDifficulty(&time) != getDifficulty()-3 {
-		t.Errorf("Difficulty should: %v, difficulty is: %v\n", 7, calculateNewDifficulty(&time))
+	//The block meets its own (easier) target, but not the one of the chain
+	b.Target = protocol.TargetToCompact(protocol.MaxTarget)
+	partialHash := b.HashBlock()
+	nonce, _, _ := searchNonce(context.Background(), 1, targetPoW(protocol.MaxTarget), partialHash)
+	sealBlock(b, partialHash, nonce)
+	if err := validateBlock(b); err == nil {
+		t.Error("Block with an easier target was accepted.\n")
 	}
 
-	//should: 100, is: 500, log2(0.2) = -2.3 -> target -= 2
-	time = timerange{100, 600}
-	if calculateNewDifficulty(&time) != getDifficulty()-2 {
-		t.Errorf("Difficulty should: %v, difficulty is: %v\n", 8, calculateNewDifficulty(&time))
+	b = newBlock(lastBlock.Hash)
+	finalizeBlock(b)
+	if err := validateBlock(b); err != nil {
+		t.Errorf("Block with the current target was rejected: %v\n", err)
 	}
+}
+
+//Tests whether the leading zero bit difficulty is adapted the way it was before the target fork
+func TestCalculateLegacyTarget(t *testing.T) {
+
+	cleanAndPrepare()
 
-	//should: 100, is: 1, log2(100) > 3 -> target_change = 3
-	time = timerange{1000, 1001}
-	if calculateNewDifficulty(&time) != getDifficulty()+3 {
-		t.Errorf("Difficulty should: %v, difficulty is: %v\n", 13, calculateNewDifficulty(&time))
+	//set new system parameters
+	target[len(target)-1] = targetFromZeroBits(10)
+	activeParameters.block_interval = 10
+	activeParameters.diff_interval = 10
+
+	for _, test := range []struct {
+		time timerange
+		want uint
+	}{
+		//should: 100, is: 100, difficulty stays the same
+		{timerange{0, 100}, 10},
+		//illegal values
+		{timerange{100, 99}, 10},
+		//should: 100, is: 900, log2(0.11) < -3 -> difficulty -= 3
+		{timerange{100, 1000}, 7},
+		//should: 100, is: 500, log2(0.2) = -2.3 -> difficulty -= 2
+		{timerange{100, 600}, 8},
+		//should: 100, is: 1, log2(100) > 3 -> difficulty += 3
+		{timerange{1000, 1001}, 13},
+		//should: 100, is: 50, log2(2) = 1
+		{timerange{100, 150}, 11},
+	} {
+		if newTarget := calculateLegacyTarget(&test.time); newTarget != targetFromZeroBits(test.want) {
+			t.Errorf("Difficulty for %v should: %v, difficulty is: %v\n", test.time, test.want, zeroBits(newTarget))
+		}
+	}
+}
+
+//Blocks below the fork height are checked for leading zero bits and don't carry a target, the blocks from the fork
+//height on need to carry the target of the chain
+func TestTargetFork(t *testing.T) {
+
+	cleanAndPrepare()
+	defer func() { targetForkHeight = 1 }()
+
+	targetForkHeight = 4
+	activeParameters.diff_interval = 2
+	activeParameters.block_interval = 10
+
+	//A block below the fork height with a target is invalid, even if it meets it
+	b := newBlock(lastBlock.Hash)
+	prepareHeader(b)
+	b.Header |= protocol.BLOCKFLAG_TARGET
+	b.Target = getTarget()
+	partialHash := b.HashBlock()
+	nonce, _, _ := searchNonce(context.Background(), 1, targetPoW(protocol.CompactToTarget(b.Target)), partialHash)
+	sealBlock(b, partialHash, nonce)
+	if err := validateBlock(b); err == nil {
+		t.Error("Block with a target below the fork height was accepted.\n")
+	}
+
+	//A hash that is at most the target doesn't necessarily have the leading zero bits
+	b = newBlock(lastBlock.Hash)
+	prepareHeader(b)
+	partialHash = b.HashBlock()
+	for cnt := uint64(0); ; cnt++ {
+		binary.BigEndian.PutUint64(nonce[:], cnt)
+		hash := sha3.Sum256(append(nonce[:], partialHash[:]...))
+		if !legacyPoW(getTarget())(hash) {
+			break
+		}
+	}
+	sealBlock(b, partialHash, nonce)
+	if err := validateBlock(b); err == nil {
+		t.Error("Block without leading zero bits was accepted.\n")
+	}
+
+	if _, err := getWork(); err == nil {
+		t.Error("Work for a block below the fork height was handed out.\n")
+	}
+
+	for height := int64(1); height < targetForkHeight; height++ {
+		b = newBlock(lastBlock.Hash)
+		finalizeBlock(b)
+		if b.HasTarget() || !legacyPoW(getTarget())(b.Hash) {
+			t.Errorf("Block at height %v was not mined for leading zero bits.\n", height)
+		}
+		if err := validateBlock(b); err != nil {
+			t.Errorf("Block at height %v was rejected: %v\n", height, err)
+		}
+	}
+	if want := new(big.Int).Mul(big.NewInt(3), blockWork(targetFromZeroBits(8))); chainWork(lastBlock.Hash).Cmp(want) != 0 {
+		t.Errorf("Chain work of the blocks below the fork height is %v, want %v\n", chainWork(lastBlock.Hash), want)
+	}
+
+	//From the fork height on, a block without a target is invalid
+	b = newBlock(lastBlock.Hash)
+	prepareHeader(b)
+	if !b.HasTarget() {
+		t.Fatal("Block at the fork height was prepared without a target.\n")
+	}
+	b.Header &^= protocol.BLOCKFLAG_TARGET
+	b.Target = 0
+	partialHash = b.HashBlock()
+	nonce, _, _ = searchNonce(context.Background(), 1, legacyPoW(getTarget()), partialHash)
+	sealBlock(b, partialHash, nonce)
+	if err := validateBlock(b); err == nil {
+		t.Error("Block without a target at the fork height was accepted.\n")
 	}
 
-	//should: 100, is: 50, log2(2) = 1
-	time = timerange{100, 150}
-	if calculateNewDifficulty(&time) != getDifficulty()+1 {
-		t.Errorf("Difficulty should: %v, difficulty is: %v\n", 11, calculateNewDifficulty(&time))
+	b = newBlock(lastBlock.Hash)
+	finalizeBlock(b)
+	if err := validateBlock(b); err != nil || !b.HasTarget() {
+		t.Errorf("Block with a target at the fork height was rejected: %v\n", err)
 	}
 }
@@ -1,71 +1,124 @@
 package miner
 
 import (
+	"bytes"
+	"container/heap"
 	"github.com/lisgie/bazo_miner/protocol"
-	"github.com/lisgie/bazo_miner/storage"
-	"sort"
+	"math/bits"
 )
 
-//The code here is needed if a new block is being built. All open (not yet validated) transactions are first fetched
-//from the mempool and then sorted. The sorting is important because if transactions are fetched from the mempool
-//they're received in random order (because it's implemented as map). However, if a user wants to issue more fundsTxs
-//they need to be sorted according to increasing txCnt, this greatly increases throughput.
-
-type openTxs []protocol.Transaction
+//The code here is needed if a new block is being built. Only pending txs are fetched from the mempool, FundsTxs whose
+//TxCnt is ahead of the state wait in the mempool until their predecessors show up.
+//Txs are added in order of their fee per byte, this maximizes the fees we collect within the block size. FundsTxs of
+//the same sender can only be added in increasing txCnt order, so only the next tx of every sender competes with the
+//others. A sender's tx with a low fee therefore delays all its later txs, no matter how much they pay.
 
 func prepareBlock(block *protocol.Block) {
 
-	//Fetch all txs from mempool (opentxs)
-	opentxs := storage.ReadAllOpenTxs()
+	//Fetch all pending txs from the mempool, FundsTxs of every sender are sorted by txCnt
+	opentxs := store.ReadPendingTxs()
 
-	//This copy is strange, but seems to be necessary to leverage the sort interface.
-	//Shouldn't be too bad because no deep copy.
-	var tmpCopy openTxs
-	tmpCopy = opentxs
+	//All txs are checked against the same state, even if a block gets validated in the meantime
+	snapshot := store.State().Snapshot()
 
-	sort.Sort(tmpCopy)
+	//AccTxs and ConfigTxs are independent of each other, every one of them is a candidate right away. For FundsTxs,
+	//the first tx of every sender is a candidate, the remaining ones wait in the sender's sequence
+	candidates := new(txHeap)
+	sequences := make(map[[32]byte][]*protocol.FundsTx)
 	for _, tx := range opentxs {
-		//Prevent block size overflow
-		if block.GetSize() + tx.Size() > activeParameters.block_size {
+		fundsTx, isFundsTx := tx.(*protocol.FundsTx)
+		if !isFundsTx {
+			heap.Push(candidates, tx)
+			continue
+		}
+		if _, exists := sequences[fundsTx.From]; !exists {
+			heap.Push(candidates, tx)
+			sequences[fundsTx.From] = []*protocol.FundsTx{}
+			continue
+		}
+		sequences[fundsTx.From] = append(sequences[fundsTx.From], fundsTx)
+	}
+
+	for candidates.Len() > 0 {
+		tx := heap.Pop(candidates).(protocol.Transaction)
+
+		//Prevent block size overflow, all txs take up the same space in the block. If this one doesn't fit, none does
+		if templateSize(block)+protocol.HASH_LEN > activeParameters.block_size {
 			break
 		}
-		err := addTx(block, tx)
-		if err != nil {
-			//If the tx is invalid, we remove it completely, prevents starvation in the mempool
-			storage.DeleteOpenTx(tx)
+
+		if err := addTx(block, tx, snapshot); err != nil {
+			//If the tx is invalid, we remove it completely, prevents starvation in the mempool. The sender's later
+			//txs can't be added to this block either
+			store.DeleteOpenTx(tx)
+			continue
+		}
+
+		//The sender's next tx becomes a candidate
+		if fundsTx, isFundsTx := tx.(*protocol.FundsTx); isFundsTx && len(sequences[fundsTx.From]) > 0 {
+			heap.Push(candidates, sequences[fundsTx.From][0])
+			sequences[fundsTx.From] = sequences[fundsTx.From][1:]
 		}
 	}
 }
 
-//Implement the sort interface
-func (f openTxs) Len() int {
+//The tx counters of the block are only set when the block is finalized, but the size is checked the same way during
+//validation: every tx takes up the space of its hash
+func templateSize(block *protocol.Block) uint64 {
+
+	nrTxs := len(block.AccTxData) + len(block.FundsTxData) + len(block.ConfigTxData)
+
+	return block.GetSize() + uint64(nrTxs*protocol.HASH_LEN)
+}
+
+//Implement the heap interface, the tx with the highest fee per byte comes first. Ties are broken by hash, this
+//way every miner builds the same template from the same mempool
+type txHeap []protocol.Transaction
 
-	return len(f)
+func (h txHeap) Len() int {
+	return len(h)
 }
 
-func (f openTxs) Swap(i, j int) {
-	f[i], f[j] = f[j], f[i]
+func (h txHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
 }
 
-func (f openTxs) Less(i, j int) bool {
-	//comparison only makes sense if both tx are fundstxs
-	//why can we only do that with switch, and not e.g., if tx.(type) == ..?
-	switch f[i].(type) {
-	case *protocol.AccTx:
-		//We only want to sort a subset of all transactions, namely all fundstxs.
-		//However, to successfully do that we have to place all other txs at the beginning
-		//The order between accTxs and configTxs doesn't matter
-		return true
-	case *protocol.ConfigTx:
-		return true
+func (h txHeap) Less(i, j int) bool {
+
+	if cmp := compareFeeRate(h[i], h[j]); cmp != 0 {
+		return cmp > 0
 	}
 
-	switch f[j].(type) {
-	case *protocol.AccTx:
-		return false
-	case *protocol.ConfigTx:
-		return false
+	hashI, hashJ := h[i].Hash(), h[j].Hash()
+	return bytes.Compare(hashI[:], hashJ[:]) < 0
+}
+
+func (h *txHeap) Push(tx interface{}) {
+	*h = append(*h, tx.(protocol.Transaction))
+}
+
+func (h *txHeap) Pop() interface{} {
+
+	old := *h
+	tx := old[len(old)-1]
+	*h = old[:len(old)-1]
+
+	return tx
+}
+
+//Compares fee_a/size_a with fee_b/size_b as fee_a*size_b with fee_b*size_a, the 128 bit products can't overflow.
+//Returns 1 if a pays more per byte, -1 if b does and 0 if they pay the same
+func compareFeeRate(a, b protocol.Transaction) int {
+
+	hiA, loA := bits.Mul64(a.TxFee(), b.Size())
+	hiB, loB := bits.Mul64(b.TxFee(), a.Size())
+
+	switch {
+	case hiA > hiB || hiA == hiB && loA > loB:
+		return 1
+	case hiA < hiB || loA < loB:
+		return -1
 	}
 
-	return f[i].(*protocol.FundsTx).TxCnt < f[j].(*protocol.FundsTx).TxCnt
+	return 0
 }
@@ -1,8 +1,8 @@
 package miner
 
 import (
+	"bytes"
 	"github.com/lisgie/bazo_miner/protocol"
-	"github.com/lisgie/bazo_miner/storage"
 	"math/rand"
 	"testing"
 	"time"
@@ -20,20 +20,20 @@ func TestPrepareAndSortTxs(t *testing.T) {
 		tx, _ := protocol.ConstrFundsTx(0x01, rand.Uint64()%100+1, rand.Uint64()%100+1, uint32(cnt), accAHash, accBHash, &PrivKeyA)
 		tx2, _ := protocol.ConstrFundsTx(0x01, rand.Uint64()%100+1, rand.Uint64()%100+1, uint32(cnt), accBHash, accAHash, &PrivKeyB)
 
-		if verifyFundsTx(tx) {
-			storage.WriteOpenTx(tx)
+		if verifyFundsTx(tx, store.State().Snapshot()) {
+			store.WriteOpenTx(tx)
 		}
 
-		if verifyFundsTx(tx2) {
-			storage.WriteOpenTx(tx2)
+		if verifyFundsTx(tx2, store.State().Snapshot()) {
+			store.WriteOpenTx(tx2)
 		}
 	}
 
 	//Add other tx types as well to make the test more challenging
 	for cnt := 0; cnt < testsize; cnt++ {
 		tx,_,_ := protocol.ConstrAccTx(0x01, rand.Uint64()%100+1, &RootPrivKey)
-		if verifyAccTx(tx) {
-			storage.WriteOpenTx(tx)
+		if verifyAccTx(tx, store.State().Snapshot()) {
+			store.WriteOpenTx(tx)
 		}
 	}
 
@@ -44,8 +44,8 @@ func TestPrepareAndSortTxs(t *testing.T) {
 		if tx.Id == 3 || tx.Id == 1 {
 			continue
 		}
-		if verifyConfigTx(tx) {
-			storage.WriteOpenTx(tx)
+		if verifyConfigTx(tx, store.State().Snapshot()) {
+			store.WriteOpenTx(tx)
 		}
 	}
 
@@ -60,3 +60,46 @@ func TestPrepareAndSortTxs(t *testing.T) {
 		t.Errorf("NrFundsTx (%v) vs. testsize*2 (%v)\n", b.NrFundsTx, testsize*2)
 	}
 }
+
+func TestPrepareBlockFeeRate(t *testing.T) {
+
+	cleanAndPrepare()
+	accAHash := serializeHashContent(accA.Address)
+	accBHash := serializeHashContent(accB.Address)
+
+	//A's high fee tx can't go before A's low fee tx, A0 and B1 pay the same and are ordered by hash
+	txA0, _ := protocol.ConstrFundsTx(0x01, 10, 1, 0, accAHash, accBHash, &PrivKeyA)
+	txA1, _ := protocol.ConstrFundsTx(0x01, 10, 50, 1, accAHash, accBHash, &PrivKeyA)
+	txB0, _ := protocol.ConstrFundsTx(0x01, 10, 20, 0, accBHash, accAHash, &PrivKeyB)
+	txB1, _ := protocol.ConstrFundsTx(0x01, 10, 1, 1, accBHash, accAHash, &PrivKeyB)
+	for _, tx := range []*protocol.FundsTx{txA1, txB1, txA0, txB0} {
+		if err := store.WriteOpenTx(tx); err != nil {
+			t.Fatalf("Tx was not accepted by the mempool: %v\n", err)
+		}
+	}
+
+	expected := []*protocol.FundsTx{txB0, txA0, txA1, txB1}
+	hashA0, hashB1 := txA0.Hash(), txB1.Hash()
+	if bytes.Compare(hashB1[:], hashA0[:]) < 0 {
+		expected = []*protocol.FundsTx{txB0, txB1, txA0, txA1}
+	}
+
+	b := newBlock([32]byte{})
+	prepareBlock(b)
+	if len(b.FundsTxData) != len(expected) {
+		t.Fatalf("Block contains %v fundsTxs, want %v\n", len(b.FundsTxData), len(expected))
+	}
+	for i, tx := range expected {
+		if b.FundsTxData[i] != tx.Hash() {
+			t.Errorf("Unexpected fundsTx at position %v: %x\n", i, b.FundsTxData[i][0:8])
+		}
+	}
+
+	//Only 3 txs fit, the last one of the template is left out
+	b = newBlock([32]byte{})
+	activeParameters.block_size = b.GetSize() + 3*protocol.HASH_LEN
+	prepareBlock(b)
+	if len(b.FundsTxData) != 3 || b.FundsTxData[2] != expected[2].Hash() {
+		t.Errorf("Block with limited size contains %v fundsTxs, want the first 3 of the template\n", len(b.FundsTxData))
+	}
+}
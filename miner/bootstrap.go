@@ -0,0 +1,245 @@
+package miner
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/lisgie/bazo_miner/protocol"
+	"github.com/lisgie/bazo_miner/storage"
+	"io"
+	"os"
+)
+
+//A bootstrap file is a flat sequence of length-prefixed records: length (4) | record type (1) | payload. Every block
+//of the canonical chain (the genesis block excluded, every node has the same one) is preceded by the txs it contains
+const (
+	BOOTSTRAP_BLOCK = iota + 1
+	BOOTSTRAP_ACCTX
+	BOOTSTRAP_FUNDSTX
+	BOOTSTRAP_CONFIGTX
+)
+
+const BOOTSTRAP_MAXRECORD = 10000000
+
+//Writes the canonical chain of the given storage to a bootstrap file
+func Export(st storage.Storage, filename string) error {
+
+	store = st
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	if err := exportChain(w); err != nil {
+		return err
+	}
+
+	return w.Flush()
+}
+
+//Validates all blocks of the bootstrap file on top of the given storage. Blocks which are already part of the chain
+//are skipped, an interrupted import can therefore be resumed
+func Import(st storage.Storage, filename string) error {
+
+	setup(st)
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	return importChain(bufio.NewReader(file))
+}
+
+func exportChain(w io.Writer) error {
+
+	if prunedHeight := store.ReadPrunedHeight(); prunedHeight > 0 {
+		return errors.New(fmt.Sprintf("Node is pruned, txs up to height %v are not available.", prunedHeight))
+	}
+
+	_, tipHeight := store.ReadTip()
+	if tipHeight == 0 {
+		return nil
+	}
+
+	for height := uint32(1); height <= tipHeight; height++ {
+		block := store.ReadBlockByHeight(height)
+		if block == nil {
+			return errors.New(fmt.Sprintf("Block at height %v not found.", height))
+		}
+
+		for _, txHash := range block.AccTxData {
+			if err := exportTx(w, BOOTSTRAP_ACCTX, txHash); err != nil {
+				return err
+			}
+		}
+		for _, txHash := range block.FundsTxData {
+			if err := exportTx(w, BOOTSTRAP_FUNDSTX, txHash); err != nil {
+				return err
+			}
+		}
+		for _, txHash := range block.ConfigTxData {
+			if err := exportTx(w, BOOTSTRAP_CONFIGTX, txHash); err != nil {
+				return err
+			}
+		}
+
+		if err := writeRecord(w, BOOTSTRAP_BLOCK, block.Encode()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func exportTx(w io.Writer, recordType uint8, txHash [32]byte) error {
+
+	tx := store.ReadClosedTx(txHash)
+	if tx == nil {
+		return errors.New(fmt.Sprintf("Tx %x not found.", txHash[0:8]))
+	}
+
+	return writeRecord(w, recordType, tx.Encode())
+}
+
+func importChain(r io.Reader) error {
+
+	//Imported blocks are not checked against the system time, they might be a lot older
+	importing = true
+	defer func() { importing = false }()
+
+	var txs []protocol.Transaction
+	for {
+		recordType, payload, err := readRecord(r)
+		if err == io.EOF {
+			if len(txs) > 0 {
+				return errors.New("Bootstrap file ends with txs that don't belong to a block.")
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch recordType {
+		case BOOTSTRAP_ACCTX:
+			var accTx *protocol.AccTx
+			if accTx = accTx.Decode(payload); accTx == nil {
+				return errors.New("AccTx could not be decoded.")
+			}
+			txs = append(txs, accTx)
+		case BOOTSTRAP_FUNDSTX:
+			var fundsTx *protocol.FundsTx
+			if fundsTx = fundsTx.Decode(payload); fundsTx == nil {
+				return errors.New("FundsTx could not be decoded.")
+			}
+			txs = append(txs, fundsTx)
+		case BOOTSTRAP_CONFIGTX:
+			var configTx *protocol.ConfigTx
+			if configTx = configTx.Decode(payload); configTx == nil {
+				return errors.New("ConfigTx could not be decoded.")
+			}
+			txs = append(txs, configTx)
+		case BOOTSTRAP_BLOCK:
+			var block *protocol.Block
+			if block = block.Decode(payload); block == nil {
+				return errors.New("Block could not be decoded.")
+			}
+			if err := importBlock(block, txs); err != nil {
+				return err
+			}
+			txs = nil
+		default:
+			return errors.New(fmt.Sprintf("Unknown record type %v.", recordType))
+		}
+	}
+}
+
+//The txs are handed to validateBlock together with the block, it finds all tx data there and never goes to the network.
+//They don't go through the mempool, its limits are meant for open txs and would cap the blocks that can be imported
+func importBlock(block *protocol.Block, txs []protocol.Transaction) error {
+
+	if store.ReadClosedBlock(block.Hash) != nil {
+		return nil
+	}
+
+	//Otherwise validateBlock would try to fetch the missing blocks from the network
+	if block.PrevHash != lastBlock.Hash {
+		return errors.New(fmt.Sprintf("Block (%x) does not extend the current chain.", block.Hash[0:12]))
+	}
+
+	included := make(map[[32]byte]protocol.Transaction)
+	for _, tx := range txs {
+		included[tx.Hash()] = tx
+	}
+
+	if len(block.AccTxData)+len(block.FundsTxData)+len(block.ConfigTxData) != len(included) {
+		return errors.New(fmt.Sprintf("Block (%x) does not match the txs in the bootstrap file.", block.Hash[0:12]))
+	}
+	//Every tx needs to be in the file with the type the block lists it as
+	for _, txHash := range block.AccTxData {
+		if _, ok := included[txHash].(*protocol.AccTx); !ok {
+			return errors.New(fmt.Sprintf("AccTx %x of block (%x) is missing in the bootstrap file.", txHash[0:8], block.Hash[0:12]))
+		}
+	}
+	for _, txHash := range block.FundsTxData {
+		if _, ok := included[txHash].(*protocol.FundsTx); !ok {
+			return errors.New(fmt.Sprintf("FundsTx %x of block (%x) is missing in the bootstrap file.", txHash[0:8], block.Hash[0:12]))
+		}
+	}
+	for _, txHash := range block.ConfigTxData {
+		if _, ok := included[txHash].(*protocol.ConfigTx); !ok {
+			return errors.New(fmt.Sprintf("ConfigTx %x of block (%x) is missing in the bootstrap file.", txHash[0:8], block.Hash[0:12]))
+		}
+	}
+
+	block.TxPayloads = included
+	if err := validateBlock(block); err != nil {
+		return errors.New(fmt.Sprintf("Block (%x) could not be validated: %v", block.Hash[0:12], err))
+	}
+
+	return nil
+}
+
+func writeRecord(w io.Writer, recordType uint8, payload []byte) error {
+
+	header := make([]byte, 5)
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(payload)))
+	header[4] = recordType
+
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+
+	return err
+}
+
+//Returns io.EOF if the reader ended cleanly in between two records
+func readRecord(r io.Reader) (recordType uint8, payload []byte, err error) {
+
+	header := make([]byte, 5)
+	if _, err = io.ReadFull(r, header); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return 0, nil, errors.New("Bootstrap file is truncated.")
+		}
+		return 0, nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	if length > BOOTSTRAP_MAXRECORD {
+		return 0, nil, errors.New(fmt.Sprintf("Record of size %v exceeds the maximum size.", length))
+	}
+
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(r, payload); err != nil {
+		return 0, nil, errors.New("Bootstrap file is truncated.")
+	}
+
+	return header[4], payload, nil
+}
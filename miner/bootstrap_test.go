@@ -0,0 +1,132 @@
+package miner
+
+import (
+	"bytes"
+	"github.com/lisgie/bazo_miner/protocol"
+	"github.com/lisgie/bazo_miner/storage"
+	"reflect"
+	"testing"
+)
+
+//Exports a chain, starts over from the genesis block and checks whether the import leads to the same chain and state
+func TestExportImport(t *testing.T) {
+
+	cleanAndPrepare()
+
+	var blocks []*protocol.Block
+	prevHash := [32]byte{}
+	for cnt := 0; cnt < 3; cnt++ {
+		b := newBlock(prevHash)
+		createBlockWithTxs(b)
+		finalizeBlock(b)
+		if err := validateBlock(b); err != nil {
+			t.Fatalf("Block validation failed: %v\n", err)
+		}
+		blocks = append(blocks, b)
+		prevHash = b.Hash
+	}
+
+	stateBefore := make(map[[32]byte]protocol.Account)
+	for hash, acc := range store.State().Accounts() {
+		stateBefore[hash] = *acc
+	}
+	//The miner test account gets a new key on every reset, it is not part of the chain anyway
+	delete(stateBefore, serializeHashContent(minerAcc.Address))
+
+	var buf bytes.Buffer
+	if err := exportChain(&buf); err != nil {
+		t.Fatalf("Export failed: %v\n", err)
+	}
+	exported := buf.Bytes()
+
+	cleanAndPrepare()
+	if err := importChain(bytes.NewReader(exported)); err != nil {
+		t.Fatalf("Import failed: %v\n", err)
+	}
+
+	if lastBlock.Hash != blocks[len(blocks)-1].Hash || globalBlockCount != int64(len(blocks)) {
+		t.Errorf("Imported chain ends at the wrong block: %x\n", lastBlock.Hash)
+	}
+	for _, b := range blocks {
+		for _, txHash := range b.FundsTxData {
+			if store.ReadClosedTx(txHash) == nil || store.ReadOpenTx(txHash) != nil {
+				t.Errorf("Tx %x was not properly imported.\n", txHash)
+			}
+		}
+	}
+
+	stateAfter := make(map[[32]byte]protocol.Account)
+	for hash, acc := range store.State().Accounts() {
+		stateAfter[hash] = *acc
+	}
+	delete(stateAfter, serializeHashContent(minerAcc.Address))
+	if !reflect.DeepEqual(stateBefore, stateAfter) {
+		t.Error("State after import differs from the exported one.\n")
+	}
+
+	//Blocks that are already part of the chain are skipped
+	if err := importChain(bytes.NewReader(exported)); err != nil {
+		t.Errorf("Importing the same chain twice failed: %v\n", err)
+	}
+
+	//Truncated files and blocks without their txs are rejected
+	cleanAndPrepare()
+	if err := importChain(bytes.NewReader(exported[:len(exported)-1])); err == nil {
+		t.Error("Truncated bootstrap file was accepted.\n")
+	}
+
+	cleanAndPrepare()
+	var incomplete bytes.Buffer
+	writeRecord(&incomplete, BOOTSTRAP_BLOCK, blocks[0].Encode())
+	if err := importChain(&incomplete); err == nil || lastBlock.Hash == blocks[0].Hash {
+		t.Error("Block without its txs was accepted.\n")
+	}
+}
+
+//Blocks are imported independently of the mempool limits, e.g., the per sender queue
+func TestImportBeyondMempoolLimits(t *testing.T) {
+
+	cleanAndPrepare()
+
+	//A new account gets funded and spends more txs than the mempool queues for a sender in the same block
+	accTx, newKey, _ := protocol.ConstrAccTx(0, 1, &RootPrivKey)
+	newHash := serializeHashContent(accTx.PubKey)
+	accAHash := serializeHashContent(accA.Address)
+	accBHash := serializeHashContent(accB.Address)
+	fundTx, _ := protocol.ConstrFundsTx(0x01, 100000, 1, accA.TxCnt, accAHash, newHash, &PrivKeyA)
+
+	b := newBlock(lastBlock.Hash)
+	b.AccTxData = append(b.AccTxData, accTx.Hash())
+	b.FundsTxData = append(b.FundsTxData, fundTx.Hash())
+	b.TxPayloads = map[[32]byte]protocol.Transaction{accTx.Hash(): accTx, fundTx.Hash(): fundTx}
+	for cnt := 0; cnt <= storage.MEMPOOL_MAXQUEUED; cnt++ {
+		tx, _ := protocol.ConstrFundsTx(0x01, 10, 1, uint32(cnt), newHash, accBHash, newKey)
+		b.FundsTxData = append(b.FundsTxData, tx.Hash())
+		b.TxPayloads[tx.Hash()] = tx
+	}
+	finalizeBlock(b)
+	if err := validateBlock(b); err != nil {
+		t.Fatalf("Block validation failed: %v\n", err)
+	}
+
+	var buf bytes.Buffer
+	if err := exportChain(&buf); err != nil {
+		t.Fatalf("Export failed: %v\n", err)
+	}
+
+	cleanAndPrepare()
+	if err := importChain(&buf); err != nil {
+		t.Fatalf("Import failed: %v\n", err)
+	}
+	if lastBlock.Hash != b.Hash {
+		t.Errorf("Imported chain ends at the wrong block: %x\n", lastBlock.Hash)
+	}
+	if acc := store.State().GetAccount(newHash); acc == nil || acc.TxCnt != storage.MEMPOOL_MAXQUEUED+1 {
+		t.Error("Txs of the imported block were not applied.\n")
+	}
+	for _, txHash := range b.FundsTxData {
+		if store.ReadOpenTx(txHash) != nil {
+			t.Errorf("Imported tx %x was left in the mempool.\n", txHash)
+		}
+	}
+}
@@ -1,5 +1,9 @@
 package miner
 
+import (
+	"github.com/lisgie/bazo_miner/protocol"
+)
+
 const (
 	//Root Public Keys at initialization time. This is the only existing account at startup
 	//All other accounts are created
@@ -16,6 +20,30 @@ const (
 	//After requesting a tx/block, timeout after this amount of seconds
 	TXFETCH_TIMEOUT    = 5
 	BLOCKFETCH_TIMEOUT = 40
+	//Same for snapshot requests (per chunk), also the time a new miner waits for a peer to start a fast sync
+	SNAPSHOTFETCH_TIMEOUT = 20
+	//Fast synced miners ask this many random peers for every block of the chain they verify
+	BLOCKFETCH_TRIES = 3
+
+	//PoW workers check whether they should stop after this many hashes
+	POW_BATCHSIZE = 1000
+	//Number of block templates handed out to external workers that are kept, older ones can't be submitted anymore
+	MAX_TEMPLATES = 16
+
+	//Every SNAPSHOT_INTERVAL blocks, a block commits to the state it is built on
+	SNAPSHOT_INTERVAL = 1000
+
+	//Leading zero bits of the genesis target. Fast synced miners don't accept chains with easier targets
+	GENESIS_TARGET_BITS = 26
+	//Blocks from this height on carry a compact target and need a hash that is at most the target. The blocks below
+	//it were checked for leading zero bits and are still validated that way. All miners need to run a version that
+	//knows about the fork before the chain reaches it
+	TARGET_FORK_HEIGHT = 100000
+
+	//Difficulty adjustment algorithm of the genesis block (see protocol.DIFF_ALGORITHM_*), config txs can change it
+	GENESIS_DIFF_ALGORITHM = protocol.DIFF_ALGORITHM_INTERVAL
+	//Number of solve times the LWMA algorithm averages over
+	LWMA_WINDOW = 45
 
 	//Some prominent programming languages (e.g., Java) have not unsigned integer types
 	//Neglecting MSB simplifies compatibility
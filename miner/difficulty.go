@@ -0,0 +1,165 @@
+package miner
+
+import (
+	"github.com/lisgie/bazo_miner/protocol"
+	"math/big"
+)
+
+//The difficulty adjustment algorithm is a system parameter, set in the genesis block and changed by config txs. After
+//every block, collectStatistics asks the active algorithm for the target of the next block. Blocks carry the target
+//they were mined against in their header, rollbacks go back to it no matter which algorithm calculated it.
+
+type difficultyAlgorithm interface {
+	//Target of the block after b, which has just been appended to the chain at height globalBlockCount. t is the
+	//timerange of the current difficulty interval, periodEnd is set if b completes it
+	nextTarget(b *protocol.Block, t *timerange, periodEnd bool) uint32
+}
+
+var difficultyAlgorithms = map[uint64]difficultyAlgorithm{
+	protocol.DIFF_ALGORITHM_INTERVAL: intervalAlgorithm{},
+	protocol.DIFF_ALGORITHM_LWMA:     lwmaAlgorithm{window: LWMA_WINDOW},
+}
+
+//Config txs with unknown algorithms never make it into the parameters (see parameterBoundsChecking). The targets of the
+//blocks below the target fork height are calculated the way they were before the fork, whatever the parameters say
+func activeDifficultyAlgorithm() difficultyAlgorithm {
+
+	if globalBlockCount+1 < targetForkHeight {
+		return legacyAlgorithm{}
+	}
+
+	if algorithm, exists := difficultyAlgorithms[activeParameters.diff_algorithm]; exists {
+		return algorithm
+	}
+
+	return difficultyAlgorithms[protocol.DIFF_ALGORITHM_INTERVAL]
+}
+
+//Retargets once per difficulty interval, based on how long the whole interval took (see calculateNewTarget)
+type intervalAlgorithm struct{}
+
+func (intervalAlgorithm) nextTarget(b *protocol.Block, t *timerange, periodEnd bool) uint32 {
+
+	//The genesis block has timestamp = 0. This simplifies certain things: Every miner can start with an already
+	//existing genesis block (because all fields are set to 0). The "find common ancestor" algorithm can then
+	//use the genesis block as a common ancestor for new miners who have not synchronized with the chain yet.
+	if !periodEnd || t.first == 0 {
+		return getTarget()
+	}
+
+	return calculateNewTarget(t)
+}
+
+//Retargets once per difficulty interval like intervalAlgorithm, the difficulty is a number of leading zero bits (see
+//calculateLegacyTarget)
+type legacyAlgorithm struct{}
+
+func (legacyAlgorithm) nextTarget(b *protocol.Block, t *timerange, periodEnd bool) uint32 {
+
+	if !periodEnd || t.first == 0 {
+		return getTarget()
+	}
+
+	return calculateLegacyTarget(t)
+}
+
+//Linearly weighted moving average: Retargets every block, the average target of the last window blocks is scaled by
+//the weighted average of their solve times. The most recent solve time has the highest weight, the target reacts
+//quickly to changes of the hash rate
+type lwmaAlgorithm struct {
+	window int
+}
+
+func (algorithm lwmaAlgorithm) nextTarget(b *protocol.Block, t *timerange, periodEnd bool) uint32 {
+	return lwmaTarget(recentBlockStats(b, globalBlockCount, algorithm.window+1), activeParameters.block_interval)
+}
+
+//Expects the stats of consecutive blocks, oldest first. Chains shorter than the window use all blocks they have
+func lwmaTarget(stats []blockStat, blockInterval uint64) uint32 {
+
+	//We need at least one solve time
+	if len(stats) < 2 || blockInterval == 0 {
+		return getTarget()
+	}
+
+	n := int64(len(stats) - 1)
+	interval := int64(blockInterval)
+
+	var weightedTimes int64
+	targetSum := new(big.Int)
+	for i := int64(1); i <= n; i++ {
+		//Timestamps are only roughly checked, a single block can't move the target too much
+		solveTime := stats[i].timestamp - stats[i-1].timestamp
+		if solveTime > 6*interval {
+			solveTime = 6 * interval
+		} else if solveTime < -6*interval {
+			solveTime = -6 * interval
+		}
+
+		weightedTimes += i * solveTime
+		targetSum.Add(targetSum, protocol.CompactToTarget(stats[i].target))
+	}
+
+	//Weighted sum if every block took exactly the block interval. Blocks with the same (or decreasing) timestamps
+	//would result in a zero (or negative) target, at most 10 times as hard as the average target
+	expected := interval * n * (n + 1) / 2
+	if weightedTimes < expected/10 {
+		weightedTimes = expected / 10
+	}
+	if weightedTimes < 1 {
+		weightedTimes = 1
+	}
+
+	//average target * weightedTimes / expected
+	newTarget := targetSum.Mul(targetSum, big.NewInt(weightedTimes))
+	newTarget.Div(newTarget, big.NewInt(n*expected))
+
+	if newTarget.Sign() == 0 {
+		newTarget.SetInt64(1)
+	} else if newTarget.Cmp(protocol.MaxTarget) > 0 {
+		newTarget.Set(protocol.MaxTarget)
+	}
+
+	return protocol.TargetToCompact(newTarget)
+}
+
+//Timestamp and target of a block of the chain
+type blockStat struct {
+	height    uint32
+	target    uint32
+	timestamp int64
+}
+
+//Stats of the last n blocks up to b (at the given height), oldest first. The genesis block and the blocks below the
+//target fork height are never part of it, they have no target. Fast synced miners don't have the blocks below the
+//snapshot, their stats come with the snapshot
+func recentBlockStats(b *protocol.Block, height int64, n int) []blockStat {
+
+	var stats []blockStat
+	var snapshotStats map[uint32]blockStat
+	for block := b; height > 0 && height >= targetForkHeight && len(stats) < n; height-- {
+		if block != nil {
+			stats = append(stats, blockStat{uint32(height), block.Target, block.Timestamp})
+			block = store.ReadClosedBlock(block.PrevHash)
+			continue
+		}
+
+		if snapshotStats == nil {
+			snapshotStats = make(map[uint32]blockStat)
+			for _, stat := range decodeBlockStats(store.ReadChainState(SNAPSHOTSTATS_KEY)) {
+				snapshotStats[stat.height] = stat
+			}
+		}
+		stat, exists := snapshotStats[uint32(height)]
+		if !exists {
+			break
+		}
+		stats = append(stats, stat)
+	}
+
+	for i, j := 0, len(stats)-1; i < j; i, j = i+1, j-1 {
+		stats[i], stats[j] = stats[j], stats[i]
+	}
+
+	return stats
+}
@@ -0,0 +1,135 @@
+package miner
+
+import (
+	"github.com/lisgie/bazo_miner/protocol"
+	"github.com/lisgie/bazo_miner/storage"
+	"math/big"
+	"reflect"
+	"testing"
+)
+
+func TestLWMATarget(t *testing.T) {
+
+	cleanAndPrepare()
+
+	current := protocol.CompactToTarget(getTarget())
+	statsWithSolveTime := func(solveTime int64) (stats []blockStat) {
+		for cnt := 0; cnt <= LWMA_WINDOW; cnt++ {
+			stats = append(stats, blockStat{uint32(cnt + 1), getTarget(), int64(cnt) * solveTime})
+		}
+		return stats
+	}
+	scaled := func(num, denom int64) uint32 {
+		newTarget := new(big.Int).Mul(current, big.NewInt(num))
+		return protocol.TargetToCompact(newTarget.Div(newTarget, big.NewInt(denom)))
+	}
+
+	for _, test := range []struct {
+		solveTime int64
+		want      uint32
+	}{
+		//Blocks on time keep the target
+		{60, getTarget()},
+		//Twice as slow, twice as easy
+		{120, scaled(2, 1)},
+		//Twice as fast, twice as hard
+		{30, scaled(1, 2)},
+		//Solve times are clamped to 6 block intervals
+		{1000, scaled(6, 1)},
+		//Blocks without solve time make it at most 10 times as hard
+		{0, scaled(1, 10)},
+	} {
+		if newTarget := lwmaTarget(statsWithSolveTime(test.solveTime), 60); newTarget != test.want {
+			t.Errorf("Target for solve time %v should: %x, target is: %x\n", test.solveTime, test.want, newTarget)
+		}
+	}
+
+	//Without a solve time the target stays the same
+	if lwmaTarget(statsWithSolveTime(120)[:1], 60) != getTarget() {
+		t.Error("Target changed without a solve time.\n")
+	}
+
+	//The most recent solve time weighs the most
+	stats := statsWithSolveTime(60)
+	stats[len(stats)-1].timestamp += 60
+	slowLast := protocol.CompactToTarget(lwmaTarget(stats, 60))
+	stats = statsWithSolveTime(60)
+	for i := 1; i < len(stats); i++ {
+		stats[i].timestamp += 60
+	}
+	slowFirst := protocol.CompactToTarget(lwmaTarget(stats, 60))
+	if slowLast.Cmp(slowFirst) <= 0 || slowLast.Cmp(current) <= 0 {
+		t.Errorf("Recent solve time is not weighted the most: %x vs. %x\n", slowLast, slowFirst)
+	}
+}
+
+//A config tx switches to LWMA, the targets of the following blocks are rolled back block by block
+func TestDifficultyAlgorithmRollback(t *testing.T) {
+
+	cleanAndPrepare()
+	activeParameters.diff_interval = 2
+
+	var blocks []*protocol.Block
+	states := []chainState{saveChainState()}
+	for cnt := 0; cnt < 4; cnt++ {
+		b := newBlock(lastBlock.Hash)
+		if cnt == 0 {
+			tx, _ := protocol.ConstrConfigTx(0, protocol.DIFF_ALGORITHM_ID, protocol.DIFF_ALGORITHM_LWMA, 1, 0, &RootPrivKey)
+			if err := addTx(b, tx, store.State().Snapshot()); err != nil {
+				t.Fatalf("Config tx could not be added: %v\n", err)
+			}
+			store.WriteOpenTx(tx)
+		}
+		finalizeBlock(b)
+		if err := validateBlock(b); err != nil {
+			t.Fatalf("Block %v could not be validated: %v\n", cnt, err)
+		}
+		blocks = append(blocks, b)
+		states = append(states, saveChainState())
+	}
+
+	if activeParameters.diff_algorithm != protocol.DIFF_ALGORITHM_LWMA {
+		t.Fatal("Difficulty algorithm was not switched.\n")
+	}
+	//Blocks came in faster than the block interval, every block got a harder target. The block after the switch is
+	//the first one with a solve time, its successor is the first with a new target
+	for i := 2; i < len(blocks); i++ {
+		if protocol.CompactToTarget(blocks[i].Target).Cmp(protocol.CompactToTarget(blocks[i-1].Target)) >= 0 {
+			t.Errorf("Target of block %v did not get harder: %x vs. %x\n", i, blocks[i].Target, blocks[i-1].Target)
+		}
+	}
+
+	for i := len(blocks) - 1; i >= 0; i-- {
+		if err := validateBlockRollback(blocks[i]); err != nil {
+			t.Fatalf("Block %v could not be rolled back: %v\n", i, err)
+		}
+		if err := compareChainState(states[i], saveChainState()); err != nil {
+			t.Errorf("Chain state after the rollback of block %v differs: %v\n", i, err)
+		}
+	}
+	if activeParameters.diff_algorithm != GENESIS_DIFF_ALGORITHM {
+		t.Error("Difficulty algorithm was not rolled back.\n")
+	}
+}
+
+//Fast synced miners take the stats of the blocks they don't have from the snapshot
+func TestRecentBlockStats(t *testing.T) {
+
+	cleanAndPrepare()
+
+	snapshotStats := []blockStat{{1, 0x1d00ffff, 60}, {2, 0x1d00fffe, 120}}
+	batch := storage.NewBatch()
+	batch.WriteChainState(SNAPSHOTSTATS_KEY, encodeBlockStats(snapshotStats))
+	store.Commit(batch)
+
+	b := newBlock([32]byte{9})
+	b.Target, b.Timestamp = 0x1d00fffd, 180
+
+	want := append(snapshotStats, blockStat{3, b.Target, b.Timestamp})
+	if stats := recentBlockStats(b, 3, LWMA_WINDOW+1); !reflect.DeepEqual(stats, want) {
+		t.Errorf("Wrong block stats: %v, want %v\n", stats, want)
+	}
+	if stats := recentBlockStats(b, 3, 2); !reflect.DeepEqual(stats, want[1:]) {
+		t.Errorf("Wrong block stats: %v, want %v\n", stats, want[1:])
+	}
+}
@@ -0,0 +1,162 @@
+package miner
+
+import (
+	"errors"
+	"fmt"
+	"github.com/lisgie/bazo_miner/p2p"
+	"github.com/lisgie/bazo_miner/protocol"
+	"time"
+)
+
+//Starts from the latest snapshot the peers offer, instead of replaying the chain from the genesis block. Only blocks
+//after the snapshot are validated
+func fastSync() error {
+
+	//Connections to other miners are established in the background, give them some time
+	var asked int
+	var err error
+	for tries := 0; tries < SNAPSHOTFETCH_TIMEOUT; tries++ {
+		if asked, err = p2p.SnapshotReq(); err == nil {
+			break
+		}
+		time.Sleep(time.Second)
+	}
+	if err != nil {
+		return err
+	}
+
+	offers := collectSnapshotOffers(asked)
+	if len(offers) == 0 {
+		return errors.New("Snapshot request timed out.")
+	}
+
+	best, err := bestSnapshot(offers, fetchBlock, fetchSnapshot)
+	if err != nil {
+		return err
+	}
+
+	blockValidation.Lock()
+	err = loadSnapshot(best)
+	blockValidation.Unlock()
+	if err != nil {
+		return err
+	}
+	logger.Printf("Started from snapshot at height %v, last block: %v", globalBlockCount, lastBlock)
+
+	//The committing block is the first one that is validated the regular way
+	if err := validateBlock(best.block); err != nil {
+		logger.Printf("Committing block (%x) could not be validated: %v\n", best.block.Hash[0:12], err)
+	}
+
+	return nil
+}
+
+//Waits until all asked peers offered their snapshot, peers without a snapshot don't answer at all
+func collectSnapshotOffers(asked int) (offers []*p2p.SnapshotInfo) {
+
+	timeout := time.After(SNAPSHOTFETCH_TIMEOUT * time.Second)
+	for len(offers) < asked {
+		select {
+		case info := <-p2p.SnapshotChan:
+			offers = append(offers, info)
+		case <-timeout:
+			return offers
+		}
+	}
+
+	return offers
+}
+
+//Returns the snapshot data of the offer
+type snapshotFetcher func(info *p2p.SnapshotInfo) ([]byte, error)
+
+//Peers don't necessarily agree on the chain, every offered snapshot is verified and the one on the chain with the
+//most cumulative work is trusted. Offers of the same snapshot are only verified once, if the snapshot can't be fetched
+//from a peer the next peer offering it is asked
+func bestSnapshot(offers []*p2p.SnapshotInfo, fetch blockFetcher, fetchData snapshotFetcher) (best *verifiedSnapshot, err error) {
+
+	checked := make(map[[32]byte]bool)
+	for _, info := range offers {
+		if checked[info.BlockHash] {
+			continue
+		}
+
+		block := fetch(info.BlockHash)
+		if block == nil || block.Hash != info.BlockHash {
+			logger.Printf("Committing block (%x) of an offered snapshot could not be fetched.\n", info.BlockHash[0:12])
+			checked[info.BlockHash] = true
+			continue
+		}
+		snapshot, err := fetchData(info)
+		if err != nil {
+			logger.Printf("Snapshot at height %v could not be fetched: %v\n", info.Height, err)
+			continue
+		}
+		checked[info.BlockHash] = true
+		verified, err := verifySnapshot(block, snapshot, fetch)
+		if err != nil {
+			logger.Printf("Snapshot at height %v is invalid: %v\n", info.Height, err)
+			continue
+		}
+
+		if best == nil || verified.work.Cmp(best.work) > 0 {
+			best = verified
+		}
+	}
+
+	if best == nil {
+		return nil, errors.New("None of the offered snapshots could be verified.")
+	}
+
+	return best, nil
+}
+
+func fetchSnapshot(info *p2p.SnapshotInfo) (snapshot []byte, err error) {
+
+	for index := uint32(0); len(snapshot) < int(info.Size); index++ {
+		if err := p2p.SnapshotChunkReq(info, index); err != nil {
+			return nil, err
+		}
+
+		var chunk *p2p.SnapshotChunk
+		select {
+		case chunk = <-p2p.SnapshotChunkChan:
+		case <-time.After(SNAPSHOTFETCH_TIMEOUT * time.Second):
+			return nil, errors.New(fmt.Sprintf("Snapshot chunk %v request timed out.", index))
+		}
+
+		if chunk.Height != info.Height || chunk.Index != index || len(chunk.Data) == 0 {
+			return nil, errors.New("Received snapshot chunk did not correspond to our request.")
+		}
+		snapshot = append(snapshot, chunk.Data...)
+	}
+
+	if len(snapshot) != int(info.Size) {
+		return nil, errors.New("Snapshot size does not match.")
+	}
+
+	return snapshot, nil
+}
+
+//Blocks are requested from random peers, peers that started from a snapshot themselves don't have the older blocks.
+//Returns nil if no peer delivered the block
+func fetchBlock(hash [32]byte) *protocol.Block {
+
+	for tries := 0; tries < BLOCKFETCH_TRIES; tries++ {
+		if err := p2p.BlockReq(hash); err != nil {
+			return nil
+		}
+
+		var block *protocol.Block
+		select {
+		case encodedBlock := <-p2p.BlockReqChan:
+			block = block.Decode(encodedBlock)
+		case <-time.After(BLOCKFETCH_TIMEOUT * time.Second):
+		}
+		if block != nil && block.Hash == hash {
+			return block
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,203 @@
+package miner
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/lisgie/bazo_miner/protocol"
+	"github.com/lisgie/bazo_miner/storage"
+	"math"
+	"reflect"
+	"sort"
+)
+
+//Replays all blocks of the canonical chain from the genesis block into a fresh state, with the same validation as
+//blocks from the network (Merkle root, PoW, tx verification, state changes, difficulty adaption). The replayed chain
+//and the indexes written while replaying are then compared to what is stored. Returns the first divergence, nil if
+//the stored data is consistent. The given storage is only read
+func Fsck(st storage.Storage) error {
+
+	initLogger()
+
+	store = st
+	if !restoreChainState() {
+		return errors.New("No chain state found.")
+	}
+	if prunedHeight := store.ReadPrunedHeight(); prunedHeight > 0 {
+		return errors.New(fmt.Sprintf("Node is pruned, txs up to height %v are not available.", prunedHeight))
+	}
+	stored := saveChainState()
+
+	//Replay on a fresh in-memory storage, starting with the genesis block every node has
+	store = storage.NewMemStorage()
+	parameterSlice, activeParameters = nil, nil
+	target, targetTimes, currentTargetTime = nil, nil, nil
+	globalBlockCount, localBlockCount = -1, -1
+	lastBlock = nil
+	initGenesis()
+
+	return replayChain(st, stored)
+}
+
+func replayChain(st storage.Storage, stored chainState) error {
+
+	importing = true
+	defer func() { importing = false }()
+
+	if genesis := st.ReadBlockByHeight(0); genesis == nil || genesis.Hash != lastBlock.Hash {
+		return errors.New("Divergence at height 0: Stored genesis block differs.")
+	}
+
+	for height := uint32(1); int64(height) <= stored.globalBlockCount; height++ {
+		block := st.ReadBlockByHeight(height)
+		if block == nil {
+			return errors.New(fmt.Sprintf("Divergence at height %v: Block is missing.", height))
+		}
+
+		var txs []protocol.Transaction
+		var txHashes [][32]byte
+		txHashes = append(txHashes, block.AccTxData...)
+		txHashes = append(txHashes, block.FundsTxData...)
+		txHashes = append(txHashes, block.ConfigTxData...)
+		for _, txHash := range txHashes {
+			tx := st.ReadClosedTx(txHash)
+			if tx == nil {
+				return errors.New(fmt.Sprintf("Divergence at height %v: Tx %x is missing.", height, txHash[0:8]))
+			}
+			txs = append(txs, tx)
+		}
+
+		if err := importBlock(block, txs); err != nil {
+			return errors.New(fmt.Sprintf("Divergence at height %v: %v", height, err))
+		}
+	}
+
+	replayed := saveChainState()
+	if err := compareChainState(stored, replayed); err != nil {
+		return err
+	}
+
+	return compareIndexes(st, stored, replayed)
+}
+
+//Compares the stored chain state with the one of the replayed chain
+func compareChainState(stored, replayed chainState) error {
+
+	if stored.lastBlock.Hash != replayed.lastBlock.Hash {
+		return errors.New(fmt.Sprintf("Divergence in chain tip: Stored %x, replayed %x.", stored.lastBlock.Hash[0:12], replayed.lastBlock.Hash[0:12]))
+	}
+	if stored.globalBlockCount != replayed.globalBlockCount || stored.localBlockCount != replayed.localBlockCount {
+		return errors.New(fmt.Sprintf("Divergence in block count: Stored %v/%v, replayed %v/%v.",
+			stored.globalBlockCount, stored.localBlockCount, replayed.globalBlockCount, replayed.localBlockCount))
+	}
+	if !reflect.DeepEqual(stored.parameters, replayed.parameters) {
+		return errors.New(fmt.Sprintf("Divergence in parameter history: Stored %v, replayed %v.", stored.parameters, replayed.parameters))
+	}
+	if !reflect.DeepEqual(stored.target, replayed.target) {
+		return errors.New(fmt.Sprintf("Divergence in difficulty targets: Stored %v, replayed %v.", stored.target, replayed.target))
+	}
+	if !reflect.DeepEqual(stored.targetTimes, replayed.targetTimes) || stored.currentTargetTime != replayed.currentTargetTime {
+		return errors.New("Divergence in difficulty timeranges.")
+	}
+
+	if err := compareAccounts("account", stored.accounts, replayed.accounts); err != nil {
+		return err
+	}
+	return compareAccounts("root key", stored.rootKeys, replayed.rootKeys)
+}
+
+//The indexes of the replay are in store. They're compared block by block in the order of the chain, the account
+//histories in the order of the account hashes
+func compareIndexes(st storage.Storage, stored, replayed chainState) error {
+
+	for height := uint32(0); int64(height) <= stored.globalBlockCount; height++ {
+		block := st.ReadBlockByHeight(height)
+
+		storedWork, replayedWork := st.ReadChainWork(block.Hash), store.ReadChainWork(block.Hash)
+		if (storedWork == nil) != (replayedWork == nil) || storedWork != nil && storedWork.Cmp(replayedWork) != 0 {
+			return errors.New(fmt.Sprintf("Divergence in chain work of block %x: Stored %v, replayed %v.", block.Hash[0:8], storedWork, replayedWork))
+		}
+
+		storedUndo, replayedUndo := st.ReadUndo(block.Hash), store.ReadUndo(block.Hash)
+		if (storedUndo == nil) != (replayedUndo == nil) || !bytes.Equal(storedUndo.Encode(), replayedUndo.Encode()) {
+			return errors.New(fmt.Sprintf("Divergence in undo data of block %x.", block.Hash[0:8]))
+		}
+
+		var txHashes [][32]byte
+		txHashes = append(txHashes, block.AccTxData...)
+		txHashes = append(txHashes, block.FundsTxData...)
+		txHashes = append(txHashes, block.ConfigTxData...)
+		for _, txHash := range txHashes {
+			storedLoc, replayedLoc := st.ReadTxLocation(txHash), store.ReadTxLocation(txHash)
+			if !bytes.Equal(storedLoc.Encode(), replayedLoc.Encode()) {
+				return errors.New(fmt.Sprintf("Divergence in location of tx %x: Stored %v, replayed %v.", txHash[0:8], storedLoc, replayedLoc))
+			}
+		}
+
+		if !bytes.Equal(st.ReadSnapshot(height), store.ReadSnapshot(height)) {
+			return errors.New(fmt.Sprintf("Divergence in snapshot at height %v.", height))
+		}
+	}
+
+	accounts := make(map[[32]byte]*protocol.Account)
+	for _, accs := range []map[[32]byte]*protocol.Account{stored.accounts, stored.rootKeys, replayed.accounts, replayed.rootKeys} {
+		for hash, acc := range accs {
+			accounts[hash] = acc
+		}
+	}
+	var hashes [][32]byte
+	for hash := range accounts {
+		hashes = append(hashes, hash)
+	}
+	sort.Slice(hashes, func(i, j int) bool { return bytes.Compare(hashes[i][:], hashes[j][:]) < 0 })
+
+	for _, hash := range hashes {
+		storedHistory := st.ReadAccountHistory(hash, 0, math.MaxInt32)
+		replayedHistory := store.ReadAccountHistory(hash, 0, math.MaxInt32)
+		for i := 0; i < len(storedHistory) || i < len(replayedHistory); i++ {
+			switch {
+			case i >= len(storedHistory):
+				return errors.New(fmt.Sprintf("Divergence in history of account %x: Entry %v (tx %x) not stored.", hash[0:8], i, replayedHistory[i].Hash[0:8]))
+			case i >= len(replayedHistory):
+				return errors.New(fmt.Sprintf("Divergence in history of account %x: Entry %v (tx %x) stored, but not created by any block.", hash[0:8], i, storedHistory[i].Hash[0:8]))
+			case *storedHistory[i] != *replayedHistory[i]:
+				return errors.New(fmt.Sprintf("Divergence in history of account %x: Stored entry %v is tx %x, replayed tx %x.", hash[0:8], i, storedHistory[i].Hash[0:8], replayedHistory[i].Hash[0:8]))
+			}
+		}
+	}
+
+	return nil
+}
+
+//Accounts are compared in the order of their hashes, the reported divergence is the same for every run
+func compareAccounts(kind string, stored, replayed map[[32]byte]*protocol.Account) error {
+
+	var hashes [][32]byte
+	for hash := range stored {
+		hashes = append(hashes, hash)
+	}
+	for hash := range replayed {
+		if _, exists := stored[hash]; !exists {
+			hashes = append(hashes, hash)
+		}
+	}
+	sort.Slice(hashes, func(i, j int) bool { return bytes.Compare(hashes[i][:], hashes[j][:]) < 0 })
+
+	for _, hash := range hashes {
+		storedAcc, replayedAcc := stored[hash], replayed[hash]
+		switch {
+		case storedAcc == nil:
+			return errors.New(fmt.Sprintf("Divergence in %v %x: Not stored.", kind, hash[0:8]))
+		case replayedAcc == nil:
+			return errors.New(fmt.Sprintf("Divergence in %v %x: Stored, but not created by any block.", kind, hash[0:8]))
+		case storedAcc.Balance != replayedAcc.Balance:
+			return errors.New(fmt.Sprintf("Divergence in %v %x: Stored balance %v, replayed %v.", kind, hash[0:8], storedAcc.Balance, replayedAcc.Balance))
+		case storedAcc.TxCnt != replayedAcc.TxCnt:
+			return errors.New(fmt.Sprintf("Divergence in %v %x: Stored TxCnt %v, replayed %v.", kind, hash[0:8], storedAcc.TxCnt, replayedAcc.TxCnt))
+		case *storedAcc != *replayedAcc:
+			return errors.New(fmt.Sprintf("Divergence in %v %x: Stored %v, replayed %v.", kind, hash[0:8], storedAcc, replayedAcc))
+		}
+	}
+
+	return nil
+}
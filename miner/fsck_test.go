@@ -0,0 +1,153 @@
+package miner
+
+import (
+	"fmt"
+	"github.com/lisgie/bazo_miner/protocol"
+	"github.com/lisgie/bazo_miner/storage"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+//Replays a stored chain and checks whether divergences in the stored data are reported
+func TestFsck(t *testing.T) {
+
+	testStore := store
+	defer func() { store = testStore }()
+
+	cleanAndPrepare()
+	//Blocks at even heights commit to a snapshot
+	snapshotInterval = 2
+	defer func() { snapshotInterval = SNAPSHOT_INTERVAL }()
+	origMiner := *minerAcc
+	origTarget := append([]uint32{}, target...)
+	genesis := lastBlock
+
+	batch := storage.NewBatch()
+	batch.WriteTip(genesis.Hash, 0)
+	store.Commit(batch)
+
+	prevHash := [32]byte{}
+	for cnt := 0; cnt < 3; cnt++ {
+		b := newBlock(prevHash)
+		addStateCommitment(b)
+		createBlockWithTxs(b)
+		finalizeBlock(b)
+		if err := validateBlock(b); err != nil {
+			t.Fatalf("Block validation failed: %v\n", err)
+		}
+		prevHash = b.Hash
+	}
+	stored := saveChainState()
+
+	//Every replay starts from the same genesis state as the stored chain
+	prepareReplay := func() {
+		store = storage.NewMemStorage()
+		cleanAndPrepare()
+		target = append([]uint32{}, origTarget...)
+		store.State().DeleteAccount(serializeHashContent(minerAcc.Address))
+		*minerAcc = origMiner
+		store.State().SetAccount(serializeHashContent(minerAcc.Address), minerAcc)
+	}
+
+	prepareReplay()
+	if err := replayChain(testStore, stored); err != nil {
+		t.Errorf("Consistent chain reported a divergence: %v\n", err)
+	}
+
+	//Stored balance diverges
+	accAHash := serializeHashContent(accA.Address)
+	tampered := stored
+	tampered.accounts = make(map[[32]byte]*protocol.Account)
+	for hash, acc := range stored.accounts {
+		tampered.accounts[hash] = acc
+	}
+	tamperedAcc := *stored.accounts[accAHash]
+	tamperedAcc.Balance++
+	tampered.accounts[accAHash] = &tamperedAcc
+
+	prepareReplay()
+	if err := replayChain(testStore, tampered); err == nil || !strings.Contains(err.Error(), "balance") {
+		t.Errorf("Diverging balance was not reported: %v\n", err)
+	}
+
+	//Stored difficulty target diverges
+	tampered = stored
+	tampered.target = append([]uint32{}, stored.target...)
+	tampered.target[len(tampered.target)-1]++
+
+	prepareReplay()
+	if err := replayChain(testStore, tampered); err == nil || !strings.Contains(err.Error(), "target") {
+		t.Errorf("Diverging target was not reported: %v\n", err)
+	}
+
+	//Diverging indexes are reported with the first key that differs
+	b := testStore.ReadBlockByHeight(2)
+	txHash := append(append(b.AccTxData, b.FundsTxData...), b.ConfigTxData...)[0]
+	loc, undo, work := testStore.ReadTxLocation(txHash), testStore.ReadUndo(b.Hash), testStore.ReadChainWork(b.Hash)
+	tamperedLoc := *loc
+	tamperedLoc.Index++
+	snapshotHeight, snapshot := testStore.ReadLatestSnapshot()
+	historyEntry := &storage.HistoryEntry{Height: 2, TxType: storage.FUNDSTX, Index: 99, Hash: [32]byte{1}}
+
+	for _, test := range []struct {
+		tamper, restore func(batch *storage.Batch)
+		want            string
+	}{
+		{
+			func(batch *storage.Batch) { batch.WriteChainWork(b.Hash, big.NewInt(1)) },
+			func(batch *storage.Batch) { batch.WriteChainWork(b.Hash, work) },
+			fmt.Sprintf("chain work of block %x", b.Hash[0:8]),
+		},
+		{
+			func(batch *storage.Batch) { batch.WriteUndo(b.Hash, store.State().NewJournal()) },
+			func(batch *storage.Batch) { batch.WriteUndo(b.Hash, undo) },
+			fmt.Sprintf("undo data of block %x", b.Hash[0:8]),
+		},
+		{
+			func(batch *storage.Batch) { batch.WriteTxLocation(txHash, &tamperedLoc) },
+			func(batch *storage.Batch) { batch.WriteTxLocation(txHash, loc) },
+			fmt.Sprintf("location of tx %x", txHash[0:8]),
+		},
+		{
+			func(batch *storage.Batch) { batch.WriteSnapshot(snapshotHeight, snapshot[1:]) },
+			func(batch *storage.Batch) { batch.WriteSnapshot(snapshotHeight, snapshot) },
+			fmt.Sprintf("snapshot at height %v", snapshotHeight),
+		},
+		{
+			func(batch *storage.Batch) { batch.WriteHistoryEntry(accAHash, historyEntry) },
+			func(batch *storage.Batch) { batch.DeleteHistoryEntry(accAHash, historyEntry) },
+			fmt.Sprintf("history of account %x", accAHash[0:8]),
+		},
+	} {
+		batch := storage.NewBatch()
+		test.tamper(batch)
+		testStore.Commit(batch)
+
+		prepareReplay()
+		if err := replayChain(testStore, stored); err == nil || !strings.Contains(err.Error(), test.want) {
+			t.Errorf("Divergence in %v was not reported: %v\n", test.want, err)
+		}
+
+		batch = storage.NewBatch()
+		test.restore(batch)
+		testStore.Commit(batch)
+	}
+
+	prepareReplay()
+	if err := replayChain(testStore, stored); err != nil {
+		t.Errorf("Restored indexes reported a divergence: %v\n", err)
+	}
+
+	//A tx of the second block is missing on disk, replaying stops there
+	if len(b.AccTxData) > 0 {
+		tx := testStore.ReadClosedTx(b.AccTxData[0])
+		testStore.DeleteClosedTx(tx)
+
+		prepareReplay()
+		if err := replayChain(testStore, stored); err == nil || !strings.Contains(err.Error(), "height 2") {
+			t.Errorf("Missing tx was not reported: %v\n", err)
+		}
+		testStore.WriteClosedTx(tx)
+	}
+}
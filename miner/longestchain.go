@@ -3,12 +3,12 @@ package miner
 import (
 	"github.com/lisgie/bazo_miner/p2p"
 	"github.com/lisgie/bazo_miner/protocol"
-	"github.com/lisgie/bazo_miner/storage"
+	"math/big"
 	"time"
 )
 
 //Function to give a list of blocks to rollback (in the right order) and a list of blocks to validate.
-//Covers both cases (if block belongs to the longest chain or not to the longest chain)
+//Covers both cases (if block belongs to the heaviest chain or not to the heaviest chain)
 func getBlockSequences(newBlock *protocol.Block) (blocksToRollback, blocksToValidate []*protocol.Block) {
 
 	//Fetch all blocks that are needed to validate
@@ -27,19 +27,55 @@ func getBlockSequences(newBlock *protocol.Block) (blocksToRollback, blocksToVali
 		}
 		blocksToRollback = append(blocksToRollback, tmpBlock)
 		//the block needs to be in closed storage
-		tmpBlock = storage.ReadClosedBlock(tmpBlock.PrevHash)
+		tmpBlock = store.ReadClosedBlock(tmpBlock.PrevHash)
 	}
 
-	//Compare current length with new chain length
-	if len(blocksToRollback) >= len(newChain) {
-		//Current chain length is longer or equal (our conesnsus protocol states that in this case we reject the block)
+	//Compare the work of the current chain since the ancestor with the work of the new chain. The work of the new
+	//blocks comes from the targets in their headers, whether these are the expected ones is checked during validation.
+	//Blocks below the target fork height don't carry a target, they're counted with the current one
+	currentWork := new(big.Int).Sub(chainWork(lastBlock.Hash), chainWork(ancestor.Hash))
+	newWork := new(big.Int)
+	height := globalBlockCount - int64(len(blocksToRollback))
+	for _, block := range newChain {
+		height++
+		if block.HasTarget() {
+			newWork.Add(newWork, blockWork(block.Target))
+		} else if height < targetForkHeight {
+			newWork.Add(newWork, blockWork(getTarget()))
+		} else {
+			return nil, nil
+		}
+	}
+
+	if currentWork.Cmp(newWork) >= 0 {
+		//Current chain is heavier or equal (our conesnsus protocol states that in this case we reject the block)
 		return nil, nil
 	} else {
-		//New chain is longer, rollback and validate new chain
+		//New chain is heavier, rollback and validate new chain
 		return blocksToRollback, newChain
 	}
 }
 
+//Expected number of hashes to find a block with the given target (compact encoding): 2^256 / (target+1)
+func blockWork(compact uint32) *big.Int {
+
+	target := protocol.CompactToTarget(compact)
+	work := new(big.Int).Lsh(big.NewInt(1), 256)
+
+	return work.Div(work, target.Add(target, big.NewInt(1)))
+}
+
+//Cumulative work up to and including the block. Fast synced miners know the work from the last block of the snapshot
+//on, the common ancestor is never below the snapshot
+func chainWork(hash [32]byte) *big.Int {
+
+	if work := store.ReadChainWork(hash); work != nil {
+		return work
+	}
+
+	return big.NewInt(0)
+}
+
 //Returns the ancestor from which the split occurs (if a split occured, if not it's just our last block) and a list
 //of blocks that belong to a new chain
 func getNewChain(newBlock *protocol.Block) (ancestor *protocol.Block, newChain []*protocol.Block) {
@@ -49,7 +85,7 @@ func getNewChain(newBlock *protocol.Block) (ancestor *protocol.Block, newChain [
 
 		//Search for an ancestor (which needs to be in closed storage -> validated block)
 		prevBlockHash := newBlock.PrevHash
-		potentialAncestor := storage.ReadClosedBlock(prevBlockHash)
+		potentialAncestor := store.ReadClosedBlock(prevBlockHash)
 
 		if potentialAncestor != nil {
 			//found ancestor
@@ -62,7 +98,7 @@ func getNewChain(newBlock *protocol.Block) (ancestor *protocol.Block, newChain [
 		}
 
 		//It might be the case that we already started a sync and the block is in the openblock storage
-		newBlock = storage.ReadOpenBlock(prevBlockHash)
+		newBlock = store.ReadOpenBlock(prevBlockHash)
 		if newBlock != nil {
 			continue
 		}
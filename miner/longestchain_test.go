@@ -1,7 +1,7 @@
 package miner
 
 import (
-	"github.com/lisgie/bazo_miner/storage"
+	"github.com/lisgie/bazo_miner/protocol"
 	"testing"
 )
 
@@ -35,27 +35,27 @@ func TestGetBlockSequences(t *testing.T) {
 		t.Error("Wrong validation sequence\n")
 	}
 
-	//PoW needs lastBlock, have to set it manually
-	lastBlock = storage.ReadClosedBlock([32]byte{})
+	//PoW needs the tip, have to set it manually
+	setTip(store.ReadClosedBlock([32]byte{}))
 	c := newBlock([32]byte{})
 	createBlockWithTxs(c)
 	finalizeBlock(c)
-	storage.WriteOpenBlock(c)
+	store.WriteOpenBlock(c)
 
-	//PoW needs lastBlock, have to set it manually
-	lastBlock = c
+	//PoW needs the tip, have to set it manually
+	setTip(c)
 	c2 := newBlock(c.Hash)
 	createBlockWithTxs(c2)
 	finalizeBlock(c2)
-	storage.WriteOpenBlock(c2)
+	store.WriteOpenBlock(c2)
 
-	//PoW needs lastBlock, have to set it manually
-	lastBlock = c2
+	//PoW needs the tip, have to set it manually
+	setTip(c2)
 	c3 := newBlock(c2.Hash)
 	createBlockWithTxs(c3)
 	finalizeBlock(c3)
 
-	lastBlock = b2
+	setTip(b2)
 	//Blockchain now: genesis <- b <- b2
 	//New Blockchain of longer size: genesis <- c <- c2 <- c3
 	rollback, validate = getBlockSequences(c3)
@@ -93,31 +93,109 @@ func TestGetBlockSequences(t *testing.T) {
 
 	//Blockchain now: genesis <- b <- b2 <- b3
 	//Competing chain: genesis <- c <- c2 <- c3
-	lastBlock = storage.ReadClosedBlock([32]byte{})
+	setTip(store.ReadClosedBlock([32]byte{}))
 	c = newBlock([32]byte{})
 	createBlockWithTxs(c)
 	finalizeBlock(c)
-	storage.WriteOpenBlock(c)
+	store.WriteOpenBlock(c)
 
-	lastBlock = c
+	setTip(c)
 	c2 = newBlock(c.Hash)
 	createBlockWithTxs(c2)
 	finalizeBlock(c2)
-	storage.WriteOpenBlock(c2)
+	store.WriteOpenBlock(c2)
 
-	lastBlock = c2
+	setTip(c2)
 	c3 = newBlock(c2.Hash)
 	createBlockWithTxs(c3)
 	finalizeBlock(c3)
 
 	//Make sure that the new blockchain of equal length does not get activated
-	lastBlock = b3
+	setTip(b3)
 	rollback, validate = getBlockSequences(c3)
 	if rollback != nil || validate != nil {
 		t.Error("Did not properly detect longest chain\n")
 	}
 }
 
+//A longer chain of low-difficulty blocks doesn't beat a shorter, heavier one
+func TestForkChoiceByWork(t *testing.T) {
+
+	cleanAndPrepare()
+	genesis := lastBlock
+
+	//Blockchain: genesis <- b <- b2, both at a higher difficulty
+	target = append(target, targetFromZeroBits(12))
+	b := newBlock(genesis.Hash)
+	createBlockWithTxs(b)
+	finalizeBlock(b)
+	validateBlock(b)
+
+	b2 := newBlock(b.Hash)
+	createBlockWithTxs(b2)
+	finalizeBlock(b2)
+	validateBlock(b2)
+
+	if work := chainWork(b2.Hash); work.Cmp(blockWork(targetFromZeroBits(12))) <= 0 || chainWork(b2.Hash).Cmp(chainWork(b.Hash)) <= 0 {
+		t.Errorf("Cumulative work was not stored: %v\n", work)
+	}
+
+	//Competing chain: genesis <- c <- c2 <- c3 at the lower difficulty
+	target = append(target, targetFromZeroBits(8))
+	setTip(genesis)
+	c := newBlock(genesis.Hash)
+	createBlockWithTxs(c)
+	finalizeBlock(c)
+	store.WriteOpenBlock(c)
+
+	setTip(c)
+	c2 := newBlock(c.Hash)
+	createBlockWithTxs(c2)
+	finalizeBlock(c2)
+	store.WriteOpenBlock(c2)
+
+	setTip(c2)
+	c3 := newBlock(c2.Hash)
+	createBlockWithTxs(c3)
+	finalizeBlock(c3)
+
+	//The new blocks are counted with the targets in their headers, not with the current one
+	setTip(b2)
+	target = append(target, targetFromZeroBits(12))
+	if rollback, validate := getBlockSequences(c3); rollback != nil || validate != nil {
+		t.Error("Longer chain with less work was activated.\n")
+	}
+
+	//Competing chain: genesis <- d <- d2 <- d3 at the higher difficulty has more work
+	setTip(genesis)
+	d := newBlock(genesis.Hash)
+	createBlockWithTxs(d)
+	finalizeBlock(d)
+	store.WriteOpenBlock(d)
+
+	setTip(d)
+	d2 := newBlock(d.Hash)
+	createBlockWithTxs(d2)
+	finalizeBlock(d2)
+	store.WriteOpenBlock(d2)
+
+	setTip(d2)
+	d3 := newBlock(d2.Hash)
+	createBlockWithTxs(d3)
+	finalizeBlock(d3)
+
+	setTip(b2)
+	if rollback, validate := getBlockSequences(d3); len(rollback) != 2 || len(validate) != 3 {
+		t.Error("Chain with more work was not activated.\n")
+	}
+
+	//Blocks without a target don't count as work
+	d3.Header &^= protocol.BLOCKFLAG_TARGET
+	if rollback, validate := getBlockSequences(d3); rollback != nil || validate != nil {
+		t.Error("Chain with a block without target was activated.\n")
+	}
+}
+
 //Test whether we get the new proper chain (we leverage the fact that open storage is checked so we don't need
 //to need network functionality for that test
 func TestGetNewChain(t *testing.T) {
@@ -143,18 +221,18 @@ func TestGetNewChain(t *testing.T) {
 
 	//Blockchain now: genesis <- b
 	//New chain: genesis <- c <- c2
-	lastBlock = storage.ReadClosedBlock([32]byte{})
+	setTip(store.ReadClosedBlock([32]byte{}))
 	c := newBlock([32]byte{})
 	createBlockWithTxs(c)
 	finalizeBlock(c)
-	storage.WriteOpenBlock(c)
+	store.WriteOpenBlock(c)
 
-	lastBlock = c
+	setTip(c)
 	c2 := newBlock(c.Hash)
 	createBlockWithTxs(c2)
 	finalizeBlock(c2)
 
-	lastBlock = b
+	setTip(b)
 	ancestor, newChain = getNewChain(c2)
 
 	if ancestor.Hash != [32]byte{} {
@@ -165,3 +243,94 @@ func TestGetNewChain(t *testing.T) {
 		t.Error("Wrong new chain\n")
 	}
 }
+
+//The height index has to follow the canonical chain when a longer chain replaces the current one
+func TestReorgBlockHeights(t *testing.T) {
+
+	cleanAndPrepare()
+
+	b := newBlock([32]byte{})
+	finalizeBlock(b)
+	validateBlock(b)
+
+	b2 := newBlock(b.Hash)
+	finalizeBlock(b2)
+	validateBlock(b2)
+
+	if tip, height := store.ReadTip(); tip == nil || tip.Hash != b2.Hash || height != 2 {
+		t.Errorf("Wrong tip: %v at height %v\n", tip, height)
+	}
+
+	//Competing chain: genesis <- c <- c2 <- c3
+	setTip(store.ReadClosedBlock([32]byte{}))
+	c := newBlock([32]byte{})
+	finalizeBlock(c)
+	store.WriteOpenBlock(c)
+
+	setTip(c)
+	c2 := newBlock(c.Hash)
+	finalizeBlock(c2)
+	store.WriteOpenBlock(c2)
+
+	setTip(c2)
+	c3 := newBlock(c2.Hash)
+	finalizeBlock(c3)
+
+	setTip(b2)
+	if err := validateBlock(c3); err != nil {
+		t.Errorf("Validation of the longer chain failed: %v\n", err)
+	}
+
+	for height, block := range []*protocol.Block{c, c2, c3} {
+		if indexed := store.ReadBlockByHeight(uint32(height + 1)); indexed == nil || indexed.Hash != block.Hash {
+			t.Errorf("Block at height %v is not part of the new chain: %v\n", height+1, indexed)
+		}
+	}
+
+	if tip, height := store.ReadTip(); tip == nil || tip.Hash != c3.Hash || height != 3 {
+		t.Errorf("Wrong tip after reorg: %v at height %v\n", tip, height)
+	}
+}
+
+//The blocks of a new chain are checked against the targets of that chain, not against the one of the current tip
+func TestReorgAcrossRetarget(t *testing.T) {
+
+	cleanAndPrepare()
+	genesis := lastBlock
+	//Retargets every block, the blocks come in faster than the block interval
+	activeParameters.diff_algorithm = protocol.DIFF_ALGORITHM_LWMA
+
+	//Chain: genesis <- c <- c2 <- c3, c3 has a harder target than its predecessors
+	var chain []*protocol.Block
+	for cnt := 0; cnt < 3; cnt++ {
+		c := newBlock(lastBlock.Hash)
+		finalizeBlock(c)
+		if err := validateBlock(c); err != nil {
+			t.Fatalf("Block %v could not be validated: %v\n", cnt, err)
+		}
+		chain = append(chain, c)
+	}
+	if chain[2].Target == chain[0].Target {
+		t.Fatal("Target did not change within the chain.\n")
+	}
+	for cnt := len(chain) - 1; cnt >= 0; cnt-- {
+		validateBlockRollback(chain[cnt])
+	}
+
+	//Current chain: genesis <- b
+	b := newBlock(genesis.Hash)
+	createBlockWithTxs(b)
+	finalizeBlock(b)
+	if err := validateBlock(b); err != nil {
+		t.Fatalf("Block could not be validated: %v\n", err)
+	}
+
+	store.WriteOpenBlock(chain[0])
+	store.WriteOpenBlock(chain[1])
+	if err := validateBlock(chain[2]); err != nil {
+		t.Errorf("Longer chain with changing targets was rejected: %v\n", err)
+	}
+	if lastBlock.Hash != chain[2].Hash {
+		t.Error("Longer chain is not the active chain.\n")
+	}
+}
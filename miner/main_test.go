@@ -12,6 +12,7 @@ import (
 	"math/big"
 	"os"
 	"testing"
+	"time"
 )
 
 //Some user accounts for testing
@@ -80,8 +81,8 @@ func addTestingAccounts() {
 	hashB := serializeHashContent(accB.Address)
 
 	//just to bootstrap
-	storage.State[hashA] = accA
-	storage.State[hashB] = accB
+	store.State().SetAccount(hashA, accA)
+	store.State().SetAccount(hashB, accB)
 
 	minerPrivKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
 	var pubKey [64]byte
@@ -91,7 +92,7 @@ func addTestingAccounts() {
 	minerHash := serializeHashContent(pubKey)
 	copy(shortMiner[:], minerHash[0:8])
 	minerAcc.Address = pubKey
-	storage.State[minerHash] = minerAcc
+	store.State().SetAccount(minerHash, minerAcc)
 
 }
 
@@ -119,20 +120,16 @@ func addRootAccounts() {
 	rootHash := serializeHashContent(pubKey)
 
 	rootAcc := protocol.Account{Address: pubKey}
-	storage.State[rootHash] = &rootAcc
-	storage.RootKeys[rootHash] = &rootAcc
+	store.State().SetAccount(rootHash, &rootAcc)
+	store.State().SetRootKey(rootHash, &rootAcc)
 }
 
 //The state changes (accounts, funds, system parameters etc.) need to be reverted before any new test starts
 //So every test has the same view on the blockchain
 func cleanAndPrepare() {
 
-	storage.DeleteAll()
-	tmpState := make(map[[32]byte]*protocol.Account)
-	tmpRootKeys := make(map[[32]byte]*protocol.Account)
-
-	storage.State = tmpState
-	storage.RootKeys = tmpRootKeys
+	//Clears the state as well
+	store.DeleteAll()
 
 	lastBlock = nil
 
@@ -142,7 +139,10 @@ func cleanAndPrepare() {
 	//Prepare system parameters
 	targetTimes = []timerange{}
 	currentTargetTime = new(timerange)
-	target = append(target, 8)
+	genesisTarget = targetFromZeroBits(8)
+	target = []uint32{genesisTarget}
+	//Tests of blocks below the fork height set it themselves
+	targetForkHeight = 1
 
 	var tmpSlice []parameters
 	tmpSlice = append(tmpSlice, parameters{
@@ -152,13 +152,14 @@ func cleanAndPrepare() {
 		2016,
 		60,
 		0,
+		GENESIS_DIFF_ALGORITHM,
 	})
 	parameterSlice = tmpSlice
 	activeParameters = &parameterSlice[0]
 
 	genesis := newBlock([32]byte{})
 	collectStatistics(genesis)
-	storage.WriteClosedBlock(genesis)
+	store.WriteClosedBlock(genesis)
 
 	addTestingAccounts()
 	addRootAccounts()
@@ -169,12 +170,19 @@ func cleanAndPrepare() {
 	accB.Balance = 823237654321
 	accA.TxCnt = 0
 	accB.TxCnt = 0
+
+	publishAdmissionParams()
 }
 
 func TestMain(m *testing.M) {
 
-	storage.Init("test.db")
-	p2p.Init("127.0.0.1:8000")
+	//Tests don't need to touch the disk
+	store = storage.NewMemStorage()
+	p2p.Init("127.0.0.1:8000", store)
+	//Block timestamps are checked against the system time, which is set in the background
+	for p2p.ReadSystemTime() == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
 
 	addTestingAccounts()
 	addRootAccounts()
@@ -182,6 +190,11 @@ func TestMain(m *testing.M) {
 	logger = log.New(nil, "", 0)
 	logger.SetOutput(ioutil.Discard)
 	os.Exit(m.Run())
+}
 
-	storage.TearDown()
+//Moves the tip without validating a block, PoW is only calculated on top of the tip
+func setTip(b *protocol.Block) {
+	lastBlock = b
+	newTip(b.Hash)
+	publishAdmissionParams()
 }
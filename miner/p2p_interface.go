@@ -3,7 +3,6 @@ package miner
 import (
 	"github.com/lisgie/bazo_miner/p2p"
 	"github.com/lisgie/bazo_miner/protocol"
-	"github.com/lisgie/bazo_miner/storage"
 )
 
 //The code in this source file communicates with the p2p package via channels
@@ -22,7 +21,7 @@ func processBlock(payload []byte) {
 	block = block.Decode(payload)
 
 	//Block already confirmed and validated
-	if storage.ReadClosedBlock(block.Hash) != nil {
+	if store.ReadClosedBlock(block.Hash) != nil {
 		logger.Printf("Received block (%x) has already been validated.\n", block.Hash[0:12])
 		return
 	}
@@ -0,0 +1,463 @@
+package miner
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/lisgie/bazo_miner/protocol"
+	"github.com/lisgie/bazo_miner/storage"
+	"golang.org/x/crypto/sha3"
+	"math/big"
+)
+
+//Keys under which the miner's chain state is persisted. Together with the account state this is everything that is
+//needed to resume from the last validated block after a restart
+const (
+	PARAMETERS_KEY  = "parameters"
+	TARGET_KEY      = "target"
+	TARGETTIMES_KEY = "targettimes"
+	BLOCKCOUNT_KEY  = "blockcount"
+	//Stats of the blocks below the snapshot a fast synced miner started from (see recentBlockStats)
+	SNAPSHOTSTATS_KEY = "snapshotstats"
+	//Version of the encoding of the entries above, missing in databases written before it was introduced. Storage
+	//migrations don't know about these entries, restoreChainState converts older ones (see chainStateUpgrades)
+	CHAINSTATEVERSION_KEY = "chainstateversion"
+
+	PARAMETERS_SIZE = 80
+	TIMERANGE_SIZE  = 16
+	TARGET_SIZE     = 4
+	BLOCKSTAT_SIZE  = 16
+)
+
+//Adds the accounts touched by the block and the chain state to the batch. This is called after validation and after
+//rollback, so what is on disk always corresponds to lastBlock
+func persistState(batch *storage.Batch, accounts [][32]byte) {
+
+	for _, hash := range accounts {
+		persistAccount(batch, hash)
+	}
+	persistChainState(batch)
+}
+
+//The account might have been deleted (rollback of an accTx), in that case it is removed from disk as well
+func persistAccount(batch *storage.Batch, hash [32]byte) {
+
+	if acc := store.State().GetAccount(hash); acc != nil {
+		batch.WriteAccount(hash, acc)
+	} else {
+		batch.DeleteAccount(hash)
+	}
+
+	if acc := store.State().GetRootKey(hash); acc != nil {
+		batch.WriteRootKey(hash, acc)
+	} else {
+		batch.DeleteRootKey(hash)
+	}
+}
+
+//Records which block (and position within the block) confirmed each transaction
+func persistTxLocations(batch *storage.Batch, data blockData, height uint32) {
+
+	for index, txHash := range data.block.AccTxData {
+		batch.WriteTxLocation(txHash, newTxLocation(data.block, height, storage.ACCTX, index))
+	}
+	for index, txHash := range data.block.FundsTxData {
+		batch.WriteTxLocation(txHash, newTxLocation(data.block, height, storage.FUNDSTX, index))
+	}
+	for index, txHash := range data.block.ConfigTxData {
+		batch.WriteTxLocation(txHash, newTxLocation(data.block, height, storage.CONFIGTX, index))
+	}
+}
+
+func newTxLocation(block *protocol.Block, height uint32, txType uint8, index int) *storage.TxLocation {
+	return &storage.TxLocation{
+		BlockHash: block.Hash,
+		Height:    height,
+		TxType:    txType,
+		Index:     uint16(index),
+	}
+}
+
+func deleteTxLocations(batch *storage.Batch, data blockData) {
+
+	for _, txHash := range data.block.AccTxData {
+		batch.DeleteTxLocation(txHash)
+	}
+	for _, txHash := range data.block.FundsTxData {
+		batch.DeleteTxLocation(txHash)
+	}
+	for _, txHash := range data.block.ConfigTxData {
+		batch.DeleteTxLocation(txHash)
+	}
+}
+
+//Adds the block to the history of every account it touched. The slices are index-aligned with the tx data of the
+//block, so the position of a tx is the same as in the location index
+func persistHistory(batch *storage.Batch, data blockData, height uint32) {
+
+	accounts, entries := historyEntries(data, height)
+	for i := range accounts {
+		batch.WriteHistoryEntry(accounts[i], entries[i])
+	}
+}
+
+func deleteHistory(batch *storage.Batch, data blockData, height uint32) {
+
+	accounts, entries := historyEntries(data, height)
+	for i := range accounts {
+		batch.DeleteHistoryEntry(accounts[i], entries[i])
+	}
+}
+
+//Returns the accounts touched by the block together with the corresponding history entry. ConfigTxs don't show up,
+//their fees are part of the beneficiary's block reward entry
+func historyEntries(data blockData, height uint32) (accounts [][32]byte, entries []*storage.HistoryEntry) {
+
+	for index, tx := range data.accTxSlice {
+		entry := newHistoryEntry(height, storage.ACCTX, index, data.block.AccTxData[index])
+		accounts = append(accounts, sha3.Sum256(tx.PubKey[:]), tx.Issuer)
+		entries = append(entries, entry, entry)
+	}
+	for index, tx := range data.fundsTxSlice {
+		entry := newHistoryEntry(height, storage.FUNDSTX, index, data.block.FundsTxData[index])
+		accounts = append(accounts, tx.From, tx.To)
+		entries = append(entries, entry, entry)
+	}
+	accounts = append(accounts, data.block.Beneficiary)
+	entries = append(entries, newHistoryEntry(height, storage.BLOCKREWARD, 0, data.block.Hash))
+
+	return accounts, entries
+}
+
+func newHistoryEntry(height uint32, txType uint8, index int, hash [32]byte) *storage.HistoryEntry {
+	return &storage.HistoryEntry{
+		Height: height,
+		TxType: txType,
+		Index:  uint16(index),
+		Hash:   hash,
+	}
+}
+
+//Pruned nodes only keep the tx payloads and undo data of the last pruneDepth blocks. Everything older is removed,
+//which also covers nodes that switched from full to pruned mode or lowered the depth
+func pruneBlocks(batch *storage.Batch, height uint32) {
+
+	if pruneDepth == 0 || height <= pruneDepth {
+		return
+	}
+
+	prunedHeight := store.ReadPrunedHeight()
+	for h := prunedHeight + 1; h <= height-pruneDepth; h++ {
+		block := store.ReadBlockByHeight(h)
+		if block == nil {
+			continue
+		}
+		for _, txHash := range block.AccTxData {
+			batch.PruneTx(txHash)
+		}
+		for _, txHash := range block.FundsTxData {
+			batch.PruneTx(txHash)
+		}
+		for _, txHash := range block.ConfigTxData {
+			batch.PruneTx(txHash)
+		}
+		batch.DeleteUndo(block.Hash)
+	}
+
+	if height-pruneDepth > prunedHeight {
+		batch.WritePrunedHeight(height - pruneDepth)
+	}
+}
+
+func persistChainState(batch *storage.Batch) {
+
+	var blockCount [16]byte
+	binary.BigEndian.PutUint64(blockCount[0:8], uint64(globalBlockCount))
+	binary.BigEndian.PutUint64(blockCount[8:16], uint64(localBlockCount))
+
+	//The currently active timerange is stored as the last entry
+	timeranges := append(targetTimes[:len(targetTimes):len(targetTimes)], *currentTargetTime)
+
+	batch.WriteTip(lastBlock.Hash, uint32(globalBlockCount))
+	batch.WriteChainState(PARAMETERS_KEY, encodeParameters(parameterSlice))
+	batch.WriteChainState(TARGET_KEY, encodeTargets(target))
+	batch.WriteChainState(TARGETTIMES_KEY, encodeTimeranges(timeranges))
+	batch.WriteChainState(BLOCKCOUNT_KEY, blockCount[:])
+	batch.WriteChainState(CHAINSTATEVERSION_KEY, encodeChainStateVersion(chainStateVersion()))
+}
+
+//Returns false if there is no (consistent) chain state on disk, the caller then starts from the genesis block
+func restoreChainState() bool {
+
+	tip, height := store.ReadTip()
+	entries := make(map[string][]byte)
+	for _, key := range []string{PARAMETERS_KEY, TARGET_KEY, TARGETTIMES_KEY, BLOCKCOUNT_KEY, CHAINSTATEVERSION_KEY} {
+		entries[key] = store.ReadChainState(key)
+	}
+	if tip == nil {
+		return false
+	}
+	if err := upgradeChainState(entries); err != nil {
+		logger.Printf("Chain state could not be restored: %v\n", err)
+		return false
+	}
+
+	blockCount := entries[BLOCKCOUNT_KEY]
+	if len(blockCount) != 16 {
+		return false
+	}
+
+	params := decodeParameters(entries[PARAMETERS_KEY])
+	targets := decodeTargets(entries[TARGET_KEY])
+	timeranges := decodeTimeranges(entries[TARGETTIMES_KEY])
+	if len(params) == 0 || len(targets) == 0 || len(timeranges) == 0 || int64(height) != int64(binary.BigEndian.Uint64(blockCount[0:8])) {
+		return false
+	}
+
+	store.LoadState()
+
+	lastBlock = tip
+	parameterSlice = params
+	activeParameters = &parameterSlice[len(parameterSlice)-1]
+	target = targets
+	targetTimes = timeranges[:len(timeranges)-1]
+	currentTargetTime = &timeranges[len(timeranges)-1]
+	globalBlockCount = int64(binary.BigEndian.Uint64(blockCount[0:8]))
+	localBlockCount = int64(binary.BigEndian.Uint64(blockCount[8:16]))
+
+	return true
+}
+
+//Databases written before the cumulative work was stored with every block. The work of the past blocks is derived from
+//the targets in their headers, or from the target history for blocks below the target fork height
+func backfillChainWork() {
+
+	if store.ReadChainWork(lastBlock.Hash) != nil {
+		return
+	}
+
+	batch := storage.NewBatch()
+	work := big.NewInt(0)
+	for height := int64(0); height <= globalBlockCount; height++ {
+		block := store.ReadBlockByHeight(uint32(height))
+		//Fast synced miners don't have the blocks below the snapshot
+		if block == nil {
+			return
+		}
+
+		if block.HasTarget() {
+			work.Add(work, blockWork(block.Target))
+		} else if height > 0 {
+			work.Add(work, blockWork(legacyTarget(target, activeParameters.diff_interval, height)))
+		}
+		batch.WriteChainWork(block.Hash, work)
+	}
+
+	if err := store.Commit(batch); err != nil {
+		logger.Printf("Cumulative work could not be written to disk: %v\n", err)
+		return
+	}
+	logger.Printf("Filled in the cumulative work of %v blocks.\n", globalBlockCount+1)
+}
+
+//A step converts the chain state entries of version-1 to version. The entries are only converted in memory when the
+//chain state is restored, they're written in the current version together with the next block
+type chainStateUpgrade struct {
+	version     uint32
+	description string
+	upgrade     func(entries map[string][]byte) error
+}
+
+//Ordered by version, without gaps. The last step defines the version this code writes
+var chainStateUpgrades = []chainStateUpgrade{
+	{
+		version:     1,
+		description: "The target history is stored in compact encoding instead of as leading zero bits",
+		upgrade: func(entries map[string][]byte) error {
+			var targets []uint32
+			for _, bits := range entries[TARGET_KEY] {
+				targets = append(targets, targetFromZeroBits(uint(bits)))
+			}
+			entries[TARGET_KEY] = encodeTargets(targets)
+			return nil
+		},
+	},
+	{
+		version:     2,
+		description: "System parameters gain the difficulty algorithm, existing entries get the default algorithm (0)",
+		upgrade: func(entries map[string][]byte) error {
+			//Size of the parameter entries before the algorithm was appended to them
+			const oldSize = 72
+
+			encoded := entries[PARAMETERS_KEY]
+			if len(encoded)%oldSize != 0 {
+				return errors.New(fmt.Sprintf("Parameter history has an invalid length of %v bytes.", len(encoded)))
+			}
+
+			converted := make([]byte, len(encoded)/oldSize*PARAMETERS_SIZE)
+			for i := 0; i < len(encoded)/oldSize; i++ {
+				copy(converted[i*PARAMETERS_SIZE:], encoded[i*oldSize:(i+1)*oldSize])
+			}
+			entries[PARAMETERS_KEY] = converted
+			return nil
+		},
+	},
+}
+
+func chainStateVersion() uint32 {
+	return chainStateUpgrades[len(chainStateUpgrades)-1].version
+}
+
+//Entries of a newer version are refused, we can't know what changed
+func upgradeChainState(entries map[string][]byte) error {
+
+	var version uint32
+	if encoded := entries[CHAINSTATEVERSION_KEY]; len(encoded) == 4 {
+		version = binary.BigEndian.Uint32(encoded)
+	}
+	if version > chainStateVersion() {
+		return errors.New(fmt.Sprintf("Chain state has version %v, this miner only supports up to version %v.", version, chainStateVersion()))
+	}
+
+	for _, step := range chainStateUpgrades {
+		if step.version <= version {
+			continue
+		}
+		if err := step.upgrade(entries); err != nil {
+			return errors.New(fmt.Sprintf("Upgrade of the chain state to version %v (%v) failed: %v", step.version, step.description, err))
+		}
+	}
+	entries[CHAINSTATEVERSION_KEY] = encodeChainStateVersion(chainStateVersion())
+
+	return nil
+}
+
+func encodeChainStateVersion(version uint32) []byte {
+
+	encoded := make([]byte, 4)
+	binary.BigEndian.PutUint32(encoded, version)
+
+	return encoded
+}
+
+func encodeParameters(params []parameters) (encoded []byte) {
+
+	encoded = make([]byte, len(params)*PARAMETERS_SIZE)
+	index := 0
+	for _, param := range params {
+		copy(encoded[index:index+32], param.blockHash[:])
+		binary.BigEndian.PutUint64(encoded[index+32:index+40], param.fee_minimum)
+		binary.BigEndian.PutUint64(encoded[index+40:index+48], param.block_size)
+		binary.BigEndian.PutUint64(encoded[index+48:index+56], param.diff_interval)
+		binary.BigEndian.PutUint64(encoded[index+56:index+64], param.block_interval)
+		binary.BigEndian.PutUint64(encoded[index+64:index+72], param.block_reward)
+		binary.BigEndian.PutUint64(encoded[index+72:index+80], param.diff_algorithm)
+		index += PARAMETERS_SIZE
+	}
+
+	return encoded
+}
+
+func decodeParameters(encoded []byte) (params []parameters) {
+
+	if len(encoded)%PARAMETERS_SIZE != 0 {
+		return nil
+	}
+
+	for index := 0; index < len(encoded); index += PARAMETERS_SIZE {
+		var param parameters
+		copy(param.blockHash[:], encoded[index:index+32])
+		param.fee_minimum = binary.BigEndian.Uint64(encoded[index+32 : index+40])
+		param.block_size = binary.BigEndian.Uint64(encoded[index+40 : index+48])
+		param.diff_interval = binary.BigEndian.Uint64(encoded[index+48 : index+56])
+		param.block_interval = binary.BigEndian.Uint64(encoded[index+56 : index+64])
+		param.block_reward = binary.BigEndian.Uint64(encoded[index+64 : index+72])
+		param.diff_algorithm = binary.BigEndian.Uint64(encoded[index+72 : index+80])
+		params = append(params, param)
+	}
+
+	return params
+}
+
+func encodeTimeranges(timeranges []timerange) (encoded []byte) {
+
+	encoded = make([]byte, len(timeranges)*TIMERANGE_SIZE)
+	index := 0
+	for _, t := range timeranges {
+		binary.BigEndian.PutUint64(encoded[index:index+8], uint64(t.first))
+		binary.BigEndian.PutUint64(encoded[index+8:index+16], uint64(t.last))
+		index += TIMERANGE_SIZE
+	}
+
+	return encoded
+}
+
+func decodeTimeranges(encoded []byte) (timeranges []timerange) {
+
+	if len(encoded)%TIMERANGE_SIZE != 0 {
+		return nil
+	}
+
+	for index := 0; index < len(encoded); index += TIMERANGE_SIZE {
+		timeranges = append(timeranges, timerange{
+			int64(binary.BigEndian.Uint64(encoded[index : index+8])),
+			int64(binary.BigEndian.Uint64(encoded[index+8 : index+16])),
+		})
+	}
+
+	return timeranges
+}
+
+func encodeTargets(targets []uint32) (encoded []byte) {
+
+	encoded = make([]byte, len(targets)*TARGET_SIZE)
+	for i, t := range targets {
+		binary.BigEndian.PutUint32(encoded[i*TARGET_SIZE:(i+1)*TARGET_SIZE], t)
+	}
+
+	return encoded
+}
+
+func decodeTargets(encoded []byte) (targets []uint32) {
+
+	if len(encoded)%TARGET_SIZE != 0 {
+		return nil
+	}
+
+	for index := 0; index < len(encoded); index += TARGET_SIZE {
+		targets = append(targets, binary.BigEndian.Uint32(encoded[index:index+TARGET_SIZE]))
+	}
+
+	return targets
+}
+
+func encodeBlockStats(stats []blockStat) (encoded []byte) {
+
+	encoded = make([]byte, len(stats)*BLOCKSTAT_SIZE)
+	index := 0
+	for _, stat := range stats {
+		binary.BigEndian.PutUint32(encoded[index:index+4], stat.height)
+		binary.BigEndian.PutUint32(encoded[index+4:index+8], stat.target)
+		binary.BigEndian.PutUint64(encoded[index+8:index+16], uint64(stat.timestamp))
+		index += BLOCKSTAT_SIZE
+	}
+
+	return encoded
+}
+
+func decodeBlockStats(encoded []byte) (stats []blockStat) {
+
+	if len(encoded)%BLOCKSTAT_SIZE != 0 {
+		return nil
+	}
+
+	for index := 0; index < len(encoded); index += BLOCKSTAT_SIZE {
+		stats = append(stats, blockStat{
+			binary.BigEndian.Uint32(encoded[index : index+4]),
+			binary.BigEndian.Uint32(encoded[index+4 : index+8]),
+			int64(binary.BigEndian.Uint64(encoded[index+8 : index+16])),
+		})
+	}
+
+	return stats
+}
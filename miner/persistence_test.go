@@ -0,0 +1,370 @@
+package miner
+
+import (
+	"github.com/lisgie/bazo_miner/protocol"
+	"github.com/lisgie/bazo_miner/storage"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+//Validates some blocks, wipes the in-memory state and checks whether the node is able to resume from disk
+func TestRestoreChainState(t *testing.T) {
+
+	cleanAndPrepare()
+
+	//The test accounts are not part of a block, they need to be written to disk manually
+	batch := storage.NewBatch()
+	for hash := range store.State().Accounts() {
+		persistAccount(batch, hash)
+	}
+	store.Commit(batch)
+
+	activeParameters.diff_interval = 2
+	activeParameters.block_interval = 10
+
+	prevHash := [32]byte{}
+	for cnt := 0; cnt < 5; cnt++ {
+		b := newBlock(prevHash)
+		createBlockWithTxs(b)
+		finalizeBlock(b)
+		if err := validateBlock(b); err != nil {
+			t.Errorf("Block validation failed: %v\n", err)
+		}
+		prevHash = b.Hash
+	}
+
+	stateBefore := make(map[[32]byte]protocol.Account)
+	for hash, acc := range store.State().Accounts() {
+		stateBefore[hash] = *acc
+	}
+	rootKeysBefore := make(map[[32]byte]protocol.Account)
+	for hash, acc := range store.State().RootKeys() {
+		rootKeysBefore[hash] = *acc
+	}
+	paramsBefore := make([]parameters, len(parameterSlice))
+	copy(paramsBefore, parameterSlice)
+	targetBefore := make([]uint32, len(target))
+	copy(targetBefore, target)
+	targetTimesBefore := make([]timerange, len(targetTimes))
+	copy(targetTimesBefore, targetTimes)
+	currentTargetTimeBefore := *currentTargetTime
+	globalBefore, localBefore := globalBlockCount, localBlockCount
+	lastBlockBefore := lastBlock.Hash
+
+	//Simulate a restart
+	store.State().Reset()
+	parameterSlice, activeParameters = nil, nil
+	target, targetTimes, currentTargetTime = nil, nil, nil
+	globalBlockCount, localBlockCount = -1, -1
+	lastBlock = nil
+
+	if !restoreChainState() {
+		t.Fatal("Chain state could not be restored.\n")
+	}
+
+	stateAfter := make(map[[32]byte]protocol.Account)
+	for hash, acc := range store.State().Accounts() {
+		stateAfter[hash] = *acc
+	}
+	rootKeysAfter := make(map[[32]byte]protocol.Account)
+	for hash, acc := range store.State().RootKeys() {
+		rootKeysAfter[hash] = *acc
+	}
+
+	if !reflect.DeepEqual(stateBefore, stateAfter) || !reflect.DeepEqual(rootKeysBefore, rootKeysAfter) {
+		t.Error("State was not properly restored.\n")
+	}
+	if !reflect.DeepEqual(paramsBefore, parameterSlice) || activeParameters != &parameterSlice[len(parameterSlice)-1] {
+		t.Error("System parameters were not properly restored.\n")
+	}
+	if !reflect.DeepEqual(targetBefore, target) ||
+		!reflect.DeepEqual(targetTimesBefore, targetTimes) ||
+		currentTargetTimeBefore != *currentTargetTime {
+		t.Error("Difficulty history was not properly restored.\n")
+	}
+	if globalBefore != globalBlockCount || localBefore != localBlockCount || lastBlockBefore != lastBlock.Hash {
+		t.Error("Chain tip was not properly restored.\n")
+	}
+
+	//The restored node needs to be able to continue the chain
+	b := newBlock(lastBlock.Hash)
+	finalizeBlock(b)
+	if err := validateBlock(b); err != nil {
+		t.Errorf("Block validation after restore failed: %v\n", err)
+	}
+}
+
+//The undo data is stored with the blocks, a restarted node needs to be able to roll back blocks it validated before
+func TestRollbackAfterRestore(t *testing.T) {
+
+	cleanAndPrepare()
+
+	batch := storage.NewBatch()
+	for hash := range store.State().Accounts() {
+		persistAccount(batch, hash)
+	}
+	store.Commit(batch)
+
+	stateBefore := make(map[[32]byte]protocol.Account)
+	for hash, acc := range store.State().Accounts() {
+		stateBefore[hash] = *acc
+	}
+
+	var blocks []*protocol.Block
+	prevHash := [32]byte{}
+	for cnt := 0; cnt < 3; cnt++ {
+		b := newBlock(prevHash)
+		createBlockWithTxs(b)
+		finalizeBlock(b)
+		if err := validateBlock(b); err != nil {
+			t.Errorf("Block validation failed: %v\n", err)
+		}
+		blocks = append(blocks, b)
+		prevHash = b.Hash
+	}
+
+	//Simulate a restart
+	store.State().Reset()
+	if !restoreChainState() {
+		t.Fatal("Chain state could not be restored.\n")
+	}
+
+	for cnt := len(blocks) - 1; cnt >= 0; cnt-- {
+		if err := validateBlockRollback(blocks[cnt]); err != nil {
+			t.Errorf("Rollback after restore failed: %v\n", err)
+		}
+	}
+
+	stateAfter := make(map[[32]byte]protocol.Account)
+	for hash, acc := range store.State().Accounts() {
+		stateAfter[hash] = *acc
+	}
+	if !reflect.DeepEqual(stateBefore, stateAfter) {
+		t.Error("State after rollback differs from the state before the blocks.\n")
+	}
+	for hash, rootAcc := range store.State().RootKeys() {
+		if acc := store.State().GetAccount(hash); acc != nil && acc != rootAcc {
+			t.Errorf("Root account %x is not shared between State and RootKeys.\n", hash[0:8])
+		}
+	}
+}
+
+//The accounts a rollback restores are written to disk, a restarted node resumes with the rolled back state
+func TestRollbackPersistence(t *testing.T) {
+
+	cleanAndPrepare()
+
+	batch := storage.NewBatch()
+	for hash := range store.State().Accounts() {
+		persistAccount(batch, hash)
+	}
+	store.Commit(batch)
+
+	b := newBlock(lastBlock.Hash)
+	createBlockWithTxs(b)
+	finalizeBlock(b)
+	if err := validateBlock(b); err != nil {
+		t.Fatalf("Block validation failed: %v\n", err)
+	}
+	if err := validateBlockRollback(b); err != nil {
+		t.Fatalf("Rollback failed: %v\n", err)
+	}
+
+	inMemory := make(map[[32]byte]protocol.Account)
+	for hash, acc := range store.State().Accounts() {
+		inMemory[hash] = *acc
+	}
+
+	//Simulate a restart
+	store.State().Reset()
+	store.LoadState()
+
+	onDisk := make(map[[32]byte]protocol.Account)
+	for hash, acc := range store.State().Accounts() {
+		onDisk[hash] = *acc
+	}
+	for hash, acc := range inMemory {
+		if onDisk[hash] != acc {
+			t.Errorf("Account %x differs after reloading: %v (in memory) vs. %v (on disk)\n", hash[0:8], acc, onDisk[hash])
+		}
+	}
+	if len(onDisk) != len(inMemory) {
+		t.Errorf("Reloaded state has %v accounts, want %v\n", len(onDisk), len(inMemory))
+	}
+}
+
+//A pruned node keeps the blocks, but only the tx payloads and undo data of the most recent blocks
+func TestPruneBlocks(t *testing.T) {
+
+	cleanAndPrepare()
+	pruneDepth = 2
+	defer func() { pruneDepth = 0 }()
+
+	var blocks []*protocol.Block
+	prevHash := [32]byte{}
+	for cnt := 0; cnt < 5; cnt++ {
+		b := newBlock(prevHash)
+		createBlockWithTxs(b)
+		finalizeBlock(b)
+		if err := validateBlock(b); err != nil {
+			t.Fatalf("Block validation failed: %v\n", err)
+		}
+		blocks = append(blocks, b)
+		prevHash = b.Hash
+	}
+
+	if prunedHeight := store.ReadPrunedHeight(); prunedHeight != 3 {
+		t.Errorf("Wrong pruned height: %v\n", prunedHeight)
+	}
+
+	for i, b := range blocks {
+		height := uint32(i + 1)
+		if indexed := store.ReadBlockByHeight(height); indexed == nil || indexed.Hash != b.Hash {
+			t.Errorf("Block at height %v was removed.\n", height)
+		}
+
+		pruned := height <= 3
+		for _, txHash := range b.FundsTxData {
+			if (store.ReadClosedTx(txHash) == nil) != pruned || store.IsPruned(txHash) != pruned {
+				t.Errorf("Tx %x at height %v: expected pruned = %v\n", txHash[0:8], height, pruned)
+			}
+			if store.ReadTxLocation(txHash) == nil {
+				t.Errorf("Location of tx %x at height %v was removed.\n", txHash[0:8], height)
+			}
+		}
+		if (store.ReadUndo(b.Hash) == nil) != pruned {
+			t.Errorf("Undo data at height %v: expected pruned = %v\n", height, pruned)
+		}
+	}
+
+	//Competing chain that forks off below the pruned height: genesis <- blocks[0..1] <- c[0..3]
+	var competing []*protocol.Block
+	prevHash = blocks[1].Hash
+	setTip(blocks[1])
+	for cnt := 0; cnt < 4; cnt++ {
+		c := newBlock(prevHash)
+		if err := finalizeBlock(c); err != nil {
+			t.Fatalf("Competing block could not be mined: %v\n", err)
+		}
+		store.WriteOpenBlock(c)
+		competing = append(competing, c)
+		prevHash = c.Hash
+		setTip(c)
+	}
+	setTip(blocks[4])
+
+	if err := validateBlock(competing[len(competing)-1]); err == nil || !strings.Contains(err.Error(), "pruned") {
+		t.Error("Rollback beyond the pruned height was accepted.\n")
+	}
+	if lastBlock.Hash != blocks[4].Hash {
+		t.Error("Chain was changed by a rejected rollback.\n")
+	}
+
+	//Rolling back the unpruned blocks is still possible
+	setTip(blocks[2])
+	c := newBlock(blocks[2].Hash)
+	finalizeBlock(c)
+	store.WriteOpenBlock(c)
+
+	setTip(c)
+	c2 := newBlock(c.Hash)
+	finalizeBlock(c2)
+	store.WriteOpenBlock(c2)
+
+	setTip(c2)
+	c3 := newBlock(c2.Hash)
+	finalizeBlock(c3)
+
+	setTip(blocks[4])
+
+	if err := validateBlock(c3); err != nil {
+		t.Errorf("Rollback within the prune depth failed: %v\n", err)
+	}
+}
+
+//Pruned nodes don't have the payloads of old txs anymore, a block that includes one of them again is still rejected
+func TestPrunedTxReplay(t *testing.T) {
+
+	cleanAndPrepare()
+	pruneDepth = 1
+	defer func() { pruneDepth = 0 }()
+
+	tx, _ := protocol.ConstrConfigTx(0, protocol.FEE_MINIMUM_ID, 1, 1, 0, &RootPrivKey)
+	b := newBlock(lastBlock.Hash)
+	if err := addTx(b, tx, store.State().Snapshot()); err != nil {
+		t.Fatalf("ConfigTx could not be added: %v\n", err)
+	}
+	store.WriteOpenTx(tx)
+	finalizeBlock(b)
+	if err := validateBlock(b); err != nil {
+		t.Fatalf("Block validation failed: %v\n", err)
+	}
+
+	b2 := newBlock(lastBlock.Hash)
+	finalizeBlock(b2)
+	if err := validateBlock(b2); err != nil {
+		t.Fatalf("Block validation failed: %v\n", err)
+	}
+	if store.ReadClosedTx(tx.Hash()) != nil || !store.IsPruned(tx.Hash()) {
+		t.Fatal("ConfigTx was not pruned.\n")
+	}
+
+	replay := newBlock(lastBlock.Hash)
+	replay.ConfigTxData = append(replay.ConfigTxData, tx.Hash())
+	store.WriteOpenTx(tx)
+	finalizeBlock(replay)
+	if err := validateBlock(replay); err == nil {
+		t.Error("Block that replays a pruned tx was accepted.\n")
+	}
+}
+
+//Chain states written before the version record existed have the target history as leading zero bits and parameter
+//entries without the difficulty algorithm
+func TestChainStateUpgrade(t *testing.T) {
+
+	cleanAndPrepare()
+
+	parameterSlice = append(parameterSlice, parameters{[32]byte{1}, 2, 3, 4, 5, 6, protocol.DIFF_ALGORITHM_INTERVAL})
+	paramsBefore := make([]parameters, len(parameterSlice))
+	copy(paramsBefore, parameterSlice)
+
+	var legacyParams []byte
+	for _, param := range parameterSlice {
+		legacyParams = append(legacyParams, encodeParameters([]parameters{param})[:72]...)
+	}
+
+	batch := storage.NewBatch()
+	persistChainState(batch)
+	batch.WriteChainState(PARAMETERS_KEY, legacyParams)
+	batch.WriteChainState(TARGET_KEY, []byte{8, 10})
+	batch.WriteChainState(CHAINSTATEVERSION_KEY, nil)
+	store.Commit(batch)
+
+	parameterSlice, target = nil, nil
+	if !restoreChainState() {
+		t.Fatal("Chain state could not be restored.\n")
+	}
+	if !reflect.DeepEqual(target, []uint32{targetFromZeroBits(8), targetFromZeroBits(10)}) {
+		t.Errorf("Target history was not upgraded: %x\n", target)
+	}
+	if !reflect.DeepEqual(parameterSlice, paramsBefore) {
+		t.Errorf("Parameter history was not upgraded: %v\n", parameterSlice)
+	}
+
+	//Parameter entries of an unknown size can't be converted
+	batch = storage.NewBatch()
+	batch.WriteChainState(PARAMETERS_KEY, legacyParams[:100])
+	store.Commit(batch)
+	if restoreChainState() {
+		t.Error("Chain state with broken parameter entries was restored.\n")
+	}
+
+	//Chain states of a newer version are refused
+	batch = storage.NewBatch()
+	batch.WriteChainState(CHAINSTATEVERSION_KEY, encodeChainStateVersion(chainStateVersion()+1))
+	store.Commit(batch)
+	if restoreChainState() {
+		t.Error("Chain state of a newer version was restored.\n")
+	}
+}
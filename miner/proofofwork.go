@@ -1,13 +1,39 @@
 package miner
 
 import (
+	"context"
 	"errors"
 	"golang.org/x/crypto/sha3"
 	"encoding/binary"
+	"math/big"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-//Tests whether the first diff bits are zero
-func validateProofOfWork(diff uint8, hash [32]byte) bool {
+var (
+	//Number of goroutines that search for a nonce concurrently
+	powWorkers = runtime.NumCPU()
+
+	//Cancelled as soon as the chain tip changes, the PoW for a block on top of the old tip is worthless
+	tipLock   = &sync.Mutex{}
+	tipHash   [32]byte
+	tipCtx    context.Context
+	tipCancel context.CancelFunc
+)
+
+//Decides whether a hash is a valid PoW
+type powCheck func(hash [32]byte) bool
+
+//Tests whether the hash, read as a big endian number, is at most the target
+func validateProofOfWork(target *big.Int, hash [32]byte) bool {
+	return new(big.Int).SetBytes(hash[:]).Cmp(target) <= 0
+}
+
+//Tests whether the first diff bits are zero. This is how blocks below the target fork height are checked. The bits
+//check looks at the byte after the one it should look at, this can't be fixed without invalidating these blocks
+func validateLegacyProofOfWork(diff uint8, hash [32]byte) bool {
 	var byteNr uint8
 	//Bytes check
 	for byteNr = 0; byteNr < (uint8)(diff/8); byteNr++ {
@@ -15,54 +41,133 @@ func validateProofOfWork(diff uint8, hash [32]byte) bool {
 			return false
 		}
 	}
-	//Bits check
-	if diff%8 != 0 && hash[byteNr+1] >= 1<<(8-diff%8) {
+	//Bits check, the byte after the last one doesn't exist for the highest difficulties
+	if diff%8 != 0 && (int(byteNr)+1 >= len(hash) || hash[byteNr+1] >= 1<<(8-diff%8)) {
 		return false
 	}
 	return true
 }
 
-//diff and partialHash is needed to calculate a valid PoW, prevHash is needed to check whether we should stop
+func targetPoW(target *big.Int) powCheck {
+	return func(hash [32]byte) bool { return validateProofOfWork(target, hash) }
+}
+
+//The target history of the blocks below the fork height only contains targets created by targetFromZeroBits
+func legacyPoW(compact uint32) powCheck {
+	diff := zeroBits(compact)
+	return func(hash [32]byte) bool { return validateLegacyProofOfWork(diff, hash) }
+}
+
+//Called whenever lastBlock changes (during block validation, rollbacks and when the chain state is restored)
+func newTip(hash [32]byte) {
+
+	tipLock.Lock()
+	defer tipLock.Unlock()
+
+	if tipCancel != nil {
+		tipCancel()
+	}
+	tipHash = hash
+	tipCtx, tipCancel = context.WithCancel(context.Background())
+}
+
+//Returns a context that is cancelled once a block on top of prevHash is useless. If prevHash isn't the tip anymore,
+//the context is cancelled already
+func tipContext(prevHash [32]byte) context.Context {
+
+	tipLock.Lock()
+	defer tipLock.Unlock()
+
+	if tipCtx == nil || prevHash != tipHash {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		return ctx
+	}
+
+	return tipCtx
+}
+
+//valid and partialHash is needed to calculate a valid PoW, prevHash is needed to check whether we should stop
 //PoW calculation because another block has been validated meanwhile
-func proofOfWork(diff uint8, partialHash, prevHash [32]byte) ([8]byte, error) {
+func proofOfWork(valid powCheck, partialHash, prevHash [32]byte) ([8]byte, error) {
 
-	var (
-		pow [32]byte
-		byteNr uint8
-		abort bool
+	start := time.Now()
+	nonce, hashes, err := searchNonce(tipContext(prevHash), powWorkers, valid, partialHash)
 
-		cntBuf [8]byte
-		cnt uint64
-	)
+	elapsed := time.Since(start)
+	if elapsed > 0 {
+		logger.Printf("PoW: %v hashes in %v with %v workers (%.0f H/s)\n", hashes, elapsed, powWorkers, float64(hashes)/elapsed.Seconds())
+	}
 
-	//2^64-1 = 18446744073709551615
-	for cnt = 0; cnt < 18446744073709551615; cnt++ {
-		//lastBlock is a global variable which points to the last block. This check makes sure we abort if another
-		//block has been validated
+	return nonce, err
+}
 
-		if prevHash != lastBlock.Hash {
-			return [8]byte{}, errors.New("Abort mining, another block has been successfully validated in the meantime")
-		}
-		abort = false
-
-		binary.BigEndian.PutUint64(cntBuf[:], cnt)
-		pow = sha3.Sum256(append(cntBuf[:], partialHash[:]...))
-		//Byte check
-		for byteNr = 0; byteNr < (uint8)(diff/8); byteNr++ {
-			if pow[byteNr] != 0 {
-				abort = true
-				break
+//The nonce space is split between the workers, worker i tries i, i+workers, i+2*workers etc. The first worker that
+//finds a valid nonce stops the others, as does cancelling ctx. Returns the number of hashes calculated by all workers
+func searchNonce(ctx context.Context, workers int, valid powCheck, partialHash [32]byte) (nonce [8]byte, hashes uint64, err error) {
+
+	if workers < 1 {
+		workers = 1
+	}
+	if ctx.Err() != nil {
+		return [8]byte{}, 0, errors.New("Abort mining, another block has been successfully validated in the meantime")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	found := make(chan [8]byte, 1)
+	var wg sync.WaitGroup
+	for worker := 0; worker < workers; worker++ {
+		wg.Add(1)
+		go func(first uint64) {
+			defer wg.Done()
+			if nonce, ok := powWorker(ctx, first, uint64(workers), valid, partialHash, &hashes); ok {
+				//Only the first nonce is taken, the others are discarded
+				select {
+				case found <- nonce:
+					cancel()
+				default:
+				}
 			}
+		}(uint64(worker))
+	}
+	wg.Wait()
+
+	select {
+	case nonce = <-found:
+		return nonce, hashes, nil
+	default:
+		return [8]byte{}, hashes, errors.New("Abort mining, another block has been successfully validated in the meantime")
+	}
+}
+
+//Checks for cancellation every POW_BATCHSIZE hashes, the hash counter is updated at the same time
+func powWorker(ctx context.Context, first, step uint64, valid powCheck, partialHash [32]byte, hashes *uint64) (nonce [8]byte, ok bool) {
+
+	var batch uint64
+	defer func() { atomic.AddUint64(hashes, batch) }()
+
+	for cnt := first; ; cnt += step {
+		binary.BigEndian.PutUint64(nonce[:], cnt)
+		batch++
+		if valid(sha3.Sum256(append(nonce[:], partialHash[:]...))) {
+			return nonce, true
 		}
-		if abort {
-			continue
+
+		//The nonce space of this worker is exhausted
+		if cnt > ^uint64(0)-step {
+			return nonce, false
 		}
-		//Bit check
-		if diff%8 != 0 && pow[byteNr+1] >= 1<<(8-diff%8) {
-			continue
+
+		if batch == POW_BATCHSIZE {
+			atomic.AddUint64(hashes, batch)
+			batch = 0
+			select {
+			case <-ctx.Done():
+				return nonce, false
+			default:
+			}
 		}
-		break
 	}
-
-	return cntBuf, nil
 }
@@ -1,11 +1,14 @@
 package miner
 
 import (
+	"context"
 	"testing"
 	"fmt"
 	"time"
 	"math/rand"
 	"golang.org/x/crypto/sha3"
+	"github.com/lisgie/bazo_miner/protocol"
+	"math/big"
 )
 
 func TestProofOfWork(t *testing.T) {
@@ -15,15 +18,66 @@ func TestProofOfWork(t *testing.T) {
 
 	//Calculate random partial hash
 	partialHash := serializeHashContent(rand.Uint32())
-	diff := 10
+	target := protocol.CompactToTarget(targetFromZeroBits(10))
 
-	nonce,_ := proofOfWork(uint8(diff), partialHash, [32]byte{})
+	nonce,_ := proofOfWork(targetPoW(target), partialHash, [32]byte{})
 
-	if !validateProofOfWork(uint8(diff),sha3.Sum256(append(nonce[:], partialHash[:]...))) {
+	if !validateProofOfWork(target,sha3.Sum256(append(nonce[:], partialHash[:]...))) {
 		fmt.Printf("Invalid PoW calculation\n")
 	}
 }
 
+func TestProofOfWorkWorkers(t *testing.T) {
+
+	partialHash := serializeHashContent(uint32(42))
+
+	target := protocol.CompactToTarget(targetFromZeroBits(12))
+
+	//Every worker count finds a valid nonce
+	for _, workers := range []int{1, 3, 8} {
+		nonce, hashes, err := searchNonce(context.Background(), workers, targetPoW(target), partialHash)
+		if err != nil || hashes == 0 {
+			t.Errorf("No nonce found with %v workers: %v\n", workers, err)
+		}
+		if !validateProofOfWork(target, sha3.Sum256(append(nonce[:], partialHash[:]...))) {
+			t.Errorf("Invalid nonce found with %v workers\n", workers)
+		}
+	}
+
+	//An unreachable target only stops when the context is cancelled
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, hashes, err := searchNonce(ctx, 4, targetPoW(big.NewInt(0)), partialHash); err == nil || hashes == 0 {
+		t.Errorf("PoW was not cancelled (%v hashes)\n", hashes)
+	}
+}
+
+//A new tip cancels the PoW on top of the old one
+func TestProofOfWorkNewTip(t *testing.T) {
+
+	newTip([32]byte{1})
+	ctx := tipContext([32]byte{1})
+	if ctx.Err() != nil || tipContext([32]byte{2}).Err() == nil {
+		t.Error("Context of the tip is cancelled or context of another block is not.\n")
+	}
+
+	errChan := make(chan error)
+	go func() {
+		_, err := proofOfWork(targetPoW(big.NewInt(0)), [32]byte{}, [32]byte{1})
+		errChan <- err
+	}()
+
+	newTip([32]byte{2})
+	select {
+	case err := <-errChan:
+		if err == nil || ctx.Err() == nil {
+			t.Error("PoW on top of the old tip was not aborted.\n")
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("PoW on top of the old tip is still running.\n")
+	}
+}
+
 func TestValidateProofOfWork(t *testing.T) {
 
 	var hash [32]byte
@@ -36,11 +90,48 @@ func TestValidateProofOfWork(t *testing.T) {
 	}
 
 	//First 8*8+2 bits are set to 0
-	if !validateProofOfWork(8*8+2, hash) {
+	if !validateProofOfWork(new(big.Int).Rsh(protocol.MaxTarget, 8*8+2), hash) {
+		t.Error("Invalid PoW validation")
+	}
+
+	if validateProofOfWork(new(big.Int).Rsh(protocol.MaxTarget, 8*8+3), hash) {
+		t.Error("Invalid PoW validation")
+	}
+
+	//A hash equal to the target is valid, it is not for the next smaller target
+	target := new(big.Int).SetBytes(hash[:])
+	if !validateProofOfWork(target, hash) || validateProofOfWork(target.Sub(target, big.NewInt(1)), hash) {
+		t.Error("Invalid PoW validation at the target boundary")
+	}
+}
+func TestValidateLegacyProofOfWork(t *testing.T) {
+
+	var hash [32]byte
+
+	for cnt := 0; cnt < 32; cnt++ {
+		if cnt >= 8 {
+			//0x3f == 0011 1111
+			hash[cnt] = 0x3f
+		}
+	}
+
+	//First 8*8+2 bits are set to 0
+	if !validateLegacyProofOfWork(8*8+2, hash) {
 		t.Error("Invalid PoW validation")
 	}
 
-	if validateProofOfWork(8*8+3, hash) {
+	if validateLegacyProofOfWork(8*8+3, hash) {
 		t.Error("Invalid PoW validation")
 	}
-}
\ No newline at end of file
+
+	//The difficulty comes from the target history
+	if !legacyPoW(targetFromZeroBits(8*8+2))(hash) || legacyPoW(targetFromZeroBits(8*8+3))(hash) {
+		t.Error("Invalid PoW validation for a target of the history")
+	}
+
+	//The bits are checked in the byte after the zero bytes. Blocks below the fork height rely on this
+	hash[8], hash[9] = 0xff, 0
+	if !validateLegacyProofOfWork(8*8+2, hash) {
+		t.Error("Legacy PoW validation changed")
+	}
+}
@@ -0,0 +1,424 @@
+package miner
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/lisgie/bazo_miner/protocol"
+	"github.com/lisgie/bazo_miner/storage"
+	"golang.org/x/crypto/sha3"
+	"io"
+	"math/big"
+	"sort"
+)
+
+//Every snapshotInterval blocks, the block commits to the state it is built on (accounts, root keys, system
+//parameters and difficulty history after its predecessor). The committed snapshot is stored together with the block
+//and served to other miners, which can then start from the snapshot instead of replaying the whole chain.
+
+//Everything the miner keeps in memory about the chain
+type chainState struct {
+	parameters        []parameters
+	target            []uint32
+	targetTimes       []timerange
+	currentTargetTime timerange
+	globalBlockCount  int64
+	localBlockCount   int64
+	lastBlock         *protocol.Block
+	//Stats of the last blocks up to lastBlock, the LWMA algorithm needs them for the next blocks
+	blockStats        []blockStat
+	accounts          map[[32]byte]*protocol.Account
+	rootKeys          map[[32]byte]*protocol.Account
+}
+
+func saveChainState() (cs chainState) {
+
+	cs.parameters = make([]parameters, len(parameterSlice))
+	copy(cs.parameters, parameterSlice)
+	cs.target = make([]uint32, len(target))
+	copy(cs.target, target)
+	cs.targetTimes = make([]timerange, len(targetTimes))
+	copy(cs.targetTimes, targetTimes)
+	cs.currentTargetTime = *currentTargetTime
+	cs.globalBlockCount = globalBlockCount
+	cs.localBlockCount = localBlockCount
+	cs.lastBlock = lastBlock
+	cs.blockStats = recentBlockStats(lastBlock, globalBlockCount, LWMA_WINDOW+1)
+	cs.accounts = make(map[[32]byte]*protocol.Account)
+	for hash, acc := range store.State().Accounts() {
+		accCopy := *acc
+		cs.accounts[hash] = &accCopy
+	}
+	cs.rootKeys = make(map[[32]byte]*protocol.Account)
+	for hash, acc := range store.State().RootKeys() {
+		accCopy := *acc
+		cs.rootKeys[hash] = &accCopy
+	}
+
+	return cs
+}
+
+//Replaces the in-memory chain state and the state, nothing is written to disk
+func loadChainState(cs *chainState) {
+
+	parameterSlice = cs.parameters
+	activeParameters = &parameterSlice[len(parameterSlice)-1]
+	target = cs.target
+	targetTimes = cs.targetTimes
+	currentTargetTime = new(timerange)
+	*currentTargetTime = cs.currentTargetTime
+	globalBlockCount = cs.globalBlockCount
+	localBlockCount = cs.localBlockCount
+	lastBlock = cs.lastBlock
+
+	store.State().Reset()
+	for hash, acc := range cs.accounts {
+		store.State().SetAccount(hash, acc)
+	}
+	//Root accounts that are part of the state share the same pointer
+	for hash, acc := range cs.rootKeys {
+		if stateAcc := store.State().GetAccount(hash); stateAcc != nil {
+			acc = stateAcc
+		}
+		store.State().SetRootKey(hash, acc)
+	}
+}
+
+//Accounts and root keys are sorted by hash, every miner gets the same encoding for the same state:
+//block counts (16) | last block | parameters | targets | timeranges | block stats | accounts | root keys
+//All variable-sized parts are prefixed with their length (4), accounts and root keys with their number (4)
+func (cs *chainState) encode() []byte {
+
+	var buf bytes.Buffer
+
+	binary.Write(&buf, binary.BigEndian, cs.globalBlockCount)
+	binary.Write(&buf, binary.BigEndian, cs.localBlockCount)
+	writeSnapshotField(&buf, cs.lastBlock.Encode())
+	writeSnapshotField(&buf, encodeParameters(cs.parameters))
+	writeSnapshotField(&buf, encodeTargets(cs.target))
+	writeSnapshotField(&buf, encodeTimeranges(append(cs.targetTimes[:len(cs.targetTimes):len(cs.targetTimes)], cs.currentTargetTime)))
+	writeSnapshotField(&buf, encodeBlockStats(cs.blockStats))
+	writeSnapshotAccounts(&buf, cs.accounts)
+	writeSnapshotAccounts(&buf, cs.rootKeys)
+
+	return buf.Bytes()
+}
+
+func decodeChainState(encoded []byte) (*chainState, error) {
+
+	cs := new(chainState)
+	r := bytes.NewReader(encoded)
+
+	if err := binary.Read(r, binary.BigEndian, &cs.globalBlockCount); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &cs.localBlockCount); err != nil {
+		return nil, err
+	}
+
+	var encodedBlock, encodedParameters, encodedTargets, encodedTimeranges, encodedStats []byte
+	for _, field := range []*[]byte{&encodedBlock, &encodedParameters, &encodedTargets, &encodedTimeranges, &encodedStats} {
+		var err error
+		if *field, err = readSnapshotField(r); err != nil {
+			return nil, err
+		}
+	}
+
+	if cs.lastBlock = cs.lastBlock.Decode(encodedBlock); cs.lastBlock == nil {
+		return nil, errors.New("Last block of the snapshot could not be decoded.")
+	}
+	cs.parameters = decodeParameters(encodedParameters)
+	cs.target = decodeTargets(encodedTargets)
+	timeranges := decodeTimeranges(encodedTimeranges)
+	if len(cs.parameters) == 0 || len(cs.target) == 0 || len(timeranges) == 0 {
+		return nil, errors.New("Snapshot lacks system parameters or difficulty history.")
+	}
+	cs.targetTimes = timeranges[:len(timeranges)-1]
+	cs.currentTargetTime = timeranges[len(timeranges)-1]
+	if cs.blockStats = decodeBlockStats(encodedStats); len(encodedStats)%BLOCKSTAT_SIZE != 0 {
+		return nil, errors.New("Snapshot has malformed block stats.")
+	}
+
+	var err error
+	if cs.accounts, err = readSnapshotAccounts(r); err != nil {
+		return nil, err
+	}
+	if cs.rootKeys, err = readSnapshotAccounts(r); err != nil {
+		return nil, err
+	}
+
+	if r.Len() != 0 {
+		return nil, errors.New("Snapshot has trailing data.")
+	}
+
+	return cs, nil
+}
+
+func writeSnapshotField(buf *bytes.Buffer, field []byte) {
+
+	binary.Write(buf, binary.BigEndian, uint32(len(field)))
+	buf.Write(field)
+}
+
+func readSnapshotField(r *bytes.Reader) (field []byte, err error) {
+
+	var length uint32
+	if err = binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	if int64(length) > int64(r.Len()) {
+		return nil, errors.New("Snapshot is truncated.")
+	}
+
+	field = make([]byte, length)
+	_, err = io.ReadFull(r, field)
+
+	return field, err
+}
+
+func writeSnapshotAccounts(buf *bytes.Buffer, accounts map[[32]byte]*protocol.Account) {
+
+	var hashes [][32]byte
+	for hash := range accounts {
+		hashes = append(hashes, hash)
+	}
+	sort.Slice(hashes, func(i, j int) bool { return bytes.Compare(hashes[i][:], hashes[j][:]) < 0 })
+
+	binary.Write(buf, binary.BigEndian, uint32(len(hashes)))
+	for _, hash := range hashes {
+		buf.Write(hash[:])
+		buf.Write(accounts[hash].Encode())
+	}
+}
+
+func readSnapshotAccounts(r *bytes.Reader) (accounts map[[32]byte]*protocol.Account, err error) {
+
+	var nrAccounts uint32
+	if err = binary.Read(r, binary.BigEndian, &nrAccounts); err != nil {
+		return nil, err
+	}
+	if int64(nrAccounts)*(32+protocol.ACC_SIZE) > int64(r.Len()) {
+		return nil, errors.New("Snapshot is truncated.")
+	}
+
+	accounts = make(map[[32]byte]*protocol.Account)
+	encodedAcc := make([]byte, protocol.ACC_SIZE)
+	for cnt := uint32(0); cnt < nrAccounts; cnt++ {
+		var hash [32]byte
+		var acc *protocol.Account
+		io.ReadFull(r, hash[:])
+		io.ReadFull(r, encodedAcc)
+		if acc = acc.Decode(encodedAcc); acc == nil {
+			return nil, errors.New("Account of the snapshot could not be decoded.")
+		}
+		accounts[hash] = acc
+	}
+
+	return accounts, nil
+}
+
+func isSnapshotHeight(height int64) bool {
+	return height > 0 && height%snapshotInterval == 0
+}
+
+//Blocks at snapshot heights commit to the state they are built on. Needs to be called while blockValidation is held
+//and lastBlock is the block's predecessor
+func addStateCommitment(b *protocol.Block) {
+
+	if !isSnapshotHeight(globalBlockCount + 1) {
+		return
+	}
+
+	cs := saveChainState()
+	b.Header |= protocol.BLOCKFLAG_STATECOMMITMENT
+	b.StateCommitment = sha3.Sum256(cs.encode())
+}
+
+//Called right before the state change of the block, the state is the one the block is built on. Returns the encoded
+//snapshot if the block commits to one
+func verifyStateCommitment(b *protocol.Block) (snapshot []byte, err error) {
+
+	if !isSnapshotHeight(globalBlockCount + 1) {
+		if b.HasStateCommitment() {
+			return nil, errors.New("Block commits to a state, but is not at a snapshot height.")
+		}
+		return nil, nil
+	}
+
+	if !b.HasStateCommitment() {
+		return nil, errors.New("State commitment missing.")
+	}
+
+	cs := saveChainState()
+	snapshot = cs.encode()
+	if sha3.Sum256(snapshot) != b.StateCommitment {
+		return nil, errors.New("State commitment incorrect.")
+	}
+
+	return snapshot, nil
+}
+
+//Snapshots are written together with the block that commits to them. The previous snapshot is kept as well, in case
+//the latest one is rolled back
+func persistSnapshot(batch *storage.Batch, data blockData, height uint32) {
+
+	if data.snapshot == nil {
+		return
+	}
+
+	batch.WriteSnapshot(height-1, data.snapshot)
+	if older := int64(height-1) - 2*snapshotInterval; older >= 0 {
+		batch.DeleteSnapshot(uint32(older))
+	}
+}
+
+func deleteSnapshot(batch *storage.Batch, data blockData, height uint32) {
+
+	if data.block.HasStateCommitment() {
+		batch.DeleteSnapshot(height - 1)
+	}
+}
+
+//Returns the block with the given hash, nil if it is not available
+type blockFetcher func(hash [32]byte) *protocol.Block
+
+//A snapshot of another miner that has been checked against the chain of its committing block
+type verifiedSnapshot struct {
+	block    *protocol.Block
+	snapshot []byte
+	cs       *chainState
+	//Cumulative work up to the last block of the snapshot
+	work     *big.Int
+}
+
+//Verifies a snapshot received from another miner against the block that commits to it and makes it the starting
+//point of this miner
+func applySnapshot(block *protocol.Block, snapshot []byte, fetch blockFetcher) error {
+
+	verified, err := verifySnapshot(block, snapshot, fetch)
+	if err != nil {
+		return err
+	}
+
+	return loadSnapshot(verified)
+}
+
+//The snapshot is as trustworthy as the work that went into the chain of the committing block, the headers of the
+//whole chain are fetched and checked down to the genesis block. Nothing is changed locally
+func verifySnapshot(block *protocol.Block, snapshot []byte, fetch blockFetcher) (*verifiedSnapshot, error) {
+
+	if !block.HasStateCommitment() || sha3.Sum256(snapshot) != block.StateCommitment {
+		return nil, errors.New("Snapshot does not match the commitment of the block.")
+	}
+
+	cs, err := decodeChainState(snapshot)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Snapshot could not be decoded: %v", err))
+	}
+	if cs.lastBlock.Hash != block.PrevHash || !isSnapshotHeight(cs.globalBlockCount+1) {
+		return nil, errors.New("Snapshot is not the state the block is built on.")
+	}
+
+	//The difficulty history decides the targets of the blocks after the snapshot
+	for _, compact := range cs.target {
+		if protocol.CompactToTarget(compact).Cmp(protocol.CompactToTarget(genesisTarget)) > 0 {
+			return nil, errors.New(fmt.Sprintf("Snapshot has a target above the genesis target: %x", compact))
+		}
+	}
+	if block.HasTarget() && block.Target != cs.target[len(cs.target)-1] {
+		return nil, errors.New("Target of the committing block does not match the snapshot.")
+	}
+
+	work, err := verifyHeaderChain(block, cs, fetch)
+	if err != nil {
+		return nil, errors.New(fmt.Sprintf("Chain of the committing block is invalid: %v", err))
+	}
+
+	return &verifiedSnapshot{block, snapshot, cs, work}, nil
+}
+
+//Makes a verified snapshot the starting point of this miner
+func loadSnapshot(verified *verifiedSnapshot) error {
+
+	cs, snapshot := verified.cs, verified.snapshot
+	loadChainState(cs)
+
+	//Blocks and txs below the snapshot are not available, to the rest of the miner this looks like a pruned node
+	height := uint32(globalBlockCount)
+	batch := storage.NewBatch()
+	batch.WriteClosedBlock(lastBlock)
+	batch.WriteChainWork(lastBlock.Hash, verified.work)
+	for hash := range cs.accounts {
+		persistAccount(batch, hash)
+	}
+	for hash := range cs.rootKeys {
+		persistAccount(batch, hash)
+	}
+	persistChainState(batch)
+	batch.WriteChainState(SNAPSHOTSTATS_KEY, encodeBlockStats(cs.blockStats))
+	batch.WritePrunedHeight(height)
+	batch.WriteSnapshot(height, snapshot)
+
+	return store.Commit(batch)
+}
+
+//Walks from the committing block back to the genesis block. Every block needs a correct PoW for a target that is not
+//easier than the genesis target, and the block stats of the snapshot need to match the headers. Blocks below the
+//target fork height are checked against the target history of the snapshot. Returns the cumulative work up to the
+//last block of the snapshot
+func verifyHeaderChain(block *protocol.Block, cs *chainState, fetch blockFetcher) (*big.Int, error) {
+
+	stats := make(map[uint32]blockStat)
+	for _, stat := range cs.blockStats {
+		stats[stat.height] = stat
+	}
+
+	work := big.NewInt(0)
+	maxTarget := protocol.CompactToTarget(genesisTarget)
+	b, matchedStats := block, 0
+	for height := cs.globalBlockCount + 1; height > 0; height-- {
+		blockTarget, valid := b.Target, targetPoW(protocol.CompactToTarget(b.Target))
+		if height < targetForkHeight {
+			if b.HasTarget() {
+				return nil, errors.New(fmt.Sprintf("Block at height %v is below the target fork height and carries a target.", height))
+			}
+			blockTarget = legacyTarget(cs.target, cs.parameters[len(cs.parameters)-1].diff_interval, height)
+			valid = legacyPoW(blockTarget)
+		} else if !b.HasTarget() || protocol.CompactToTarget(b.Target).Cmp(maxTarget) > 0 {
+			return nil, errors.New(fmt.Sprintf("Block at height %v has no valid target.", height))
+		}
+		partialHash := b.HashBlock()
+		if b.Hash != sha3.Sum256(append(b.Nonce[:], partialHash[:]...)) || !valid(b.Hash) {
+			return nil, errors.New(fmt.Sprintf("Proof of work of the block at height %v is incorrect.", height))
+		}
+
+		if stat, exists := stats[uint32(height)]; exists {
+			if stat.target != b.Target || stat.timestamp != b.Timestamp {
+				return nil, errors.New(fmt.Sprintf("Block stats of the snapshot don't match the block at height %v.", height))
+			}
+			matchedStats++
+		}
+		if b != block {
+			work.Add(work, blockWork(blockTarget))
+		}
+
+		//The genesis block is the same for every miner, its hash is 0
+		if height == 1 {
+			if b.PrevHash != [32]byte{} {
+				return nil, errors.New("Chain does not start at the genesis block.")
+			}
+			break
+		}
+		prevHash := b.PrevHash
+		if b = fetch(prevHash); b == nil || b.Hash != prevHash {
+			return nil, errors.New(fmt.Sprintf("Block at height %v could not be fetched.", height-1))
+		}
+	}
+
+	if matchedStats != len(cs.blockStats) {
+		return nil, errors.New("Snapshot has block stats of blocks that are not part of the chain.")
+	}
+
+	return work, nil
+}
@@ -0,0 +1,207 @@
+package miner
+
+import (
+	"bytes"
+	"errors"
+	"github.com/lisgie/bazo_miner/p2p"
+	"github.com/lisgie/bazo_miner/protocol"
+	"github.com/lisgie/bazo_miner/storage"
+	"testing"
+)
+
+//Blocks at snapshot heights commit to the state, a new miner can start from the committed snapshot
+func TestStateSnapshot(t *testing.T) {
+
+	testStore := store
+	defer func() { store = testStore }()
+	cleanAndPrepare()
+	snapshotInterval = 3
+	defer func() { snapshotInterval = SNAPSHOT_INTERVAL }()
+	//The headers of the blocks below the fork height are checked against the target history of the snapshot
+	targetForkHeight = 4
+	defer func() { targetForkHeight = 1 }()
+
+	var blocks []*protocol.Block
+	var afterFive chainState
+	prevHash := [32]byte{}
+	for cnt := 0; cnt < 7; cnt++ {
+		b := newBlock(prevHash)
+		addStateCommitment(b)
+		createBlockWithTxs(b)
+		finalizeBlock(b)
+		if err := validateBlock(b); err != nil {
+			t.Fatalf("Block validation failed: %v\n", err)
+		}
+		blocks = append(blocks, b)
+		prevHash = b.Hash
+		if cnt == 4 {
+			afterFive = saveChainState()
+		}
+	}
+	final := saveChainState()
+
+	for i, b := range blocks {
+		if b.HasStateCommitment() != ((i+1)%3 == 0) {
+			t.Errorf("Block at height %v: wrong commitment flag.\n", i+1)
+		}
+	}
+	if height, snapshot := store.ReadLatestSnapshot(); height != 5 || snapshot == nil {
+		t.Errorf("Wrong latest snapshot at height %v.\n", height)
+	}
+	if store.ReadSnapshot(2) == nil {
+		t.Error("Previous snapshot was not kept.\n")
+	}
+
+	//Encoding is deterministic
+	snapshot := store.ReadSnapshot(5)
+	if cs, err := decodeChainState(snapshot); err != nil || !bytes.Equal(cs.encode(), snapshot) {
+		t.Errorf("Snapshot could not be decoded: %v\n", err)
+	}
+
+	//Commitments are only allowed (and required) at snapshot heights
+	b := newBlock(lastBlock.Hash)
+	b.Header |= protocol.BLOCKFLAG_STATECOMMITMENT
+	finalizeBlock(b)
+	if err := validateBlock(b); err == nil {
+		t.Error("Block with a commitment at a regular height was accepted.\n")
+	}
+
+	//Start a new miner from the snapshot at height 5, committed to by the block at height 6
+	store = storage.NewMemStorage()
+	if err := applySnapshot(blocks[5], append(snapshot[:len(snapshot)-1:len(snapshot)-1], snapshot[len(snapshot)-1]^1), testStore.ReadClosedBlock); err == nil {
+		t.Error("Tampered snapshot was accepted.\n")
+	}
+	//The chain of the committing block needs to be available down to the genesis block
+	if err := applySnapshot(blocks[5], snapshot, func(hash [32]byte) *protocol.Block {
+		if hash == blocks[1].Hash {
+			return nil
+		}
+		return testStore.ReadClosedBlock(hash)
+	}); err == nil {
+		t.Error("Snapshot without the headers of its chain was accepted.\n")
+	}
+	//Blocks with targets easier than the genesis target cost next to nothing
+	genesisTarget = targetFromZeroBits(12)
+	err := applySnapshot(blocks[5], snapshot, testStore.ReadClosedBlock)
+	genesisTarget = targetFromZeroBits(8)
+	if err == nil {
+		t.Error("Snapshot with targets above the genesis target was accepted.\n")
+	}
+	if err := applySnapshot(blocks[5], snapshot, testStore.ReadClosedBlock); err != nil {
+		t.Fatalf("Snapshot could not be applied: %v\n", err)
+	}
+	if work := chainWork(blocks[4].Hash); work.Cmp(testStore.ReadChainWork(blocks[4].Hash)) != 0 {
+		t.Errorf("Wrong cumulative work of the snapshot: %v\n", work)
+	}
+	if err := compareChainState(afterFive, saveChainState()); err != nil {
+		t.Errorf("Applied snapshot differs: %v\n", err)
+	}
+	if store.ReadPrunedHeight() != 5 || store.ReadSnapshot(5) == nil {
+		t.Error("Snapshot miner is not marked as pruned or doesn't serve the snapshot.\n")
+	}
+
+	//The subsequent blocks are validated the regular way
+	for _, b := range blocks[5:] {
+		for _, txHashes := range [][][32]byte{b.AccTxData, b.FundsTxData, b.ConfigTxData} {
+			for _, txHash := range txHashes {
+				store.WriteOpenTx(testStore.ReadClosedTx(txHash))
+			}
+		}
+		if err := validateBlock(b); err != nil {
+			t.Errorf("Block validation after snapshot failed: %v\n", err)
+		}
+	}
+	if err := compareChainState(final, saveChainState()); err != nil {
+		t.Errorf("State after snapshot and blocks differs: %v\n", err)
+	}
+}
+
+//Of the snapshots that peers offer, the one on the chain with the most cumulative work is trusted, not the highest one
+func TestBestSnapshot(t *testing.T) {
+
+	testStore := store
+	defer func() { store = testStore }()
+	snapshotInterval = 3
+	defer func() { snapshotInterval = SNAPSHOT_INTERVAL }()
+
+	mineChain := func(length int) (blocks []*protocol.Block) {
+		for cnt := 0; cnt < length; cnt++ {
+			b := newBlock(lastBlock.Hash)
+			addStateCommitment(b)
+			createBlockWithTxs(b)
+			finalizeBlock(b)
+			if err := validateBlock(b); err != nil {
+				t.Fatalf("Block validation failed: %v\n", err)
+			}
+			blocks = append(blocks, b)
+		}
+		return blocks
+	}
+
+	//The longer chain has its latest snapshot at height 5, committed to by the block at height 6
+	cleanAndPrepare()
+	longer := mineChain(7)
+	//The shorter chain only has a snapshot at height 2, but its blocks have a harder target
+	store = storage.NewMemStorage()
+	cleanAndPrepare()
+	genesisTarget = targetFromZeroBits(12)
+	target = []uint32{genesisTarget}
+	heavier := mineChain(4)
+	genesisTarget = targetFromZeroBits(8)
+	heavierStore := store
+	store = storage.NewMemStorage()
+
+	fetch := func(hash [32]byte) *protocol.Block {
+		if b := testStore.ReadClosedBlock(hash); b != nil {
+			return b
+		}
+		return heavierStore.ReadClosedBlock(hash)
+	}
+	fetched := make(map[[32]byte]int)
+	fetchData := func(info *p2p.SnapshotInfo) ([]byte, error) {
+		fetched[info.BlockHash]++
+		//The first peer offering the latest snapshot doesn't deliver it
+		if info.Size == 1 {
+			return nil, errors.New("Snapshot chunk request timed out.")
+		}
+		for _, st := range []storage.Storage{testStore, heavierStore} {
+			if st.ReadClosedBlock(info.BlockHash) != nil && st.ReadSnapshot(info.Height) != nil {
+				return st.ReadSnapshot(info.Height), nil
+			}
+		}
+		return nil, errors.New("Snapshot not found.")
+	}
+
+	latest := &p2p.SnapshotInfo{Height: 5, BlockHash: longer[5].Hash}
+	earlier := &p2p.SnapshotInfo{Height: 2, BlockHash: longer[2].Hash}
+	heaviest := &p2p.SnapshotInfo{Height: 2, BlockHash: heavier[2].Hash}
+	//The block doesn't commit to a snapshot and the other one doesn't exist at all
+	invalid := &p2p.SnapshotInfo{Height: 5, BlockHash: longer[4].Hash}
+	missing := &p2p.SnapshotInfo{Height: 8, BlockHash: [32]byte{1}}
+
+	unavailable := &p2p.SnapshotInfo{Height: 5, BlockHash: longer[5].Hash, Size: 1}
+
+	best, err := bestSnapshot([]*p2p.SnapshotInfo{earlier, invalid, unavailable, latest, missing, latest, earlier}, fetch, fetchData)
+	if err != nil || best.block.Hash != longer[5].Hash {
+		t.Errorf("Latest snapshot of a single chain was not chosen: %v\n", err)
+	}
+	if fetched[earlier.BlockHash] != 1 || fetched[latest.BlockHash] != 2 || fetched[missing.BlockHash] != 0 {
+		t.Errorf("Offered snapshots were fetched the wrong number of times: %v\n", fetched)
+	}
+
+	for _, offers := range [][]*p2p.SnapshotInfo{{latest, heaviest}, {heaviest, latest}} {
+		best, err := bestSnapshot(offers, fetch, fetchData)
+		if err != nil || best.block.Hash != heavier[2].Hash {
+			t.Errorf("Snapshot on the chain with the most work was not chosen: %v\n", err)
+		}
+	}
+
+	if _, err := bestSnapshot([]*p2p.SnapshotInfo{invalid, missing}, fetch, fetchData); err == nil {
+		t.Error("Snapshot was chosen although none could be verified.\n")
+	}
+
+	//The chosen snapshot is loaded like an applied one
+	if err := loadSnapshot(best); err != nil || lastBlock.Hash != longer[4].Hash || chainWork(lastBlock.Hash).Cmp(testStore.ReadChainWork(longer[4].Hash)) != 0 {
+		t.Errorf("Chosen snapshot was not loaded: %v\n", err)
+	}
+}
@@ -9,65 +9,73 @@ import (
 )
 
 func isRootKey(hash [32]byte) bool {
-	_, exists := storage.RootKeys[hash]
-	return exists
+	return store.State().IsRootKey(hash)
 }
 
-func accStateChange(txSlice []*protocol.AccTx) error {
+//All state changes record the accounts they modify in the journal. If an error is returned, the caller has to revert
+//the journal, the state might have been changed partially
+func accStateChange(txSlice []*protocol.AccTx, j *storage.Journal) error {
 
 	for _, tx := range txSlice {
+		j.Touch(sha3.Sum256(tx.PubKey[:]))
 		switch tx.Header {
 		case 1:
 			//First bit set, given account will be a new root account
-			//It might be cleaner to move this to the storage package (e.g., storage.Delete(...))
+			//It might be cleaner to move this to the storage package (e.g., store.Delete(...))
 			//leave it here for now (not fully convinced yet)
 			newAcc := protocol.Account{Address: tx.PubKey}
-			storage.RootKeys[sha3.Sum256(tx.PubKey[:])] = &newAcc
+			store.State().SetRootKey(sha3.Sum256(tx.PubKey[:]), &newAcc)
 			continue
 		case 2:
 			//Second bit set, delete account from root account
-			delete(storage.RootKeys, sha3.Sum256(tx.PubKey[:]))
+			store.State().DeleteRootKey(sha3.Sum256(tx.PubKey[:]))
 			continue
 		}
 
 		//Create a regular account
 		addressHash := sha3.Sum256(tx.PubKey[:])
-		acc := storage.GetAccountFromHash(addressHash)
+		acc := store.State().GetAccount(addressHash)
 		if acc != nil {
 			//Shouldn't happen, because this should have been prevented when adding an accTx to the block
 			return errors.New("CRITICAL: Address already exists in the state")
 		}
 		newAcc := protocol.Account{Address: tx.PubKey}
-		storage.State[addressHash] = &newAcc
+		store.State().SetAccount(addressHash, &newAcc)
 	}
 	return nil
 }
 
-func fundsStateChange(txSlice []*protocol.FundsTx) error {
+func fundsStateChange(txSlice []*protocol.FundsTx, j *storage.Journal) error {
 
-	for index, tx := range txSlice {
+	for _, tx := range txSlice {
 
 		var err error
+		j.Touch(tx.From)
+		j.Touch(tx.To)
 		//Check if we have to issue new coins (in case a root account signed the tx)
-		for hash, rootAcc := range storage.RootKeys {
-			if hash == tx.From {
-				if rootAcc.Balance+tx.Amount+tx.Fee > MAX_MONEY {
-					err = errors.New("Sender does not exist in the State.")
-				}
-				rootAcc.Balance += tx.Amount
-				rootAcc.Balance += tx.Fee
+		if rootAcc := store.State().GetRootKey(tx.From); rootAcc != nil {
+			if rootAcc.Balance+tx.Amount+tx.Fee > MAX_MONEY {
+				err = errors.New("Sender does not exist in the State.")
 			}
+			rootAcc.Balance += tx.Amount
+			rootAcc.Balance += tx.Fee
 		}
 
-		accSender, accReceiver := storage.GetAccountFromHash(tx.From), storage.GetAccountFromHash(tx.To)
+		accSender, accReceiver := store.State().GetAccount(tx.From), store.State().GetAccount(tx.To)
 		if accSender == nil {
 			logger.Printf("CRITICAL: Sender does not exist in the State: %x\n", tx.From[0:8])
-			err = errors.New("Sender does not exist in the State.")
+			return errors.New("Sender does not exist in the State.")
 		}
 
 		if accReceiver == nil {
 			logger.Printf("CRITICAL: Receiver does not exist in the State: %x\n", tx.To[0:8])
-			err = errors.New("Receiver does not exist in the State.")
+			return errors.New("Receiver does not exist in the State.")
+		}
+
+		//The block is not part of the statistics yet, its height is one above the current count
+		if tx.Expired(uint32(globalBlockCount + 1)) {
+			logger.Printf("Transaction expired at height %v, block height is %v\n", tx.ValidUntil, globalBlockCount+1)
+			err = errors.New("Transaction expired.")
 		}
 
 		//Check transaction counter
@@ -89,11 +97,6 @@ func fundsStateChange(txSlice []*protocol.FundsTx) error {
 		}
 
 		if err != nil {
-			//If it was the first tx in the block, no rollback needed
-			if index == 0 {
-				return err
-			}
-			fundsStateChangeRollback(txSlice[0 : index-1])
 			return err
 		}
 
@@ -145,6 +148,11 @@ func configStateChange(configTxSlice []*protocol.ConfigTx, blockHash [32]byte) {
 				newParameters.block_interval = tx.Payload
 				change = true
 			}
+		case protocol.DIFF_ALGORITHM_ID:
+			if parameterBoundsChecking(protocol.DIFF_ALGORITHM_ID, tx.Payload) {
+				newParameters.diff_algorithm = tx.Payload
+				change = true
+			}
 		}
 	}
 
@@ -157,61 +165,67 @@ func configStateChange(configTxSlice []*protocol.ConfigTx, blockHash [32]byte) {
 	}
 }
 
-func collectTxFees(accTxSlice []*protocol.AccTx, fundsTxSlice []*protocol.FundsTx, configTxSlice []*protocol.ConfigTx, minerHash [32]byte) error {
+func configStateChangeRollback(txSlice []*protocol.ConfigTx, blockHash [32]byte) {
 
-	var tmpAccTx []*protocol.AccTx
-	var tmpFundsTx []*protocol.FundsTx
-	var tmpConfigTx []*protocol.ConfigTx
+	if len(txSlice) == 0 {
+		return
+	}
+	//Only rollback if the config changes lead to a parameterChange
+	//there might be the case that the client is not running the latest version, it's still confirming
+	//the transaction but does not understand the ID and thus is not changing the state
+	if parameterSlice[len(parameterSlice)-1].blockHash != blockHash {
+		return
+	}
+	//remove the latest entry in the parameters slice$
+	parameterSlice = parameterSlice[:len(parameterSlice)-1]
+	activeParameters = &parameterSlice[len(parameterSlice)-1]
+	logger.Printf("Config parameters rolled back. New configuration: %v", *activeParameters)
+}
+
+func collectTxFees(accTxSlice []*protocol.AccTx, fundsTxSlice []*protocol.FundsTx, configTxSlice []*protocol.ConfigTx, minerHash [32]byte, j *storage.Journal) error {
 
-	minerAcc := storage.GetAccountFromHash(minerHash)
+	j.Touch(minerHash)
+	minerAcc := store.State().GetAccount(minerHash)
 
 	for _, tx := range accTxSlice {
 		if minerAcc.Balance+tx.Fee > MAX_MONEY {
-			//Rollback of all perviously transferred transaction fees to the protocol's account
-			collectTxFeesRollback(tmpAccTx, tmpFundsTx, tmpConfigTx, minerHash)
 			logger.Printf("Miner balance (%v) overflows with transaction fee (%v).\n", minerAcc.Balance, tx.Fee)
 			return errors.New("Miner balance overflows with transaction fee.\n")
 		}
 
 		//Money gets created from thin air, no need to subtract money from root key
 		minerAcc.Balance += tx.Fee
-		tmpAccTx = append(tmpAccTx, tx)
 	}
 
 	//subtract fees from sender (check if that is allowed has already been done in the block validation)
 	for _, tx := range fundsTxSlice {
 		//Prevent protocol account from overflowing
 		if minerAcc.Balance+tx.Fee > MAX_MONEY {
-			//Rollback of all perviously transferred transaction fees to the protocol's account
-			collectTxFeesRollback(tmpAccTx, tmpFundsTx, tmpConfigTx, minerHash)
 			return errors.New("Miner balance overflows with transaction fee.\n")
 		}
 		minerAcc.Balance += tx.Fee
 
-		senderAcc := storage.GetAccountFromHash(tx.From)
+		j.Touch(tx.From)
+		senderAcc := store.State().GetAccount(tx.From)
 		senderAcc.Balance -= tx.Fee
-
-		tmpFundsTx = append(tmpFundsTx, tx)
 	}
 
 	for _, tx := range configTxSlice {
 		if minerAcc.Balance+tx.Fee > MAX_MONEY {
-			//Rollback of all perviously transferred transaction fees to the protocol's account
-			collectTxFeesRollback(tmpAccTx, tmpFundsTx, tmpConfigTx, minerHash)
 			logger.Printf("Miner balance (%v) overflows with transaction fee (%v).\n", minerAcc.Balance, tx.Fee)
 			return errors.New("Miner balance overflows with transaction fee.\n")
 		}
 
 		//No need to subtract money because signed by root account
 		minerAcc.Balance += tx.Fee
-		tmpConfigTx = append(tmpConfigTx, tx)
 	}
 
 	return nil
 }
 
-func collectBlockReward(reward uint64, minerHash [32]byte) error {
-	miner := storage.GetAccountFromHash(minerHash)
+func collectBlockReward(reward uint64, minerHash [32]byte, j *storage.Journal) error {
+	j.Touch(minerHash)
+	miner := store.State().GetAccount(minerHash)
 
 	if miner == nil {
 		return errors.New("Miner doesn't exist in the state!")
@@ -227,7 +241,7 @@ func collectBlockReward(reward uint64, minerHash [32]byte) error {
 
 //For logging purposes
 func getState() (state string) {
-	for key, acc := range storage.State {
+	for key, acc := range store.State().Accounts() {
 		state += fmt.Sprintf("%x: %v\n", key[0:10], acc)
 	}
 	return state
@@ -2,7 +2,6 @@ package miner
 
 import (
 	"github.com/lisgie/bazo_miner/protocol"
-	"github.com/lisgie/bazo_miner/storage"
 	"math/rand"
 	"reflect"
 	"testing"
@@ -37,7 +36,7 @@ func TestFundsTxStateChange(t *testing.T) {
 	loopMax := int(rand.Uint32()%testSize + 1)
 	for i := 0; i < loopMax+1; i++ {
 		ftx, _ := protocol.ConstrFundsTx(0x01, rand.Uint64()%1000000+1, rand.Uint64()%100+1, uint32(i), accAHash, accBHash, &PrivKeyA)
-		if addTx(b, ftx) == nil {
+		if addTx(b, ftx, store.State().Snapshot()) == nil {
 			funds = append(funds, ftx)
 			balanceA -= ftx.Amount
 			feeA += ftx.Fee
@@ -46,7 +45,7 @@ func TestFundsTxStateChange(t *testing.T) {
 		}
 
 		ftx2, _ := protocol.ConstrFundsTx(0x01, rand.Uint64()%1000+1, rand.Uint64()%100+1, uint32(i), accAHash, accAHash, &PrivKeyB)
-		if addTx(b, ftx2) == nil {
+		if addTx(b, ftx2, store.State().Snapshot()) == nil {
 			funds = append(funds, ftx2)
 			balanceB -= ftx2.Amount
 			feeB += ftx2.Fee
@@ -55,19 +54,19 @@ func TestFundsTxStateChange(t *testing.T) {
 		}
 	}
 
-	fundsStateChange(funds)
+	fundsStateChange(funds, store.State().NewJournal())
 
 	if accA.Balance != balanceA || accB.Balance != balanceB {
 		t.Errorf("State update failed: %v != %v or %v != %v\n", accA.Balance, balanceA, accB.Balance, balanceB)
 	}
 
-	collectTxFees(nil, funds, nil, minerAccHash)
+	collectTxFees(nil, funds, nil, minerAccHash, store.State().NewJournal())
 	if feeA+feeB != minerAcc.Balance-minerBal {
 		t.Error("Fee Collection failed!")
 	}
 
 	balBeforeRew := minerAcc.Balance
-	collectBlockReward(activeParameters.block_reward, minerAccHash)
+	collectBlockReward(activeParameters.block_reward, minerAccHash, store.State().NewJournal())
 	if minerAcc.Balance != balBeforeRew+activeParameters.block_reward {
 		t.Error("Block reward collection failed!")
 	}
@@ -83,12 +82,12 @@ func TestAccountOverflow(t *testing.T) {
 	accA.Balance = MAX_MONEY
 	accA.TxCnt = 0
 	tx, err := protocol.ConstrFundsTx(0x01, 1, 1, 0, accBHash, accAHash, &PrivKeyB)
-	if !verifyFundsTx(tx) || err != nil {
+	if !verifyFundsTx(tx, store.State().Snapshot()) || err != nil {
 		t.Error("Failed to create reasonable fundsTx\n")
 		return
 	}
 	accSlice = append(accSlice, tx)
-	err = fundsStateChange(accSlice)
+	err = fundsStateChange(accSlice, store.State().NewJournal())
 
 	//Err shouldn't be nil, because the tx can't have been successful
 	//Also, the balance of A shouldn't have changed
@@ -97,6 +96,35 @@ func TestAccountOverflow(t *testing.T) {
 	}
 }
 
+func TestFundsTxExpiry(t *testing.T) {
+
+	cleanAndPrepare()
+	accAHash := serializeHashContent(accA.Address)
+	accBHash := serializeHashContent(accB.Address)
+
+	accA.Balance = 1000
+	//The next block is at height 10
+	globalBlockCount = 9
+	height := uint32(globalBlockCount + 1)
+
+	expired, _ := protocol.ConstrExpiringFundsTx(0x01, 10, 1, 0, height-1, accAHash, accBHash, &PrivKeyA)
+	if err := addTx(newBlock([32]byte{}), expired, store.State().Snapshot()); err == nil {
+		t.Error("Expired tx was added to the block.\n")
+	}
+	if err := fundsStateChange([]*protocol.FundsTx{expired}, store.State().NewJournal()); err == nil || accA.Balance != 1000 {
+		t.Error("Expired tx was applied to the state.\n")
+	}
+
+	//The expiry height itself is still valid
+	valid, _ := protocol.ConstrExpiringFundsTx(0x01, 10, 1, 0, height, accAHash, accBHash, &PrivKeyA)
+	if err := addTx(newBlock([32]byte{}), valid, store.State().Snapshot()); err != nil {
+		t.Errorf("Tx that expires at the block height was not added: %v\n", err)
+	}
+	if err := fundsStateChange([]*protocol.FundsTx{valid}, store.State().NewJournal()); err != nil {
+		t.Errorf("Tx that expires at the block height was not applied: %v\n", err)
+	}
+}
+
 func TestAccTxStateChange(t *testing.T) {
 
 	cleanAndPrepare()
@@ -113,11 +141,11 @@ func TestAccTxStateChange(t *testing.T) {
 		accs = append(accs, tx)
 	}
 
-	accStateChange(accs)
+	accStateChange(accs, store.State().NewJournal())
 
 	for _, acc := range accs {
 		accHash := serializeHashContent(acc.PubKey)
-		acc := storage.State[accHash]
+		acc := store.State().GetAccount(accHash)
 		//make sure the previously created acc is in the state
 		if acc == nil {
 			t.Errorf("Account State failed to update for the following account: %v\n", acc)
@@ -131,7 +159,7 @@ func TestAccTxStateChange(t *testing.T) {
 	var pubKeyTmp [64]byte
 	copy(pubKeyTmp[:], tx.PubKey[:])
 
-	accStateChange(singleSlice)
+	accStateChange(singleSlice, store.State().NewJournal())
 
 	if !isRootKey(serializeHashContent(pubKeyTmp)) {
 		t.Errorf("AccTx Header bit 1 not working.")
@@ -141,7 +169,7 @@ func TestAccTxStateChange(t *testing.T) {
 	newTx := *tx
 	newTx.Header = 0x02
 	singleSlice[0] = &newTx
-	accStateChange(singleSlice)
+	accStateChange(singleSlice, store.State().NewJournal())
 
 	if isRootKey(serializeHashContent(pubKeyTmp)) {
 		t.Errorf("AccTx Header bit 2 not working.")
@@ -161,7 +189,7 @@ func TestConfigTxStateChange(t *testing.T) {
 		if err != nil {
 			t.Errorf("ConfigTx Creation failed (%v)\n", err)
 		}
-		if verifyConfigTx(tx) {
+		if verifyConfigTx(tx, store.State().Snapshot()) {
 			configs = append(configs, tx)
 		}
 	}
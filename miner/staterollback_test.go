@@ -2,7 +2,6 @@ package miner
 
 import (
 	"github.com/lisgie/bazo_miner/protocol"
-	"github.com/lisgie/bazo_miner/storage"
 	"math/rand"
 	"reflect"
 	"testing"
@@ -38,7 +37,7 @@ func TestFundsStateChangeRollback(t *testing.T) {
 	loopMax := int(rand.Uint32()%testSize + 1)
 	for i := 0; i < loopMax+1; i++ {
 		ftx, _ := protocol.ConstrFundsTx(0x01, rand.Uint64()%1000000+1, rand.Uint64()%100+1, uint32(i), accAHash, accBHash, &PrivKeyA)
-		if addTx(b, ftx) == nil {
+		if addTx(b, ftx, store.State().Snapshot()) == nil {
 			funds = append(funds, ftx)
 			balanceA -= ftx.Amount
 			feeA += ftx.Fee
@@ -49,7 +48,7 @@ func TestFundsStateChangeRollback(t *testing.T) {
 		}
 
 		ftx2, _ := protocol.ConstrFundsTx(0x01, rand.Uint64()%1000+1, rand.Uint64()%100+1, uint32(i), accBHash, accAHash, &PrivKeyB)
-		if addTx(b, ftx2) == nil {
+		if addTx(b, ftx2, store.State().Snapshot()) == nil {
 			funds = append(funds, ftx2)
 			balanceB -= ftx2.Amount
 			feeB += ftx2.Fee
@@ -59,11 +58,12 @@ func TestFundsStateChangeRollback(t *testing.T) {
 			t.Errorf("Block rejected a valid transaction: %v\n", ftx2)
 		}
 	}
-	fundsStateChange(funds)
+	journal := store.State().NewJournal()
+	fundsStateChange(funds, journal)
 	if accA.Balance != balanceA || accB.Balance != balanceB {
 		t.Error("State update failed!")
 	}
-	fundsStateChangeRollback(funds)
+	journal.Revert()
 	if accA.Balance != rollBackA || accB.Balance != rollBackB {
 		t.Error("Rollback failed!")
 	}
@@ -71,11 +71,12 @@ func TestFundsStateChangeRollback(t *testing.T) {
 	//collectTxFees is checked below in its own test (to additionally cover overflow scenario)
 	balBeforeRew := minerAcc.Balance
 	reward := 5
-	collectBlockReward(uint64(reward), minerAccHash)
+	journal = store.State().NewJournal()
+	collectBlockReward(uint64(reward), minerAccHash, journal)
 	if minerAcc.Balance != balBeforeRew+uint64(reward) {
 		t.Error("Block reward collection failed!")
 	}
-	collectBlockRewardRollback(uint64(reward), minerAccHash)
+	journal.Revert()
 	if minerAcc.Balance != balBeforeRew {
 		t.Error("Block reward collection rollback failed!")
 	}
@@ -98,21 +99,22 @@ func TestAccStateChangeRollback(t *testing.T) {
 		accs = append(accs, tx)
 	}
 
-	accStateChange(accs)
+	journal := store.State().NewJournal()
+	accStateChange(accs, journal)
 
 	for _, acc := range accs {
 		accHash := serializeHashContent(acc.PubKey)
-		acc := storage.State[accHash]
+		acc := store.State().GetAccount(accHash)
 		if acc == nil {
 			t.Errorf("Account State failed to update for the following account: %v\n", acc)
 		}
 	}
 
-	accStateChangeRollback(accs)
+	journal.Revert()
 
 	for _, acc := range accs {
 		accHash := serializeHashContent(acc.PubKey)
-		acc := storage.State[accHash]
+		acc := store.State().GetAccount(accHash)
 		if acc != nil {
 			t.Errorf("Account State failed to rollback the following account: %v\n", acc)
 		}
@@ -169,11 +171,12 @@ func TestCollectTxFeesRollback(t *testing.T) {
 		fee += tx.Fee
 	}
 
-	collectTxFees(nil, funds, nil, minerHash)
+	journal := store.State().NewJournal()
+	collectTxFees(nil, funds, nil, minerHash, journal)
 	if minerBal+fee != minerAcc.Balance {
 		t.Errorf("%v + %v != %v\n", minerBal, fee, minerAcc.Balance)
 	}
-	collectTxFeesRollback(nil, funds, nil, minerHash)
+	journal.Revert()
 	if minerBal != minerAcc.Balance {
 		t.Errorf("Tx fees rollback failed: %v != %v\n", minerBal, minerAcc.Balance)
 	}
@@ -193,7 +196,7 @@ func TestCollectTxFeesRollback(t *testing.T) {
 	//Should throw an error and result in a rollback, because of acc balance overflow
 	tmpBlock := newBlock([32]byte{})
 	tmpBlock.Beneficiary = minerHash
-	data := blockData{nil, funds2, nil, tmpBlock}
+	data := blockData{nil, funds2, nil, tmpBlock, store.State().NewJournal(), nil}
 	if err := stateValidation(data); err == nil ||
 		minerBal != minerAcc.Balance ||
 		accA.Balance != accABal ||
@@ -201,3 +204,61 @@ func TestCollectTxFeesRollback(t *testing.T) {
 		t.Errorf("No rollback resulted, %v != %v\n", minerBal, minerAcc.Balance)
 	}
 }
+
+//A failing tx in the middle of the block needs to revert all previous txs of the block, including the one right
+//before the failing tx
+func TestFundsStateChangePartialRollback(t *testing.T) {
+
+	cleanAndPrepare()
+
+	accAHash := serializeHashContent(accA.Address)
+	accBHash := serializeHashContent(accB.Address)
+	balanceA, balanceB := accA.Balance, accB.Balance
+	txCntA := accA.TxCnt
+
+	var funds []*protocol.FundsTx
+	for i := 0; i < 3; i++ {
+		tx, _ := protocol.ConstrFundsTx(0x01, 10, 1, txCntA+uint32(i), accAHash, accBHash, &PrivKeyA)
+		funds = append(funds, tx)
+	}
+	//TxCnt mismatch, the last tx fails
+	tx, _ := protocol.ConstrFundsTx(0x01, 10, 1, txCntA+10, accAHash, accBHash, &PrivKeyA)
+	funds = append(funds, tx)
+
+	tmpBlock := newBlock([32]byte{})
+	tmpBlock.Beneficiary = serializeHashContent(minerAcc.Address)
+	data := blockData{nil, funds, nil, tmpBlock, store.State().NewJournal(), nil}
+	if err := stateValidation(data); err == nil {
+		t.Fatal("Block with invalid tx passed state validation.\n")
+	}
+
+	if accA.Balance != balanceA || accB.Balance != balanceB || accA.TxCnt != txCntA {
+		t.Errorf("State was not fully rolled back: %v vs. %v, %v vs. %v, %v vs. %v\n",
+			accA.Balance, balanceA, accB.Balance, balanceB, accA.TxCnt, txCntA)
+	}
+}
+
+//The rollback needs to take away the reward that was actually paid, even if the block reward changed since
+func TestBlockRewardRollback(t *testing.T) {
+
+	cleanAndPrepare()
+
+	b := newBlock([32]byte{})
+	finalizeBlock(b)
+	beneficiaryBal := store.State().GetAccount(b.Beneficiary).Balance
+
+	if err := validateBlock(b); err != nil {
+		t.Fatalf("Block validation failed: %v\n", err)
+	}
+	if store.State().GetAccount(b.Beneficiary).Balance != beneficiaryBal+activeParameters.block_reward {
+		t.Error("Block reward was not paid.\n")
+	}
+
+	activeParameters.block_reward += 1000
+	if err := validateBlockRollback(b); err != nil {
+		t.Errorf("%v\n", err)
+	}
+	if store.State().GetAccount(b.Beneficiary).Balance != beneficiaryBal {
+		t.Errorf("Block reward rollback failed: %v vs. %v\n", store.State().GetAccount(b.Beneficiary).Balance, beneficiaryBal)
+	}
+}
@@ -3,32 +3,120 @@ package miner
 import (
 	"crypto/ecdsa"
 	"crypto/elliptic"
+	"errors"
+	"fmt"
+	"github.com/lisgie/bazo_miner/p2p"
 	"github.com/lisgie/bazo_miner/protocol"
 	"github.com/lisgie/bazo_miner/storage"
+	"golang.org/x/crypto/sha3"
 	"math/big"
 	"reflect"
+	"sync"
 )
 
 //We can't use polymorphism, e.g. we can't use tx.verify() because the Transaction interface doesn't declare
 //the verify method. This is because verification depends on the State (e.g., dynamic properties), which
 //should only be of concern to the miner, not to the protocol package. However, this has the disadvantage
 //that we have to do case distinction here.
-func verify(tx protocol.Transaction) bool {
+func verify(tx protocol.Transaction, snapshot *storage.Snapshot) bool {
 
 	var verified bool
 
 	switch tx.(type) {
 	case *protocol.FundsTx:
-		verified = verifyFundsTx(tx.(*protocol.FundsTx))
+		verified = verifyFundsTx(tx.(*protocol.FundsTx), snapshot)
 	case *protocol.AccTx:
-		verified = verifyAccTx(tx.(*protocol.AccTx))
+		verified = verifyAccTx(tx.(*protocol.AccTx), snapshot)
 	case *protocol.ConfigTx:
-		verified = verifyConfigTx(tx.(*protocol.ConfigTx))
+		verified = verifyConfigTx(tx.(*protocol.ConfigTx), snapshot)
 	}
 	return verified
 }
 
-func verifyFundsTx(tx *protocol.FundsTx) bool {
+//Chain values txs from the network are checked against. verifyOpenTx runs on the p2p goroutines, which can't wait
+//for blockValidation: a block validation might wait for a tx response that the same goroutine needs to read
+type admissionParams struct {
+	feeMinimum uint64
+	//Height of the next block
+	height uint32
+}
+
+var (
+	admission     admissionParams
+	admissionLock = &sync.RWMutex{}
+)
+
+//Needs to be called while blockValidation is held, after the chain has changed
+func publishAdmissionParams() {
+
+	admissionLock.Lock()
+	defer admissionLock.Unlock()
+
+	admission = admissionParams{activeParameters.fee_minimum, uint32(globalBlockCount + 1)}
+}
+
+func currentAdmissionParams() admissionParams {
+
+	admissionLock.RLock()
+	defer admissionLock.RUnlock()
+
+	return admission
+}
+
+//Admission check for txs from the network, done before they're written to the mempool and relayed to other miners.
+//Besides the signature, everything that doesn't depend on other open txs is checked against the current state. Whether
+//a fundsTx can be paid after the sender's earlier txs is only known when the block is built. Txs that are invalid
+//whatever the state of the sender's chain are rejected with a TxFault, the sender gets disconnected eventually
+func verifyOpenTx(tx protocol.Transaction) error {
+
+	params := currentAdmissionParams()
+	if tx.TxFee() < params.feeMinimum {
+		return &p2p.TxFault{Reason: fmt.Sprintf("Transaction fee too low: %v (minimum is: %v)", tx.TxFee(), params.feeMinimum)}
+	}
+
+	snapshot := store.State().Snapshot()
+
+	switch tx := tx.(type) {
+	case *protocol.FundsTx:
+		accFrom, accTo := snapshot.GetAccount(tx.From), snapshot.GetAccount(tx.To)
+		if accFrom == nil || accTo == nil {
+			return errors.New("Sender or receiver account not present in the state.")
+		}
+		//Both accounts exist, the tx is checked against the sender's public key
+		if !verifyFundsTx(tx, snapshot) {
+			return &p2p.TxFault{Reason: "Invalid signature or amount."}
+		}
+		if tx.Expired(params.height) {
+			return errors.New(fmt.Sprintf("Transaction expired at height %v.", tx.ValidUntil))
+		}
+		if tx.TxCnt < accFrom.TxCnt {
+			return errors.New(fmt.Sprintf("Sender txCnt already used: %v (tx.txCnt) vs. %v (state txCnt)", tx.TxCnt, accFrom.TxCnt))
+		}
+		if !snapshot.IsRootKey(tx.From) && (tx.Fee >= accFrom.Balance || tx.Amount >= accFrom.Balance-tx.Fee) {
+			return errors.New("Not enough funds to complete the transaction!")
+		}
+	case *protocol.AccTx:
+		if !verifyAccTx(tx, snapshot) {
+			return &p2p.TxFault{Reason: "Not signed by a root account."}
+		}
+		if tx.Header&0x02 != 0x02 && snapshot.GetAccount(sha3.Sum256(tx.PubKey[:])) != nil {
+			return errors.New("Account already exists.")
+		}
+	case *protocol.ConfigTx:
+		if !verifyConfigTx(tx, snapshot) {
+			return &p2p.TxFault{Reason: "Not signed by a root account."}
+		}
+		if !parameterBoundsChecking(tx.Id, tx.Payload) {
+			return &p2p.TxFault{Reason: fmt.Sprintf("Parameter %v out of bounds: %v", tx.Id, tx.Payload)}
+		}
+	default:
+		return &p2p.TxFault{Reason: "Transaction type not recognized."}
+	}
+
+	return nil
+}
+
+func verifyFundsTx(tx *protocol.FundsTx, snapshot *storage.Snapshot) bool {
 
 	if tx == nil {
 		return false
@@ -44,8 +132,8 @@ func verifyFundsTx(tx *protocol.FundsTx) bool {
 	}
 
 	//Check if accounts are present in the actual state
-	accFrom := storage.State[tx.From]
-	accTo := storage.State[tx.To]
+	accFrom := snapshot.GetAccount(tx.From)
+	accTo := snapshot.GetAccount(tx.To)
 
 	//Accounts non existant
 	if accFrom == nil || accTo == nil {
@@ -76,7 +164,7 @@ func verifyFundsTx(tx *protocol.FundsTx) bool {
 	return false
 }
 
-func verifyAccTx(tx *protocol.AccTx) bool {
+func verifyAccTx(tx *protocol.AccTx, snapshot *storage.Snapshot) bool {
 
 	if tx == nil {
 		return false
@@ -88,7 +176,7 @@ func verifyAccTx(tx *protocol.AccTx) bool {
 	r.SetBytes(tx.Sig[:32])
 	s.SetBytes(tx.Sig[32:])
 
-	for _, rootAcc := range storage.RootKeys {
+	for _, rootAcc := range snapshot.RootKeys() {
 		pub1.SetBytes(rootAcc.Address[:32])
 		pub2.SetBytes(rootAcc.Address[32:])
 
@@ -104,7 +192,7 @@ func verifyAccTx(tx *protocol.AccTx) bool {
 	return false
 }
 
-func verifyConfigTx(tx *protocol.ConfigTx) bool {
+func verifyConfigTx(tx *protocol.ConfigTx, snapshot *storage.Snapshot) bool {
 
 	if tx == nil {
 		return false
@@ -117,7 +205,7 @@ func verifyConfigTx(tx *protocol.ConfigTx) bool {
 	r.SetBytes(tx.Sig[:32])
 	s.SetBytes(tx.Sig[32:])
 
-	for _, rootAcc := range storage.RootKeys {
+	for _, rootAcc := range snapshot.RootKeys() {
 		pub1.SetBytes(rootAcc.Address[:32])
 		pub2.SetBytes(rootAcc.Address[32:])
 
@@ -156,6 +244,10 @@ func parameterBoundsChecking(id uint8, payload uint64) bool {
 		if payload >= protocol.MIN_BLOCK_REWARD && payload <= protocol.MAX_BLOCK_REWARD {
 			return true
 		}
+	case protocol.DIFF_ALGORITHM_ID:
+		if payload >= protocol.MIN_DIFF_ALGORITHM && payload <= protocol.MAX_DIFF_ALGORITHM {
+			return true
+		}
 	}
 	return false
 }
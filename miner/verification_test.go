@@ -1,6 +1,7 @@
 package miner
 
 import (
+	"github.com/lisgie/bazo_miner/p2p"
 	"github.com/lisgie/bazo_miner/protocol"
 	"math/rand"
 	"testing"
@@ -15,7 +16,7 @@ func TestFundsTxVerification(t *testing.T) {
 	accBHash := serializeHashContent(accB.Address)
 	for i := 0; i < loopMax; i++ {
 		tx, _ := protocol.ConstrFundsTx(0x01, rand.Uint64()%100000+1, rand.Uint64()%10+1, uint32(i), accAHash, accBHash, &PrivKeyA)
-		if verifyFundsTx(tx) == false {
+		if verifyFundsTx(tx, store.State().Snapshot()) == false {
 			t.Errorf("Tx could not be verified: \n%v", tx)
 		}
 	}
@@ -28,7 +29,7 @@ func TestAccTx(t *testing.T) {
 	loopMax := int(rand.Uint64() % 1000)
 	for i := 0; i <= loopMax; i++ {
 		tx,_,_ := protocol.ConstrAccTx(0, rand.Uint64()%100+1, &RootPrivKey)
-		if verifyAccTx(tx) == false {
+		if verifyAccTx(tx, store.State().Snapshot()) == false {
 			t.Errorf("AccTx could not be verified: %v\n", tx)
 		}
 	}
@@ -47,12 +48,114 @@ func TestConfigTx(t *testing.T) {
 	//Add an invalid configTx, should not be accepted
 	txfail, err6 := protocol.ConstrConfigTx(uint8(rand.Uint32()%256), 20, 5000, rand.Uint64(), 0, &RootPrivKey)
 
-	if (verifyConfigTx(tx) == false || err != nil) &&
-		(verifyConfigTx(tx2) == false || err2 != nil) &&
-		(verifyConfigTx(tx3) == false || err3 != nil) &&
-		(verifyConfigTx(tx4) == false || err4 != nil) &&
-		(verifyConfigTx(tx5) == false || err5 != nil) &&
-		(verifyConfigTx(txfail) == true || err6 != nil) {
+	if (verifyConfigTx(tx, store.State().Snapshot()) == false || err != nil) &&
+		(verifyConfigTx(tx2, store.State().Snapshot()) == false || err2 != nil) &&
+		(verifyConfigTx(tx3, store.State().Snapshot()) == false || err3 != nil) &&
+		(verifyConfigTx(tx4, store.State().Snapshot()) == false || err4 != nil) &&
+		(verifyConfigTx(tx5, store.State().Snapshot()) == false || err5 != nil) &&
+		(verifyConfigTx(txfail, store.State().Snapshot()) == true || err6 != nil) {
 		t.Error("ConfigTx verification malfunctioning!")
 	}
 }
+
+func TestOpenTxVerification(t *testing.T) {
+
+	cleanAndPrepare()
+	accAHash := serializeHashContent(accA.Address)
+	accBHash := serializeHashContent(accB.Address)
+	var unknown [32]byte
+
+	valid, _ := protocol.ConstrFundsTx(0x01, 10, 1, 0, accAHash, accBHash, &PrivKeyA)
+	lowFee, _ := protocol.ConstrFundsTx(0x01, 10, 0, 0, accAHash, accBHash, &PrivKeyA)
+	unknownReceiver, _ := protocol.ConstrFundsTx(0x01, 10, 1, 0, accAHash, unknown, &PrivKeyA)
+	wrongSig, _ := protocol.ConstrFundsTx(0x01, 10, 1, 0, accAHash, accBHash, &PrivKeyB)
+	noFunds, _ := protocol.ConstrFundsTx(0x01, accA.Balance, 1, 0, accAHash, accBHash, &PrivKeyA)
+	accA.TxCnt = 2
+	usedTxCnt, _ := protocol.ConstrFundsTx(0x01, 10, 1, 1, accAHash, accBHash, &PrivKeyA)
+	future, _ := protocol.ConstrFundsTx(0x01, 10, 1, 5, accAHash, accBHash, &PrivKeyA)
+	accA.TxCnt = 0
+
+	if err := verifyOpenTx(valid); err != nil {
+		t.Errorf("Valid fundsTx was rejected: %v\n", err)
+	}
+	//Only txs that are invalid no matter the state count against the miner that sent them
+	for _, test := range []struct {
+		tx     *protocol.FundsTx
+		faulty bool
+	}{
+		{lowFee, true},
+		{unknownReceiver, false},
+		{wrongSig, true},
+		{noFunds, false},
+	} {
+		err := verifyOpenTx(test.tx)
+		if err == nil {
+			t.Errorf("Invalid fundsTx was accepted: %v\n", test.tx)
+		}
+		if _, faulty := err.(*p2p.TxFault); faulty != test.faulty {
+			t.Errorf("Rejection %v should be a fault: %v\n", err, test.faulty)
+		}
+	}
+
+	accA.TxCnt = 2
+	if err := verifyOpenTx(usedTxCnt); err == nil {
+		t.Error("FundsTx with a used txCnt was accepted.\n")
+	} else if _, faulty := err.(*p2p.TxFault); faulty {
+		t.Error("FundsTx with a used txCnt was rejected as a fault.\n")
+	}
+	//Txs ahead of the state wait in the mempool
+	if err := verifyOpenTx(future); err != nil {
+		t.Errorf("FundsTx with a future txCnt was rejected: %v\n", err)
+	}
+
+	accTx, _, _ := protocol.ConstrAccTx(0, 1, &RootPrivKey)
+	fakeAccTx, _, _ := protocol.ConstrAccTx(0, 1, &PrivKeyA)
+	if err := verifyOpenTx(accTx); err != nil {
+		t.Errorf("Valid accTx was rejected: %v\n", err)
+	}
+	if _, faulty := verifyOpenTx(fakeAccTx).(*p2p.TxFault); !faulty {
+		t.Error("AccTx not signed by a root account was not rejected as a fault.\n")
+	}
+
+	configTx, _ := protocol.ConstrConfigTx(0, protocol.FEE_MINIMUM_ID, 5, 1, 0, &RootPrivKey)
+	outOfBounds, _ := protocol.ConstrConfigTx(0, protocol.FEE_MINIMUM_ID, protocol.MAX_FEE_MINIMUM+1, 1, 0, &RootPrivKey)
+	if err := verifyOpenTx(configTx); err != nil {
+		t.Errorf("Valid configTx was rejected: %v\n", err)
+	}
+	if _, faulty := verifyOpenTx(outOfBounds).(*p2p.TxFault); !faulty {
+		t.Error("ConfigTx with a parameter out of bounds was not rejected as a fault.\n")
+	}
+}
+
+//Txs from the network are checked while blocks are validated, run with -race
+func TestOpenTxVerificationConcurrency(t *testing.T) {
+
+	cleanAndPrepare()
+	accAHash, accBHash := serializeHashContent(accA.Address), serializeHashContent(accB.Address)
+	tx, _ := protocol.ConstrFundsTx(0x01, 10, 1, 0, accAHash, accBHash, &PrivKeyA)
+
+	done := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				verifyOpenTx(tx)
+			}
+		}
+	}()
+
+	for cnt := 0; cnt < 3; cnt++ {
+		b := newBlock(lastBlock.Hash)
+		finalizeBlock(b)
+		if err := validateBlock(b); err != nil {
+			t.Errorf("Block validation failed: %v\n", err)
+		}
+	}
+	done <- true
+
+	if params := currentAdmissionParams(); params.height != uint32(globalBlockCount+1) || params.feeMinimum != activeParameters.fee_minimum {
+		t.Errorf("Admission params are outdated: %v\n", params)
+	}
+}
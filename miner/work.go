@@ -0,0 +1,105 @@
+package miner
+
+import (
+	"errors"
+	"fmt"
+	"github.com/lisgie/bazo_miner/p2p"
+	"github.com/lisgie/bazo_miner/protocol"
+	"golang.org/x/crypto/sha3"
+	"sync"
+	"time"
+)
+
+//Getwork-style interface for external workers. The node builds a block template like the mining loop does and hands
+//out its partial hash, the target and an id. A worker that finds a nonce submits it together with the id, the node
+//completes the block, validates and broadcasts it. Templates on top of an old tip are dropped, their blocks would
+//never make it into the chain.
+//Selecting the txs holds up block validation, it is only done again once the tip or the mempool changed. Workers that
+//ask within the same second get the same template
+
+type template struct {
+	block       *protocol.Block
+	partialHash [32]byte
+}
+
+var (
+	templates    = make(map[uint32]*template)
+	templateCnt  uint32
+	templateLock = &sync.Mutex{}
+	//Latest block with selected txs and the mempool generation they were selected from, templates are copies of it
+	templateBase       *protocol.Block
+	templateGeneration uint64
+)
+
+func getWork() (*p2p.Work, error) {
+
+	templateLock.Lock()
+	defer templateLock.Unlock()
+
+	//Same as in the mining loop, the block is built on the tip and the state of the tip
+	blockValidation.Lock()
+	if lastBlock == nil {
+		blockValidation.Unlock()
+		return nil, errors.New("Chain not initialized yet.")
+	}
+	//Workers compare the hash with the target, blocks below the target fork height are checked for leading zero bits
+	if globalBlockCount+1 < targetForkHeight {
+		blockValidation.Unlock()
+		return nil, errors.New(fmt.Sprintf("Blocks below the target fork height (%v) can't be mined by workers.", targetForkHeight))
+	}
+	tip, generation := lastBlock.Hash, store.ReadMempoolGeneration()
+	if templateBase == nil || templateBase.PrevHash != tip || templateGeneration != generation {
+		templateBase = newBlock(tip)
+		addStateCommitment(templateBase)
+		prepareBlock(templateBase)
+		prepareHeader(templateBase)
+		templateGeneration = generation
+	}
+	blockValidation.Unlock()
+
+	timestamp := time.Now().Unix()
+	if t := templates[templateCnt]; t != nil && t.block.PrevHash == tip && t.block.MerkleRoot == templateBase.MerkleRoot && t.block.Timestamp == timestamp {
+		return &p2p.Work{TemplateID: templateCnt, Target: t.block.Target, PartialHash: t.partialHash}, nil
+	}
+
+	//The txs are shared with the base, they're never modified
+	b := *templateBase
+	b.Timestamp = timestamp
+	partialHash := b.HashBlock()
+
+	templateCnt++
+	templates[templateCnt] = &template{&b, partialHash}
+	for id, t := range templates {
+		if t.block.PrevHash != tip || templateCnt-id >= MAX_TEMPLATES {
+			delete(templates, id)
+		}
+	}
+
+	return &p2p.Work{TemplateID: templateCnt, Target: b.Target, PartialHash: partialHash}, nil
+}
+
+//A template can only be submitted once. Submissions with an invalid nonce don't use it up
+func submitWork(templateID uint32, nonce [8]byte) error {
+
+	templateLock.Lock()
+	t := templates[templateID]
+	if t == nil {
+		templateLock.Unlock()
+		return errors.New(fmt.Sprintf("Template %v unknown or expired.", templateID))
+	}
+	if !validateProofOfWork(protocol.CompactToTarget(t.block.Target), sha3.Sum256(append(nonce[:], t.partialHash[:]...))) {
+		templateLock.Unlock()
+		return errors.New(fmt.Sprintf("Nonce %x does not satisfy the target of template %v.", nonce, templateID))
+	}
+	delete(templates, templateID)
+	templateLock.Unlock()
+
+	sealBlock(t.block, t.partialHash, nonce)
+	if err := validateBlock(t.block); err != nil {
+		return errors.New(fmt.Sprintf("Block (%x) could not be validated: %v", t.block.Hash[0:12], err))
+	}
+	broadcastBlock(t.block)
+	logger.Printf("Block (%x) of template %v mined by an external worker.\n", t.block.Hash[0:12], templateID)
+
+	return nil
+}
@@ -0,0 +1,114 @@
+package miner
+
+import (
+	"context"
+	"github.com/lisgie/bazo_miner/protocol"
+	"golang.org/x/crypto/sha3"
+	"testing"
+)
+
+//An external worker fetches a template, finds a nonce and submits it, the block ends up in the chain
+func TestWorkTemplate(t *testing.T) {
+
+	cleanAndPrepare()
+	tip := lastBlock.Hash
+
+	work, err := getWork()
+	if err != nil {
+		t.Fatalf("Could not get work: %v\n", err)
+	}
+	if work.Target != getTarget() {
+		t.Errorf("Template target is %x, want %x\n", work.Target, getTarget())
+	}
+
+	//A nonce that doesn't satisfy the target doesn't use the template up
+	var invalid [8]byte
+	for cnt := byte(0); validateProofOfWork(protocol.CompactToTarget(work.Target), sha3.Sum256(append(invalid[:], work.PartialHash[:]...))); cnt++ {
+		invalid[7] = cnt
+	}
+	if err := submitWork(work.TemplateID, invalid); err == nil {
+		t.Error("Invalid nonce was accepted.\n")
+	}
+
+	nonce, _, _ := searchNonce(context.Background(), 2, targetPoW(protocol.CompactToTarget(work.Target)), work.PartialHash)
+	if err := submitWork(work.TemplateID, nonce); err != nil {
+		t.Errorf("Valid nonce was not accepted: %v\n", err)
+	}
+	if lastBlock.PrevHash != tip || lastBlock.Hash != sha3.Sum256(append(nonce[:], work.PartialHash[:]...)) {
+		t.Error("Submitted block is not the new tip.\n")
+	}
+
+	//Templates can only be submitted once
+	if err := submitWork(work.TemplateID, nonce); err == nil {
+		t.Error("Template was submitted twice.\n")
+	}
+}
+
+//Templates are only rebuilt if the tip or the mempool changed. Templates on top of an old tip and the oldest templates
+//are dropped
+func TestWorkTemplateExpiry(t *testing.T) {
+
+	cleanAndPrepare()
+
+	first, _ := getWork()
+	base := templateBase
+	//Repeated requests get the same template, or a copy with a new timestamp once the second is over
+	for cnt := 0; cnt < MAX_TEMPLATES; cnt++ {
+		getWork()
+	}
+	if templateBase != base {
+		t.Error("Template was rebuilt without a change of the tip or the mempool.\n")
+	}
+	if templateCnt-first.TemplateID > 1 || templates[first.TemplateID] == nil {
+		t.Error("Repeated requests pushed out other templates.\n")
+	}
+
+	for cnt := 0; cnt < MAX_TEMPLATES; cnt++ {
+		tx, _ := protocol.ConstrConfigTx(0, protocol.FEE_MINIMUM_ID, uint64(cnt+2), 1, 0, &RootPrivKey)
+		store.WriteOpenTx(tx)
+		if work, _ := getWork(); work.PartialHash == first.PartialHash {
+			t.Errorf("Template was not rebuilt after mempool change %v.\n", cnt)
+		}
+	}
+	if err := submitWork(first.TemplateID, [8]byte{}); err == nil || templates[first.TemplateID] != nil {
+		t.Error("Oldest template was not dropped.\n")
+	}
+
+	stale, _ := getWork()
+	b := newBlock(lastBlock.Hash)
+	finalizeBlock(b)
+	validateBlock(b)
+	getWork()
+	if templates[stale.TemplateID] != nil {
+		t.Error("Template on top of the old tip was not dropped.\n")
+	}
+}
+
+//The mempool can replace a tx after it was put in a template, the template's block is still valid
+func TestWorkTemplateReplacedTx(t *testing.T) {
+
+	cleanAndPrepare()
+	accAHash, accBHash := serializeHashContent(accA.Address), serializeHashContent(accB.Address)
+
+	tx, _ := protocol.ConstrFundsTx(0x01, 10, 1, 0, accAHash, accBHash, &PrivKeyA)
+	if err := store.WriteOpenTx(tx); err != nil {
+		t.Fatalf("Tx could not be written to the mempool: %v\n", err)
+	}
+	work, _ := getWork()
+	if len(templates[work.TemplateID].block.FundsTxData) != 1 {
+		t.Fatal("Tx is not part of the template.\n")
+	}
+
+	replacement, _ := protocol.ConstrFundsTx(0x01, 10, 100, 0, accAHash, accBHash, &PrivKeyA)
+	if err := store.WriteOpenTx(replacement); err != nil || store.ReadOpenTx(tx.Hash()) != nil {
+		t.Fatalf("Tx was not replaced: %v\n", err)
+	}
+
+	nonce, _, _ := searchNonce(context.Background(), 2, targetPoW(protocol.CompactToTarget(work.Target)), work.PartialHash)
+	if err := submitWork(work.TemplateID, nonce); err != nil {
+		t.Errorf("Block with a replaced tx could not be validated: %v\n", err)
+	}
+	if store.ReadTxLocation(tx.Hash()) == nil {
+		t.Error("Tx of the template was not confirmed.\n")
+	}
+}
@@ -18,8 +18,14 @@ const (
 	TIME_BRDCST_INTERVAL = 20
 	//Calculate system time every UPDATE_SYS_TIME seconds
 	UPDATE_SYS_TIME = 60
+	//Miners that broadcast more invalid txs are disconnected
+	MAX_INVALID_TXS = 20
 
 	//Protocol constants
 	IPV4ADDR_SIZE = 4
 	PORT_SIZE     = 2
+	//Snapshots are sent in chunks of this size
+	SNAPSHOT_CHUNKSIZE = 1000000
+	//Number of tx hashes per request when fetching the mempool of another miner
+	MEMPOOL_FETCHSIZE = 500
 )
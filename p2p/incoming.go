@@ -27,10 +27,22 @@ func processIncomingMsg(p *peer, header *Header, payload []byte) {
 		blockRes(p, payload)
 	case ACC_REQ:
 		accRes(p, payload)
+	case SNAPSHOT_REQ:
+		snapshotRes(p)
+	case SNAPSHOTCHUNK_REQ:
+		snapshotChunkRes(p, payload)
+	case MEMPOOL_REQ:
+		mempoolRes(p)
+	case MEMPOOLTX_REQ:
+		mempoolTxRes(p, payload)
 	case MINER_PING:
 		pongRes(p, payload)
 	case NEIGHBOR_REQ:
 		neighborRes(p)
+	case WORK_REQ:
+		workRes(p)
+	case SUBMITWORK_REQ:
+		submitWorkRes(p, payload)
 
 		//Miner Responses
 	case NEIGHBOR_RES:
@@ -43,5 +55,15 @@ func processIncomingMsg(p *peer, header *Header, payload []byte) {
 		forwardTxReqToMiner(p, payload, ACCTX_RES)
 	case CONFIGTX_RES:
 		forwardTxReqToMiner(p, payload, CONFIGTX_RES)
+	case SNAPSHOT_RES:
+		forwardSnapshotResToMiner(p, payload)
+	case SNAPSHOTCHUNK_RES:
+		forwardSnapshotChunkResToMiner(p, payload)
+	case MEMPOOL_RES:
+		processMempoolRes(p, payload)
+	case MEMPOOLTX_RES:
+		processMempoolTxRes(p, payload)
+	case TX_REJECTED:
+		processTxRejected(p, payload)
 	}
 }
\ No newline at end of file
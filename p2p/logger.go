@@ -29,12 +29,20 @@ func logInit() {
 	logMapping[12] = "CONFIGTX_REQ"
 	logMapping[13] = "BLOCK_REQ"
 	logMapping[14] = "ACC_REQ"
+	logMapping[15] = "SNAPSHOT_REQ"
+	logMapping[16] = "SNAPSHOTCHUNK_REQ"
+	logMapping[17] = "MEMPOOL_REQ"
+	logMapping[18] = "MEMPOOLTX_REQ"
 
 	logMapping[20] = "FUNDSTX_RES"
 	logMapping[21] = "ACCTX_RES"
 	logMapping[22] = "CONFIGTX_RES"
 	logMapping[23] = "BLOCK_RES"
 	logMapping[24] = "ACC_RES"
+	logMapping[25] = "SNAPSHOT_RES"
+	logMapping[26] = "SNAPSHOTCHUNK_RES"
+	logMapping[27] = "MEMPOOL_RES"
+	logMapping[28] = "MEMPOOLTX_RES"
 
 	logMapping[30] = "NEIGHBOR_REQ"
 
@@ -42,8 +50,16 @@ func logInit() {
 
 	logMapping[50] = "TIME_BRDCST"
 
+	logMapping[60] = "WORK_REQ"
+	logMapping[61] = "WORK_RES"
+	logMapping[62] = "SUBMITWORK_REQ"
+	logMapping[63] = "SUBMITWORK_RES"
+	logMapping[64] = "WORK_REJECTED"
+
 	logMapping[100] = "MINER_PING"
 	logMapping[101] = "MINER_PONG"
 
 	logMapping[110] = "NOT_FOUND"
+	logMapping[111] = "PRUNED"
+	logMapping[112] = "TX_REJECTED"
 }
@@ -1,6 +1,7 @@
 package p2p
 
 import (
+	"github.com/lisgie/bazo_miner/storage"
 	"os"
 	"testing"
 )
@@ -13,6 +14,7 @@ var (
 func TestMain(m *testing.M) {
 
 	logInit()
+	store = storage.NewMemStorage()
 
 	//Used for some tests, the bootstarp server is listening at 8000 at the same time
 	localConn = "127.0.0.1:9000"
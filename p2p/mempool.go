@@ -0,0 +1,122 @@
+package p2p
+
+import (
+	"github.com/lisgie/bazo_miner/protocol"
+)
+
+//Miners exchange their mempools right after the handshake, otherwise a freshly started miner only knows the txs that
+//are broadcast after it connected. Both sides ask for the other's inventory (the hashes of all open txs) and fetch the
+//txs they don't have yet from the same peer.
+//Inventory entries consist of the tx type (the broadcast id) and the hash, fetched txs are sent as type | encoded tx.
+
+const (
+	MEMPOOLINV_ENTRY_SIZE = 33
+)
+
+func mempoolReq(p *peer) {
+
+	packet := BuildPacket(MEMPOOL_REQ, nil)
+	sendData(p, packet)
+}
+
+//Pending txs come first, this way the requesting miner can add the txs of a sender in TxCnt order
+func mempoolRes(p *peer) {
+
+	openTxs := append(store.ReadPendingTxs(), store.ReadQueuedTxs()...)
+
+	inventory := make([]byte, 0, len(openTxs)*MEMPOOLINV_ENTRY_SIZE)
+	for _, tx := range openTxs {
+		txHash := tx.Hash()
+		inventory = append(inventory, txBrdcstType(tx))
+		inventory = append(inventory, txHash[:]...)
+	}
+
+	packet := BuildPacket(MEMPOOL_RES, inventory)
+	sendData(p, packet)
+}
+
+//Requests all txs we know neither as open nor as closed, in batches of MEMPOOL_FETCHSIZE hashes
+func processMempoolRes(p *peer, payload []byte) {
+
+	var missing []byte
+	for index := 0; index+MEMPOOLINV_ENTRY_SIZE <= len(payload); index += MEMPOOLINV_ENTRY_SIZE {
+		var txHash [32]byte
+		copy(txHash[:], payload[index+1:index+MEMPOOLINV_ENTRY_SIZE])
+
+		if store.ReadOpenTx(txHash) != nil || store.ReadTxLocation(txHash) != nil {
+			continue
+		}
+		missing = append(missing, txHash[:]...)
+	}
+
+	logger.Printf("%v of %v txs in the mempool of %v are missing.\n", len(missing)/32, len(payload)/MEMPOOLINV_ENTRY_SIZE, p.getIPPort())
+
+	for len(missing) > 0 {
+		batchSize := len(missing)
+		if batchSize > MEMPOOL_FETCHSIZE*32 {
+			batchSize = MEMPOOL_FETCHSIZE * 32
+		}
+		packet := BuildPacket(MEMPOOLTX_REQ, missing[:batchSize])
+		sendData(p, packet)
+		missing = missing[batchSize:]
+	}
+}
+
+//Txs that left the mempool in the meantime are skipped, the requesting miner learns about them with the next block
+func mempoolTxRes(p *peer, payload []byte) {
+
+	for index := 0; index+32 <= len(payload); index += 32 {
+		var txHash [32]byte
+		copy(txHash[:], payload[index:index+32])
+
+		tx := store.ReadOpenTx(txHash)
+		if tx == nil {
+			continue
+		}
+
+		packet := BuildPacket(MEMPOOLTX_RES, append([]byte{txBrdcstType(tx)}, tx.Encode()...))
+		sendData(p, packet)
+	}
+}
+
+//Fetched txs are checked like broadcast txs, but they're not relayed (the peer's neighbors have most likely seen them
+//already) and rejections don't count against the peer. Mempools differ, e.g., if the peer hasn't seen the latest block
+func processMempoolTxRes(p *peer, payload []byte) {
+
+	if len(payload) < 1 {
+		return
+	}
+
+	tx := decodeTx(payload[1:], payload[0])
+	if tx == nil {
+		return
+	}
+	if store.ReadOpenTx(tx.Hash()) != nil || store.ReadTxLocation(tx.Hash()) != nil {
+		return
+	}
+
+	if ValidateTx != nil {
+		if err := ValidateTx(tx); err != nil {
+			logger.Printf("Transaction (%x) from the mempool of %v is invalid: %v\n", tx.Hash(), p.getIPPort(), err)
+			return
+		}
+	}
+
+	if err := store.WriteOpenTx(tx); err != nil {
+		logger.Printf("Transaction (%x) from the mempool of %v not accepted: %v\n", tx.Hash(), p.getIPPort(), err)
+	}
+}
+
+func txBrdcstType(tx protocol.Transaction) (brdcstType uint8) {
+
+	switch tx.(type) {
+	case *protocol.FundsTx:
+		brdcstType = FUNDSTX_BRDCST
+	case *protocol.AccTx:
+		brdcstType = ACCTX_BRDCST
+	case *protocol.ConfigTx:
+		brdcstType = CONFIGTX_BRDCST
+	}
+
+	return brdcstType
+}
@@ -0,0 +1,75 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"github.com/lisgie/bazo_miner/protocol"
+	"github.com/lisgie/bazo_miner/storage"
+	"net"
+	"testing"
+)
+
+//Inventory, fetch request and tx response of a mempool exchange, both miners share the same store in this test
+func TestMempoolSync(t *testing.T) {
+
+	store = storage.NewMemStorage()
+
+	privKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	var txs []*protocol.ConfigTx
+	for cnt := 0; cnt < 3; cnt++ {
+		tx, _ := protocol.ConstrConfigTx(0, 1, uint64(cnt), 1, 0, privKey)
+		txs = append(txs, tx)
+	}
+	store.WriteOpenTx(txs[0])
+
+	local, remote := net.Pipe()
+	p := &peer{conn: local, listenerPort: "8000"}
+	received := make(chan []byte)
+	go func() {
+		for {
+			header, payload, err := rcvData(&peer{conn: remote})
+			if err != nil {
+				close(received)
+				return
+			}
+			received <- append([]byte{header.TypeID}, payload...)
+		}
+	}()
+	defer local.Close()
+
+	//Our inventory only contains the tx we have
+	go mempoolRes(p)
+	inventory := <-received
+	hash0 := txs[0].Hash()
+	if inventory[0] != MEMPOOL_RES || len(inventory) != 1+MEMPOOLINV_ENTRY_SIZE || inventory[1] != CONFIGTX_BRDCST || !bytes.Equal(inventory[2:], hash0[:]) {
+		t.Errorf("Wrong mempool inventory: %x\n", inventory)
+	}
+
+	//Only the missing txs are requested
+	var peerInventory []byte
+	for _, tx := range txs {
+		txHash := tx.Hash()
+		peerInventory = append(append(peerInventory, CONFIGTX_BRDCST), txHash[:]...)
+	}
+	go processMempoolRes(p, peerInventory)
+	req := <-received
+	hash1, hash2 := txs[1].Hash(), txs[2].Hash()
+	if req[0] != MEMPOOLTX_REQ || !bytes.Equal(req[1:], append(hash1[:], hash2[:]...)) {
+		t.Errorf("Wrong mempool tx request: %x\n", req)
+	}
+
+	//Txs we have are sent, unknown hashes are skipped
+	go mempoolTxRes(p, append(hash0[:], hash1[:]...))
+	res := <-received
+	if res[0] != MEMPOOLTX_RES || res[1] != CONFIGTX_BRDCST || !bytes.Equal(res[2:], txs[0].Encode()) {
+		t.Errorf("Wrong mempool tx response: %x\n", res)
+	}
+
+	//Fetched txs end up in the mempool
+	processMempoolTxRes(p, append([]byte{CONFIGTX_BRDCST}, txs[1].Encode()...))
+	if store.ReadOpenTx(hash1) == nil {
+		t.Error("Fetched tx was not written to the mempool.\n")
+	}
+}
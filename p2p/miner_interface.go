@@ -2,6 +2,7 @@ package p2p
 
 import (
 	"github.com/lisgie/bazo_miner/protocol"
+	"sync/atomic"
 )
 
 var (
@@ -15,8 +16,29 @@ var (
 	AccTxChan = make(chan *protocol.AccTx)
 	ConfigTxChan = make(chan *protocol.ConfigTx)
 	BlockReqChan = make(chan []byte)
+	//Buffered, all peers are asked for their snapshot at the same time
+	SnapshotChan = make(chan *SnapshotInfo, MAX_MINERS)
+	SnapshotChunkChan = make(chan *SnapshotChunk)
+
+	//Set by the miner, checks broadcast txs before they're written to the mempool and relayed. Without it, every tx
+	//that can be decoded is accepted. Txs that are invalid no matter the state are rejected with a TxFault
+	ValidateTx func(tx protocol.Transaction) error
+
+	//Set by the miner, hand out block templates to external workers and accept their nonces (see work.go)
+	GetWork    func() (*Work, error)
+	SubmitWork func(templateID uint32, nonce [8]byte) error
 )
 
+//Rejection of a tx that no valid chain accepts (e.g., a bad signature or a fee below the minimum), the sender can't
+//be an honest miner. Other rejections happen to honest miners as well, e.g. if their chain is ahead or behind ours
+type TxFault struct {
+	Reason string
+}
+
+func (fault *TxFault) Error() string {
+	return fault.Reason
+}
+
 //This is for blocks and txs that the miner successfully validated
 func receiveBlockFromMiner() {
 	for {
@@ -66,5 +88,5 @@ func forwardBlockReqToMiner(p *peer, payload []byte) {
 }
 
 func ReadSystemTime() int64 {
-	return systemTime
+	return atomic.LoadInt64(&systemTime)
 }
@@ -16,6 +16,8 @@ type peer struct {
 	l            sync.Mutex
 	listenerPort string
 	time         int64
+	//Number of broadcast txs that didn't pass the admission check
+	invalidTxs uint32
 }
 
 //peerStruct is a thread-safe map that supports all necessary map operations needed by the server
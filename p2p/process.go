@@ -4,53 +4,99 @@ import (
 	"encoding/binary"
 	"strconv"
 	"github.com/lisgie/bazo_miner/protocol"
-	"github.com/lisgie/bazo_miner/storage"
 )
 
 //Process tx broadcasts from other miners. We can't broadcast incoming messages directly, first check if
 //the tx has already been broadcast before, whether it is a valid tx etc.
 func processTxBrdcst(p *peer, payload []byte, brdcstType uint8) {
 
-	var tx protocol.Transaction
-
 	//Make sure the transaction can be properly decoded, verification is done at a later stage to reduce latency
+	tx := decodeTx(payload, brdcstType)
+	if tx == nil {
+		return
+	}
+	if store.ReadOpenTx(tx.Hash()) != nil {
+		logger.Printf("Received transaction (%x) already in the mempool.\n", tx.Hash())
+		return
+	}
+	if store.ReadTxLocation(tx.Hash()) != nil {
+		logger.Printf("Received transaction (%x) already validated.\n", tx.Hash())
+		return
+	}
+
+	//Invalid txs are not relayed, otherwise they'd be gossiped through the whole network
+	if ValidateTx != nil {
+		if err := ValidateTx(tx); err != nil {
+			rejectTx(p, tx, err)
+			return
+		}
+	}
+
+	//Write to mempool and rebroadcast
+	logger.Printf("Writing transaction (%x) in the mempool.\n", tx.Hash())
+	if err := store.WriteOpenTx(tx); err != nil {
+		logger.Printf("Transaction (%x) not accepted by the mempool: %v\n", tx.Hash(), err)
+		return
+	}
+	toBrdcst := BuildPacket(brdcstType, payload)
+	brdcstMsg <- toBrdcst
+}
+
+//Returns nil if the payload is not a valid encoding of the given broadcast type
+func decodeTx(payload []byte, brdcstType uint8) protocol.Transaction {
+
 	switch brdcstType {
 	case FUNDSTX_BRDCST:
 		var fTx *protocol.FundsTx
-		fTx = fTx.Decode(payload)
-		if fTx == nil {
-			return
+		if fTx = fTx.Decode(payload); fTx != nil {
+			return fTx
 		}
-		tx = fTx
 	case ACCTX_BRDCST:
 		var aTx *protocol.AccTx
-		aTx = aTx.Decode(payload)
-		if aTx == nil {
-			return
+		if aTx = aTx.Decode(payload); aTx != nil {
+			return aTx
 		}
-		tx = aTx
 	case CONFIGTX_BRDCST:
 		var cTx *protocol.ConfigTx
-		cTx = cTx.Decode(payload)
-		if cTx == nil {
-			return
+		if cTx = cTx.Decode(payload); cTx != nil {
+			return cTx
 		}
-		tx = cTx
 	}
-	if storage.ReadOpenTx(tx.Hash()) != nil {
-		logger.Printf("Received transaction (%x) already in the mempool.\n", tx.Hash())
+
+	return nil
+}
+
+//Tells the sender why the tx was rejected. Miners that keep sending faulty txs (see TxFault) are disconnected, the
+//reader of the connection (see minerConn) then cleans up
+func rejectTx(p *peer, tx protocol.Transaction, reason error) {
+
+	txHash := tx.Hash()
+	logger.Printf("Rejected transaction (%x) from %v: %v\n", txHash[0:8], p.conn.RemoteAddr().String(), reason)
+
+	packet := BuildPacket(TX_REJECTED, append(txHash[:], []byte(reason.Error())...))
+	sendData(p, packet)
+
+	if _, faulty := reason.(*TxFault); !faulty {
 		return
 	}
-	if storage.ReadClosedTx(tx.Hash()) != nil {
-		logger.Printf("Received transaction (%x) already validated.\n", tx.Hash())
-		return
+
+	p.l.Lock()
+	p.invalidTxs++
+	invalidTxs := p.invalidTxs
+	p.l.Unlock()
+
+	if invalidTxs > MAX_INVALID_TXS {
+		logger.Printf("Disconnecting %v, sent %v invalid transactions.\n", p.conn.RemoteAddr().String(), invalidTxs)
+		p.conn.Close()
 	}
+}
 
-	//Write to mempool and rebroadcast
-	logger.Printf("Writing transaction (%x) in the mempool.\n", tx.Hash())
-	storage.WriteOpenTx(tx)
-	toBrdcst := BuildPacket(brdcstType, payload)
-	brdcstMsg <- toBrdcst
+func processTxRejected(p *peer, payload []byte) {
+
+	if len(payload) < 32 {
+		return
+	}
+	logger.Printf("Transaction (%x) rejected by %v: %s\n", payload[0:8], p.conn.RemoteAddr().String(), payload[32:])
 }
 
 func processTimeRes(p *peer, payload []byte) {
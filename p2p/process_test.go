@@ -1,6 +1,13 @@
 package p2p
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
+	"github.com/lisgie/bazo_miner/protocol"
+	"github.com/lisgie/bazo_miner/storage"
+	"net"
 	"testing"
 )
 
@@ -30,3 +37,64 @@ func TestProcessNeighborRes(t *testing.T) {
 		t.Errorf("Parsing IP address failed: %v\n", ipportList[3])
 	}
 }
+
+//Invalid txs are neither written to the mempool nor relayed, the sender is told why. Only senders of faulty txs are
+//disconnected eventually
+func TestRejectTx(t *testing.T) {
+
+	store = storage.NewMemStorage()
+	defer func() { ValidateTx = nil }()
+	var fault bool
+	ValidateTx = func(tx protocol.Transaction) error {
+		if fault {
+			return &TxFault{Reason: "invalid"}
+		}
+		return errors.New("invalid")
+	}
+
+	privKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	local, remote := net.Pipe()
+	p := &peer{conn: local, listenerPort: "8000"}
+
+	//Collect the rejections the peer receives until the connection is closed
+	rejections := make(chan int)
+	go func() {
+		var cnt int
+		for {
+			header, payload, err := rcvData(&peer{conn: remote})
+			if err != nil {
+				rejections <- cnt
+				return
+			}
+			if header.TypeID == TX_REJECTED && string(payload[32:]) == "invalid" {
+				cnt++
+			}
+		}
+	}()
+
+	//Txs that can be invalid for us but valid for the sender (e.g., a TxCnt it has not seen used yet) don't count
+	var cnt uint64
+	for ; cnt <= MAX_INVALID_TXS; cnt++ {
+		tx, _ := protocol.ConstrConfigTx(0, 1, cnt, 1, 0, privKey)
+		processTxBrdcst(p, tx.Encode(), CONFIGTX_BRDCST)
+	}
+	if p.invalidTxs != 0 {
+		t.Errorf("Peer has %v invalid txs without sending a faulty one\n", p.invalidTxs)
+	}
+
+	fault = true
+	for ; cnt <= 2*MAX_INVALID_TXS+1; cnt++ {
+		tx, _ := protocol.ConstrConfigTx(0, 1, cnt, 1, 0, privKey)
+		processTxBrdcst(p, tx.Encode(), CONFIGTX_BRDCST)
+		if store.ReadOpenTx(tx.Hash()) != nil {
+			t.Error("Invalid tx was written to the mempool.\n")
+		}
+	}
+
+	if cnt := <-rejections; cnt != 2*(MAX_INVALID_TXS+1) {
+		t.Errorf("Peer received %v rejections, want %v\n", cnt, 2*(MAX_INVALID_TXS+1))
+	}
+	if p.invalidTxs != MAX_INVALID_TXS+1 {
+		t.Errorf("Peer has %v invalid txs, want %v\n", p.invalidTxs, MAX_INVALID_TXS+1)
+	}
+}
@@ -16,12 +16,20 @@ const (
 	CONFIGTX_REQ = 12
 	BLOCK_REQ    = 13
 	ACC_REQ      = 14
+	SNAPSHOT_REQ      = 15
+	SNAPSHOTCHUNK_REQ = 16
+	MEMPOOL_REQ       = 17
+	MEMPOOLTX_REQ     = 18
 
 	FUNDSTX_RES  = 20
 	ACCTX_RES    = 21
 	CONFIGTX_RES = 22
 	BLOCK_RES    = 23
 	ACC_RES      = 24
+	SNAPSHOT_RES      = 25
+	SNAPSHOTCHUNK_RES = 26
+	MEMPOOL_RES       = 27
+	MEMPOOLTX_RES     = 28
 
 	NEIGHBOR_REQ = 30
 
@@ -29,11 +37,23 @@ const (
 
 	TIME_BRDCST = 50
 
+	//Interface for external mining workers, see work.go
+	WORK_REQ       = 60
+	WORK_RES       = 61
+	SUBMITWORK_REQ = 62
+	SUBMITWORK_RES = 63
+	//Work could not be handed out or the submission was not accepted. The payload is the reason
+	WORK_REJECTED = 64
+
 	MINER_PING = 100
 	MINER_PONG = 101
 
 	//Used to signal error
 	NOT_FOUND = 110
+	//The data existed, but a pruned node has discarded it. The payload is the requested hash
+	PRUNED = 111
+	//A broadcast tx was not accepted. The payload is the tx hash followed by the reason
+	TX_REJECTED = 112
 )
 
 type Header struct {
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"encoding/binary"
 	"github.com/lisgie/bazo_miner/protocol"
-	"github.com/lisgie/bazo_miner/storage"
 	"strconv"
 	"strings"
 )
@@ -17,8 +16,8 @@ func txRes(p *peer, payload []byte, txKind uint8) {
 
 	var tx protocol.Transaction
 	//Check closed and open storage if the tx is available
-	openTx := storage.ReadOpenTx(txHash)
-	closedTx := storage.ReadClosedTx(txHash)
+	openTx := store.ReadOpenTx(txHash)
+	closedTx := store.ReadClosedTx(txHash)
 
 	if openTx != nil {
 		tx = openTx
@@ -26,7 +25,12 @@ func txRes(p *peer, payload []byte, txKind uint8) {
 		tx = closedTx
 	}
 
-	//In case it was not found, send a corresponding message back
+	//In case it was not found, send a corresponding message back. Pruned txs need to be requested from another miner
+	if tx == nil && store.IsPruned(txHash) {
+		packet := BuildPacket(PRUNED, txHash[:])
+		sendData(p, packet)
+		return
+	}
 	if tx == nil {
 		packet := BuildPacket(NOT_FOUND, nil)
 		sendData(p, packet)
@@ -56,9 +60,9 @@ func blockRes(p *peer, payload []byte) {
 
 	copy(blockHash[:], payload[0:32])
 
-	block = storage.ReadClosedBlock(blockHash)
+	block = store.ReadClosedBlock(blockHash)
 	if block == nil {
-		block = storage.ReadOpenBlock(blockHash)
+		block = store.ReadOpenBlock(blockHash)
 	}
 
 	if block == nil {
@@ -67,16 +71,35 @@ func blockRes(p *peer, payload []byte) {
 		return
 	}
 
+	//The block itself is kept, but the requesting miner wouldn't be able to fetch its txs from us
+	if isPrunedBlock(block) {
+		packet := BuildPacket(PRUNED, blockHash[:])
+		sendData(p, packet)
+		return
+	}
+
 	packet := BuildPacket(BLOCK_RES, block.Encode())
 	sendData(p, packet)
 }
 
+//All txs of a block are pruned at once, checking one of them is enough
+func isPrunedBlock(block *protocol.Block) bool {
+
+	for _, txHashes := range [][][32]byte{block.AccTxData, block.FundsTxData, block.ConfigTxData} {
+		if len(txHashes) > 0 {
+			return store.IsPruned(txHashes[0])
+		}
+	}
+	return false
+}
+
 //Responds to an account request from another miner
 func accRes(p *peer, payload []byte) {
 
 	var hash [32]byte
 	copy(hash[:], payload[0:32])
-	acc := storage.GetAccountFromHash(hash)
+	//Snapshots return a consistent copy, even if a block is validated at the same time
+	acc := store.State().Snapshot().GetAccount(hash)
 	encodedAcc := acc.Encode()
 
 	if encodedAcc == nil {
@@ -106,10 +129,11 @@ func pongRes(p *peer, payload []byte) {
 		return
 	}
 
-	go minerConn(p)
-	//Complete handshake
+	//Complete handshake. The pong needs to be the first message the other miner receives, minerConn starts sending
+	//requests right away
 	packet := BuildPacket(MINER_PONG, nil)
 	sendData(p, packet)
+	go minerConn(p)
 }
 
 //Decouple the function for testing
@@ -2,6 +2,8 @@ package p2p
 
 import (
 	"encoding/binary"
+	"github.com/lisgie/bazo_miner/protocol"
+	"github.com/lisgie/bazo_miner/storage"
 	"strconv"
 	"testing"
 )
@@ -61,3 +63,31 @@ func Test_PongRes(t *testing.T) {
 		t.Errorf("Failed to extract IP:Port: (%v) vs. (%v)\n", "8000", ipportRet)
 	}
 }
+
+func TestIsPrunedBlock(t *testing.T) {
+
+	store = storage.NewMemStorage()
+
+	b := new(protocol.Block)
+	b.Hash = [32]byte{'p', 'r', 'u', 'n', 'e'}
+	b.FundsTxData = [][32]byte{{'t', 'x'}}
+
+	batch := storage.NewBatch()
+	batch.WriteTxLocation(b.FundsTxData[0], &storage.TxLocation{BlockHash: b.Hash, Height: 5, TxType: storage.FUNDSTX})
+	store.Commit(batch)
+
+	if isPrunedBlock(b) || isPrunedBlock(new(protocol.Block)) {
+		t.Error("Block was reported as pruned before pruning.\n")
+	}
+
+	batch = storage.NewBatch()
+	batch.WritePrunedHeight(5)
+	store.Commit(batch)
+
+	if !isPrunedBlock(b) {
+		t.Error("Pruned block was not reported as pruned.\n")
+	}
+	if isPrunedBlock(new(protocol.Block)) {
+		t.Error("Empty block was reported as pruned.\n")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"github.com/lisgie/bazo_miner/storage"
 	"log"
 	"net"
 	"strconv"
@@ -18,6 +19,7 @@ var (
 	peers      peersStruct
 
 	logger     *log.Logger
+	store      storage.Storage
 
 	iplistChan = make(chan string, MIN_MINERS)
 	brdcstMsg = make(chan []byte)
@@ -26,9 +28,10 @@ var (
 )
 
 //Entry point for p2p package
-func Init(connTuple string) error {
+func Init(connTuple string, st storage.Storage) error {
 
 	logInit()
+	store = st
 
 	//Initialize peer map
 	peers.peerConns = make(map[*peer]bool)
@@ -84,7 +87,7 @@ func initiateNewMinerConnection(ipport string) (*peer, error) {
 	//Open up a tcp connection and instantiate a peer struct, wait for adding it to the peerStruct before we finalize
 	//the handshake
 	conn, err := net.Dial("tcp", ipport)
-	p := &peer{conn, nil, sync.Mutex{}, strings.Split(ipport, ":")[1], 0}
+	p := &peer{conn, nil, sync.Mutex{}, strings.Split(ipport, ":")[1], 0, 0}
 
 	if err != nil {
 		return nil, err
@@ -137,7 +140,7 @@ func listener(ipport string) {
 			logger.Printf("%v\n", err)
 			continue
 		}
-		p := &peer{conn, nil, sync.Mutex{}, "", 0}
+		p := &peer{conn, nil, sync.Mutex{}, "", 0, 0}
 		go handleNewConn(p)
 	}
 }
@@ -164,6 +167,9 @@ func minerConn(p *peer) {
 	register <- p
 	go peerBroadcast(p)
 
+	//The handshake is complete, catch up with the txs the miner knows about
+	mempoolReq(p)
+
 	for {
 		header, payload, err := rcvData(p)
 		if err != nil {
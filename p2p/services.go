@@ -1,6 +1,7 @@
 package p2p
 
 import (
+	"sync/atomic"
 	"time"
 )
 
@@ -69,7 +70,7 @@ func checkHealthService() {
 //Calculates periodically system time from available sources and broadcasts the time to all connected peers
 func timeService() {
 	//Initialize system time
-	systemTime = time.Now().Unix()
+	atomic.StoreInt64(&systemTime, time.Now().Unix())
 	go func() {
 		for {
 			time.Sleep(UPDATE_SYS_TIME * time.Second)
@@ -0,0 +1,177 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+//Miners serve the latest state snapshot that has been committed to by a block. New miners first ask for the
+//snapshot's height, the committing block and its size, and then fetch the snapshot chunk by chunk
+
+const (
+	SNAPSHOTINFO_SIZE    = 40
+	SNAPSHOTCHUNKREQ_SIZE = 8
+)
+
+type SnapshotInfo struct {
+	//The snapshot is the state after the block at this height
+	Height    uint32
+	BlockHash [32]byte
+	Size      uint32
+	//Not serialized, chunks are requested from the peer that offered the snapshot
+	peer      *peer
+}
+
+type SnapshotChunk struct {
+	Height uint32
+	Index  uint32
+	Data   []byte
+}
+
+func (info *SnapshotInfo) Encode() (encoded []byte) {
+
+	encoded = make([]byte, SNAPSHOTINFO_SIZE)
+	binary.BigEndian.PutUint32(encoded[0:4], info.Height)
+	copy(encoded[4:36], info.BlockHash[:])
+	binary.BigEndian.PutUint32(encoded[36:40], info.Size)
+
+	return encoded
+}
+
+func (*SnapshotInfo) Decode(encoded []byte) (info *SnapshotInfo) {
+
+	if len(encoded) != SNAPSHOTINFO_SIZE {
+		return nil
+	}
+
+	info = new(SnapshotInfo)
+	info.Height = binary.BigEndian.Uint32(encoded[0:4])
+	copy(info.BlockHash[:], encoded[4:36])
+	info.Size = binary.BigEndian.Uint32(encoded[36:40])
+
+	return info
+}
+
+//Chunks are sent as height (4) | index (4) | data, the request consists of height and index only
+func (chunk *SnapshotChunk) Encode() (encoded []byte) {
+
+	encoded = make([]byte, SNAPSHOTCHUNKREQ_SIZE+len(chunk.Data))
+	binary.BigEndian.PutUint32(encoded[0:4], chunk.Height)
+	binary.BigEndian.PutUint32(encoded[4:8], chunk.Index)
+	copy(encoded[8:], chunk.Data)
+
+	return encoded
+}
+
+func (*SnapshotChunk) Decode(encoded []byte) (chunk *SnapshotChunk) {
+
+	if len(encoded) < SNAPSHOTCHUNKREQ_SIZE {
+		return nil
+	}
+
+	chunk = new(SnapshotChunk)
+	chunk.Height = binary.BigEndian.Uint32(encoded[0:4])
+	chunk.Index = binary.BigEndian.Uint32(encoded[4:8])
+	chunk.Data = encoded[8:]
+
+	return chunk
+}
+
+func snapshotRes(p *peer) {
+
+	height, snapshot := store.ReadLatestSnapshot()
+	block := store.ReadBlockByHeight(height + 1)
+	if snapshot == nil || block == nil || !block.HasStateCommitment() {
+		packet := BuildPacket(NOT_FOUND, nil)
+		sendData(p, packet)
+		return
+	}
+
+	info := SnapshotInfo{Height: height, BlockHash: block.Hash, Size: uint32(len(snapshot))}
+	packet := BuildPacket(SNAPSHOT_RES, info.Encode())
+	sendData(p, packet)
+}
+
+func snapshotChunkRes(p *peer, payload []byte) {
+
+	var req *SnapshotChunk
+	req = req.Decode(payload)
+
+	var snapshot []byte
+	if req != nil {
+		snapshot = store.ReadSnapshot(req.Height)
+	}
+	if snapshot == nil || uint64(req.Index)*SNAPSHOT_CHUNKSIZE >= uint64(len(snapshot)) {
+		packet := BuildPacket(NOT_FOUND, nil)
+		sendData(p, packet)
+		return
+	}
+
+	from := uint64(req.Index) * SNAPSHOT_CHUNKSIZE
+	to := from + SNAPSHOT_CHUNKSIZE
+	if to > uint64(len(snapshot)) {
+		to = uint64(len(snapshot))
+	}
+
+	chunk := SnapshotChunk{req.Height, req.Index, snapshot[from:to]}
+	packet := BuildPacket(SNAPSHOTCHUNK_RES, chunk.Encode())
+	sendData(p, packet)
+}
+
+//The peer is remembered in the info that is handed over to the miner, chunk requests go to the same peer
+func forwardSnapshotResToMiner(p *peer, payload []byte) {
+
+	var info *SnapshotInfo
+	if info = info.Decode(payload); info == nil {
+		return
+	}
+	info.peer = p
+
+	//Nobody is waiting if the response is unsolicited or arrives after the timeout
+	select {
+	case SnapshotChan <- info:
+	default:
+	}
+}
+
+func forwardSnapshotChunkResToMiner(p *peer, payload []byte) {
+
+	var chunk *SnapshotChunk
+	if chunk = chunk.Decode(payload); chunk == nil {
+		return
+	}
+
+	select {
+	case SnapshotChunkChan <- chunk:
+	default:
+	}
+}
+
+//Asks all connected miners for their latest snapshot, a single peer could offer the snapshot of any chain it likes.
+//Returns the number of peers that have been asked
+func SnapshotReq() (int, error) {
+
+	peerList := peers.getAllPeers()
+	if len(peerList) == 0 {
+		return 0, errors.New("Couldn't get a connection, request not transmitted.")
+	}
+
+	packet := BuildPacket(SNAPSHOT_REQ, nil)
+	for _, p := range peerList {
+		sendData(p, packet)
+	}
+	return len(peerList), nil
+}
+
+//The info needs to come from SnapshotChan, the chunk is requested from the peer that offered the snapshot
+func SnapshotChunkReq(info *SnapshotInfo, index uint32) error {
+
+	if info.peer == nil {
+		return errors.New("Snapshot was not offered by a peer, request not transmitted.")
+	}
+
+	req := SnapshotChunk{info.Height, index, nil}
+	packet := BuildPacket(SNAPSHOTCHUNK_REQ, req.Encode())
+	sendData(info.peer, packet)
+	return nil
+}
@@ -3,9 +3,11 @@ package p2p
 import (
 	"encoding/binary"
 	"sort"
+	"sync/atomic"
 	"time"
 )
 
+//Written by the time service, read by the miner's block validation. Only accessed atomically
 var (
 	systemTime     int64
 )
@@ -35,11 +37,11 @@ func writeSystemTime() {
 
 	//If we don't have at least MIN_PEERS_FOR_TIME different time values, we take our own system time for reference
 	if len(ipeerTimes) < MIN_PEERS_FOR_TIME {
-		systemTime = time.Now().Unix()
+		atomic.StoreInt64(&systemTime, time.Now().Unix())
 		return
 	}
 
-	systemTime = calcMedian(ipeerTimes)
+	atomic.StoreInt64(&systemTime, calcMedian(ipeerTimes))
 }
 
 //To protect against outliers, get the median
@@ -0,0 +1,114 @@
+package p2p
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+//External workers fetch work from a node and submit the nonces they find. Both are requests of a client connection,
+//the connection is answered like any other request:
+//	- WORK_REQ (no payload) -> WORK_RES: template id (4) | compact target (4) | partial hash (32)
+//	- SUBMITWORK_REQ: template id (4) | nonce (8) -> SUBMITWORK_RES (no payload) or WORK_REJECTED: reason
+//Building a template holds up block validation, only workers on the same host and the ones in WorkerIPs are served
+
+const (
+	WORK_SIZE          = 40
+	SUBMITWORKREQ_SIZE = 12
+)
+
+//Addresses of external workers on other hosts, set at startup
+var WorkerIPs []net.IP
+
+type Work struct {
+	TemplateID uint32
+	//Compact encoding (see protocol.CompactToTarget) of the target sha3(nonce | partial hash) needs to meet
+	Target      uint32
+	PartialHash [32]byte
+}
+
+func (work *Work) Encode() (encoded []byte) {
+
+	encoded = make([]byte, WORK_SIZE)
+	binary.BigEndian.PutUint32(encoded[0:4], work.TemplateID)
+	binary.BigEndian.PutUint32(encoded[4:8], work.Target)
+	copy(encoded[8:40], work.PartialHash[:])
+
+	return encoded
+}
+
+func (*Work) Decode(encoded []byte) (work *Work) {
+
+	if len(encoded) != WORK_SIZE {
+		return nil
+	}
+
+	work = new(Work)
+	work.TemplateID = binary.BigEndian.Uint32(encoded[0:4])
+	work.Target = binary.BigEndian.Uint32(encoded[4:8])
+	copy(work.PartialHash[:], encoded[8:40])
+
+	return work
+}
+
+func isWorker(addr net.Addr) bool {
+
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	if tcpAddr.IP.IsLoopback() {
+		return true
+	}
+	for _, ip := range WorkerIPs {
+		if ip.Equal(tcpAddr.IP) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func workRes(p *peer) {
+
+	if GetWork == nil || !isWorker(p.conn.RemoteAddr()) {
+		packet := BuildPacket(WORK_REJECTED, []byte("Node does not hand out work."))
+		sendData(p, packet)
+		return
+	}
+
+	work, err := GetWork()
+	if err != nil {
+		packet := BuildPacket(WORK_REJECTED, []byte(err.Error()))
+		sendData(p, packet)
+		return
+	}
+
+	packet := BuildPacket(WORK_RES, work.Encode())
+	sendData(p, packet)
+}
+
+func submitWorkRes(p *peer, payload []byte) {
+
+	if SubmitWork == nil || !isWorker(p.conn.RemoteAddr()) {
+		packet := BuildPacket(WORK_REJECTED, []byte("Node does not hand out work."))
+		sendData(p, packet)
+		return
+	}
+	if len(payload) != SUBMITWORKREQ_SIZE {
+		packet := BuildPacket(WORK_REJECTED, []byte("Malformed submission."))
+		sendData(p, packet)
+		return
+	}
+
+	var nonce [8]byte
+	copy(nonce[:], payload[4:12])
+	if err := SubmitWork(binary.BigEndian.Uint32(payload[0:4]), nonce); err != nil {
+		logger.Printf("Work submitted by %v rejected: %v\n", p.conn.RemoteAddr().String(), err)
+		packet := BuildPacket(WORK_REJECTED, []byte(err.Error()))
+		sendData(p, packet)
+		return
+	}
+
+	packet := BuildPacket(SUBMITWORK_RES, nil)
+	sendData(p, packet)
+}
@@ -0,0 +1,87 @@
+package p2p
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestWorkSubmission(t *testing.T) {
+
+	work := &Work{TemplateID: 7, Target: 0x1d3fffff, PartialHash: [32]byte{1, 2, 3}}
+	var decoded *Work
+	if decoded = decoded.Decode(work.Encode()); !reflect.DeepEqual(work, decoded) {
+		t.Errorf("Work serialization failed (%v) vs. (%v)\n", work, decoded)
+	}
+
+	defer func() { SubmitWork = nil }()
+	SubmitWork = func(templateID uint32, nonce [8]byte) error {
+		if templateID != 7 || nonce != [8]byte{0, 0, 0, 0, 0, 0, 0, 9} {
+			return errors.New("invalid")
+		}
+		return nil
+	}
+
+	local, remote := net.Pipe()
+	defer local.Close()
+	p := &peer{conn: workerConn{local, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}}, listenerPort: "8000"}
+
+	for _, test := range []struct {
+		payload []byte
+		typeID  uint8
+	}{
+		{[]byte{0, 0, 0, 7, 0, 0, 0, 0, 0, 0, 0, 9}, SUBMITWORK_RES},
+		{[]byte{0, 0, 0, 7, 0, 0, 0, 0, 0, 0, 0, 8}, WORK_REJECTED},
+		{[]byte{0, 0, 0, 7}, WORK_REJECTED},
+	} {
+		go submitWorkRes(p, test.payload)
+		header, _, err := rcvData(&peer{conn: remote})
+		if err != nil || header.TypeID != test.typeID {
+			t.Errorf("Submission %x answered with %v, want %v (%v)\n", test.payload, header, test.typeID, err)
+		}
+	}
+}
+
+//Pipes don't have an IP address
+type workerConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (conn workerConn) RemoteAddr() net.Addr {
+	return conn.remote
+}
+
+//Only local workers and the configured ones are served
+func TestWorkerAuthorization(t *testing.T) {
+
+	defer func() { WorkerIPs = nil }()
+	WorkerIPs = []net.IP{net.ParseIP("10.0.0.2")}
+
+	for _, test := range []struct {
+		addr   net.Addr
+		worker bool
+	}{
+		{&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, true},
+		{&net.TCPAddr{IP: net.IPv6loopback}, true},
+		{&net.TCPAddr{IP: net.IPv4(10, 0, 0, 2)}, true},
+		{&net.TCPAddr{IP: net.IPv4(10, 0, 0, 3)}, false},
+		{workerConn{}.RemoteAddr(), false},
+	} {
+		if isWorker(test.addr) != test.worker {
+			t.Errorf("Worker %v authorization should be %v\n", test.addr, test.worker)
+		}
+	}
+
+	defer func() { GetWork = nil }()
+	GetWork = func() (*Work, error) { return &Work{}, nil }
+
+	local, remote := net.Pipe()
+	defer local.Close()
+	p := &peer{conn: workerConn{local, &net.TCPAddr{IP: net.IPv4(10, 0, 0, 3)}}, listenerPort: "8000"}
+	go workRes(p)
+	if header, _, err := rcvData(&peer{conn: remote}); err != nil || header.TypeID != WORK_REJECTED {
+		t.Errorf("Work request of an unknown host answered with %v (%v)\n", header, err)
+	}
+}
@@ -12,6 +12,14 @@ const (
 	BLOCKHEADER_SIZE = 150
 )
 
+//Flags in the header byte of a block
+const (
+	//The block carries a commitment to the state it is built on, the commitment follows the fixed-size header
+	BLOCKFLAG_STATECOMMITMENT = 0x01
+	//The block carries the compact encoding of its target (see target.go), right after the fixed-size header
+	BLOCKFLAG_TARGET = 0x02
+)
+
 type Block struct {
 	Header      byte
 	Hash        [32]byte
@@ -23,7 +31,12 @@ type Block struct {
 	NrFundsTx   uint16
 	NrAccTx     uint16
 	NrConfigTx  uint8
+	//Compact target, only set (and serialized) if the BLOCKFLAG_TARGET flag is set
+	Target uint32
+	//Only set (and serialized) if the BLOCKFLAG_STATECOMMITMENT flag is set
+	StateCommitment [32]byte
 	StateCopy    map[[32]byte]*Account //won't be serialized, just keeping track of local state changes
+	TxPayloads   map[[32]byte]Transaction //won't be serialized, txs added by this miner or imported with the block
 	FundsTxData  [][32]byte
 	AccTxData    [][32]byte
 	ConfigTxData [][32]byte
@@ -49,14 +62,38 @@ func (b *Block) HashBlock() (hash [32]byte) {
 	}
 
 	binary.Write(&buf, binary.BigEndian, blockToHash)
+	//Blocks without a target or a commitment hash the same way they did before these were introduced
+	if b.HasTarget() {
+		binary.Write(&buf, binary.BigEndian, b.Target)
+	}
+	if b.HasStateCommitment() {
+		buf.Write(b.StateCommitment[:])
+	}
 	return sha3.Sum256(buf.Bytes())
 }
 
+func (b *Block) HasStateCommitment() bool {
+	return b.Header&BLOCKFLAG_STATECOMMITMENT != 0
+}
+
+func (b *Block) HasTarget() bool {
+	return b.Header&BLOCKFLAG_TARGET != 0
+}
+
 func (b *Block) GetSize() (size uint64) {
-	return uint64(BLOCKHEADER_SIZE+
+
+	size = uint64(BLOCKHEADER_SIZE+
 		int(b.NrAccTx)*HASH_LEN+
 		int(b.NrFundsTx)*HASH_LEN+
 		int(b.NrConfigTx)*HASH_LEN)
+	if b.HasTarget() {
+		size += BLOCKTARGET_SIZE
+	}
+	if b.HasStateCommitment() {
+		size += HASH_LEN
+	}
+
+	return size
 }
 
 func (b *Block) Encode() (encodedBlock []byte) {
@@ -90,6 +127,16 @@ func (b *Block) Encode() (encodedBlock []byte) {
 
 	index := BLOCKHEADER_SIZE
 
+	if b.HasTarget() {
+		binary.BigEndian.PutUint32(encodedBlock[index:index+BLOCKTARGET_SIZE], b.Target)
+		index += BLOCKTARGET_SIZE
+	}
+
+	if b.HasStateCommitment() {
+		copy(encodedBlock[index:index+HASH_LEN], b.StateCommitment[:])
+		index += HASH_LEN
+	}
+
 	//Serialize all tx hashes
 	for _, txHash := range b.FundsTxData {
 		copy(encodedBlock[index:index+HASH_LEN], txHash[:])
@@ -133,8 +180,22 @@ func (*Block) Decode(encodedBlock []byte) (b *Block) {
 	b.NrAccTx = nrAccTx
 	b.NrConfigTx = uint8(encodedBlock[149])
 
+	if len(encodedBlock) < int(b.GetSize()) {
+		return nil
+	}
+
 	index := BLOCKHEADER_SIZE
 
+	if b.HasTarget() {
+		b.Target = binary.BigEndian.Uint32(encodedBlock[index : index+BLOCKTARGET_SIZE])
+		index += BLOCKTARGET_SIZE
+	}
+
+	if b.HasStateCommitment() {
+		copy(b.StateCommitment[:], encodedBlock[index:index+HASH_LEN])
+		index += HASH_LEN
+	}
+
 	//Deserialize all tx hashes
 	var hash [32]byte
 	for cnt := 0; cnt < int(nrFundsTx); cnt++ {
@@ -168,7 +229,9 @@ func (b Block) String() string {
 		"Beneficiary: %x\n"+
 		"Amount of fundsTx: %v\n"+
 		"Amount of accTx: %v\n"+
-		"Amount of configTx: %v\n",
+		"Amount of configTx: %v\n"+
+		"Target: %x\n"+
+		"State commitment: %x\n",
 		b.Hash[0:8],
 		b.PrevHash[0:8],
 		b.Header,
@@ -179,5 +242,7 @@ func (b Block) String() string {
 		b.NrFundsTx,
 		b.NrAccTx,
 		b.NrConfigTx,
+		b.Target,
+		b.StateCommitment[0:8],
 	)
 }
@@ -6,6 +6,7 @@ import (
 	"time"
 	"reflect"
 	"fmt"
+	"math/big"
 )
 
 func TestBlockSerialization(t *testing.T) {
@@ -45,3 +46,71 @@ func TestGetSize(t *testing.T) {
 	}
 }
 
+
+func TestBlockStateCommitment(t *testing.T) {
+
+	b := new(Block)
+	b.PrevHash = [32]byte{1, 2, 3, 4, 5}
+	b.FundsTxData = [][32]byte{{6, 7, 8}}
+	b.NrFundsTx = 1
+	hashWithout := b.HashBlock()
+
+	//The commitment is ignored as long as the flag is not set
+	b.StateCommitment = [32]byte{9, 10, 11}
+	if b.HashBlock() != hashWithout || b.GetSize() != BLOCKHEADER_SIZE+32 {
+		t.Error("Commitment without flag changed the block.\n")
+	}
+
+	b.Header |= BLOCKFLAG_STATECOMMITMENT
+	if b.HashBlock() == hashWithout || b.GetSize() != BLOCKHEADER_SIZE+64 {
+		t.Error("Commitment is not part of the block.\n")
+	}
+
+	b2 := b.Decode(b.Encode())
+	if b2 == nil || b2.StateCommitment != b.StateCommitment || !reflect.DeepEqual(b2.FundsTxData, b.FundsTxData) {
+		t.Errorf("Block with commitment was not properly decoded: %v\n", b2)
+	}
+
+	if b.Decode(b.Encode()[:BLOCKHEADER_SIZE+32]) != nil {
+		t.Error("Truncated block was decoded.\n")
+	}
+}
+
+func TestBlockTarget(t *testing.T) {
+
+	b := new(Block)
+	b.PrevHash = [32]byte{1, 2, 3, 4, 5}
+	hashWithout := b.HashBlock()
+
+	b.Target = 0x1d00ffff
+	if b.HashBlock() != hashWithout || b.GetSize() != BLOCKHEADER_SIZE {
+		t.Error("Target without flag changed the block.\n")
+	}
+
+	b.Header |= BLOCKFLAG_TARGET | BLOCKFLAG_STATECOMMITMENT
+	b.StateCommitment = [32]byte{9, 10, 11}
+	if b.HashBlock() == hashWithout || b.GetSize() != BLOCKHEADER_SIZE+BLOCKTARGET_SIZE+32 {
+		t.Error("Target is not part of the block.\n")
+	}
+
+	b2 := b.Decode(b.Encode())
+	if b2 == nil || b2.Target != b.Target || b2.StateCommitment != b.StateCommitment {
+		t.Errorf("Block with target was not properly decoded: %v\n", b2)
+	}
+}
+
+func TestCompactTarget(t *testing.T) {
+
+	for _, compact := range []uint32{0x1cffff00, 0x20ffffff, 0x03123456, 0x02120000, 0x01120000} {
+		if TargetToCompact(CompactToTarget(compact)) != compact {
+			t.Errorf("Compact target %x did not survive the round trip: %x\n", compact, TargetToCompact(CompactToTarget(compact)))
+		}
+	}
+
+	//Encoding cuts off the lower bytes, the target can only get harder
+	target := new(big.Int).Rsh(MaxTarget, 8)
+	decoded := CompactToTarget(TargetToCompact(target))
+	if decoded.Cmp(target) > 0 || decoded.BitLen() != target.BitLen() {
+		t.Errorf("Wrong compact encoding of %x: %x\n", target, decoded)
+	}
+}
@@ -16,6 +16,7 @@ const (
 	FEE_MINIMUM_ID    = 3
 	BLOCK_INTERVAL_ID = 4
 	BLOCK_REWARD_ID   = 5
+	DIFF_ALGORITHM_ID = 6
 
 	MIN_BLOCK_SIZE = 1000      //1KB
 	MAX_BLOCK_SIZE = 100000000 //100MB
@@ -31,6 +32,13 @@ const (
 
 	MIN_BLOCK_REWARD = 0
 	MAX_BLOCK_REWARD = 1152921504606846976 //2^60
+
+	//Difficulty adjustment algorithms, the payload of a DIFF_ALGORITHM_ID config tx
+	DIFF_ALGORITHM_INTERVAL = 0 //Retarget every diff interval blocks
+	DIFF_ALGORITHM_LWMA     = 1 //Retarget every block (linearly weighted moving average of the solve times)
+
+	MIN_DIFF_ALGORITHM = DIFF_ALGORITHM_INTERVAL
+	MAX_DIFF_ALGORITHM = DIFF_ALGORITHM_LWMA
 )
 
 type ConfigTx struct {
@@ -10,6 +10,11 @@ import (
 
 const (
 	FUNDSTX_SIZE = 149
+
+	//Txs with an expiry height use a versioned encoding that starts with the version byte. Txs without expiry keep
+	//the fixed size encoding, this way their hash and signature stay the same
+	FUNDSTX_VERSION_EXPIRY = 0x01
+	FUNDSTX_EXPIRY_SIZE    = 154
 )
 
 //when we broadcast transactions we need a way to distinguish with a type
@@ -21,10 +26,17 @@ type FundsTx struct {
 	TxCnt  uint32
 	From   [32]byte
 	To     [32]byte
-	Sig    [64]byte
+	//Last block height the tx can be included in, 0 if the tx doesn't expire. Covered by the signature
+	ValidUntil uint32
+	Sig        [64]byte
 }
 
 func ConstrFundsTx(header byte, amount uint64, fee uint64, txCnt uint32, from, to [32]byte, key *ecdsa.PrivateKey) (tx *FundsTx, err error) {
+	return ConstrExpiringFundsTx(header, amount, fee, txCnt, 0, from, to, key)
+}
+
+//Same as ConstrFundsTx, but the tx can't be included in blocks above height validUntil
+func ConstrExpiringFundsTx(header byte, amount uint64, fee uint64, txCnt uint32, validUntil uint32, from, to [32]byte, key *ecdsa.PrivateKey) (tx *FundsTx, err error) {
 
 	tx = new(FundsTx)
 
@@ -34,6 +46,7 @@ func ConstrFundsTx(header byte, amount uint64, fee uint64, txCnt uint32, from, t
 	tx.Amount = amount
 	tx.Fee = fee
 	tx.TxCnt = txCnt
+	tx.ValidUntil = validUntil
 
 	txHash := tx.Hash()
 
@@ -51,6 +64,26 @@ func (tx *FundsTx) Hash() (hash [32]byte) {
 		return [32]byte{}
 	}
 
+	if tx.ValidUntil != 0 {
+		return serializeHashContent(struct {
+			Header     byte
+			Amount     uint64
+			Fee        uint64
+			TxCnt      uint32
+			From       [32]byte
+			To         [32]byte
+			ValidUntil uint32
+		}{
+			tx.Header,
+			tx.Amount,
+			tx.Fee,
+			tx.TxCnt,
+			tx.From,
+			tx.To,
+			tx.ValidUntil,
+		})
+	}
+
 	txHash := struct {
 		Header byte
 		Amount uint64
@@ -93,6 +126,21 @@ func (tx *FundsTx) Encode() (encodedTx []byte) {
 	copy(txCntBuf[:], buf.Bytes())
 	buf.Reset()
 
+	if tx.ValidUntil != 0 {
+		encodedTx = make([]byte, FUNDSTX_EXPIRY_SIZE)
+		encodedTx[0] = FUNDSTX_VERSION_EXPIRY
+		encodedTx[1] = tx.Header
+		copy(encodedTx[2:10], amountBuf[:])
+		copy(encodedTx[10:18], feeBuf[:])
+		copy(encodedTx[18:22], txCntBuf[:])
+		binary.BigEndian.PutUint32(encodedTx[22:26], tx.ValidUntil)
+		copy(encodedTx[26:58], tx.From[:])
+		copy(encodedTx[58:90], tx.To[:])
+		copy(encodedTx[90:154], tx.Sig[:])
+
+		return encodedTx
+	}
+
 	encodedTx = make([]byte, FUNDSTX_SIZE)
 	encodedTx[0] = tx.Header
 	copy(encodedTx[1:9], amountBuf[:])
@@ -107,6 +155,26 @@ func (tx *FundsTx) Encode() (encodedTx []byte) {
 
 func (*FundsTx) Decode(encodedTx []byte) (tx *FundsTx) {
 
+	//The fixed size encoding has no version byte, the length tells them apart
+	if len(encodedTx) == FUNDSTX_EXPIRY_SIZE && encodedTx[0] == FUNDSTX_VERSION_EXPIRY {
+		tx = new(FundsTx)
+		tx.Header = encodedTx[1]
+		tx.Amount = binary.BigEndian.Uint64(encodedTx[2:10])
+		tx.Fee = binary.BigEndian.Uint64(encodedTx[10:18])
+		tx.TxCnt = binary.BigEndian.Uint32(encodedTx[18:22])
+		tx.ValidUntil = binary.BigEndian.Uint32(encodedTx[22:26])
+		copy(tx.From[:], encodedTx[26:58])
+		copy(tx.To[:], encodedTx[58:90])
+		copy(tx.Sig[:], encodedTx[90:154])
+
+		//A zero expiry has to use the fixed size encoding, otherwise the same tx would have two encodings
+		if tx.ValidUntil == 0 {
+			return nil
+		}
+
+		return tx
+	}
+
 	if len(encodedTx) != FUNDSTX_SIZE {
 		return nil
 	}
@@ -124,7 +192,20 @@ func (*FundsTx) Decode(encodedTx []byte) (tx *FundsTx) {
 }
 
 func (tx *FundsTx) TxFee() uint64 { return tx.Fee }
-func (tx *FundsTx) Size() uint64  { return FUNDSTX_SIZE }
+
+func (tx *FundsTx) Size() uint64 {
+
+	if tx.ValidUntil != 0 {
+		return FUNDSTX_EXPIRY_SIZE
+	}
+
+	return FUNDSTX_SIZE
+}
+
+//An expired tx can't be included in a block at the given height anymore
+func (tx *FundsTx) Expired(height uint32) bool {
+	return tx.ValidUntil != 0 && height > tx.ValidUntil
+}
 
 func (tx FundsTx) String() string {
 	return fmt.Sprintf(
@@ -134,6 +215,7 @@ func (tx FundsTx) String() string {
 			"TxCnt: %v\n"+
 			"From: %x\n"+
 			"To: %x\n"+
+			"ValidUntil: %v\n"+
 			"Sig: %x\n",
 		tx.Header,
 		tx.Amount,
@@ -141,6 +223,7 @@ func (tx FundsTx) String() string {
 		tx.TxCnt,
 		tx.From[0:10],
 		tx.To[0:10],
+		tx.ValidUntil,
 		tx.Sig[0:10],
 	)
 }
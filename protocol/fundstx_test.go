@@ -27,3 +27,40 @@ func TestFundsTxSerialization(t *testing.T) {
 		}
 	}
 }
+
+func TestFundsTxExpirySerialization(t *testing.T) {
+
+	accAHash := serializeHashContent(accA.Address)
+	accBHash := serializeHashContent(accB.Address)
+
+	tx, _ := ConstrFundsTx(0x01, 100, 1, 0, accAHash, accBHash, &PrivKeyA)
+	expiringTx, _ := ConstrExpiringFundsTx(0x01, 100, 1, 0, 50, accAHash, accBHash, &PrivKeyA)
+
+	//The expiry is covered by the hash, txs without expiry keep the fixed size encoding
+	if tx.Hash() == expiringTx.Hash() {
+		t.Error("Expiry height is not part of the tx hash.\n")
+	}
+	if len(tx.Encode()) != FUNDSTX_SIZE || tx.Size() != FUNDSTX_SIZE {
+		t.Errorf("Tx without expiry has size %v, want %v\n", len(tx.Encode()), FUNDSTX_SIZE)
+	}
+	if len(expiringTx.Encode()) != FUNDSTX_EXPIRY_SIZE || expiringTx.Size() != FUNDSTX_EXPIRY_SIZE {
+		t.Errorf("Tx with expiry has size %v, want %v\n", len(expiringTx.Encode()), FUNDSTX_EXPIRY_SIZE)
+	}
+
+	var decodedTx *FundsTx
+	decodedTx = decodedTx.Decode(expiringTx.Encode())
+	if !reflect.DeepEqual(expiringTx, decodedTx) {
+		t.Errorf("FundsTx with expiry serialization failed (%v) vs. (%v)\n", expiringTx, decodedTx)
+	}
+
+	//A zero expiry in the versioned encoding is refused
+	encoded := expiringTx.Encode()
+	copy(encoded[22:26], []byte{0, 0, 0, 0})
+	if decodedTx.Decode(encoded) != nil {
+		t.Error("Versioned encoding without expiry was decoded.\n")
+	}
+
+	if expiringTx.Expired(50) || !expiringTx.Expired(51) || tx.Expired(1 << 31) {
+		t.Error("Expiry height is not enforced correctly.\n")
+	}
+}
@@ -0,0 +1,43 @@
+package protocol
+
+import (
+	"math/big"
+)
+
+//A block hash, read as a 256 bit big endian number, needs to be at most the target of the block. Lower targets mean
+//more work. Targets are encoded in 4 bytes: the first byte is the length of the target in bytes, the other three are
+//its most significant bytes (like Bitcoin's compact encoding, without the sign bit). Lower bytes are cut off, the
+//encoded target is at most the original one
+
+const (
+	BLOCKTARGET_SIZE = 4
+)
+
+//2^256-1, every hash meets it
+var MaxTarget = new(big.Int).Sub(new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(1))
+
+func CompactToTarget(compact uint32) *big.Int {
+
+	size := uint(compact >> 24)
+	mantissa := big.NewInt(int64(compact & 0x00ffffff))
+
+	if size <= 3 {
+		return mantissa.Rsh(mantissa, 8*(3-size))
+	}
+
+	return mantissa.Lsh(mantissa, 8*(size-3))
+}
+
+func TargetToCompact(target *big.Int) uint32 {
+
+	size := uint((target.BitLen() + 7) / 8)
+
+	var mantissa uint64
+	if size <= 3 {
+		mantissa = new(big.Int).Lsh(target, 8*(3-size)).Uint64()
+	} else {
+		mantissa = new(big.Int).Rsh(target, 8*(size-3)).Uint64()
+	}
+
+	return uint32(size)<<24 | uint32(mantissa)
+}
@@ -0,0 +1,210 @@
+package storage
+
+import (
+	"encoding/binary"
+	"github.com/lisgie/bazo_miner/protocol"
+	"math/big"
+)
+
+//A batch collects all disk writes that belong to a single block (the block itself, its transactions, the state diff and
+//the chain tip). Commit applies them in one bolt transaction, either all of them are written or none. This way a crash
+//can't leave closed blocks, closed txs and the persisted state inconsistent.
+type Batch struct {
+	ops []batchOp
+
+	//The mempool lives in memory, changes are applied after the disk writes succeeded
+	openTxsToWrite  []protocol.Transaction
+	openTxsToDelete []protocol.Transaction
+	//Accounts were written, the mempool needs to catch up with the new TxCnts
+	stateChanged bool
+	//The chain tip moved, expired txs are dropped from the mempool
+	tipChanged bool
+	tipHeight  uint32
+}
+
+//A nil value deletes the key from the bucket
+type batchOp struct {
+	bucket string
+	key    []byte
+	value  []byte
+}
+
+func NewBatch() *Batch {
+	return new(Batch)
+}
+
+func (batch *Batch) put(bucket string, key []byte, value []byte) {
+	batch.ops = append(batch.ops, batchOp{bucket, key, value})
+}
+
+func (batch *Batch) delete(bucket string, key []byte) {
+	batch.ops = append(batch.ops, batchOp{bucket, key, nil})
+}
+
+func (batch *Batch) WriteClosedBlock(block *protocol.Block) {
+	batch.put("closedblocks", block.Hash[:], block.Encode())
+}
+
+func (batch *Batch) DeleteClosedBlock(hash [32]byte) {
+	batch.delete("closedblocks", hash[:])
+}
+
+func (batch *Batch) DeleteOpenBlock(hash [32]byte) {
+	batch.delete("openblocks", hash[:])
+}
+
+func (batch *Batch) WriteClosedTx(transaction protocol.Transaction) {
+	hash := transaction.Hash()
+	batch.put(closedTxBucket(transaction), hash[:], transaction.Encode())
+}
+
+func (batch *Batch) DeleteClosedTx(transaction protocol.Transaction) {
+	hash := transaction.Hash()
+	batch.delete(closedTxBucket(transaction), hash[:])
+}
+
+func (batch *Batch) WriteTxLocation(hash [32]byte, loc *TxLocation) {
+	batch.put("txlocations", hash[:], loc.Encode())
+}
+
+func (batch *Batch) DeleteTxLocation(hash [32]byte) {
+	batch.delete("txlocations", hash[:])
+}
+
+func (batch *Batch) WriteHistoryEntry(account [32]byte, entry *HistoryEntry) {
+	batch.put("history", historyKey(account, entry), entry.Hash[:])
+}
+
+func (batch *Batch) DeleteHistoryEntry(account [32]byte, entry *HistoryEntry) {
+	batch.delete("history", historyKey(account, entry))
+}
+
+//The undo data is stored with the block, so blocks can be rolled back after a restart as well
+func (batch *Batch) WriteUndo(blockHash [32]byte, j *Journal) {
+	batch.put("undo", blockHash[:], j.Encode())
+}
+
+func (batch *Batch) DeleteUndo(blockHash [32]byte) {
+	batch.delete("undo", blockHash[:])
+}
+
+//Serialized state after the block at the given height, the storage package doesn't interpret it
+func (batch *Batch) WriteSnapshot(height uint32, snapshot []byte) {
+	batch.put("snapshots", heightKey(height), snapshot)
+}
+
+func (batch *Batch) DeleteSnapshot(height uint32) {
+	batch.delete("snapshots", heightKey(height))
+}
+
+//Deletes the payload of a closed tx, the tx is still known by its hash (block, tx location and history index)
+func (batch *Batch) PruneTx(hash [32]byte) {
+	batch.delete("closedfunds", hash[:])
+	batch.delete("closedaccs", hash[:])
+	batch.delete("closedconfigs", hash[:])
+}
+
+//All tx payloads of blocks up to and including this height have been pruned
+func (batch *Batch) WritePrunedHeight(height uint32) {
+	batch.put("chainstate", []byte(PRUNEDHEIGHT_KEY), heightKey(height))
+}
+
+//Sets the canonical chain tip. The tip is also added to the height index, blocks below the tip are expected to be
+//indexed already
+func (batch *Batch) WriteTip(hash [32]byte, height uint32) {
+
+	var tip [36]byte
+	copy(tip[0:32], hash[:])
+	binary.BigEndian.PutUint32(tip[32:36], height)
+
+	batch.put("blockheights", heightKey(height), hash[:])
+	batch.put("chainstate", []byte(TIP_KEY), tip[:])
+	batch.tipChanged, batch.tipHeight = true, height
+}
+
+//Cumulative work of the chain up to and including the block. Blocks keep their work if they're rolled back, it only
+//depends on their predecessors
+func (batch *Batch) WriteChainWork(hash [32]byte, work *big.Int) {
+
+	encoded := make([]byte, CHAINWORK_SIZE)
+	work.FillBytes(encoded)
+	batch.put("chainwork", hash[:], encoded)
+}
+
+//Removes a block from the height index, needed if the block gets rolled back
+func (batch *Batch) DeleteBlockHeight(height uint32) {
+	batch.delete("blockheights", heightKey(height))
+}
+
+//The account is encoded right away, later changes to the account don't end up in the batch
+func (batch *Batch) WriteAccount(hash [32]byte, acc *protocol.Account) {
+	batch.stateChanged = true
+	batch.put("accounts", hash[:], acc.Encode())
+}
+
+func (batch *Batch) DeleteAccount(hash [32]byte) {
+	batch.stateChanged = true
+	batch.delete("accounts", hash[:])
+}
+
+func (batch *Batch) WriteRootKey(hash [32]byte, acc *protocol.Account) {
+	batch.put("rootkeys", hash[:], acc.Encode())
+}
+
+func (batch *Batch) DeleteRootKey(hash [32]byte) {
+	batch.delete("rootkeys", hash[:])
+}
+
+func (batch *Batch) WriteChainState(key string, value []byte) {
+	batch.put("chainstate", []byte(key), value)
+}
+
+func (batch *Batch) WriteOpenTx(transaction protocol.Transaction) {
+	batch.openTxsToWrite = append(batch.openTxsToWrite, transaction)
+}
+
+func (batch *Batch) DeleteOpenTx(transaction protocol.Transaction) {
+	batch.openTxsToDelete = append(batch.openTxsToDelete, transaction)
+}
+
+//Writes the whole batch at once (a single bolt transaction). If any of the operations fails, nothing is written
+//and the mempool is left untouched. Batches that change the state are committed by the writer, which can read the
+//state directly (see StateDB)
+func (s *store) Commit(batch *Batch) error {
+
+	if err := s.backend.write(batch.ops); err != nil {
+		return err
+	}
+
+	for _, transaction := range batch.openTxsToDelete {
+		s.mempool.remove(transaction)
+	}
+	if batch.tipChanged {
+		s.mempool.expire(batch.tipHeight)
+	}
+	//The sender queues need to know the state first, txs of rolled back blocks would otherwise be checked against the
+	//TxCnts of the state before the rollback
+	if batch.stateChanged || len(batch.openTxsToWrite) > 0 {
+		s.mempool.reorganize(s.state.GetAccount)
+	}
+	//Txs of rolled back blocks, if the mempool is full or they expired they're lost
+	for _, transaction := range batch.openTxsToWrite {
+		s.mempool.add(transaction, s.state.GetAccount)
+	}
+
+	return nil
+}
+
+func closedTxBucket(transaction protocol.Transaction) (bucket string) {
+
+	switch transaction.(type) {
+	case *protocol.FundsTx:
+		bucket = "closedfunds"
+	case *protocol.AccTx:
+		bucket = "closedaccs"
+	case *protocol.ConfigTx:
+		bucket = "closedconfigs"
+	}
+
+	return bucket
+}
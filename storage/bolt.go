@@ -0,0 +1,111 @@
+package storage
+
+import (
+	"fmt"
+	"github.com/boltdb/bolt"
+)
+
+type boltBackend struct {
+	db *bolt.DB
+}
+
+//Opens (or creates) the bolt database file, missing buckets are created and older databases are migrated to the
+//current schema version
+func NewBoltStorage(dbname string) (Storage, error) {
+
+	db, err := bolt.Open(dbname, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range buckets {
+			if _, err := tx.CreateBucketIfNotExists([]byte(bucket)); err != nil {
+				return fmt.Errorf("Create bucket: %s", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	s := newStore(&boltBackend{db})
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (backend *boltBackend) get(bucket string, key []byte) (value []byte) {
+
+	backend.db.View(func(tx *bolt.Tx) error {
+		//Bolt's slices are only valid during the transaction
+		if v := tx.Bucket([]byte(bucket)).Get(key); v != nil {
+			value = make([]byte, len(v))
+			copy(value, v)
+		}
+		return nil
+	})
+
+	return value
+}
+
+func (backend *boltBackend) scan(bucket string, seek []byte, fn func(key []byte, value []byte) bool) {
+
+	backend.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(bucket)).Cursor()
+		k, v := c.First()
+		if seek != nil {
+			k, v = c.Seek(seek)
+		}
+		for ; k != nil; k, v = c.Next() {
+			if !fn(copyBytes(k), copyBytes(v)) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+func (backend *boltBackend) write(ops []batchOp) error {
+
+	return backend.db.Update(func(tx *bolt.Tx) error {
+		for _, op := range ops {
+			b := tx.Bucket([]byte(op.bucket))
+			if b == nil {
+				return fmt.Errorf("Bucket %v does not exist", op.bucket)
+			}
+
+			var err error
+			if op.value == nil {
+				err = b.Delete(op.key)
+			} else {
+				err = b.Put(op.key, op.value)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (backend *boltBackend) clear(bucket string) {
+
+	backend.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		b.ForEach(func(k, v []byte) error {
+			b.Delete(k)
+			return nil
+		})
+		return nil
+	})
+}
+
+func (backend *boltBackend) close() error {
+	return backend.db.Close()
+}
@@ -1,100 +1,60 @@
 package storage
 
 import (
-	"github.com/boltdb/bolt"
 	"github.com/lisgie/bazo_miner/protocol"
 )
 
 //There exist open/closed buckets and closed tx buckets for all types (open txs are in volatile storage)
-func DeleteOpenBlock(hash [32]byte) {
+func (s *store) DeleteOpenBlock(hash [32]byte) {
 
-	db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("openblocks"))
-		err := b.Delete(hash[:])
-		return err
-	})
+	batch := NewBatch()
+	batch.DeleteOpenBlock(hash)
+	s.Commit(batch)
 }
 
-func DeleteClosedBlock(hash [32]byte) {
+func (s *store) DeleteClosedBlock(hash [32]byte) {
 
-	db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("closedblocks"))
-		err := b.Delete(hash[:])
-		return err
-	})
+	batch := NewBatch()
+	batch.DeleteClosedBlock(hash)
+	s.Commit(batch)
 }
 
-func DeleteOpenTx(transaction protocol.Transaction) {
+func (s *store) DeleteOpenTx(transaction protocol.Transaction) {
 
-	delete(txMemPool, transaction.Hash())
+	s.mempool.remove(transaction)
 }
 
-func DeleteClosedTx(transaction protocol.Transaction) {
+func (s *store) DeleteClosedTx(transaction protocol.Transaction) {
 
-	var bucket string
-	switch transaction.(type) {
-	case *protocol.FundsTx:
-		bucket = "closedfunds"
-	case *protocol.AccTx:
-		bucket = "closedaccs"
-	case *protocol.ConfigTx:
-		bucket = "closedconfigs"
-	}
+	batch := NewBatch()
+	batch.DeleteClosedTx(transaction)
+	s.Commit(batch)
+}
+
+func (s *store) DeleteAccount(hash [32]byte) {
+
+	batch := NewBatch()
+	batch.DeleteAccount(hash)
+	s.Commit(batch)
+}
+
+func (s *store) DeleteRootKey(hash [32]byte) {
 
-	hash := transaction.Hash()
-	db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(bucket))
-		err := b.Delete(hash[:])
-		return err
-	})
+	batch := NewBatch()
+	batch.DeleteRootKey(hash)
+	s.Commit(batch)
 }
 
-func DeleteAll() {
+func (s *store) DeleteAll() {
 
 	//Delete in-memory storage
-	for key := range txMemPool {
-		delete(txMemPool, key)
-	}
+	s.mempool.clear()
+	s.state.Reset()
 
-	//Delete disk-based storage
-	db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("openblocks"))
-		b.ForEach(func(k, v []byte) error {
-			b.Delete(k)
-			return nil
-		})
-		return nil
-	})
-	db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("closedblocks"))
-		b.ForEach(func(k, v []byte) error {
-			b.Delete(k)
-			return nil
-		})
-		return nil
-	})
-	db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("closedfunds"))
-		b.ForEach(func(k, v []byte) error {
-			b.Delete(k)
-			return nil
-		})
-		return nil
-	})
-	db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("closedaccs"))
-		b.ForEach(func(k, v []byte) error {
-			b.Delete(k)
-			return nil
-		})
-		return nil
-	})
-	db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("closedconfigs"))
-		b.ForEach(func(k, v []byte) error {
-			b.Delete(k)
-			return nil
-		})
-		return nil
-	})
+	//Delete persisted storage
+	for _, bucket := range buckets {
+		s.backend.clear(bucket)
+	}
+	//The empty database still has the current layout
+	s.migrate()
 }
@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	//Account hash (32) | height (4) | tx type (1) | index (2)
+	HISTORYKEY_SIZE = 39
+)
+
+//One entry of an account's history. Hash is the tx hash, or the block hash if the entry is a block reward. For block
+//rewards, the tx fees the beneficiary collected are included
+type HistoryEntry struct {
+	Height uint32
+	TxType uint8
+	Index  uint16
+	Hash   [32]byte
+}
+
+//Entries are sorted by key, the key layout makes sure that an account's entries are ordered by height and
+//position within the block
+func historyKey(account [32]byte, entry *HistoryEntry) []byte {
+
+	key := make([]byte, HISTORYKEY_SIZE)
+	copy(key[0:32], account[:])
+	binary.BigEndian.PutUint32(key[32:36], entry.Height)
+	key[36] = entry.TxType
+	binary.BigEndian.PutUint16(key[37:39], entry.Index)
+
+	return key
+}
+
+func decodeHistoryEntry(key []byte, value []byte) (entry *HistoryEntry) {
+
+	if len(key) != HISTORYKEY_SIZE || len(value) != 32 {
+		return nil
+	}
+
+	entry = new(HistoryEntry)
+	entry.Height = binary.BigEndian.Uint32(key[32:36])
+	entry.TxType = key[36]
+	entry.Index = binary.BigEndian.Uint16(key[37:39])
+	copy(entry.Hash[:], value)
+
+	return entry
+}
+
+//Returns at most limit entries of the account's history, starting at the offset-th entry (oldest first). Fewer
+//entries than limit are returned once the end of the history is reached
+func (s *store) ReadAccountHistory(account [32]byte, offset int, limit int) (entries []*HistoryEntry) {
+
+	if offset < 0 || limit <= 0 {
+		return nil
+	}
+
+	cnt := 0
+	s.backend.scan("history", account[:], func(k, v []byte) bool {
+		if !bytes.HasPrefix(k, account[:]) || len(entries) >= limit {
+			return false
+		}
+		if cnt >= offset {
+			if entry := decodeHistoryEntry(k, v); entry != nil {
+				entries = append(entries, entry)
+			}
+		}
+		cnt++
+		return true
+	})
+
+	return entries
+}
+
+func (entry HistoryEntry) String() string {
+	return fmt.Sprintf(
+		"\nHeight: %v\n"+
+			"Tx Type: %v\n"+
+			"Index: %v\n"+
+			"Hash: %x\n",
+		entry.Height,
+		entry.TxType,
+		entry.Index,
+		entry.Hash[0:8],
+	)
+}
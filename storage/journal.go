@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"github.com/lisgie/bazo_miner/protocol"
+)
+
+const (
+	JOURNALENTRY_FLAG_STATE   = 1
+	JOURNALENTRY_FLAG_ROOTKEY = 2
+)
+
+//The journal records the version of every account before it was changed for the first time. Every state change of a
+//block is recorded in its own journal, reverting the journal brings the accounts and root keys back to exactly what
+//they were before the block. All state changes must call Touch before modifying an account.
+type Journal struct {
+	state   *StateDB
+	entries []journalEntry
+	touched map[[32]byte]bool
+}
+
+//An account that did not exist before (as account or root key) is nil
+type journalEntry struct {
+	hash    [32]byte
+	state   *protocol.Account
+	rootKey *protocol.Account
+}
+
+//The journal records changes of the given state only
+func (db *StateDB) NewJournal() *Journal {
+	return &Journal{state: db, touched: make(map[[32]byte]bool)}
+}
+
+//Records the current version of the account. Only the first call per account is recorded, because the version
+//before the block is the one we need to go back to. The StateDB is notified on every call
+func (j *Journal) Touch(hash [32]byte) {
+
+	j.state.Touch(hash)
+	if j.touched[hash] {
+		return
+	}
+	j.touched[hash] = true
+
+	j.entries = append(j.entries, journalEntry{
+		hash:    hash,
+		state:   copyAccount(j.state.GetAccount(hash)),
+		rootKey: copyAccount(j.state.GetRootKey(hash)),
+	})
+}
+
+//Returns the hashes of all accounts that were touched, in the order they were touched first
+func (j *Journal) Accounts() (hashes [][32]byte) {
+
+	for _, entry := range j.entries {
+		hashes = append(hashes, entry.hash)
+	}
+	return hashes
+}
+
+//Restores all recorded accounts. Accounts are modified in place, so pointers shared by the state and the root keys
+//(root accounts) stay shared. If an account has to be recreated, the root key uses the same pointer as the state
+//(like LoadState does)
+func (j *Journal) Revert() {
+
+	for cnt := len(j.entries) - 1; cnt >= 0; cnt-- {
+		entry := j.entries[cnt]
+		j.state.Touch(entry.hash)
+
+		acc := j.state.GetAccount(entry.hash)
+		if acc == nil {
+			acc = j.state.GetRootKey(entry.hash)
+		}
+
+		if entry.state != nil {
+			if acc == nil {
+				acc = new(protocol.Account)
+			}
+			*acc = *entry.state
+			j.state.SetAccount(entry.hash, acc)
+		} else {
+			j.state.DeleteAccount(entry.hash)
+		}
+
+		if entry.rootKey != nil {
+			rootAcc := j.state.GetRootKey(entry.hash)
+			if rootAcc == nil {
+				rootAcc = j.state.GetAccount(entry.hash)
+			}
+			if rootAcc == nil {
+				rootAcc = new(protocol.Account)
+			}
+			*rootAcc = *entry.rootKey
+			j.state.SetRootKey(entry.hash, rootAcc)
+		} else {
+			j.state.DeleteRootKey(entry.hash)
+		}
+	}
+
+	j.entries = nil
+	j.touched = make(map[[32]byte]bool)
+}
+
+//Each entry is encoded as hash (32) | flags (1) | state account (ACC_SIZE, if flag set) | root key (ACC_SIZE, if flag set)
+func (j *Journal) Encode() (encodedJournal []byte) {
+
+	if j == nil {
+		return nil
+	}
+
+	//An empty journal still needs a value, bolt doesn't distinguish between empty and deleted
+	encodedJournal = []byte{}
+	for _, entry := range j.entries {
+		var flags byte
+		if entry.state != nil {
+			flags |= JOURNALENTRY_FLAG_STATE
+		}
+		if entry.rootKey != nil {
+			flags |= JOURNALENTRY_FLAG_ROOTKEY
+		}
+
+		encodedJournal = append(encodedJournal, entry.hash[:]...)
+		encodedJournal = append(encodedJournal, flags)
+		encodedJournal = append(encodedJournal, entry.state.Encode()...)
+		encodedJournal = append(encodedJournal, entry.rootKey.Encode()...)
+	}
+
+	return encodedJournal
+}
+
+func (*Journal) Decode(encodedJournal []byte) (j *Journal) {
+
+	if encodedJournal == nil {
+		return nil
+	}
+
+	//The state is set by the storage the journal is read from
+	j = &Journal{touched: make(map[[32]byte]bool)}
+	for index := 0; index < len(encodedJournal); {
+		if index+33 > len(encodedJournal) {
+			return nil
+		}
+
+		var entry journalEntry
+		copy(entry.hash[:], encodedJournal[index:index+32])
+		flags := encodedJournal[index+32]
+		index += 33
+
+		if flags&JOURNALENTRY_FLAG_STATE != 0 {
+			if index+protocol.ACC_SIZE > len(encodedJournal) {
+				return nil
+			}
+			entry.state = entry.state.Decode(encodedJournal[index : index+protocol.ACC_SIZE])
+			index += protocol.ACC_SIZE
+		}
+		if flags&JOURNALENTRY_FLAG_ROOTKEY != 0 {
+			if index+protocol.ACC_SIZE > len(encodedJournal) {
+				return nil
+			}
+			entry.rootKey = entry.rootKey.Decode(encodedJournal[index : index+protocol.ACC_SIZE])
+			index += protocol.ACC_SIZE
+		}
+
+		j.entries = append(j.entries, entry)
+		j.touched[entry.hash] = true
+	}
+
+	return j
+}
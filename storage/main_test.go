@@ -27,6 +27,7 @@ const (
 	RootPriv = "277ed539f56122c25a6fc115d07d632b47e71416c9aebf1beb54ee704f11842c"
 )
 
+var testStore Storage
 var accA, accB, minerAcc *protocol.Account
 var PrivKeyA, PrivKeyB ecdsa.PrivateKey
 var PubKeyA, PubKeyB ecdsa.PublicKey
@@ -34,16 +35,20 @@ var RootPrivKey ecdsa.PrivateKey
 
 func TestMain(m *testing.M) {
 
-	Init("test.db")
+	//The tests run against bolt, the in-memory backend is compared to bolt in TestBackends
+	var err error
+	if testStore, err = NewBoltStorage("test.db"); err != nil {
+		log.Fatal(err)
+	}
 
-	DeleteAll()
+	testStore.DeleteAll()
 	addTestingAccounts()
 	addRootAccounts()
 	//we don't want logging msgs when testing, designated messages
 	log.SetOutput(ioutil.Discard)
-	os.Exit(m.Run())
-
-	TearDown()
+	code := m.Run()
+	testStore.Close()
+	os.Exit(code)
 }
 
 func addTestingAccounts() {
@@ -85,8 +90,8 @@ func addTestingAccounts() {
 	copy(accB.Address[32:64], PrivKeyB.PublicKey.Y.Bytes())
 	accBHash := serializeHashContent(accB.Address)
 
-	State[accAHash] = accA
-	State[accBHash] = accB
+	testStore.State().SetAccount(accAHash, accA)
+	testStore.State().SetAccount(accBHash, accB)
 }
 
 func addRootAccounts() {
@@ -112,6 +117,6 @@ func addRootAccounts() {
 	rootHash := serializeHashContent(pubKey)
 
 	rootAcc := protocol.Account{Address: pubKey}
-	State[rootHash] = &rootAcc
-	RootKeys[rootHash] = &rootAcc
+	testStore.State().SetAccount(rootHash, &rootAcc)
+	testStore.State().SetRootKey(rootHash, &rootAcc)
 }
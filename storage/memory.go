@@ -0,0 +1,98 @@
+package storage
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+//Nothing is written to disk, everything is lost when the process exits
+type memBackend struct {
+	mutex   sync.RWMutex
+	buckets map[string]map[string][]byte
+}
+
+func NewMemStorage() Storage {
+
+	backend := &memBackend{buckets: make(map[string]map[string][]byte)}
+	for _, bucket := range buckets {
+		backend.buckets[bucket] = make(map[string][]byte)
+	}
+
+	s := newStore(backend)
+	//Can't fail, the backend is empty and only gets the version record
+	s.migrate()
+
+	return s
+}
+
+func (backend *memBackend) get(bucket string, key []byte) []byte {
+
+	backend.mutex.RLock()
+	defer backend.mutex.RUnlock()
+
+	if value, exists := backend.buckets[bucket][string(key)]; exists {
+		return copyBytes(value)
+	}
+	return nil
+}
+
+//Keys are sorted on every call, good enough for the amount of data we keep in memory
+func (backend *memBackend) scan(bucket string, seek []byte, fn func(key []byte, value []byte) bool) {
+
+	backend.mutex.RLock()
+	var keys []string
+	for key := range backend.buckets[bucket] {
+		if key >= string(seek) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		values[i] = copyBytes(backend.buckets[bucket][key])
+	}
+	backend.mutex.RUnlock()
+
+	for i, key := range keys {
+		if !fn([]byte(key), values[i]) {
+			break
+		}
+	}
+}
+
+func (backend *memBackend) write(ops []batchOp) error {
+
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	//Check first, the batch is either applied completely or not at all
+	for _, op := range ops {
+		if _, exists := backend.buckets[op.bucket]; !exists {
+			return fmt.Errorf("Bucket %v does not exist", op.bucket)
+		}
+	}
+
+	for _, op := range ops {
+		if op.value == nil {
+			delete(backend.buckets[op.bucket], string(op.key))
+		} else {
+			backend.buckets[op.bucket][string(op.key)] = copyBytes(op.value)
+		}
+	}
+
+	return nil
+}
+
+func (backend *memBackend) clear(bucket string) {
+
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	backend.buckets[bucket] = make(map[string][]byte)
+}
+
+func (backend *memBackend) close() error {
+	return nil
+}
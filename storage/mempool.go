@@ -0,0 +1,551 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/lisgie/bazo_miner/protocol"
+	"sort"
+	"sync"
+)
+
+//Limits of the mempool. Queued txs are limited per sender as well, otherwise a single account could fill the mempool
+//with txs that are never going to be included
+const (
+	MEMPOOL_MAXTXS    = 20000
+	MEMPOOL_MAXSIZE   = 5000000 //Bytes
+	MEMPOOL_MAXQUEUED = 64      //Per sender
+
+	//A pending or queued FundsTx can be replaced by one with the same sender and TxCnt if it pays this much more fee
+	MEMPOOL_REPLACEBUMP = 10 //Percent
+)
+
+//Tx types of the entries in the mempool bucket
+const (
+	MEMPOOL_FUNDSTX = iota + 1
+	MEMPOOL_ACCTX
+	MEMPOOL_CONFIGTX
+)
+
+//Minimum fee bump for replacements in percent, can be changed at startup
+var ReplaceFeeBump uint64 = MEMPOOL_REPLACEBUMP
+
+//The mempool holds all open (not yet validated) txs. FundsTxs are organized per sender and keyed by TxCnt:
+//	- pending: txs that continue the TxCnt of the sender in the state without a gap, they can go into the next block
+//	- queued: txs further ahead, they wait until the gap is filled or their predecessors are confirmed
+//AccTxs and ConfigTxs don't have a TxCnt, they are always pending.
+type mempool struct {
+	mutex   sync.RWMutex
+	txs     map[[32]byte]protocol.Transaction
+	senders map[[32]byte]*senderQueue
+	size    uint64
+	//Height of the chain tip, FundsTxs that can't go into the next block anymore are dropped
+	height uint32
+	//Changes whenever the pending txs might have changed, block templates are only rebuilt if it did
+	generation uint64
+
+	maxTxs, maxQueued int
+	maxSize           uint64
+
+	//Every change is written to the mempool bucket as well, a restarted miner reloads the txs from there. Nil if the
+	//mempool is not persisted
+	backend backend
+	ops     []batchOp
+}
+
+type senderQueue struct {
+	//TxCnt of the sender in the state, queued txs of senders that don't exist (yet) are never promoted
+	txCnt   uint32
+	exists  bool
+	pending map[uint32]*protocol.FundsTx
+	queued  map[uint32]*protocol.FundsTx
+}
+
+//Returns the account (e.g., from a state snapshot), nil if it does not exist
+type accountLookup func(hash [32]byte) *protocol.Account
+
+func newMempool(backend backend) *mempool {
+
+	return &mempool{
+		txs:       make(map[[32]byte]protocol.Transaction),
+		senders:   make(map[[32]byte]*senderQueue),
+		maxTxs:    MEMPOOL_MAXTXS,
+		maxSize:   MEMPOOL_MAXSIZE,
+		maxQueued: MEMPOOL_MAXQUEUED,
+		backend:   backend,
+	}
+}
+
+func newSenderQueue(acc *protocol.Account) *senderQueue {
+
+	q := &senderQueue{
+		pending: make(map[uint32]*protocol.FundsTx),
+		queued:  make(map[uint32]*protocol.FundsTx),
+	}
+	q.setAccount(acc)
+
+	return q
+}
+
+func (mp *mempool) get(hash [32]byte) protocol.Transaction {
+
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+
+	return mp.txs[hash]
+}
+
+func (mp *mempool) all() (txs []protocol.Transaction) {
+
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+
+	for _, tx := range mp.txs {
+		txs = append(txs, tx)
+	}
+
+	return txs
+}
+
+//AccTxs and ConfigTxs first (ordered by hash), then the FundsTxs of every sender (ordered by sender, then TxCnt)
+func (mp *mempool) pendingTxs() (txs []protocol.Transaction) {
+
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+
+	var others []protocol.Transaction
+	for _, tx := range mp.txs {
+		if _, isFundsTx := tx.(*protocol.FundsTx); !isFundsTx {
+			others = append(others, tx)
+		}
+	}
+	sort.Slice(others, func(i, j int) bool {
+		hashI, hashJ := others[i].Hash(), others[j].Hash()
+		return bytes.Compare(hashI[:], hashJ[:]) < 0
+	})
+	txs = append(txs, others...)
+
+	for _, sender := range mp.sortedSenders() {
+		txs = append(txs, sortByTxCnt(mp.senders[sender].pending)...)
+	}
+
+	return txs
+}
+
+func (mp *mempool) currentGeneration() uint64 {
+
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+
+	return mp.generation
+}
+
+//Ordered by sender, then TxCnt
+func (mp *mempool) queuedTxs() (txs []protocol.Transaction) {
+
+	mp.mutex.RLock()
+	defer mp.mutex.RUnlock()
+
+	for _, sender := range mp.sortedSenders() {
+		txs = append(txs, sortByTxCnt(mp.senders[sender].queued)...)
+	}
+
+	return txs
+}
+
+//Returns an error if the tx is not accepted. The lookup is only used for senders that have no txs in the mempool yet,
+//the others are kept up-to-date by reorganize
+func (mp *mempool) add(tx protocol.Transaction, lookup accountLookup) error {
+
+	hash := tx.Hash()
+
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	defer mp.persist()
+
+	if _, exists := mp.txs[hash]; exists {
+		return nil
+	}
+
+	if fundsTx, isFundsTx := tx.(*protocol.FundsTx); isFundsTx {
+		q := mp.senders[fundsTx.From]
+		if q == nil {
+			q = newSenderQueue(lookup(fundsTx.From))
+		}
+
+		if fundsTx.Expired(mp.height + 1) {
+			return errors.New(fmt.Sprintf("Tx expired at height %v, the chain is at height %v.", fundsTx.ValidUntil, mp.height))
+		}
+
+		if q.exists && fundsTx.TxCnt < q.txCnt {
+			return errors.New(fmt.Sprintf("TxCnt %v of the sender has already been used (state txCnt is %v).", fundsTx.TxCnt, q.txCnt))
+		}
+
+		if replaced := q.get(fundsTx.TxCnt); replaced != nil {
+			//The replaced tx is gone, it's neither included in new blocks nor sent to other miners anymore. Blocks that
+			//are already being mined keep their own copy
+			if minFee := replacementFee(replaced.Fee); fundsTx.Fee < minFee {
+				return errors.New(fmt.Sprintf("There is already a tx with TxCnt %v of the sender in the mempool, a replacement needs a fee of at least %v.", fundsTx.TxCnt, minFee))
+			}
+			mp.removeLocked(replaced.Hash())
+		} else if !q.continues(fundsTx.TxCnt) && len(q.queued) >= mp.maxQueued {
+			return errors.New(fmt.Sprintf("Sender has already %v queued txs in the mempool.", len(q.queued)))
+		}
+
+		mp.senders[fundsTx.From] = q
+		q.queued[fundsTx.TxCnt] = fundsTx
+		q.promote()
+	}
+
+	mp.txs[hash] = tx
+	mp.size += tx.Size()
+	mp.generation++
+	mp.ops = append(mp.ops, batchOp{"mempool", hash[:], encodeOpenTx(tx)})
+
+	if evicted := mp.evict(); evicted[hash] {
+		return errors.New("Mempool is full and the tx is the first one to be evicted.")
+	}
+
+	return nil
+}
+
+func (mp *mempool) remove(tx protocol.Transaction) {
+
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	defer mp.persist()
+
+	mp.removeLocked(tx.Hash())
+}
+
+//Txs behind a removed pending tx have a gap now, they are queued again. The caller needs to hold the lock
+func (mp *mempool) removeLocked(hash [32]byte) {
+
+	tx, exists := mp.txs[hash]
+	if !exists {
+		return
+	}
+	delete(mp.txs, hash)
+	mp.size -= tx.Size()
+	mp.generation++
+	mp.ops = append(mp.ops, batchOp{"mempool", hash[:], nil})
+
+	fundsTx, isFundsTx := tx.(*protocol.FundsTx)
+	if !isFundsTx {
+		return
+	}
+
+	q := mp.senders[fundsTx.From]
+	if q.queued[fundsTx.TxCnt] != nil {
+		delete(q.queued, fundsTx.TxCnt)
+	} else {
+		delete(q.pending, fundsTx.TxCnt)
+		for txCnt, pendingTx := range q.pending {
+			if txCnt > fundsTx.TxCnt {
+				delete(q.pending, txCnt)
+				q.queued[txCnt] = pendingTx
+			}
+		}
+	}
+
+	if len(q.pending) == 0 && len(q.queued) == 0 {
+		delete(mp.senders, fundsTx.From)
+	}
+}
+
+//Needs to be called after the state changed (e.g., a block was validated or rolled back). Txs whose TxCnt has been
+//used in the meantime are dropped, queued txs whose predecessors got confirmed are promoted
+func (mp *mempool) reorganize(lookup accountLookup) {
+
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	defer mp.persist()
+
+	mp.generation++
+	for _, q := range mp.senders {
+		q.setAccount(lookup(q.sender()))
+
+		for txCnt, pendingTx := range q.pending {
+			delete(q.pending, txCnt)
+			q.queued[txCnt] = pendingTx
+		}
+		if q.exists {
+			for txCnt, queuedTx := range q.queued {
+				if txCnt < q.txCnt {
+					mp.removeLocked(queuedTx.Hash())
+				}
+			}
+		}
+		q.promote()
+	}
+}
+
+//Called whenever the chain tip changes. Expired txs are removed like invalid ones, the sender's later txs are queued
+//until the TxCnt gap is filled (e.g., by a tx that doesn't expire)
+func (mp *mempool) expire(height uint32) {
+
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	defer mp.persist()
+
+	mp.height = height
+	for hash, tx := range mp.txs {
+		if fundsTx, isFundsTx := tx.(*protocol.FundsTx); isFundsTx && fundsTx.Expired(height+1) {
+			mp.removeLocked(hash)
+		}
+	}
+}
+
+func (mp *mempool) clear() {
+
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+
+	mp.txs = make(map[[32]byte]protocol.Transaction)
+	mp.senders = make(map[[32]byte]*senderQueue)
+	mp.size = 0
+	mp.height = 0
+	mp.generation++
+	mp.ops = nil
+}
+
+//Writes the changes collected since the last call. This is done while holding the lock, the changes reach the disk in
+//the same order they were applied. The in-memory mempool is authoritative, if the write fails the txs on disk are
+//revalidated when they're loaded anyway
+func (mp *mempool) persist() {
+
+	if mp.backend != nil && len(mp.ops) > 0 {
+		mp.backend.write(mp.ops)
+	}
+	mp.ops = nil
+}
+
+//Evicts txs until the mempool is within its limits again. Only the last tx of a sender is evicted (no new gaps),
+//queued ones before pending ones, lower fees first. AccTxs and ConfigTxs (issued by root accounts) are never evicted.
+//The caller needs to hold the lock
+func (mp *mempool) evict() (evicted map[[32]byte]bool) {
+
+	evicted = make(map[[32]byte]bool)
+
+	for len(mp.txs) > mp.maxTxs || mp.size > mp.maxSize {
+		var victim *protocol.FundsTx
+		var victimQueued bool
+
+		for _, q := range mp.senders {
+			tail, queued := q.tail()
+			if victim == nil || evictsBefore(tail, queued, victim, victimQueued) {
+				victim, victimQueued = tail, queued
+			}
+		}
+		if victim == nil {
+			break
+		}
+
+		hash := victim.Hash()
+		mp.removeLocked(hash)
+		evicted[hash] = true
+	}
+
+	return evicted
+}
+
+func evictsBefore(tx *protocol.FundsTx, queued bool, other *protocol.FundsTx, otherQueued bool) bool {
+
+	if queued != otherQueued {
+		return queued
+	}
+	if tx.Fee != other.Fee {
+		return tx.Fee < other.Fee
+	}
+	hash, otherHash := tx.Hash(), other.Hash()
+
+	return bytes.Compare(hash[:], otherHash[:]) > 0
+}
+
+func (mp *mempool) sortedSenders() (senders [][32]byte) {
+
+	for sender := range mp.senders {
+		senders = append(senders, sender)
+	}
+	sort.Slice(senders, func(i, j int) bool { return bytes.Compare(senders[i][:], senders[j][:]) < 0 })
+
+	return senders
+}
+
+func (q *senderQueue) setAccount(acc *protocol.Account) {
+
+	q.exists = acc != nil
+	q.txCnt = 0
+	if acc != nil {
+		q.txCnt = acc.TxCnt
+	}
+}
+
+//Every queue has at least one tx, all of them are from the same sender
+func (q *senderQueue) sender() [32]byte {
+
+	for _, tx := range q.pending {
+		return tx.From
+	}
+	for _, tx := range q.queued {
+		return tx.From
+	}
+
+	return [32]byte{}
+}
+
+func (q *senderQueue) get(txCnt uint32) *protocol.FundsTx {
+
+	if tx := q.pending[txCnt]; tx != nil {
+		return tx
+	}
+
+	return q.queued[txCnt]
+}
+
+//Whether a tx with this TxCnt would be pending
+func (q *senderQueue) continues(txCnt uint32) bool {
+	return q.exists && txCnt == q.txCnt+uint32(len(q.pending))
+}
+
+//Moves queued txs to pending as long as there is no gap
+func (q *senderQueue) promote() {
+
+	for q.exists {
+		next := q.txCnt + uint32(len(q.pending))
+		tx := q.queued[next]
+		if tx == nil {
+			return
+		}
+		delete(q.queued, next)
+		q.pending[next] = tx
+	}
+}
+
+//The tx with the highest TxCnt, and whether it is queued
+func (q *senderQueue) tail() (tail *protocol.FundsTx, queued bool) {
+
+	txs, queued := q.pending, false
+	if len(q.queued) > 0 {
+		txs, queued = q.queued, true
+	}
+	for _, tx := range txs {
+		if tail == nil || tx.TxCnt > tail.TxCnt {
+			tail = tx
+		}
+	}
+
+	return tail, queued
+}
+
+//The fee is bumped by at least 1, otherwise a replacement of a tx with a small fee could pay the same
+func replacementFee(fee uint64) uint64 {
+
+	bump := fee/100*ReplaceFeeBump + fee%100*ReplaceFeeBump/100
+	if bump == 0 {
+		bump = 1
+	}
+
+	return fee + bump
+}
+
+//Reloads the txs that were in the mempool when the miner stopped. Txs that have been confirmed in the meantime or don't
+//pass validation against the restored state are dropped, from memory and disk
+func (s *store) LoadMempool(validate func(transaction protocol.Transaction) error) (loaded int, dropped int) {
+
+	var txs []protocol.Transaction
+	batch := NewBatch()
+	s.backend.scan("mempool", nil, func(k, v []byte) bool {
+		if tx := decodeOpenTx(v); tx != nil {
+			txs = append(txs, tx)
+		} else {
+			batch.delete("mempool", k)
+			dropped++
+		}
+		return true
+	})
+
+	//FundsTxs are added in increasing txCnt order, otherwise the sender's limit of queued txs might be hit
+	sort.SliceStable(txs, func(i, j int) bool {
+		fundsTxI, isFundsTxI := txs[i].(*protocol.FundsTx)
+		fundsTxJ, isFundsTxJ := txs[j].(*protocol.FundsTx)
+		if isFundsTxI != isFundsTxJ {
+			return isFundsTxJ
+		}
+		return isFundsTxI && fundsTxI.TxCnt < fundsTxJ.TxCnt
+	})
+
+	snapshot := s.state.Snapshot()
+	for _, tx := range txs {
+		hash := tx.Hash()
+		confirmed := s.ReadTxLocation(hash) != nil || s.ReadClosedTx(hash) != nil
+		if confirmed || validate(tx) != nil || s.mempool.add(tx, snapshot.GetAccount) != nil {
+			batch.delete("mempool", hash[:])
+			dropped++
+			continue
+		}
+		loaded++
+	}
+
+	s.Commit(batch)
+
+	return loaded, dropped
+}
+
+//Entries of the mempool bucket are the tx type followed by the encoded tx
+func encodeOpenTx(tx protocol.Transaction) []byte {
+
+	var txType byte
+	switch tx.(type) {
+	case *protocol.FundsTx:
+		txType = MEMPOOL_FUNDSTX
+	case *protocol.AccTx:
+		txType = MEMPOOL_ACCTX
+	case *protocol.ConfigTx:
+		txType = MEMPOOL_CONFIGTX
+	}
+
+	return append([]byte{txType}, tx.Encode()...)
+}
+
+func decodeOpenTx(encoded []byte) protocol.Transaction {
+
+	if len(encoded) == 0 {
+		return nil
+	}
+
+	switch encoded[0] {
+	case MEMPOOL_FUNDSTX:
+		var fundsTx *protocol.FundsTx
+		if fundsTx = fundsTx.Decode(encoded[1:]); fundsTx != nil {
+			return fundsTx
+		}
+	case MEMPOOL_ACCTX:
+		var accTx *protocol.AccTx
+		if accTx = accTx.Decode(encoded[1:]); accTx != nil {
+			return accTx
+		}
+	case MEMPOOL_CONFIGTX:
+		var configTx *protocol.ConfigTx
+		if configTx = configTx.Decode(encoded[1:]); configTx != nil {
+			return configTx
+		}
+	}
+
+	return nil
+}
+
+func sortByTxCnt(txs map[uint32]*protocol.FundsTx) (sorted []protocol.Transaction) {
+
+	var txCnts []uint32
+	for txCnt := range txs {
+		txCnts = append(txCnts, txCnt)
+	}
+	sort.Slice(txCnts, func(i, j int) bool { return txCnts[i] < txCnts[j] })
+
+	for _, txCnt := range txCnts {
+		sorted = append(sorted, txs[txCnt])
+	}
+
+	return sorted
+}
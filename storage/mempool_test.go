@@ -0,0 +1,302 @@
+package storage
+
+import (
+	"errors"
+	"github.com/lisgie/bazo_miner/protocol"
+	"os"
+	"testing"
+)
+
+func TestMempoolQueues(t *testing.T) {
+
+	accAHash := serializeHashContent(accA.Address)
+	accBHash := serializeHashContent(accB.Address)
+
+	sender := &protocol.Account{Address: accA.Address, TxCnt: 5}
+	lookup := func(hash [32]byte) *protocol.Account {
+		if hash == accAHash {
+			return sender
+		}
+		return nil
+	}
+
+	var txs []*protocol.FundsTx
+	for txCnt := uint32(0); txCnt < 10; txCnt++ {
+		tx, _ := protocol.ConstrFundsTx(0x01, 10, 1, txCnt, accAHash, accBHash, &PrivKeyA)
+		txs = append(txs, tx)
+	}
+
+	mp := newMempool(nil)
+
+	//TxCnts below the state are rejected
+	if err := mp.add(txs[4], lookup); err == nil {
+		t.Error("Tx with a used TxCnt was accepted.\n")
+	}
+
+	//5 and 6 continue the state, 8 and 9 wait for 7
+	for _, txCnt := range []int{5, 6, 8, 9} {
+		if err := mp.add(txs[txCnt], lookup); err != nil {
+			t.Errorf("Tx with TxCnt %v was not accepted: %v\n", txCnt, err)
+		}
+	}
+	if len(mp.pendingTxs()) != 2 || len(mp.queuedTxs()) != 2 {
+		t.Errorf("Expected 2 pending and 2 queued txs, got %v and %v.\n", len(mp.pendingTxs()), len(mp.queuedTxs()))
+	}
+
+	//Filling the gap promotes the queued txs, pending txs are ordered by TxCnt
+	mp.add(txs[7], lookup)
+	pending := mp.pendingTxs()
+	if len(pending) != 5 || len(mp.queuedTxs()) != 0 {
+		t.Errorf("Expected 5 pending and 0 queued txs, got %v and %v.\n", len(pending), len(mp.queuedTxs()))
+	}
+	for i, tx := range pending {
+		if tx.(*protocol.FundsTx).TxCnt != uint32(5+i) {
+			t.Errorf("Pending txs are not ordered by TxCnt: %v at position %v\n", tx.(*protocol.FundsTx).TxCnt, i)
+		}
+	}
+
+	//Removing a pending tx queues the txs behind it again
+	mp.remove(txs[6])
+	if len(mp.pendingTxs()) != 1 || len(mp.queuedTxs()) != 3 {
+		t.Errorf("Expected 1 pending and 3 queued txs, got %v and %v.\n", len(mp.pendingTxs()), len(mp.queuedTxs()))
+	}
+
+	//5 and 6 got confirmed, 5 is dropped and the rest is promoted
+	sender.TxCnt = 7
+	mp.reorganize(lookup)
+	if mp.get(txs[5].Hash()) != nil || len(mp.pendingTxs()) != 3 || len(mp.queuedTxs()) != 0 {
+		t.Errorf("Expected 3 pending and 0 queued txs after the reorganization, got %v and %v.\n", len(mp.pendingTxs()), len(mp.queuedTxs()))
+	}
+}
+
+func TestMempoolLimits(t *testing.T) {
+
+	accAHash := serializeHashContent(accA.Address)
+	accBHash := serializeHashContent(accB.Address)
+
+	lookup := func(hash [32]byte) *protocol.Account {
+		if hash == accAHash {
+			return &protocol.Account{Address: accA.Address}
+		}
+		if hash == accBHash {
+			return &protocol.Account{Address: accB.Address}
+		}
+		return nil
+	}
+
+	mp := newMempool(nil)
+	mp.maxQueued = 2
+
+	//Queued txs are limited per sender
+	for txCnt := uint32(10); txCnt < 13; txCnt++ {
+		tx, _ := protocol.ConstrFundsTx(0x01, 10, 1, txCnt, accAHash, accBHash, &PrivKeyA)
+		err := mp.add(tx, lookup)
+		if txCnt < 12 && err != nil {
+			t.Errorf("Queued tx with TxCnt %v was not accepted: %v\n", txCnt, err)
+		}
+		if txCnt == 12 && err == nil {
+			t.Error("Queued tx above the limit was accepted.\n")
+		}
+	}
+
+	//The mempool is full, queued txs are evicted first (then lower fees)
+	mp.maxTxs = 3
+	txB0, _ := protocol.ConstrFundsTx(0x01, 10, 5, 0, accBHash, accAHash, &PrivKeyB)
+	txB1, _ := protocol.ConstrFundsTx(0x01, 10, 1, 1, accBHash, accAHash, &PrivKeyB)
+	if err := mp.add(txB0, lookup); err != nil {
+		t.Errorf("Pending tx was not accepted: %v\n", err)
+	}
+	if err := mp.add(txB1, lookup); err != nil {
+		t.Errorf("Pending tx was not accepted: %v\n", err)
+	}
+	if len(mp.all()) != 3 || len(mp.queuedTxs()) != 1 || mp.get(txB0.Hash()) == nil || mp.get(txB1.Hash()) == nil {
+		t.Errorf("Queued tx was not evicted: %v txs, %v queued\n", len(mp.all()), len(mp.queuedTxs()))
+	}
+
+	//Only the last tx of a sender is evicted, a new tx that would be evicted right away is rejected
+	mp.maxTxs = 2
+	mp.remove(mp.queuedTxs()[0])
+	txA0, _ := protocol.ConstrFundsTx(0x01, 10, 3, 0, accAHash, accBHash, &PrivKeyA)
+	txB2, _ := protocol.ConstrFundsTx(0x01, 10, 9, 2, accBHash, accAHash, &PrivKeyB)
+	if err := mp.add(txA0, lookup); err != nil {
+		t.Errorf("Tx with a higher fee was not accepted: %v\n", err)
+	}
+	if mp.get(txB1.Hash()) != nil || mp.get(txB0.Hash()) == nil {
+		t.Error("The wrong tx was evicted.\n")
+	}
+	if err := mp.add(txB2, lookup); err == nil || mp.get(txB2.Hash()) != nil {
+		t.Error("Tx with a gap was accepted into a full mempool.\n")
+	}
+}
+
+func TestMempoolReplacement(t *testing.T) {
+
+	accAHash := serializeHashContent(accA.Address)
+	accBHash := serializeHashContent(accB.Address)
+
+	lookup := func(hash [32]byte) *protocol.Account {
+		return &protocol.Account{Address: accA.Address}
+	}
+
+	mp := newMempool(nil)
+	tx0, _ := protocol.ConstrFundsTx(0x01, 10, 100, 0, accAHash, accBHash, &PrivKeyA)
+	tx1, _ := protocol.ConstrFundsTx(0x01, 10, 100, 1, accAHash, accBHash, &PrivKeyA)
+	mp.add(tx0, lookup)
+	mp.add(tx1, lookup)
+
+	//The fee needs to be bumped by ReplaceFeeBump percent
+	tooLow, _ := protocol.ConstrFundsTx(0x01, 20, 100+ReplaceFeeBump-1, 0, accAHash, accBHash, &PrivKeyA)
+	if err := mp.add(tooLow, lookup); err == nil || mp.get(tooLow.Hash()) != nil || mp.get(tx0.Hash()) == nil {
+		t.Error("Replacement with an insufficient fee bump was accepted.\n")
+	}
+
+	replacement, _ := protocol.ConstrFundsTx(0x01, 20, 100+ReplaceFeeBump, 0, accAHash, accBHash, &PrivKeyA)
+	if err := mp.add(replacement, lookup); err != nil {
+		t.Errorf("Replacement was not accepted: %v\n", err)
+	}
+	if mp.get(tx0.Hash()) != nil || len(mp.all()) != 2 {
+		t.Error("Replaced tx is still in the mempool.\n")
+	}
+
+	//The replacement takes the place of the replaced tx, the txs behind it are still pending
+	pending := mp.pendingTxs()
+	if len(pending) != 2 || pending[0] != protocol.Transaction(replacement) || pending[1] != protocol.Transaction(tx1) {
+		t.Errorf("Pending txs after the replacement are not [replacement, tx1]: %v\n", pending)
+	}
+
+	//The replaced tx is not accepted again
+	if err := mp.add(tx0, lookup); err == nil {
+		t.Error("Replaced tx was accepted again.\n")
+	}
+}
+
+func TestMempoolExpiry(t *testing.T) {
+
+	accAHash := serializeHashContent(accA.Address)
+	accBHash := serializeHashContent(accB.Address)
+
+	st := NewMemStorage()
+	st.State().SetAccount(accAHash, &protocol.Account{Address: accA.Address})
+
+	tx0, _ := protocol.ConstrExpiringFundsTx(0x01, 10, 1, 0, 5, accAHash, accBHash, &PrivKeyA)
+	tx1, _ := protocol.ConstrFundsTx(0x01, 10, 1, 1, accAHash, accBHash, &PrivKeyA)
+	if err := st.WriteOpenTx(tx0); err != nil {
+		t.Errorf("Tx that expires at height 5 was not accepted: %v\n", err)
+	}
+	st.WriteOpenTx(tx1)
+
+	//Block 5 can still include the tx, block 6 can't
+	batch := NewBatch()
+	batch.WriteTip([32]byte{4}, 4)
+	st.Commit(batch)
+	if st.ReadOpenTx(tx0.Hash()) == nil {
+		t.Error("Tx was dropped before it expired.\n")
+	}
+
+	batch = NewBatch()
+	batch.WriteTip([32]byte{5}, 5)
+	st.Commit(batch)
+	if st.ReadOpenTx(tx0.Hash()) != nil {
+		t.Error("Expired tx is still in the mempool.\n")
+	}
+	//The sender's later tx waits for a new tx with TxCnt 0
+	if len(st.ReadPendingTxs()) != 0 || len(st.ReadQueuedTxs()) != 1 {
+		t.Errorf("Expected 0 pending and 1 queued tx, got %v and %v.\n", len(st.ReadPendingTxs()), len(st.ReadQueuedTxs()))
+	}
+
+	if err := st.WriteOpenTx(tx0); err == nil {
+		t.Error("Expired tx was accepted.\n")
+	}
+}
+
+//Txs of a rolled back block go back into the mempool in front of the sender's later txs
+func TestMempoolRollback(t *testing.T) {
+
+	accAHash := serializeHashContent(accA.Address)
+	accBHash := serializeHashContent(accB.Address)
+
+	st := NewMemStorage()
+	sender := &protocol.Account{Address: accA.Address, TxCnt: 1}
+	st.State().SetAccount(accAHash, sender)
+
+	//tx0 is confirmed, tx1 waits for the next block
+	tx0, _ := protocol.ConstrFundsTx(0x01, 10, 1, 0, accAHash, accBHash, &PrivKeyA)
+	tx1, _ := protocol.ConstrFundsTx(0x01, 10, 1, 1, accAHash, accBHash, &PrivKeyA)
+	if err := st.WriteOpenTx(tx1); err != nil {
+		t.Fatalf("Tx was not accepted: %v\n", err)
+	}
+
+	//The block with tx0 is rolled back, the state already is at the previous block when the batch is committed
+	sender.TxCnt = 0
+	batch := NewBatch()
+	batch.WriteOpenTx(tx0)
+	st.Commit(batch)
+
+	if st.ReadOpenTx(tx0.Hash()) == nil {
+		t.Fatal("Tx of the rolled back block was dropped.\n")
+	}
+	pending := st.ReadPendingTxs()
+	if len(pending) != 2 || len(st.ReadQueuedTxs()) != 0 || pending[0].Hash() != tx0.Hash() {
+		t.Errorf("Expected tx0 and tx1 to be pending, got %v pending and %v queued txs.\n", len(pending), len(st.ReadQueuedTxs()))
+	}
+}
+
+func TestMempoolPersistence(t *testing.T) {
+
+	const dbname = "mempool_test.db"
+	os.Remove(dbname)
+	defer os.Remove(dbname)
+
+	accAHash := serializeHashContent(accA.Address)
+	accBHash := serializeHashContent(accB.Address)
+
+	st, err := NewBoltStorage(dbname)
+	if err != nil {
+		t.Fatalf("Could not open database: %v\n", err)
+	}
+	st.State().SetAccount(accAHash, &protocol.Account{Address: accA.Address})
+
+	var txs []*protocol.FundsTx
+	for txCnt := uint32(0); txCnt < 4; txCnt++ {
+		tx, _ := protocol.ConstrFundsTx(0x01, 10, 1, txCnt, accAHash, accBHash, &PrivKeyA)
+		st.WriteOpenTx(tx)
+		txs = append(txs, tx)
+	}
+	//Removed txs don't come back
+	st.DeleteOpenTx(txs[3])
+	st.Close()
+
+	if st, err = NewBoltStorage(dbname); err != nil {
+		t.Fatalf("Could not open database: %v\n", err)
+	}
+	defer st.Close()
+
+	//The first tx got confirmed while the miner was down, the third one doesn't pass validation
+	st.State().SetAccount(accAHash, &protocol.Account{Address: accA.Address, TxCnt: 1})
+	batch := NewBatch()
+	batch.WriteTxLocation(txs[0].Hash(), &TxLocation{Height: 1})
+	st.Commit(batch)
+
+	loaded, dropped := st.LoadMempool(func(tx protocol.Transaction) error {
+		if tx.Hash() == txs[2].Hash() {
+			return errors.New("invalid")
+		}
+		return nil
+	})
+	if loaded != 1 || dropped != 2 {
+		t.Errorf("Reloaded %v and dropped %v txs, want 1 and 2\n", loaded, dropped)
+	}
+	if st.ReadOpenTx(txs[1].Hash()) == nil || len(st.ReadPendingTxs()) != 1 {
+		t.Error("Valid tx was not reloaded as pending.\n")
+	}
+
+	//Dropped txs are deleted from disk as well
+	var onDisk int
+	st.(*store).backend.scan("mempool", nil, func(k, v []byte) bool {
+		onDisk++
+		return true
+	})
+	if onDisk != 1 {
+		t.Errorf("%v txs left in the mempool bucket, want 1\n", onDisk)
+	}
+}
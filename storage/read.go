@@ -1,20 +1,25 @@
 package storage
 
 import (
-	"github.com/boltdb/bolt"
+	"encoding/binary"
 	"github.com/lisgie/bazo_miner/protocol"
+	"math/big"
 )
 
 //Always return nil if requested hash is not in the storage. This return value is then checked against by the caller
-func ReadOpenBlock(hash [32]byte) (block *protocol.Block) {
+func (s *store) ReadOpenBlock(hash [32]byte) (block *protocol.Block) {
 
-	var encodedBlock []byte
-	db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("openblocks"))
-		encodedBlock = b.Get(hash[:])
+	encodedBlock := s.backend.get("openblocks", hash[:])
+	if encodedBlock == nil {
 		return nil
-	})
+	}
 
+	return block.Decode(encodedBlock)
+}
+
+func (s *store) ReadClosedBlock(hash [32]byte) (block *protocol.Block) {
+
+	encodedBlock := s.backend.get("closedblocks", hash[:])
 	if encodedBlock == nil {
 		return nil
 	}
@@ -22,68 +27,170 @@ func ReadOpenBlock(hash [32]byte) (block *protocol.Block) {
 	return block.Decode(encodedBlock)
 }
 
-func ReadClosedBlock(hash [32]byte) (block *protocol.Block) {
+//Returns the block at the given height of the canonical chain
+func (s *store) ReadBlockByHeight(height uint32) (block *protocol.Block) {
 
-	var encodedBlock []byte
-	db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("closedblocks"))
-		encodedBlock = b.Get(hash[:])
+	v := s.backend.get("blockheights", heightKey(height))
+	if v == nil {
 		return nil
-	})
+	}
 
-	if encodedBlock == nil {
+	var hash [32]byte
+	copy(hash[:], v)
+	return s.ReadClosedBlock(hash)
+}
+
+//Returns the last block of the canonical chain and its height. Block is nil if no tip has been written yet
+func (s *store) ReadTip() (block *protocol.Block, height uint32) {
+
+	v := s.backend.get("chainstate", []byte(TIP_KEY))
+	if len(v) != 36 {
+		return nil, 0
+	}
+
+	var hash [32]byte
+	copy(hash[:], v[0:32])
+	height = binary.BigEndian.Uint32(v[32:36])
+
+	return s.ReadClosedBlock(hash), height
+}
+
+//Returns nil if the work of the block is unknown
+func (s *store) ReadChainWork(hash [32]byte) *big.Int {
+
+	encoded := s.backend.get("chainwork", hash[:])
+	if len(encoded) != CHAINWORK_SIZE {
 		return nil
 	}
 
-	return block.Decode(encodedBlock)
+	return new(big.Int).SetBytes(encoded)
 }
 
-func ReadOpenTx(hash [32]byte) (transaction protocol.Transaction) {
+//Returns the blocks from height "from" up to and including height "to". The range is cut off at the first height
+//that is not part of the canonical chain (e.g., if "to" is beyond the tip)
+func (s *store) ReadBlockRange(from, to uint32) (blocks []*protocol.Block) {
+
+	for height := from; height <= to; height++ {
+		block := s.ReadBlockByHeight(height)
+		if block == nil {
+			break
+		}
+		blocks = append(blocks, block)
+
+		//Prevent overflow
+		if height == to {
+			break
+		}
+	}
 
-	return txMemPool[hash]
+	return blocks
 }
 
-//Needed for the miner to prepare a new block
-func ReadAllOpenTxs() (allOpenTxs []protocol.Transaction) {
+//Pending and queued txs
+func (s *store) ReadOpenTx(hash [32]byte) (transaction protocol.Transaction) {
+	return s.mempool.get(hash)
+}
 
-	for key := range txMemPool {
-		allOpenTxs = append(allOpenTxs, txMemPool[key])
-	}
-	return
+func (s *store) ReadAllOpenTxs() (allOpenTxs []protocol.Transaction) {
+	return s.mempool.all()
+}
+
+//Needed for the miner to prepare a new block. FundsTxs of the same sender are ordered by TxCnt
+func (s *store) ReadPendingTxs() []protocol.Transaction {
+	return s.mempool.pendingTxs()
+}
+
+func (s *store) ReadQueuedTxs() []protocol.Transaction {
+	return s.mempool.queuedTxs()
+}
+
+//Equal generations mean that ReadPendingTxs returns the same txs
+func (s *store) ReadMempoolGeneration() uint64 {
+	return s.mempool.currentGeneration()
 }
 
 //Personally I like it better to test (which tx type it is) here, and get returned the interface. Simplifies the code
-func ReadClosedTx(hash [32]byte) (transaction protocol.Transaction) {
+func (s *store) ReadClosedTx(hash [32]byte) (transaction protocol.Transaction) {
 
-	var encodedTx []byte
 	var fundstx *protocol.FundsTx
-	db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("closedfunds"))
-		encodedTx = b.Get(hash[:])
-		return nil
-	})
-	if encodedTx != nil {
+	if encodedTx := s.backend.get("closedfunds", hash[:]); encodedTx != nil {
 		return fundstx.Decode(encodedTx)
 	}
 
 	var acctx *protocol.AccTx
-	db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("closedaccs"))
-		encodedTx = b.Get(hash[:])
-		return nil
-	})
-	if encodedTx != nil {
+	if encodedTx := s.backend.get("closedaccs", hash[:]); encodedTx != nil {
 		return acctx.Decode(encodedTx)
 	}
 
 	var configtx *protocol.ConfigTx
-	db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("closedconfigs"))
-		encodedTx = b.Get(hash[:])
-		return nil
-	})
-	if encodedTx != nil {
+	if encodedTx := s.backend.get("closedconfigs", hash[:]); encodedTx != nil {
 		return configtx.Decode(encodedTx)
 	}
+
 	return nil
 }
+
+func (s *store) ReadChainState(key string) (value []byte) {
+
+	return s.backend.get("chainstate", []byte(key))
+}
+
+//Returns nil if the tx has not been confirmed (yet)
+func (s *store) ReadTxLocation(hash [32]byte) (loc *TxLocation) {
+
+	encodedLoc := s.backend.get("txlocations", hash[:])
+	if encodedLoc == nil {
+		return nil
+	}
+
+	return loc.Decode(encodedLoc)
+}
+
+//Returns nil if there is no undo data for the block (e.g., the block is not part of the canonical chain)
+func (s *store) ReadUndo(blockHash [32]byte) (j *Journal) {
+
+	encodedJournal := s.backend.get("undo", blockHash[:])
+	if encodedJournal == nil {
+		return nil
+	}
+
+	if j = j.Decode(encodedJournal); j != nil {
+		j.state = s.state
+	}
+	return j
+}
+
+//Returns 0 if nothing has been pruned (the genesis block has no txs)
+func (s *store) ReadPrunedHeight() uint32 {
+
+	v := s.backend.get("chainstate", []byte(PRUNEDHEIGHT_KEY))
+	if len(v) != 4 {
+		return 0
+	}
+
+	return binary.BigEndian.Uint32(v)
+}
+
+//A tx is pruned if it was confirmed in a block whose tx payloads have been deleted
+func (s *store) IsPruned(hash [32]byte) bool {
+
+	loc := s.ReadTxLocation(hash)
+	return loc != nil && loc.Height <= s.ReadPrunedHeight()
+}
+
+func (s *store) ReadSnapshot(height uint32) []byte {
+
+	return s.backend.get("snapshots", heightKey(height))
+}
+
+//Returns nil if no snapshot is stored
+func (s *store) ReadLatestSnapshot() (height uint32, snapshot []byte) {
+
+	//Keys are big endian heights, the last one is the latest snapshot
+	s.backend.scan("snapshots", nil, func(key []byte, value []byte) bool {
+		height, snapshot = binary.BigEndian.Uint32(key), value
+		return true
+	})
+
+	return height, snapshot
+}
@@ -0,0 +1,116 @@
+package storage
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+//The schema version is stored in the meta bucket. It describes the bucket layout and the encodings of everything that
+//is persisted. Every change to either of them gets a new version and a migration step that converts existing databases.
+//Chain state entries are opaque to the storage, their encoding is versioned by whoever writes them
+const SCHEMAVERSION_KEY = "schemaversion"
+
+//A migration step converts a database of version-1 to version. The writes are added to the batch, which is committed
+//together with the new version number, a crash during the migration leaves the database at the previous version
+type migration struct {
+	version     uint32
+	description string
+	migrate     func(s *store, batch *Batch) error
+}
+
+//Ordered by version, without gaps. The last step defines the version this code understands
+var migrations = []migration{
+	{
+		version:     1,
+		description: "Introduce the schema version. Databases without a version record already have the current bucket layout, missing buckets are created when the database is opened",
+		migrate:     func(s *store, batch *Batch) error { return nil },
+	},
+	{
+		version:     2,
+		description: "Add the mempool bucket, open txs survive restarts. The bucket is created when the database is opened",
+		migrate:     func(s *store, batch *Batch) error { return nil },
+	},
+	{
+		version:     3,
+		description: "FundsTxs with an expiry height use a versioned encoding. Existing txs keep the fixed size encoding, nothing to convert",
+		migrate:     func(s *store, batch *Batch) error { return nil },
+	},
+	{
+		version:     4,
+		description: "Add the chainwork bucket. The work of existing blocks depends on the target history, the miner fills it in when it restores the chain state",
+		migrate:     func(s *store, batch *Batch) error { return nil },
+	},
+	{
+		version:     5,
+		description: "Blocks from the target fork height on carry a compact 256 bit target behind a header flag. Existing blocks keep their encoding, the miner converts its target history when it restores the chain state",
+		migrate:     func(s *store, batch *Batch) error { return nil },
+	},
+}
+
+func schemaVersion() uint32 {
+	return migrations[len(migrations)-1].version
+}
+
+//Returns 0 if the database has no version record
+func (s *store) readSchemaVersion() uint32 {
+
+	encoded := s.backend.get("meta", []byte(SCHEMAVERSION_KEY))
+	if len(encoded) != 4 {
+		return 0
+	}
+
+	return binary.BigEndian.Uint32(encoded)
+}
+
+func (batch *Batch) writeSchemaVersion(version uint32) {
+
+	encoded := make([]byte, 4)
+	binary.BigEndian.PutUint32(encoded, version)
+	batch.put("meta", []byte(SCHEMAVERSION_KEY), encoded)
+}
+
+//A database without a tip and without closed blocks has never been used by the miner
+func (s *store) isEmpty() bool {
+
+	empty := s.backend.get("chainstate", []byte(TIP_KEY)) == nil
+	s.backend.scan("closedblocks", nil, func(k, v []byte) bool {
+		empty = false
+		return false
+	})
+
+	return empty
+}
+
+//Called whenever a database is opened. New databases get the current version, older ones are migrated step by step.
+//Databases written by a newer version of the miner are refused, we can't know what changed
+func (s *store) migrate() error {
+
+	version := s.readSchemaVersion()
+	if version > schemaVersion() {
+		return errors.New(fmt.Sprintf("Database has schema version %v, this miner only supports up to version %v.", version, schemaVersion()))
+	}
+
+	if version == 0 && s.isEmpty() {
+		batch := NewBatch()
+		batch.writeSchemaVersion(schemaVersion())
+		return s.Commit(batch)
+	}
+
+	for _, step := range migrations {
+		if step.version <= version {
+			continue
+		}
+
+		batch := NewBatch()
+		if err := step.migrate(s, batch); err != nil {
+			return errors.New(fmt.Sprintf("Migration to schema version %v (%v) failed: %v", step.version, step.description, err))
+		}
+		batch.writeSchemaVersion(step.version)
+		if err := s.Commit(batch); err != nil {
+			return errors.New(fmt.Sprintf("Migration to schema version %v could not be written: %v", step.version, err))
+		}
+	}
+
+	return nil
+}
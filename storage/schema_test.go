@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestSchemaMigration(t *testing.T) {
+
+	const dbname = "schema_test.db"
+	os.Remove(dbname)
+	defer os.Remove(dbname)
+
+	for i, step := range migrations {
+		if step.version != uint32(i+1) {
+			t.Fatalf("Migrations are not ordered: step %v has version %v\n", i, step.version)
+		}
+	}
+
+	//New databases start at the current version
+	st, err := NewBoltStorage(dbname)
+	if err != nil {
+		t.Fatalf("Could not open database: %v\n", err)
+	}
+	s := st.(*store)
+	if version := s.readSchemaVersion(); version != schemaVersion() {
+		t.Errorf("New database has version %v, want %v\n", version, schemaVersion())
+	}
+
+	//Pretend the database was written before the version record existed
+	batch := NewBatch()
+	batch.WriteChainState(TIP_KEY, make([]byte, 36))
+	batch.delete("meta", []byte(SCHEMAVERSION_KEY))
+	s.Commit(batch)
+	st.Close()
+
+	origMigrations := migrations
+	defer func() { migrations = origMigrations }()
+
+	var ran int
+	migrations = append(migrations[:len(migrations):len(migrations)], migration{
+		version:     origMigrations[len(origMigrations)-1].version + 1,
+		description: "Test",
+		migrate: func(s *store, batch *Batch) error {
+			ran++
+			batch.WriteChainState("migrated", []byte{1})
+			return nil
+		},
+	})
+
+	if st, err = NewBoltStorage(dbname); err != nil {
+		t.Fatalf("Could not open database: %v\n", err)
+	}
+	s = st.(*store)
+	if version := s.readSchemaVersion(); version != schemaVersion() || ran != 1 || st.ReadChainState("migrated") == nil {
+		t.Errorf("Database was not migrated: version %v (want %v), migration ran %v times\n", version, schemaVersion(), ran)
+	}
+	st.Close()
+
+	//Steps that were applied already don't run again
+	if st, err = NewBoltStorage(dbname); err != nil {
+		t.Fatalf("Could not open database: %v\n", err)
+	}
+	st.Close()
+	if ran != 1 {
+		t.Errorf("Migration ran %v times, want 1\n", ran)
+	}
+
+	//A database written by a newer version is refused
+	migrations = origMigrations
+	if _, err = NewBoltStorage(dbname); err == nil {
+		t.Error("Database with a newer schema version was opened\n")
+	}
+
+	//A failing step leaves the database at the previous version
+	migrations = append(migrations[:len(migrations):len(migrations)],
+		migration{schemaVersion() + 1, "Test", func(s *store, batch *Batch) error { return nil }},
+		migration{schemaVersion() + 2, "Test", func(s *store, batch *Batch) error { return errors.New("failed") }},
+	)
+	if _, err = NewBoltStorage(dbname); err == nil {
+		t.Error("Failing migration was not reported\n")
+	}
+	migrations = migrations[:len(migrations)-1]
+	if st, err = NewBoltStorage(dbname); err != nil {
+		t.Fatalf("Could not open database: %v\n", err)
+	}
+	if version := st.(*store).readSchemaVersion(); version != schemaVersion() {
+		t.Errorf("Database has version %v after the failed migration, want %v\n", version, schemaVersion())
+	}
+	st.Close()
+}
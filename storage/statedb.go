@@ -0,0 +1,295 @@
+package storage
+
+import (
+	"github.com/lisgie/bazo_miner/protocol"
+	"sync"
+)
+
+//The StateDB holds all accounts and root keys. There is a single writer (block validation) that changes accounts in
+//place, everybody else (p2p responses, block templates) reads through snapshots.
+//Writer rules:
+//	- A state transition (e.g., all state changes of a block) is done between Lock and Unlock, snapshots are never
+//	  taken in between. This way readers only see the state between two state transitions.
+//	- Before an account is modified in place, Touch has to be called (the journal does that).
+//Snapshots are copy-on-write: taking a snapshot is cheap, the writer preserves the previous version of an account
+//the first time it is touched after the snapshot was taken.
+type StateDB struct {
+	//Held by the writer for the whole state transition
+	update sync.Mutex
+	//Guards the maps and the generations, only held for a short time
+	mutex    sync.RWMutex
+	accounts map[[32]byte]*protocol.Account
+	rootKeys map[[32]byte]*protocol.Account
+	current  *generation
+}
+
+//A generation starts whenever a snapshot is taken (and accounts were changed since the last snapshot). It records
+//the version of every account at the time the generation started, nil if the account did not exist. Generations are
+//linked, a snapshot walks from its own generation to the current one. Old generations are garbage collected as soon
+//as there are no more snapshots pointing to them.
+type generation struct {
+	accounts   map[[32]byte]*protocol.Account
+	rootKeys   map[[32]byte]*protocol.Account
+	referenced bool
+	next       *generation
+}
+
+//Consistent, read-only view of the state at the time the snapshot was taken. All returned accounts are copies
+type Snapshot struct {
+	db  *StateDB
+	gen *generation
+}
+
+func NewStateDB() *StateDB {
+
+	return &StateDB{
+		accounts: make(map[[32]byte]*protocol.Account),
+		rootKeys: make(map[[32]byte]*protocol.Account),
+		current:  newGeneration(),
+	}
+}
+
+func newGeneration() *generation {
+
+	return &generation{
+		accounts: make(map[[32]byte]*protocol.Account),
+		rootKeys: make(map[[32]byte]*protocol.Account),
+	}
+}
+
+//Starts a state transition, no snapshots are taken until Unlock is called
+func (db *StateDB) Lock() {
+	db.update.Lock()
+}
+
+func (db *StateDB) Unlock() {
+	db.update.Unlock()
+}
+
+func (db *StateDB) Snapshot() *Snapshot {
+
+	db.update.Lock()
+	defer db.update.Unlock()
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	//If nothing changed since the last snapshot, the generation can be shared
+	if len(db.current.accounts) > 0 || len(db.current.rootKeys) > 0 {
+		gen := newGeneration()
+		db.current.next = gen
+		db.current = gen
+	}
+	db.current.referenced = true
+
+	return &Snapshot{db, db.current}
+}
+
+//Needs to be called before the account (or root key) is modified in place
+func (db *StateDB) Touch(hash [32]byte) {
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	db.touch(hash)
+}
+
+//Only the first version per generation is kept, it's the one snapshots of this generation need to see
+func (db *StateDB) touch(hash [32]byte) {
+
+	//Nobody reads this generation (yet), no need to keep old versions
+	if !db.current.referenced {
+		return
+	}
+
+	if _, exists := db.current.accounts[hash]; !exists {
+		db.current.accounts[hash] = copyAccount(db.accounts[hash])
+	}
+	if _, exists := db.current.rootKeys[hash]; !exists {
+		db.current.rootKeys[hash] = copyAccount(db.rootKeys[hash])
+	}
+}
+
+//Returns the account itself (not a copy), only to be used by the writer. Returns nil if the account does not exist
+func (db *StateDB) GetAccount(hash [32]byte) *protocol.Account {
+
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	return db.accounts[hash]
+}
+
+func (db *StateDB) SetAccount(hash [32]byte, acc *protocol.Account) {
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	db.touch(hash)
+	db.accounts[hash] = acc
+}
+
+func (db *StateDB) DeleteAccount(hash [32]byte) {
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	db.touch(hash)
+	delete(db.accounts, hash)
+}
+
+//Root accounts that are part of the state share the same pointer with the state account. Otherwise coins issued by the
+//root account (see fundsStateChange in the miner package) would be debited from the state account only
+func (db *StateDB) GetRootKey(hash [32]byte) *protocol.Account {
+
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	return db.rootKeys[hash]
+}
+
+func (db *StateDB) SetRootKey(hash [32]byte, acc *protocol.Account) {
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	db.touch(hash)
+	db.rootKeys[hash] = acc
+}
+
+func (db *StateDB) DeleteRootKey(hash [32]byte) {
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	db.touch(hash)
+	delete(db.rootKeys, hash)
+}
+
+func (db *StateDB) IsRootKey(hash [32]byte) bool {
+
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	_, exists := db.rootKeys[hash]
+	return exists
+}
+
+//Returns a new map with all accounts (not copies), only to be used by the writer
+func (db *StateDB) Accounts() map[[32]byte]*protocol.Account {
+
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	accounts := make(map[[32]byte]*protocol.Account)
+	for hash, acc := range db.accounts {
+		accounts[hash] = acc
+	}
+	return accounts
+}
+
+func (db *StateDB) RootKeys() map[[32]byte]*protocol.Account {
+
+	db.mutex.RLock()
+	defer db.mutex.RUnlock()
+
+	rootKeys := make(map[[32]byte]*protocol.Account)
+	for hash, acc := range db.rootKeys {
+		rootKeys[hash] = acc
+	}
+	return rootKeys
+}
+
+//Removes all accounts and root keys. Snapshots that were taken before are not affected
+func (db *StateDB) Reset() {
+
+	db.mutex.Lock()
+	defer db.mutex.Unlock()
+
+	for hash := range db.accounts {
+		db.touch(hash)
+	}
+	for hash := range db.rootKeys {
+		db.touch(hash)
+	}
+	db.accounts = make(map[[32]byte]*protocol.Account)
+	db.rootKeys = make(map[[32]byte]*protocol.Account)
+}
+
+//Returns a copy of the account as it was when the snapshot was taken, nil if it didn't exist
+func (snapshot *Snapshot) GetAccount(hash [32]byte) *protocol.Account {
+
+	snapshot.db.mutex.RLock()
+	defer snapshot.db.mutex.RUnlock()
+
+	return copyAccount(snapshot.lookup(hash, false))
+}
+
+func (snapshot *Snapshot) GetRootKey(hash [32]byte) *protocol.Account {
+
+	snapshot.db.mutex.RLock()
+	defer snapshot.db.mutex.RUnlock()
+
+	return copyAccount(snapshot.lookup(hash, true))
+}
+
+func (snapshot *Snapshot) IsRootKey(hash [32]byte) bool {
+
+	snapshot.db.mutex.RLock()
+	defer snapshot.db.mutex.RUnlock()
+
+	return snapshot.lookup(hash, true) != nil
+}
+
+func (snapshot *Snapshot) RootKeys() map[[32]byte]*protocol.Account {
+
+	snapshot.db.mutex.RLock()
+	defer snapshot.db.mutex.RUnlock()
+
+	//Root keys that were deleted after the snapshot was taken are only found in the generations
+	candidates := make(map[[32]byte]bool)
+	for hash := range snapshot.db.rootKeys {
+		candidates[hash] = true
+	}
+	for gen := snapshot.gen; gen != nil; gen = gen.next {
+		for hash := range gen.rootKeys {
+			candidates[hash] = true
+		}
+	}
+
+	rootKeys := make(map[[32]byte]*protocol.Account)
+	for hash := range candidates {
+		if acc := snapshot.lookup(hash, true); acc != nil {
+			rootKeys[hash] = copyAccount(acc)
+		}
+	}
+	return rootKeys
+}
+
+//The first generation (starting at the snapshot's) that recorded the account has the version of the snapshot. If no
+//generation recorded it, the account hasn't been touched since and the current version is returned. The caller needs
+//to hold the read lock
+func (snapshot *Snapshot) lookup(hash [32]byte, rootKey bool) *protocol.Account {
+
+	for gen := snapshot.gen; gen != nil; gen = gen.next {
+		recorded := gen.accounts
+		if rootKey {
+			recorded = gen.rootKeys
+		}
+		if acc, exists := recorded[hash]; exists {
+			return acc
+		}
+	}
+
+	if rootKey {
+		return snapshot.db.rootKeys[hash]
+	}
+	return snapshot.db.accounts[hash]
+}
+
+func copyAccount(acc *protocol.Account) *protocol.Account {
+
+	if acc == nil {
+		return nil
+	}
+	accCopy := *acc
+	return &accCopy
+}
@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"github.com/lisgie/bazo_miner/protocol"
+	"sync"
+	"testing"
+)
+
+//Snapshots need to keep their view, no matter what the writer does afterwards
+func TestSnapshotIsolation(t *testing.T) {
+
+	db := NewStateDB()
+
+	accHash, newHash, rootHash := [32]byte{'a'}, [32]byte{'n'}, [32]byte{'r'}
+	acc := &protocol.Account{Address: [64]byte{'a'}, Balance: 100}
+	root := &protocol.Account{Address: [64]byte{'r'}, Balance: 10}
+	db.SetAccount(accHash, acc)
+	db.SetAccount(rootHash, root)
+	db.SetRootKey(rootHash, root)
+
+	snapshot := db.Snapshot()
+
+	db.Lock()
+	db.Touch(accHash)
+	acc.Balance, acc.TxCnt = 50, 1
+	db.SetAccount(newHash, &protocol.Account{Address: [64]byte{'n'}})
+	db.Touch(rootHash)
+	root.Balance = 1000
+	db.DeleteRootKey(rootHash)
+	db.Unlock()
+
+	secondSnapshot := db.Snapshot()
+
+	db.Lock()
+	db.Touch(accHash)
+	acc.Balance = 0
+	db.Unlock()
+
+	if snapAcc := snapshot.GetAccount(accHash); snapAcc == nil || snapAcc.Balance != 100 || snapAcc.TxCnt != 0 {
+		t.Errorf("Snapshot sees changes of the writer: %v\n", snapAcc)
+	}
+	if snapshot.GetAccount(newHash) != nil {
+		t.Error("Snapshot sees account that was created afterwards.\n")
+	}
+	if !snapshot.IsRootKey(rootHash) || snapshot.GetRootKey(rootHash).Balance != 10 || len(snapshot.RootKeys()) != 1 {
+		t.Errorf("Snapshot does not see the deleted root key: %v\n", snapshot.RootKeys())
+	}
+
+	if snapAcc := secondSnapshot.GetAccount(accHash); snapAcc == nil || snapAcc.Balance != 50 {
+		t.Errorf("Second snapshot has the wrong version: %v\n", snapAcc)
+	}
+	if secondSnapshot.GetAccount(newHash) == nil || secondSnapshot.IsRootKey(rootHash) {
+		t.Error("Second snapshot misses changes that happened before it was taken.\n")
+	}
+
+	//Returned accounts are copies
+	snapshot.GetAccount(accHash).Balance = 12345
+	if snapshot.GetAccount(accHash).Balance != 100 {
+		t.Error("Snapshot account could be modified.\n")
+	}
+
+	//Live view
+	if db.GetAccount(accHash) != acc || acc.Balance != 0 || db.IsRootKey(rootHash) {
+		t.Error("Writer view is wrong.\n")
+	}
+}
+
+//Readers take snapshots while the writer changes the state, every snapshot has to see the state between two updates
+func TestSnapshotConcurrency(t *testing.T) {
+
+	db := NewStateDB()
+
+	//The writer moves funds between the accounts, the total stays the same
+	hashes := [][32]byte{{'a'}, {'b'}, {'c'}}
+	for _, hash := range hashes {
+		db.SetAccount(hash, &protocol.Account{Balance: 1000})
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for cnt := 0; cnt < 1000; cnt++ {
+			from, to := hashes[cnt%3], hashes[(cnt+1)%3]
+			db.Lock()
+			db.Touch(from)
+			db.Touch(to)
+			db.GetAccount(from).Balance -= 10
+			db.GetAccount(to).Balance += 10
+			db.Unlock()
+		}
+	}()
+
+	for cnt := 0; cnt < 200; cnt++ {
+		snapshot := db.Snapshot()
+		var total uint64
+		for _, hash := range hashes {
+			total += snapshot.GetAccount(hash).Balance
+		}
+		if total != 3000 {
+			t.Fatalf("Snapshot is not consistent, total balance is %v\n", total)
+		}
+	}
+
+	wg.Wait()
+}
@@ -1,71 +1,153 @@
 package storage
 
 import (
-	"fmt"
-	"github.com/boltdb/bolt"
 	"github.com/lisgie/bazo_miner/protocol"
-	"log"
-	"os"
-	"time"
+	"math/big"
 )
 
-var (
-	db        *bolt.DB
-	logger    *log.Logger
-	State     = make(map[[32]byte]*protocol.Account)
-	RootKeys  = make(map[[32]byte]*protocol.Account)
-	txMemPool = make(map[[32]byte]protocol.Transaction)
+//The canonical chain tip and the height up to which tx payloads were pruned are stored in the chainstate bucket
+const (
+	TIP_KEY          = "tip"
+	PRUNEDHEIGHT_KEY = "prunedheight"
 )
 
-//Entry function for the storage package
-func Init(dbname string) {
+//The cumulative work of a block is stored big endian with a fixed size. 40 bytes hold the work of 2^32 blocks at the
+//highest possible difficulty
+const CHAINWORK_SIZE = 40
 
-	LogFile, _ := os.OpenFile("logs/storage "+time.Now().String(), os.O_RDWR|os.O_CREATE, 0666)
-	logger = log.New(LogFile, "", log.LstdFlags)
+//All buckets a backend needs to provide
+var buckets = []string{
+	"openblocks",
+	"closedblocks",
+	"closedfunds",
+	"closedaccs",
+	"closedconfigs",
+	"blockheights",
+	"chainwork",
+	"txlocations",
+	"history",
+	"undo",
+	"snapshots",
+	"accounts",
+	"rootkeys",
+	"chainstate",
+	"mempool",
+	"meta",
+}
+
+//Everything the miner and the p2p package need to store: blocks, closed txs (and their indices), the mempool and
+//the state. Implemented on top of bolt (NewBoltStorage) and in memory (NewMemStorage), the latter is mainly useful
+//for tests and for running several nodes in one process.
+type Storage interface {
+	ReadOpenBlock(hash [32]byte) *protocol.Block
+	ReadClosedBlock(hash [32]byte) *protocol.Block
+	ReadBlockByHeight(height uint32) *protocol.Block
+	ReadTip() (block *protocol.Block, height uint32)
+	ReadBlockRange(from, to uint32) []*protocol.Block
+	ReadChainWork(hash [32]byte) *big.Int
+	WriteOpenBlock(block *protocol.Block) error
+	WriteClosedBlock(block *protocol.Block) error
+	DeleteOpenBlock(hash [32]byte)
+	DeleteClosedBlock(hash [32]byte)
+
+	ReadClosedTx(hash [32]byte) protocol.Transaction
+	WriteClosedTx(transaction protocol.Transaction) error
+	DeleteClosedTx(transaction protocol.Transaction)
+	ReadTxLocation(hash [32]byte) *TxLocation
+	ReadAccountHistory(account [32]byte, offset int, limit int) []*HistoryEntry
+	ReadUndo(blockHash [32]byte) *Journal
+	ReadPrunedHeight() uint32
+	ReadSnapshot(height uint32) []byte
+	ReadLatestSnapshot() (height uint32, snapshot []byte)
+	IsPruned(hash [32]byte) bool
+
+	//Mempool (open txs), kept in memory and persisted to survive restarts
+	ReadOpenTx(hash [32]byte) protocol.Transaction
+	ReadAllOpenTxs() []protocol.Transaction
+	ReadPendingTxs() []protocol.Transaction
+	ReadQueuedTxs() []protocol.Transaction
+	ReadMempoolGeneration() uint64
+	WriteOpenTx(transaction protocol.Transaction) error
+	DeleteOpenTx(transaction protocol.Transaction)
+	LoadMempool(validate func(transaction protocol.Transaction) error) (loaded int, dropped int)
+
+	//The in-memory state and its persisted counterpart
+	State() *StateDB
+	LoadState()
+	WriteAccount(hash [32]byte, acc *protocol.Account) error
+	WriteRootKey(hash [32]byte, acc *protocol.Account) error
+	DeleteAccount(hash [32]byte)
+	DeleteRootKey(hash [32]byte)
+	ReadChainState(key string) []byte
+	WriteChainState(key string, value []byte) error
+
+	Commit(batch *Batch) error
+	DeleteAll()
+	Close() error
+}
+
+//Key/value store with the buckets listed above. Values returned by get and scan are copies, the caller may keep them
+type backend interface {
+	get(bucket string, key []byte) []byte
+	//Iterates over the bucket in key order, starting at the first key >= seek. Stops as soon as fn returns false
+	scan(bucket string, seek []byte, fn func(key []byte, value []byte) bool)
+	//Either all operations are applied or none
+	write(ops []batchOp) error
+	clear(bucket string)
+	close() error
+}
+
+//Storage implementation shared by all backends
+type store struct {
+	backend backend
+	state   *StateDB
+	mempool *mempool
+}
+
+func newStore(backend backend) *store {
 
-	var err error
-	db, err = bolt.Open(dbname, 0600, nil)
-	if err != nil {
-		logger.Fatal(err)
+	s := &store{
+		backend: backend,
+		state:   NewStateDB(),
+		mempool: newMempool(backend),
 	}
+	//Expiry of reloaded txs is checked against the chain the database already holds
+	_, s.mempool.height = s.ReadTip()
 
-	db.Update(func(tx *bolt.Tx) error {
-		_, err = tx.CreateBucket([]byte("openblocks"))
-		if err != nil {
-			return fmt.Errorf("Create bucket: %s", err)
-		}
-		return nil
-	})
-	db.Update(func(tx *bolt.Tx) error {
-		_, err = tx.CreateBucket([]byte("closedblocks"))
-		if err != nil {
-			return fmt.Errorf("Create bucket: %s", err)
-		}
-		return nil
-	})
-	db.Update(func(tx *bolt.Tx) error {
-		_, err = tx.CreateBucket([]byte("closedfunds"))
-		if err != nil {
-			return fmt.Errorf("Create bucket: %s", err)
-		}
-		return nil
-	})
-	db.Update(func(tx *bolt.Tx) error {
-		_, err = tx.CreateBucket([]byte("closedaccs"))
-		if err != nil {
-			return fmt.Errorf("Create bucket: %s", err)
+	return s
+}
+
+func (s *store) State() *StateDB {
+	return s.state
+}
+
+//Fills the state with the accounts that were persisted during block validation
+func (s *store) LoadState() {
+
+	s.backend.scan("accounts", nil, func(k, v []byte) bool {
+		var hash [32]byte
+		var acc *protocol.Account
+		copy(hash[:], k)
+		if acc = acc.Decode(v); acc != nil {
+			s.state.SetAccount(hash, acc)
 		}
-		return nil
+		return true
 	})
-	db.Update(func(tx *bolt.Tx) error {
-		_, err = tx.CreateBucket([]byte("closedconfigs"))
-		if err != nil {
-			return fmt.Errorf("Create bucket: %s", err)
+
+	s.backend.scan("rootkeys", nil, func(k, v []byte) bool {
+		var hash [32]byte
+		var acc *protocol.Account
+		copy(hash[:], k)
+		//Root accounts that are part of the state share the same pointer (see StateDB.GetRootKey)
+		if stateAcc := s.state.GetAccount(hash); stateAcc != nil {
+			s.state.SetRootKey(hash, stateAcc)
+		} else if acc = acc.Decode(v); acc != nil {
+			s.state.SetRootKey(hash, acc)
 		}
-		return nil
+		return true
 	})
 }
 
-func TearDown() {
-	db.Close()
+func (s *store) Close() error {
+	return s.backend.close()
 }
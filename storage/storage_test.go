@@ -2,7 +2,9 @@ package storage
 
 import (
 	"github.com/lisgie/bazo_miner/protocol"
+	"math/big"
 	"math/rand"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -24,7 +26,7 @@ func TestReadWriteDeleteTx(t *testing.T) {
 	loopMax := testsize
 	for i := 0; i < loopMax; i++ {
 		tx, _ := protocol.ConstrFundsTx(0x01, rand.Uint64()%100000+1, rand.Uint64()%10+1, uint32(i), accAHash, accBHash, &PrivKeyA)
-		WriteOpenTx(tx)
+		testStore.WriteOpenTx(tx)
 		hashFundsSlice = append(hashFundsSlice, tx)
 	}
 
@@ -32,7 +34,7 @@ func TestReadWriteDeleteTx(t *testing.T) {
 	for i := 0; i < loopMax; i++ {
 		tx,_,_ := protocol.ConstrAccTx(0, rand.Uint64()%100+1, &RootPrivKey)
 		tx.Hash()
-		WriteOpenTx(tx)
+		testStore.WriteOpenTx(tx)
 		hashAccSlice = append(hashAccSlice, tx)
 	}
 
@@ -41,126 +43,126 @@ func TestReadWriteDeleteTx(t *testing.T) {
 	for cnt := 0; cnt < loopMax; cnt++ {
 		tx, _ := protocol.ConstrConfigTx(uint8(rand.Uint32()%256), uint8(rand.Uint32()%5+1), rand.Uint64()%2342873423, rand.Uint64()%1000+1, uint8(cnt), &RootPrivKey)
 		hashConfigSlice = append(hashConfigSlice, tx)
-		WriteOpenTx(tx)
+		testStore.WriteOpenTx(tx)
 	}
 
 	for _, tx := range hashFundsSlice {
-		if ReadOpenTx(tx.Hash()) == nil {
+		if testStore.ReadOpenTx(tx.Hash()) == nil {
 			t.Errorf("Error writing transaction hash: %x\n", tx)
 		}
 	}
 
 	for _, tx := range hashAccSlice {
-		if ReadOpenTx(tx.Hash()) == nil {
+		if testStore.ReadOpenTx(tx.Hash()) == nil {
 			t.Errorf("Error writing transaction hash: %x\n", tx)
 		}
 	}
 
 	for _, tx := range hashConfigSlice {
-		if ReadOpenTx(tx.Hash()) == nil {
+		if testStore.ReadOpenTx(tx.Hash()) == nil {
 			t.Errorf("Error writing transaction hash: %x\n", tx)
 		}
 	}
 
 	//Read all open txs, received in random order
-	opentxs := ReadAllOpenTxs()
+	opentxs := testStore.ReadAllOpenTxs()
 
 	//Comparing the total number of txs should be enough
 	if len(opentxs) != len(hashConfigSlice)+len(hashFundsSlice)+len(hashAccSlice) {
-		t.Error("ReadAllOpenTxs() returned an invalid list of transactions\n")
+		t.Error("testStore.ReadAllOpenTxs() returned an invalid list of transactions\n")
 	}
 
 	//Deleting open txs
 	for _, tx := range hashFundsSlice {
-		DeleteOpenTx(tx)
+		testStore.DeleteOpenTx(tx)
 	}
 
 	for _, tx := range hashAccSlice {
-		DeleteOpenTx(tx)
+		testStore.DeleteOpenTx(tx)
 	}
 
 	for _, tx := range hashConfigSlice {
-		DeleteOpenTx(tx)
+		testStore.DeleteOpenTx(tx)
 	}
 
 	//Make sure all txs are actually deleted
 	for _, tx := range hashFundsSlice {
-		if ReadOpenTx(tx.Hash()) != nil {
+		if testStore.ReadOpenTx(tx.Hash()) != nil {
 			t.Errorf("Error deleting transaction hash: %x\n", tx)
 		}
 	}
 
 	for _, tx := range hashAccSlice {
-		if ReadOpenTx(tx.Hash()) != nil {
+		if testStore.ReadOpenTx(tx.Hash()) != nil {
 			t.Errorf("Error deleting transaction hash: %x\n", tx)
 		}
 	}
 
 	for _, tx := range hashConfigSlice {
-		if ReadOpenTx(tx.Hash()) != nil {
+		if testStore.ReadOpenTx(tx.Hash()) != nil {
 			t.Errorf("Error deleting transaction hash: %x\n", tx)
 		}
 	}
 
 	//Same with k/v-based closed tx storage
 	for _, tx := range hashAccSlice {
-		WriteClosedTx(tx)
+		testStore.WriteClosedTx(tx)
 	}
 
 	for _, tx := range hashFundsSlice {
-		WriteClosedTx(tx)
+		testStore.WriteClosedTx(tx)
 	}
 
 	for _, tx := range hashConfigSlice {
-		WriteClosedTx(tx)
+		testStore.WriteClosedTx(tx)
 	}
 
 	for _, tx := range hashAccSlice {
-		if ReadClosedTx(tx.Hash()) == nil {
+		if testStore.ReadClosedTx(tx.Hash()) == nil {
 			t.Errorf("Error writing to k/v storage: %x\n", tx)
 		}
 	}
 
 	for _, tx := range hashFundsSlice {
-		if ReadClosedTx(tx.Hash()) == nil {
+		if testStore.ReadClosedTx(tx.Hash()) == nil {
 			t.Errorf("Error writing to k/v storage: %x\n", tx)
 		}
 	}
 
 	for _, tx := range hashConfigSlice {
-		if ReadClosedTx(tx.Hash()) == nil {
+		if testStore.ReadClosedTx(tx.Hash()) == nil {
 			t.Errorf("Error writing to k/v storage: %x\n", tx)
 		}
 	}
 
 	//Delete transactions from closed storage
 	for _, tx := range hashAccSlice {
-		DeleteClosedTx(tx)
+		testStore.DeleteClosedTx(tx)
 	}
 
 	for _, tx := range hashFundsSlice {
-		DeleteClosedTx(tx)
+		testStore.DeleteClosedTx(tx)
 	}
 
 	for _, tx := range hashConfigSlice {
-		DeleteClosedTx(tx)
+		testStore.DeleteClosedTx(tx)
 	}
 
 	//Make sure all txs are actually deleted
 	for _, tx := range hashAccSlice {
-		if ReadClosedTx(tx.Hash()) != nil {
+		if testStore.ReadClosedTx(tx.Hash()) != nil {
 			t.Errorf("Error deleting transaction hash: %x\n", tx)
 		}
 	}
 
 	for _, tx := range hashFundsSlice {
-		if ReadClosedTx(tx.Hash()) != nil {
+		if testStore.ReadClosedTx(tx.Hash()) != nil {
 			t.Errorf("Error deleting transaction hash: %x\n", tx)
 		}
 	}
 
 	for _, tx := range hashConfigSlice {
-		if ReadClosedTx(tx.Hash()) != nil {
+		if testStore.ReadClosedTx(tx.Hash()) != nil {
 			t.Errorf("Error deleting transaction hash: %x\n", tx)
 		}
 	}
@@ -170,48 +172,425 @@ func TestReadWriteDeleteTx(t *testing.T) {
 func TestReadWriteDeleteBlock(t *testing.T) {
 
 	//No panic
-	DeleteOpenBlock([32]byte{'0'})
+	testStore.DeleteOpenBlock([32]byte{'0'})
 
 	b, b2, b3 := new(protocol.Block), new(protocol.Block), new(protocol.Block)
 	b.Hash = [32]byte{'0'}
 	b2.Hash = [32]byte{'1'}
 	b3.Hash = [32]byte{'2'}
-	WriteOpenBlock(b)
-	WriteOpenBlock(b2)
-	WriteOpenBlock(b3)
+	testStore.WriteOpenBlock(b)
+	testStore.WriteOpenBlock(b2)
+	testStore.WriteOpenBlock(b3)
 
-	if ReadOpenBlock(b.Hash) == nil || ReadOpenBlock(b2.Hash) == nil || ReadOpenBlock(b3.Hash) == nil {
+	if testStore.ReadOpenBlock(b.Hash) == nil || testStore.ReadOpenBlock(b2.Hash) == nil || testStore.ReadOpenBlock(b3.Hash) == nil {
 		t.Error("Failed to write block to open block storage.\n")
 	}
 
-	newb1 := ReadOpenBlock(b.Hash)
-	newb2 := ReadOpenBlock(b2.Hash)
-	newb3 := ReadOpenBlock(b3.Hash)
+	newb1 := testStore.ReadOpenBlock(b.Hash)
+	newb2 := testStore.ReadOpenBlock(b2.Hash)
+	newb3 := testStore.ReadOpenBlock(b3.Hash)
 
-	DeleteOpenBlock(newb1.Hash)
-	DeleteOpenBlock(newb2.Hash)
-	DeleteOpenBlock(newb3.Hash)
+	testStore.DeleteOpenBlock(newb1.Hash)
+	testStore.DeleteOpenBlock(newb2.Hash)
+	testStore.DeleteOpenBlock(newb3.Hash)
 
-	WriteClosedBlock(newb1)
-	WriteClosedBlock(newb2)
-	WriteClosedBlock(newb3)
+	testStore.WriteClosedBlock(newb1)
+	testStore.WriteClosedBlock(newb2)
+	testStore.WriteClosedBlock(newb3)
 
-	if ReadOpenBlock(newb1.Hash) != nil ||
-		ReadOpenBlock(newb2.Hash) != nil ||
-		ReadOpenBlock(newb3.Hash) != nil ||
-		ReadClosedBlock(b.Hash) == nil ||
-		ReadClosedBlock(b2.Hash) == nil ||
-		ReadClosedBlock(b3.Hash) == nil {
+	if testStore.ReadOpenBlock(newb1.Hash) != nil ||
+		testStore.ReadOpenBlock(newb2.Hash) != nil ||
+		testStore.ReadOpenBlock(newb3.Hash) != nil ||
+		testStore.ReadClosedBlock(b.Hash) == nil ||
+		testStore.ReadClosedBlock(b2.Hash) == nil ||
+		testStore.ReadClosedBlock(b3.Hash) == nil {
 		t.Error("Failed to write block to kv storage.\n")
 	}
 
-	DeleteClosedBlock(newb1.Hash)
-	DeleteClosedBlock(newb2.Hash)
-	DeleteClosedBlock(newb3.Hash)
+	testStore.DeleteClosedBlock(newb1.Hash)
+	testStore.DeleteClosedBlock(newb2.Hash)
+	testStore.DeleteClosedBlock(newb3.Hash)
 
-	if ReadClosedBlock(b.Hash) != nil ||
-		ReadClosedBlock(b2.Hash) != nil ||
-		ReadClosedBlock(b3.Hash) != nil {
+	if testStore.ReadClosedBlock(b.Hash) != nil ||
+		testStore.ReadClosedBlock(b2.Hash) != nil ||
+		testStore.ReadClosedBlock(b3.Hash) != nil {
 		t.Error("Failed to delete block from kv storage.\n")
 	}
 }
+
+//Accounts, root keys and chain state need to survive a restart
+func TestReadWriteDeleteState(t *testing.T) {
+
+	state := testStore.State()
+	accAHash := serializeHashContent(accA.Address)
+	accBHash := serializeHashContent(accB.Address)
+
+	var rootHash [32]byte
+	for hash := range state.RootKeys() {
+		rootHash = hash
+	}
+
+	accA.Balance, accA.TxCnt = 1000, 3
+	accB.Balance, accB.TxCnt = 2000, 0
+
+	testStore.WriteAccount(accAHash, accA)
+	testStore.WriteAccount(accBHash, accB)
+	testStore.WriteAccount(rootHash, state.GetAccount(rootHash))
+	testStore.WriteRootKey(rootHash, state.GetRootKey(rootHash))
+	testStore.WriteChainState("test", []byte{1, 2, 3})
+
+	//Simulate a restart by clearing the in-memory state
+	stateBefore := make(map[[32]byte]protocol.Account)
+	for hash, acc := range state.Accounts() {
+		stateBefore[hash] = *acc
+	}
+	state.Reset()
+
+	testStore.LoadState()
+
+	if len(state.Accounts()) != len(stateBefore) {
+		t.Errorf("Loaded state has wrong size: %v vs. %v\n", len(state.Accounts()), len(stateBefore))
+	}
+	for hash, acc := range stateBefore {
+		if state.GetAccount(hash) == nil || *state.GetAccount(hash) != acc {
+			t.Errorf("Account was not properly restored: %v vs. %v\n", state.GetAccount(hash), acc)
+		}
+	}
+	//Root accounts in the state need to be the same object, otherwise root balances diverge
+	if state.GetRootKey(rootHash) == nil || state.GetRootKey(rootHash) != state.GetAccount(rootHash) {
+		t.Error("Root key was not properly restored.\n")
+	}
+	if value := testStore.ReadChainState("test"); len(value) != 3 || value[2] != 3 {
+		t.Errorf("Chain state was not properly restored: %v\n", value)
+	}
+
+	testStore.DeleteAccount(accBHash)
+	testStore.DeleteRootKey(rootHash)
+	state.DeleteAccount(accBHash)
+	state.DeleteRootKey(rootHash)
+
+	testStore.LoadState()
+
+	if state.GetAccount(accBHash) != nil || state.GetRootKey(rootHash) != nil {
+		t.Error("Failed to delete account from disk.\n")
+	}
+
+	//LoadState created new objects, the tests below expect the test accounts in the state
+	state.Reset()
+	addTestingAccounts()
+	addRootAccounts()
+}
+
+//All writes of a batch need to be applied together, or not at all
+func TestCommitBatch(t *testing.T) {
+
+	accAHash := serializeHashContent(accA.Address)
+	accBHash := serializeHashContent(accB.Address)
+
+	b := new(protocol.Block)
+	b.Hash = [32]byte{'b', 'a', 't', 'c', 'h'}
+	fundsTx, _ := protocol.ConstrFundsTx(0x01, 10, 1, 0, accAHash, accBHash, &PrivKeyA)
+	configTx, _ := protocol.ConstrConfigTx(0, 1, 5000, 1, 0, &RootPrivKey)
+
+	testStore.WriteOpenBlock(b)
+	testStore.WriteOpenTx(fundsTx)
+	testStore.WriteOpenTx(configTx)
+
+	batch := NewBatch()
+	batch.WriteClosedTx(fundsTx)
+	batch.DeleteOpenTx(fundsTx)
+	batch.WriteClosedTx(configTx)
+	batch.DeleteOpenTx(configTx)
+	batch.DeleteOpenBlock(b.Hash)
+	batch.WriteClosedBlock(b)
+	batch.WriteAccount(accAHash, accA)
+	batch.WriteChainState("batch", []byte{1})
+
+	//Nothing is written before the commit
+	if testStore.ReadClosedBlock(b.Hash) != nil || testStore.ReadClosedTx(fundsTx.Hash()) != nil || testStore.ReadOpenTx(fundsTx.Hash()) == nil {
+		t.Error("Batch was written before it was committed.\n")
+	}
+
+	if err := testStore.Commit(batch); err != nil {
+		t.Errorf("Committing batch failed: %v\n", err)
+	}
+
+	if testStore.ReadClosedBlock(b.Hash) == nil ||
+		testStore.ReadOpenBlock(b.Hash) != nil ||
+		testStore.ReadClosedTx(fundsTx.Hash()) == nil ||
+		testStore.ReadClosedTx(configTx.Hash()) == nil ||
+		testStore.ReadOpenTx(fundsTx.Hash()) != nil ||
+		testStore.ReadOpenTx(configTx.Hash()) != nil ||
+		testStore.ReadChainState("batch") == nil {
+		t.Error("Batch was not properly committed.\n")
+	}
+
+	//Revert everything, but let the last operation fail. The whole batch needs to be discarded
+	batch = NewBatch()
+	batch.DeleteClosedTx(fundsTx)
+	batch.WriteOpenTx(fundsTx)
+	batch.DeleteClosedBlock(b.Hash)
+	batch.DeleteAccount(accAHash)
+	batch.put("nonexistent", []byte{0}, []byte{0})
+
+	if err := testStore.Commit(batch); err == nil {
+		t.Error("Committing a batch with an invalid operation did not fail.\n")
+	}
+
+	if testStore.ReadClosedBlock(b.Hash) == nil || testStore.ReadClosedTx(fundsTx.Hash()) == nil || testStore.ReadOpenTx(fundsTx.Hash()) != nil {
+		t.Error("Failed batch was partially written.\n")
+	}
+
+	testStore.DeleteClosedBlock(b.Hash)
+	testStore.DeleteClosedTx(fundsTx)
+	testStore.DeleteClosedTx(configTx)
+}
+
+func TestBlockHeightIndex(t *testing.T) {
+
+	var blocks []*protocol.Block
+
+	batch := NewBatch()
+	for height := uint32(0); height < 5; height++ {
+		b := new(protocol.Block)
+		b.Hash = [32]byte{'h', byte(height)}
+		if height > 0 {
+			b.PrevHash = blocks[height-1].Hash
+		}
+		blocks = append(blocks, b)
+		batch.WriteClosedBlock(b)
+		batch.WriteTip(b.Hash, height)
+	}
+	testStore.Commit(batch)
+
+	for height, b := range blocks {
+		if block := testStore.ReadBlockByHeight(uint32(height)); block == nil || block.Hash != b.Hash {
+			t.Errorf("Block at height %v was not properly indexed.\n", height)
+		}
+	}
+
+	if tip, height := testStore.ReadTip(); tip == nil || tip.Hash != blocks[4].Hash || height != 4 {
+		t.Errorf("Wrong tip: %v at height %v\n", tip, height)
+	}
+
+	//Range is cut off at the tip
+	if blockRange := testStore.ReadBlockRange(1, 10); len(blockRange) != 4 || blockRange[0].Hash != blocks[1].Hash {
+		t.Errorf("Wrong block range: %v\n", blockRange)
+	}
+
+	//Roll back the last block
+	batch = NewBatch()
+	batch.DeleteBlockHeight(4)
+	batch.DeleteClosedBlock(blocks[4].Hash)
+	batch.WriteTip(blocks[3].Hash, 3)
+	testStore.Commit(batch)
+
+	if testStore.ReadBlockByHeight(4) != nil {
+		t.Error("Rolled back block is still indexed.\n")
+	}
+	if tip, height := testStore.ReadTip(); tip == nil || tip.Hash != blocks[3].Hash || height != 3 {
+		t.Errorf("Wrong tip after rollback: %v at height %v\n", tip, height)
+	}
+
+	for _, b := range blocks {
+		testStore.DeleteClosedBlock(b.Hash)
+	}
+}
+
+func TestChainWork(t *testing.T) {
+
+	hash := [32]byte{'w'}
+	if testStore.ReadChainWork(hash) != nil {
+		t.Error("Unknown block has a cumulative work.\n")
+	}
+
+	//The work of 2^32 blocks at the highest difficulty fits
+	work := new(big.Int).Lsh(big.NewInt(1), 255+32)
+	batch := NewBatch()
+	batch.WriteChainWork(hash, work)
+	testStore.Commit(batch)
+
+	if stored := testStore.ReadChainWork(hash); stored == nil || stored.Cmp(work) != 0 {
+		t.Errorf("Cumulative work was not stored: %v vs. %v\n", stored, work)
+	}
+}
+
+func TestTxLocation(t *testing.T) {
+
+	loc := &TxLocation{[32]byte{'l', 'o', 'c'}, 12345, FUNDSTX, 42}
+	var decodedLoc *TxLocation
+	if decodedLoc = decodedLoc.Decode(loc.Encode()); decodedLoc == nil || *decodedLoc != *loc {
+		t.Errorf("TxLocation serialization failed: %v vs. %v\n", loc, decodedLoc)
+	}
+
+	hash := [32]byte{'t', 'x'}
+	batch := NewBatch()
+	batch.WriteTxLocation(hash, loc)
+	testStore.Commit(batch)
+
+	if readLoc := testStore.ReadTxLocation(hash); readLoc == nil || *readLoc != *loc {
+		t.Errorf("TxLocation was not properly written: %v\n", readLoc)
+	}
+
+	batch = NewBatch()
+	batch.DeleteTxLocation(hash)
+	testStore.Commit(batch)
+
+	if testStore.ReadTxLocation(hash) != nil {
+		t.Error("TxLocation was not deleted.\n")
+	}
+}
+
+func TestAccountHistory(t *testing.T) {
+
+	account := [32]byte{'a', 'c', 'c'}
+	otherAccount := [32]byte{'a', 'c', 'd'}
+
+	var entries []*HistoryEntry
+	for height := uint32(1); height <= 5; height++ {
+		for index := uint16(0); index < 2; index++ {
+			entries = append(entries, &HistoryEntry{height, FUNDSTX, index, [32]byte{byte(height), byte(index)}})
+		}
+	}
+
+	//Written out of order on purpose, the index needs to return them sorted by height and position
+	batch := NewBatch()
+	for i := len(entries) - 1; i >= 0; i-- {
+		batch.WriteHistoryEntry(account, entries[i])
+	}
+	batch.WriteHistoryEntry(otherAccount, &HistoryEntry{1, BLOCKREWARD, 0, [32]byte{'b'}})
+	testStore.Commit(batch)
+
+	if history := testStore.ReadAccountHistory(account, 0, 100); !reflect.DeepEqual(history, entries) {
+		t.Errorf("Account history is not ordered or incomplete: %v\n", history)
+	}
+	if history := testStore.ReadAccountHistory(account, 3, 4); !reflect.DeepEqual(history, entries[3:7]) {
+		t.Errorf("Paginated account history is wrong: %v\n", history)
+	}
+	if history := testStore.ReadAccountHistory(account, 8, 4); len(history) != 2 {
+		t.Errorf("Last page should only contain 2 entries: %v\n", history)
+	}
+	if history := testStore.ReadAccountHistory(otherAccount, 0, 10); len(history) != 1 || history[0].TxType != BLOCKREWARD {
+		t.Errorf("Account history of other account is wrong: %v\n", history)
+	}
+
+	batch = NewBatch()
+	for _, entry := range entries {
+		batch.DeleteHistoryEntry(account, entry)
+	}
+	testStore.Commit(batch)
+
+	if history := testStore.ReadAccountHistory(account, 0, 100); len(history) != 0 {
+		t.Errorf("Account history was not deleted: %v\n", history)
+	}
+}
+
+func TestJournal(t *testing.T) {
+
+	state := testStore.State()
+	existingHash, newHash, rootHash := [32]byte{'e'}, [32]byte{'n'}, [32]byte{'r'}
+
+	existing := &protocol.Account{Address: [64]byte{'e'}, Balance: 1000, TxCnt: 3}
+	root := &protocol.Account{Address: [64]byte{'r'}, Balance: 500}
+	state.SetAccount(existingHash, existing)
+	state.SetAccount(rootHash, root)
+	state.SetRootKey(rootHash, root)
+
+	journal := state.NewJournal()
+	journal.Touch(existingHash)
+	existing.Balance, existing.TxCnt = 10, 4
+	journal.Touch(newHash)
+	state.SetAccount(newHash, &protocol.Account{Address: [64]byte{'n'}})
+	journal.Touch(rootHash)
+	root.Balance += 100
+	state.DeleteRootKey(rootHash)
+	//Only the first touch counts
+	journal.Touch(existingHash)
+	existing.Balance = 20
+
+	//Undo data is read back from disk, the decoded journal is bound to the state of the storage
+	blockHash := [32]byte{'u', 'n', 'd', 'o'}
+	batch := NewBatch()
+	batch.WriteUndo(blockHash, journal)
+	testStore.Commit(batch)
+
+	decodedJournal := testStore.ReadUndo(blockHash)
+	if decodedJournal == nil || !reflect.DeepEqual(decodedJournal.Accounts(), journal.Accounts()) {
+		t.Fatalf("Journal serialization failed: %v vs. %v\n", decodedJournal, journal)
+	}
+
+	decodedJournal.Revert()
+
+	if acc := state.GetAccount(existingHash); acc != existing || acc.Balance != 1000 || acc.TxCnt != 3 {
+		t.Errorf("Existing account was not restored: %v\n", acc)
+	}
+	if state.GetAccount(newHash) != nil {
+		t.Error("New account was not removed.\n")
+	}
+	if state.GetAccount(rootHash) != root || state.GetRootKey(rootHash) != root || root.Balance != 500 {
+		t.Errorf("Root account was not restored: %v\n", state.GetRootKey(rootHash))
+	}
+
+	state.DeleteAccount(existingHash)
+	state.DeleteAccount(rootHash)
+	state.DeleteRootKey(rootHash)
+
+	batch = NewBatch()
+	batch.DeleteUndo(blockHash)
+	testStore.Commit(batch)
+	if testStore.ReadUndo(blockHash) != nil {
+		t.Error("Undo data was not deleted.\n")
+	}
+}
+
+//Both backends need to behave the same, the miner only relies on the Storage interface
+func TestBackends(t *testing.T) {
+
+	accAHash := serializeHashContent(accA.Address)
+	memStore := NewMemStorage()
+
+	for _, st := range []Storage{testStore, memStore} {
+		b := new(protocol.Block)
+		b.Hash = [32]byte{'b', 'a', 'c', 'k', 'e', 'n', 'd'}
+
+		batch := NewBatch()
+		batch.WriteClosedBlock(b)
+		batch.WriteTip(b.Hash, 0)
+		//Written in reverse order, reading them back needs to return them sorted by height
+		for height := uint32(3); height > 0; height-- {
+			batch.WriteHistoryEntry(accAHash, &HistoryEntry{height, FUNDSTX, 0, [32]byte{byte(height)}})
+		}
+		if err := st.Commit(batch); err != nil {
+			t.Errorf("Committing batch failed: %v\n", err)
+		}
+
+		if block := st.ReadBlockByHeight(0); block == nil || block.Hash != b.Hash {
+			t.Errorf("Block was not properly indexed: %v\n", block)
+		}
+
+		history := st.ReadAccountHistory(accAHash, 0, 10)
+		if len(history) != 3 {
+			t.Errorf("Wrong history length: %v\n", len(history))
+		}
+		for i, entry := range history {
+			if entry.Height != uint32(i+1) {
+				t.Errorf("History is not sorted: %v\n", history)
+			}
+		}
+
+		batch = NewBatch()
+		batch.DeleteClosedBlock(b.Hash)
+		batch.put("nonexistent", []byte{0}, []byte{0})
+		if err := st.Commit(batch); err == nil || st.ReadClosedBlock(b.Hash) == nil {
+			t.Error("Failed batch was partially written.\n")
+		}
+
+		batch = NewBatch()
+		batch.DeleteClosedBlock(b.Hash)
+		batch.DeleteBlockHeight(0)
+		for height := uint32(1); height <= 3; height++ {
+			batch.DeleteHistoryEntry(accAHash, &HistoryEntry{height, FUNDSTX, 0, [32]byte{byte(height)}})
+		}
+		st.Commit(batch)
+	}
+}
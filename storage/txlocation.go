@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	TXLOCATION_SIZE = 39
+
+	//Transaction types as stored in the location and history index
+	FUNDSTX     = 1
+	ACCTX       = 2
+	CONFIGTX    = 3
+	BLOCKREWARD = 4
+)
+
+//Records where a closed transaction was confirmed. Index is the position of the tx hash within the corresponding
+//tx data slice of the block (e.g., block.FundsTxData for fundsTxs)
+type TxLocation struct {
+	BlockHash [32]byte
+	Height    uint32
+	TxType    uint8
+	Index     uint16
+}
+
+func (loc *TxLocation) Encode() (encodedLoc []byte) {
+
+	if loc == nil {
+		return nil
+	}
+
+	encodedLoc = make([]byte, TXLOCATION_SIZE)
+	copy(encodedLoc[0:32], loc.BlockHash[:])
+	binary.BigEndian.PutUint32(encodedLoc[32:36], loc.Height)
+	encodedLoc[36] = loc.TxType
+	binary.BigEndian.PutUint16(encodedLoc[37:39], loc.Index)
+
+	return encodedLoc
+}
+
+func (*TxLocation) Decode(encodedLoc []byte) (loc *TxLocation) {
+
+	if len(encodedLoc) != TXLOCATION_SIZE {
+		return nil
+	}
+
+	loc = new(TxLocation)
+	copy(loc.BlockHash[:], encodedLoc[0:32])
+	loc.Height = binary.BigEndian.Uint32(encodedLoc[32:36])
+	loc.TxType = encodedLoc[36]
+	loc.Index = binary.BigEndian.Uint16(encodedLoc[37:39])
+
+	return loc
+}
+
+func (loc TxLocation) String() string {
+	return fmt.Sprintf(
+		"\nBlock Hash: %x\n"+
+			"Height: %v\n"+
+			"Tx Type: %v\n"+
+			"Index: %v\n",
+		loc.BlockHash[0:8],
+		loc.Height,
+		loc.TxType,
+		loc.Index,
+	)
+}
@@ -4,12 +4,8 @@ import (
 	"bytes"
 	"encoding/binary"
 	"golang.org/x/crypto/sha3"
-	"github.com/lisgie/bazo_miner/protocol"
 )
 
-//Needed by miner and p2p package
-func GetAccountFromHash(hash [32]byte) *protocol.Account { return State[hash] }
-
 //Serializes the input in big endian and returns the sha3 hash function applied on ths input
 func serializeHashContent(data interface{}) (hash [32]byte) {
 
@@ -17,3 +13,19 @@ func serializeHashContent(data interface{}) (hash [32]byte) {
 	binary.Write(&buf, binary.BigEndian, data)
 	return sha3.Sum256(buf.Bytes())
 }
+
+//Heights are encoded big endian, this way bolt's key ordering corresponds to the chain order
+func heightKey(height uint32) []byte {
+
+	var key [4]byte
+	binary.BigEndian.PutUint32(key[:], height)
+	return key[:]
+}
+
+//Returns a non-nil copy, also for empty slices
+func copyBytes(data []byte) []byte {
+
+	dataCopy := make([]byte, len(data))
+	copy(dataCopy, data)
+	return dataCopy
+}
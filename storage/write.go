@@ -1,56 +1,61 @@
 package storage
 
 import (
-	"github.com/boltdb/bolt"
 	"github.com/lisgie/bazo_miner/protocol"
 )
 
-func WriteOpenBlock(block *protocol.Block) (err error) {
+//Single writes are committed right away, see Batch for writes that belong together
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("openblocks"))
-		err := b.Put(block.Hash[:], block.Encode())
-		return err
-	})
+func (s *store) WriteOpenBlock(block *protocol.Block) (err error) {
 
-	return err
+	batch := NewBatch()
+	batch.put("openblocks", block.Hash[:], block.Encode())
+	return s.Commit(batch)
 }
 
-func WriteClosedBlock(block *protocol.Block) (err error) {
+func (s *store) WriteClosedBlock(block *protocol.Block) (err error) {
 
-	err = db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("closedblocks"))
-		err := b.Put(block.Hash[:], block.Encode())
-		return err
-	})
-
-	return err
+	batch := NewBatch()
+	batch.WriteClosedBlock(block)
+	return s.Commit(batch)
 }
 
 //Changing the "tx" shortcut here and using "transaction" to distinguish between bolt's transactions
-func WriteOpenTx(transaction protocol.Transaction) {
+//Returns an error if the mempool doesn't accept the tx. The snapshot is taken before the mempool is locked, the
+//writer commits blocks (and reorganizes the mempool) while holding the state lock
+func (s *store) WriteOpenTx(transaction protocol.Transaction) error {
+
+	snapshot := s.state.Snapshot()
+	return s.mempool.add(transaction, snapshot.GetAccount)
+}
 
-	txMemPool[transaction.Hash()] = transaction
+func (s *store) WriteClosedTx(transaction protocol.Transaction) (err error) {
+
+	batch := NewBatch()
+	batch.WriteClosedTx(transaction)
+	return s.Commit(batch)
 }
 
-func WriteClosedTx(transaction protocol.Transaction) (err error) {
-
-	var bucket string
-	switch transaction.(type) {
-	case *protocol.FundsTx:
-		bucket = "closedfunds"
-	case *protocol.AccTx:
-		bucket = "closedaccs"
-	case *protocol.ConfigTx:
-		bucket = "closedconfigs"
-	}
-
-	hash := transaction.Hash()
-	err = db.Update(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(bucket))
-		err := b.Put(hash[:], transaction.Encode())
-		return err
-	})
-
-	return err
+//Accounts are persisted with the hash they are stored under in the state
+func (s *store) WriteAccount(hash [32]byte, acc *protocol.Account) (err error) {
+
+	batch := NewBatch()
+	batch.WriteAccount(hash, acc)
+	return s.Commit(batch)
+}
+
+func (s *store) WriteRootKey(hash [32]byte, acc *protocol.Account) (err error) {
+
+	batch := NewBatch()
+	batch.WriteRootKey(hash, acc)
+	return s.Commit(batch)
+}
+
+//The chain state consists of data the miner needs to resume (e.g., system parameters, difficulty history). The
+//storage package doesn't interpret the values, encoding is left to the caller
+func (s *store) WriteChainState(key string, value []byte) (err error) {
+
+	batch := NewBatch()
+	batch.WriteChainState(key, value)
+	return s.Commit(batch)
 }